@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/mevdschee/tqcache/pkg/client"
 	"github.com/mevdschee/tqcache/pkg/tqcache"
 	"github.com/redis/go-redis/v9"
 )
@@ -35,6 +36,7 @@ var (
 	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 	operation  = flag.String("op", "both", "operation to benchmark: set, get, or both")
 	sequential = flag.Bool("sequential", true, "Sequential key access (vs random)")
+	workload   = flag.String("workload", "getset", "Workload: getset (pure SET/GET) or mixed (get/set/delete/touch with TTLs, package protocol)")
 )
 
 // Benchmarker defines the interface for benchmarking different cache backends
@@ -96,9 +98,11 @@ func (r *RedisClient) Close() error {
 	return r.client.Close()
 }
 
-// PackageClient implements Benchmarker using direct package calls (no network)
+// PackageClient implements Benchmarker using direct package calls (no
+// network), through the gomemcache compatible client like MemcacheClient
 type PackageClient struct {
-	cache *tqcache.ShardedCache
+	cache  *tqcache.ShardedCache
+	client *client.Client
 }
 
 // Shared cache instance for package protocol
@@ -119,6 +123,7 @@ func getSharedCache() *tqcache.ShardedCache {
 		case "always":
 			cfg.SyncStrategy = tqcache.SyncAlways
 		}
+		configureEviction(&cfg)
 		var err error
 		sharedCache, err = tqcache.NewSharded(cfg, *shards)
 		if err != nil {
@@ -129,18 +134,19 @@ func getSharedCache() *tqcache.ShardedCache {
 }
 
 func NewPackageClient() *PackageClient {
+	cache := getSharedCache()
 	return &PackageClient{
-		cache: getSharedCache(),
+		cache:  cache,
+		client: client.New(cache),
 	}
 }
 
 func (p *PackageClient) Set(key string, value []byte) error {
-	_, err := p.cache.Set(key, value, 0)
-	return err
+	return p.client.Set(&client.Item{Key: key, Value: value})
 }
 
 func (p *PackageClient) Get(key string) error {
-	_, _, err := p.cache.Get(key)
+	_, err := p.client.Get(key)
 	return err
 }
 
@@ -201,6 +207,11 @@ func main() {
 		}
 	}
 
+	if *workload == "mixed" {
+		runMixed(clientFactory, keyParams, val)
+		return
+	}
+
 	// SET Benchmark
 	if *operation == "set" || *operation == "both" {
 		start := time.Now()
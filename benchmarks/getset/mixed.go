@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqcache/pkg/tqcache"
+)
+
+var (
+	mix         = flag.String("mix", "70:20:5:5", "Mixed workload ratio of get:set:delete:touch")
+	minSize     = flag.Int("min-size", 100, "Smallest value size in bytes (mixed workload, -size is the largest)")
+	ttl         = flag.Duration("ttl", time.Minute, "Largest TTL of set and touch, TTLs are spread up to it (mixed workload, 0 = none)")
+	maxDataSize = flag.Int64("max-data-size", 0, "MaxDataSize in bytes, items are evicted beyond it (package protocol only, 0 = unlimited)")
+)
+
+// MixedBenchmarker is a Benchmarker that supports all operations of the mixed workload
+type MixedBenchmarker interface {
+	Benchmarker
+	SetTTL(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+	Touch(key string, ttl time.Duration) error
+}
+
+func (p *PackageClient) SetTTL(key string, value []byte, ttl time.Duration) error {
+	_, err := p.cache.Set(key, value, ttl)
+	return err
+}
+
+func (p *PackageClient) Delete(key string) error {
+	return p.cache.Delete(key)
+}
+
+func (p *PackageClient) Touch(key string, ttl time.Duration) error {
+	_, err := p.cache.Touch(key, ttl)
+	return err
+}
+
+// Operations of the mixed workload
+var mixedOps = []string{"GET", "SET", "DELETE", "TOUCH"}
+
+// parseMix parses the get:set:delete:touch ratio into cumulative weights
+func parseMix(s string) ([]int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != len(mixedOps) {
+		return nil, fmt.Errorf("mix %q must have %d ratios", s, len(mixedOps))
+	}
+	weights := make([]int, len(parts))
+	total := 0
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid ratio %q in mix %q", part, s)
+		}
+		total += n
+		weights[i] = total
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("mix %q has no operations", s)
+	}
+	return weights, nil
+}
+
+// pickOp returns the index of a random operation according to the weights
+func pickOp(r *rand.Rand, weights []int) int {
+	n := r.Intn(weights[len(weights)-1])
+	for i, w := range weights {
+		if n < w {
+			return i
+		}
+	}
+	return len(weights) - 1
+}
+
+// pickSize returns a value size log-uniformly distributed between min and max,
+// so small values are common and large ones still occur
+func pickSize(r *rand.Rand, min, max int) int {
+	if max <= min {
+		return max
+	}
+	lo, hi := math.Log(float64(min)), math.Log(float64(max))
+	return int(math.Exp(lo + r.Float64()*(hi-lo)))
+}
+
+// pickTTL returns a TTL between half and all of max (0 = no TTL)
+func pickTTL(r *rand.Rand, max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return max/2 + time.Duration(r.Int63n(int64(max/2)+1))
+}
+
+// runMixed runs the mixed workload with random keys and reports per-operation
+// latency percentiles
+func runMixed(factory func() Benchmarker, keyParams []string, val []byte) {
+	weights, err := parseMix(*mix)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	requestsPerClient := *requests / *clients
+	latencies := make([][][]time.Duration, *clients) // client → op → latencies
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for i := 0; i < *clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, ok := factory().(MixedBenchmarker)
+			if !ok {
+				log.Fatalf("Protocol %s does not support the mixed workload", *protocol)
+			}
+			defer client.Close()
+
+			r := rand.New(rand.NewSource(int64(i)))
+			latencies[i] = make([][]time.Duration, len(mixedOps))
+			for j := 0; j < requestsPerClient; j++ {
+				key := keyParams[r.Intn(len(keyParams))]
+				op := pickOp(r, weights)
+
+				opStart := time.Now()
+				switch op {
+				case 0:
+					_ = client.Get(key)
+				case 1:
+					_ = client.SetTTL(key, val[:pickSize(r, *minSize, len(val))], pickTTL(r, *ttl))
+				case 2:
+					_ = client.Delete(key)
+				case 3:
+					_ = client.Touch(key, pickTTL(r, *ttl))
+				}
+				latencies[i][op] = append(latencies[i][op], time.Since(opStart))
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if !*csvOutput {
+		printResults("MIXED", elapsed)
+	}
+	for op, name := range mixedOps {
+		var all []time.Duration
+		for _, client := range latencies {
+			all = append(all, client[op]...)
+		}
+		printLatencies(name, all)
+	}
+	if sharedCache != nil && !*csvOutput {
+		stats := sharedCache.Stats()
+		fmt.Printf("evictions: %s, compactions: %s\n", stats["evictions"], stats["compactions_performed"])
+	}
+}
+
+// printLatencies prints the latency percentiles of one operation
+func printLatencies(op string, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	pct := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	if *csvOutput {
+		// Mode,Shards,Backend,Protocol,Operation,Count,P50(us),P90(us),P99(us),P999(us),Max(us)
+		fmt.Printf("%s,%d,%s,%s,%s,%d,%d,%d,%d,%d,%d\n", *mode, *shards, *label, *protocol, op, len(latencies),
+			pct(0.5).Microseconds(), pct(0.9).Microseconds(), pct(0.99).Microseconds(), pct(0.999).Microseconds(), latencies[len(latencies)-1].Microseconds())
+	} else {
+		fmt.Printf("%-6s: %8d ops  p50 %-10s p90 %-10s p99 %-10s p99.9 %-10s max %s\n", op, len(latencies),
+			pct(0.5), pct(0.9), pct(0.99), pct(0.999), latencies[len(latencies)-1])
+	}
+}
+
+// configureEviction applies -max-data-size to the package protocol cache
+func configureEviction(cfg *tqcache.Config) {
+	if *maxDataSize > 0 {
+		cfg.MaxDataSize = *maxDataSize
+		cfg.EvictionPolicy = tqcache.EvictionSampled
+	}
+}
@@ -1,52 +1,34 @@
 package main
 
 import (
-	"encoding/binary"
 	"flag"
 	"fmt"
 	"hash/fnv"
-	"io"
 	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
-)
+	"time"
 
-// Constants from storage.go
-const (
-	KeyRecordSize  = 1043 // 2 + 1024 + 8 + 8 + 1 + 8 (removed LastAccessed)
-	MaxKeySize     = 1024
-	DataHeaderSize = 1 + 4 // free + length
-	NumBuckets     = 16
-	MinBucketSize  = 1024
-	FlagInUse      = 0x00
-	FlagDeleted    = 0x01
+	"github.com/mevdschee/tqcache/internal/logging"
+	"github.com/mevdschee/tqcache/pkg/tqcache"
 )
 
-// KeyRecord represents a fixed-size record in the keys file
-type KeyRecord struct {
-	KeyLen  uint16
-	Key     [MaxKeySize]byte
-	Cas     uint64
-	Expiry  int64
-	Bucket  byte
-	SlotIdx int64
-}
-
-// ValidEntry holds a validated key record and its data
+// ValidEntry holds a validated key record and its data slot as stored
 type ValidEntry struct {
-	KeyRecord KeyRecord
+	KeyRecord tqcache.KeyRecord
 	Data      []byte
+	Flag      byte // FlagInUse or FlagCompressed
 }
 
-// TargetShard holds the output files and state for a target shard
+// TargetShard holds the output storage and state for a target shard
 type TargetShard struct {
-	shardDir   string
-	keysFile   *os.File
-	dataFiles  [NumBuckets]*os.File
+	storage    *tqcache.Storage
+	nextKeyId  int64
 	keyCount   int64
-	slotCounts [NumBuckets]int64
+	slotCounts []int64
 }
 
 func main() {
@@ -54,9 +36,17 @@ func main() {
 	dstDir := flag.String("dst-dir", "", "Destination directory for cleaned/resharded data (required)")
 	targetShards := flag.Int("target-shards", 0, "Number of target shards (0 = same as source)")
 	dryRun := flag.Bool("dry-run", false, "Only report errors, don't write clean files")
-	verbose := flag.Bool("verbose", false, "Print progress information")
+	verbose := flag.Bool("verbose", false, "Print progress information (same as -log-level debug)")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn, error")
 	flag.Parse()
 
+	if *verbose {
+		*logLevel = "debug"
+	}
+	if err := logging.Setup(os.Stderr, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+
 	if *dstDir == "" {
 		log.Fatal("ERROR: -dst-dir is required")
 	}
@@ -97,12 +87,25 @@ func main() {
 	allEntries := make([]ValidEntry, 0)
 	totalKeys := 0
 	totalSkipped := 0
+	var opts *tqcache.StorageOptions
 
 	for _, shardIdx := range sourceShards {
 		shardDir := filepath.Join(*srcDir, fmt.Sprintf("shard_%02d", shardIdx))
-		entries, keys, skipped, err := readShard(shardDir, *verbose)
+		shardOpts, err := tqcache.ReadStorageOptions(shardDir)
 		if err != nil {
-			log.Printf("Shard %02d: ERROR - %v", shardIdx, err)
+			slog.Error("Failed to read shard format", "shard", shardIdx, "err", err)
+			continue
+		}
+		// Data slots are copied as stored, so all shards need the same layout
+		if opts == nil {
+			opts = &shardOpts
+		} else if !sameFormat(*opts, shardOpts) {
+			log.Fatalf("Shard %d has a different format than the other shards", shardIdx)
+		}
+
+		entries, keys, skipped, err := readShard(shardDir, shardOpts)
+		if err != nil {
+			slog.Error("Failed to read shard", "shard", shardIdx, "err", err)
 			continue
 		}
 
@@ -110,8 +113,10 @@ func main() {
 		totalKeys += keys
 		totalSkipped += skipped
 
-		if *verbose || skipped > 0 {
-			log.Printf("Shard %02d: %d keys processed, %d skipped", shardIdx, keys, skipped)
+		if skipped > 0 {
+			slog.Warn("Skipped invalid keys", "shard", shardIdx, "keys", keys, "skipped", skipped)
+		} else {
+			slog.Debug("Shard read", "shard", shardIdx, "keys", keys)
 		}
 	}
 
@@ -121,60 +126,21 @@ func main() {
 		log.Printf("DRY RUN: Would write %d entries to %d shards", len(allEntries), numTargetShards)
 		return
 	}
-
-	// Phase 2: Create target shards and write entries
-	if err := os.MkdirAll(*dstDir, 0755); err != nil {
-		log.Fatalf("Failed to create destination directory: %v", err)
-	}
-
-	// Initialize target shards
-	targetShardObjs := make([]*TargetShard, numTargetShards)
-	for i := 0; i < numTargetShards; i++ {
-		ts, err := newTargetShard(*dstDir, i)
-		if err != nil {
-			log.Fatalf("Failed to create target shard %d: %v", i, err)
-		}
-		targetShardObjs[i] = ts
+	if opts == nil {
+		log.Fatal("No readable source shards")
 	}
-	defer func() {
-		for _, ts := range targetShardObjs {
-			ts.Close()
-		}
-	}()
-
-	// Write entries to target shards
-	bucketSizes := makeBucketSizes()
-	for _, entry := range allEntries {
-		// Determine target shard by hashing the key
-		keyStr := string(entry.KeyRecord.Key[:entry.KeyRecord.KeyLen])
-		targetIdx := hashKey(keyStr, numTargetShards)
-
-		ts := targetShardObjs[targetIdx]
-		bucket := int(entry.KeyRecord.Bucket)
-
-		// Write data slot first
-		slotIdx := ts.slotCounts[bucket]
-		if err := writeDataSlot(ts.dataFiles[bucket], bucket, slotIdx, entry.Data, bucketSizes[bucket]); err != nil {
-			log.Fatalf("Failed to write data to shard %d: %v", targetIdx, err)
-		}
-		ts.slotCounts[bucket]++
-
-		// Update key record with new slot index
-		newRec := entry.KeyRecord
-		newRec.SlotIdx = slotIdx
 
-		// Write key record
-		if err := writeKeyRecord(ts.keysFile, ts.keyCount, &newRec); err != nil {
-			log.Fatalf("Failed to write key to shard %d: %v", targetIdx, err)
-		}
-		ts.keyCount++
+	// Phase 2: Create target shards and write entries
+	keyCounts, err := writeShards(*dstDir, numTargetShards, *opts, allEntries)
+	if err != nil {
+		log.Fatalf("Failed to write target shards: %v", err)
 	}
 
 	// Report results
 	log.Printf("Phase 2 complete: %d entries written to %d shards", len(allEntries), numTargetShards)
-	for i, ts := range targetShardObjs {
-		if ts.keyCount > 0 {
-			log.Printf("  Shard %02d: %d keys", i, ts.keyCount)
+	for i, count := range keyCounts {
+		if count > 0 {
+			log.Printf("  Shard %02d: %d keys", i, count)
 		}
 	}
 }
@@ -206,265 +172,129 @@ func discoverShards(dataDir string) ([]int, error) {
 	return shards, nil
 }
 
-// hashKey returns a shard index for the given key
+// sameFormat reports whether two shards store key records and data slots alike
+func sameFormat(a, b tqcache.StorageOptions) bool {
+	return a.ByteOrder == b.ByteOrder && a.KeyFormat == b.KeyFormat &&
+		a.BucketMinSize == b.BucketMinSize && a.BucketGrowthFactor == b.BucketGrowthFactor &&
+		a.BucketCount == b.BucketCount
+}
+
+// hashKey returns a shard index for the given key, as the cache does
 func hashKey(key string, numShards int) int {
 	h := fnv.New32a()
 	h.Write([]byte(key))
 	return int(h.Sum32() % uint32(numShards))
 }
 
-// makeBucketSizes creates the bucket size array
-func makeBucketSizes() [NumBuckets]int {
-	var sizes [NumBuckets]int
-	size := MinBucketSize
-	for i := 0; i < NumBuckets; i++ {
-		sizes[i] = size
-		size *= 2
-	}
-	return sizes
-}
-
-// newTargetShard creates a new target shard directory and files
-func newTargetShard(dstDir string, shardIdx int) (*TargetShard, error) {
-	shardDir := filepath.Join(dstDir, fmt.Sprintf("shard_%02d", shardIdx))
-	if err := os.MkdirAll(shardDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create shard dir: %w", err)
-	}
-
-	ts := &TargetShard{
-		shardDir: shardDir,
-	}
-
-	// Create keys file
-	keysPath := filepath.Join(shardDir, "keys")
-	keysFile, err := os.Create(keysPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create keys file: %w", err)
-	}
-	ts.keysFile = keysFile
-
-	// Create data files
-	for i := 0; i < NumBuckets; i++ {
-		dataPath := filepath.Join(shardDir, fmt.Sprintf("data_%02d", i))
-		dataFile, err := os.Create(dataPath)
-		if err != nil {
-			ts.Close()
-			return nil, fmt.Errorf("failed to create data file %d: %w", i, err)
-		}
-		ts.dataFiles[i] = dataFile
-	}
-
-	return ts, nil
-}
-
-// Close closes all files in the target shard
-func (ts *TargetShard) Close() {
-	if ts.keysFile != nil {
-		ts.keysFile.Close()
-	}
-	for _, f := range ts.dataFiles {
-		if f != nil {
-			f.Close()
-		}
+// readShard reads all valid entries from a source shard. Opening it applies
+// the same recovery as the cache on startup (a torn keys file tail is cut off).
+func readShard(shardDir string, opts tqcache.StorageOptions) ([]ValidEntry, int, int, error) {
+	if _, err := os.Stat(filepath.Join(shardDir, "keys")); os.IsNotExist(err) {
+		return nil, 0, 0, nil
 	}
-}
-
-// readShard reads all valid entries from a source shard
-func readShard(shardDir string, verbose bool) ([]ValidEntry, int, int, error) {
-	keysPath := filepath.Join(shardDir, "keys")
-	keysFile, err := os.Open(keysPath)
+	storage, err := tqcache.NewStorage(shardDir, opts)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, 0, 0, nil
-		}
-		return nil, 0, 0, fmt.Errorf("failed to open keys file: %w", err)
+		return nil, 0, 0, err
 	}
-	defer keysFile.Close()
-
-	// Get key count
-	info, err := keysFile.Stat()
-	if err != nil {
-		return nil, 0, 0, fmt.Errorf("failed to stat keys file: %w", err)
-	}
-	keyCount := info.Size() / KeyRecordSize
-
-	// Open data files for reading
-	bucketSizes := makeBucketSizes()
-	dataFiles := make([]*os.File, NumBuckets)
-	for i := 0; i < NumBuckets; i++ {
-		dataPath := filepath.Join(shardDir, fmt.Sprintf("data_%02d", i))
-		dataFiles[i], err = os.Open(dataPath)
-		if err != nil && !os.IsNotExist(err) {
-			return nil, 0, 0, fmt.Errorf("failed to open data file %d: %w", i, err)
-		}
-	}
-	defer func() {
-		for _, f := range dataFiles {
-			if f != nil {
-				f.Close()
-			}
-		}
-	}()
+	defer storage.Close()
 
 	// Collect valid entries
-	validEntries := make([]ValidEntry, 0, keyCount)
+	var validEntries []ValidEntry
 	keys := 0
 	skipped := 0
+	now := time.Now().UnixMilli()
 
-	for keyId := int64(0); keyId < keyCount; keyId++ {
-		rec, err := readKeyRecord(keysFile, keyId)
-		if err != nil {
-			if verbose {
-				log.Printf("  Key %d: failed to read record: %v", keyId, err)
-			}
-			skipped++
-			continue
-		}
-
-		// Validate key length
-		if rec.KeyLen > MaxKeySize {
-			if verbose {
-				log.Printf("  Key %d: invalid key length %d", keyId, rec.KeyLen)
-			}
-			skipped++
-			continue
+	_, err = storage.ScanKeyRecords(func(keyId int64, rec *tqcache.KeyRecord) {
+		// Deleted keys are tombstones that expired in 1970
+		if rec.Expiry > 0 && rec.Expiry <= now {
+			return
 		}
 
 		// Validate bucket
-		if int(rec.Bucket) >= NumBuckets {
-			if verbose {
-				log.Printf("  Key %d: invalid bucket %d", keyId, rec.Bucket)
-			}
-			skipped++
-			continue
-		}
-
-		bucket := int(rec.Bucket)
-		slotIdx := rec.SlotIdx
-
-		// Validate slot exists in data file
-		if dataFiles[bucket] == nil {
-			if verbose {
-				log.Printf("  Key %d: data file for bucket %d does not exist", keyId, bucket)
-			}
+		if int(rec.Bucket) >= storage.NumBuckets() {
+			slog.Debug("Invalid bucket", "shard", shardDir, "key_id", keyId, "bucket", rec.Bucket)
 			skipped++
-			continue
+			return
 		}
 
-		// Read and validate data slot
-		data, err := readDataSlot(dataFiles[bucket], bucket, slotIdx, bucketSizes[bucket])
+		// Read and validate data slot, including its checksum
+		data, flag, err := storage.ReadRawDataSlot(int(rec.Bucket), rec.SlotIdx)
 		if err != nil {
-			if verbose {
-				log.Printf("  Key %d: failed to read data slot (bucket=%d, slot=%d): %v", keyId, bucket, slotIdx, err)
-			}
+			slog.Debug("Failed to read data slot", "shard", shardDir, "key_id", keyId, "bucket", rec.Bucket, "slot", rec.SlotIdx, "err", err)
 			skipped++
-			continue
+			return
 		}
 
 		// Entry is valid
 		validEntries = append(validEntries, ValidEntry{
 			KeyRecord: *rec,
 			Data:      data,
+			Flag:      flag,
 		})
 		keys++
+	})
+	if err != nil {
+		return nil, 0, 0, err
 	}
 
 	return validEntries, keys, skipped, nil
 }
 
-func readKeyRecord(f *os.File, keyId int64) (*KeyRecord, error) {
-	offset := keyId * KeyRecordSize
-	buf := make([]byte, KeyRecordSize)
-
-	n, err := f.ReadAt(buf, offset)
-	if err != nil {
-		return nil, err
-	}
-	if n != KeyRecordSize {
-		return nil, fmt.Errorf("short read: got %d, want %d", n, KeyRecordSize)
-	}
-
-	rec := &KeyRecord{
-		KeyLen:  binary.LittleEndian.Uint16(buf[0:2]),
-		Cas:     binary.LittleEndian.Uint64(buf[1026:1034]),
-		Expiry:  int64(binary.LittleEndian.Uint64(buf[1034:1042])),
-		Bucket:  buf[1042],
-		SlotIdx: int64(binary.LittleEndian.Uint64(buf[1043:1051])),
+// writeShards writes the entries to new shards in the given format and
+// returns the number of keys in each shard
+func writeShards(dstDir string, numShards int, opts tqcache.StorageOptions, entries []ValidEntry) ([]int64, error) {
+	targets := make([]*TargetShard, numShards)
+	defer func() {
+		for _, ts := range targets {
+			if ts != nil {
+				ts.storage.Close()
+			}
+		}
+	}()
+	for i := range targets {
+		storage, err := tqcache.NewStorage(filepath.Join(dstDir, fmt.Sprintf("shard_%02d", i)), opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create target shard %d: %w", i, err)
+		}
+		targets[i] = &TargetShard{storage: storage, slotCounts: make([]int64, storage.NumBuckets())}
+		if size, err := storage.KeysFileSize(); err != nil || size > 0 {
+			return nil, fmt.Errorf("target shard %d is not empty", i)
+		}
 	}
-	copy(rec.Key[:], buf[2:1026])
-
-	return rec, nil
-}
-
-func writeKeyRecord(f *os.File, keyId int64, rec *KeyRecord) error {
-	offset := keyId * KeyRecordSize
-	buf := make([]byte, KeyRecordSize)
-
-	binary.LittleEndian.PutUint16(buf[0:2], rec.KeyLen)
-	copy(buf[2:1026], rec.Key[:])
-	binary.LittleEndian.PutUint64(buf[1026:1034], rec.Cas)
-	binary.LittleEndian.PutUint64(buf[1034:1042], uint64(rec.Expiry))
-	buf[1042] = rec.Bucket
-	binary.LittleEndian.PutUint64(buf[1043:1051], uint64(rec.SlotIdx))
-
-	_, err := f.WriteAt(buf, offset)
-	return err
-}
-
-func slotSize(bucket int, bucketSize int) int {
-	return DataHeaderSize + bucketSize
-}
 
-func readDataSlot(f *os.File, bucket int, slotIdx int64, bucketSize int) ([]byte, error) {
-	slotSz := slotSize(bucket, bucketSize)
-	offset := slotIdx * int64(slotSz)
+	for _, entry := range entries {
+		// Determine target shard by hashing the key
+		keyStr := string(entry.KeyRecord.Key[:entry.KeyRecord.KeyLen])
+		targetIdx := hashKey(keyStr, numShards)
 
-	// Check if offset is valid
-	info, err := f.Stat()
-	if err != nil {
-		return nil, err
-	}
-	if offset >= info.Size() {
-		return nil, fmt.Errorf("slot index %d out of range (file size: %d, slot size: %d)", slotIdx, info.Size(), slotSz)
-	}
+		ts := targets[targetIdx]
+		bucket := int(entry.KeyRecord.Bucket)
 
-	// Read header
-	header := make([]byte, DataHeaderSize)
-	if _, err := f.ReadAt(header, offset); err != nil {
-		return nil, err
-	}
+		// Write data slot first
+		slotIdx := ts.slotCounts[bucket]
+		if err := ts.storage.WriteDataSlot(bucket, slotIdx, entry.Data, entry.Flag); err != nil {
+			return nil, fmt.Errorf("failed to write data to shard %d: %w", targetIdx, err)
+		}
+		ts.slotCounts[bucket]++
 
-	if header[0] == FlagDeleted {
-		return nil, fmt.Errorf("slot is marked as deleted")
-	}
+		// Update key record with new slot index
+		newRec := entry.KeyRecord
+		newRec.SlotIdx = slotIdx
 
-	length := binary.LittleEndian.Uint32(header[1:5])
-	if int(length) > bucketSize {
-		return nil, fmt.Errorf("invalid data length %d exceeds bucket size %d", length, bucketSize)
+		// Write key record
+		if err := ts.storage.WriteKeyRecord(ts.nextKeyId, &newRec); err != nil {
+			return nil, fmt.Errorf("failed to write key to shard %d: %w", targetIdx, err)
+		}
+		ts.nextKeyId += ts.storage.KeyIdSpan(int(newRec.KeyLen))
+		ts.keyCount++
 	}
 
-	// Read data
-	data := make([]byte, length)
-	if _, err := f.ReadAt(data, offset+DataHeaderSize); err != nil {
-		if err == io.EOF && length == 0 {
-			return data, nil
+	keyCounts := make([]int64, numShards)
+	for i, ts := range targets {
+		if err := ts.storage.Sync(); err != nil {
+			return nil, fmt.Errorf("failed to sync shard %d: %w", i, err)
 		}
-		return nil, err
+		keyCounts[i] = ts.keyCount
 	}
-
-	return data, nil
-}
-
-func writeDataSlot(f *os.File, bucket int, slotIdx int64, data []byte, bucketSize int) error {
-	slotSz := slotSize(bucket, bucketSize)
-	offset := slotIdx * int64(slotSz)
-
-	// Prepare buffer with header + data (padded to slot size)
-	buf := make([]byte, slotSz)
-	buf[0] = FlagInUse
-	binary.LittleEndian.PutUint32(buf[1:5], uint32(len(data)))
-	copy(buf[DataHeaderSize:], data)
-
-	_, err := f.WriteAt(buf, offset)
-	return err
+	return keyCounts, nil
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mevdschee/tqcache/pkg/tqcache"
+)
+
+func TestCleanupRoundTrip(t *testing.T) {
+	for _, keyFormat := range []tqcache.KeyFormat{tqcache.KeyFormatFixed, tqcache.KeyFormatPacked} {
+		t.Run(keyFormat.String(), func(t *testing.T) {
+			srcDir := t.TempDir()
+			dstDir := t.TempDir()
+
+			config := tqcache.DefaultConfig()
+			config.DataDir = srcDir
+			config.SyncStrategy = tqcache.SyncNone
+			config.KeyFormat = keyFormat
+			c, err := tqcache.NewSharded(config, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 50; i++ {
+				c.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)), 0)
+			}
+			c.Set("large", make([]byte, 5000), 0)
+			c.Delete("key0")
+			c.Close()
+
+			// Corrupt the value of one key
+			var damaged string
+			shardDir := filepath.Join(srcDir, "shard_00")
+			opts, err := tqcache.ReadStorageOptions(shardDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			storage, err := tqcache.NewStorage(shardDir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			storage.ScanKeyRecords(func(keyId int64, rec *tqcache.KeyRecord) {
+				if damaged == "" && rec.Expiry == 0 && strings.HasPrefix(string(rec.Key[:rec.KeyLen]), "key") {
+					damaged = string(rec.Key[:rec.KeyLen])
+					f, _ := os.OpenFile(filepath.Join(shardDir, fmt.Sprintf("data_%02d", rec.Bucket)), os.O_RDWR, 0)
+					f.WriteAt([]byte("X"), rec.SlotIdx*int64(storage.SlotSize(int(rec.Bucket)))+tqcache.DataHeaderSize)
+					f.Close()
+				}
+			})
+			storage.Close()
+
+			// Read both shards and write them to three
+			var entries []ValidEntry
+			skipped := 0
+			for _, shard := range []string{"shard_00", "shard_01"} {
+				shardEntries, _, shardSkipped, err := readShard(filepath.Join(srcDir, shard), opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				entries = append(entries, shardEntries...)
+				skipped += shardSkipped
+			}
+			if skipped != 1 || len(entries) != 49 {
+				t.Fatalf("Expected 49 entries and 1 skipped, got %d and %d", len(entries), skipped)
+			}
+			if _, err := writeShards(dstDir, 3, opts, entries); err != nil {
+				t.Fatal(err)
+			}
+
+			config.DataDir = dstDir
+			c, err = tqcache.NewSharded(config, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			for i := 1; i < 50; i++ {
+				key := fmt.Sprintf("key%d", i)
+				val, _, err := c.Get(key)
+				if key == damaged {
+					if err != tqcache.ErrKeyNotFound {
+						t.Errorf("Expected damaged %s to be dropped, got %v", key, err)
+					}
+					continue
+				}
+				if err != nil || string(val) != fmt.Sprintf("value%d", i) {
+					t.Errorf("Get %s: got %q, %v", key, val, err)
+				}
+			}
+			if val, _, err := c.Get("large"); err != nil || len(val) != 5000 {
+				t.Errorf("Get large: got %d bytes, %v", len(val), err)
+			}
+			if _, _, err := c.Get("key0"); err != tqcache.ErrKeyNotFound {
+				t.Errorf("Expected deleted key0 to stay deleted, got %v", err)
+			}
+
+			// Writing again into the same directory is refused
+			if _, err := writeShards(dstDir, 3, opts, entries); err == nil {
+				t.Error("Expected an error writing to non-empty target shards")
+			}
+		})
+	}
+}
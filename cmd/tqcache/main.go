@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -12,10 +13,16 @@ import (
 	"time"
 
 	"github.com/mevdschee/tqcache/internal/config"
+	"github.com/mevdschee/tqcache/internal/logging"
+	"github.com/mevdschee/tqcache/pkg/health"
+	"github.com/mevdschee/tqcache/pkg/metrics"
 	"github.com/mevdschee/tqcache/pkg/server"
 	"github.com/mevdschee/tqcache/pkg/tqcache"
 )
 
+// shutdownTimeout is how long a shutdown waits for open connections
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	defaults := tqcache.DefaultConfig()
 
@@ -23,6 +30,7 @@ func main() {
 	port := flag.Int("p", 11211, "TCP port to listen on")
 	listenAddr := flag.String("l", "", "Interface to listen on (default: INADDR_ANY)")
 	socketPath := flag.String("s", "", "Unix socket path (overrides -p and -l)")
+	udpPort := flag.Int("U", 0, "UDP port to listen on (0 = off)")
 	connections := flag.Int("c", 1024, "Max simultaneous connections")
 	threads := flag.Int("t", tqcache.DefaultShardCount, "Number of shards/threads to use")
 
@@ -30,6 +38,7 @@ func main() {
 	flag.IntVar(port, "port", 11211, "TCP port to listen on")
 	flag.StringVar(listenAddr, "listen", "", "Interface to listen on")
 	flag.StringVar(socketPath, "socket", "", "Unix socket path")
+	flag.IntVar(udpPort, "udp-port", 0, "UDP port to listen on")
 	flag.IntVar(connections, "connections", 1024, "Max simultaneous connections")
 	flag.IntVar(threads, "threads", tqcache.DefaultShardCount, "Number of shards/threads")
 
@@ -41,6 +50,13 @@ func main() {
 	syncMode := flag.String("sync-mode", "periodic", "Sync mode: none, periodic, always")
 	syncInterval := flag.Duration("sync-interval", defaults.SyncInterval, "Sync interval for periodic fsync")
 	pprofEnabled := flag.Bool("pprof", false, "Enable pprof profiling server on :6062")
+	metricsEnabled := flag.Bool("metrics", false, "Expose Prometheus metrics on :6062/metrics")
+	healthEnabled := flag.Bool("health", false, "Serve /healthz and /readyz checks on :6062")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Close connections idle for this long (0 = never)")
+	slowOpThreshold := flag.Duration("slow-op-threshold", 0, "Log commands taking longer than this (0 = off)")
+	rateLimit := flag.Int("rate-limit", 0, "Max commands per second per connection (0 = unlimited)")
+	adminCommands := flag.Bool("admin-commands", false, "Accept commands that change settings at runtime (sync_mode)")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn, error")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
@@ -48,7 +64,8 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Memcached-compatible options:\n")
 		fmt.Fprintf(os.Stderr, "  -p, -port <num>          TCP port to listen on (default: 11211)\n")
 		fmt.Fprintf(os.Stderr, "  -l, -listen <addr>       Interface to listen on (default: INADDR_ANY)\n")
-		fmt.Fprintf(os.Stderr, "  -s, -socket <path>       Unix socket path (overrides -p and -l)\n")
+		fmt.Fprintf(os.Stderr, "  -s, -socket <path>       Unix socket path, not on Windows (overrides -p and -l)\n")
+		fmt.Fprintf(os.Stderr, "  -U, -udp-port <num>      UDP port to listen on (default: 0, off)\n")
 		fmt.Fprintf(os.Stderr, "  -c, -connections <num>   Max simultaneous connections (default: 1024)\n")
 		fmt.Fprintf(os.Stderr, "  -t, -threads <num>       Number of shards/threads (default: %d)\n", tqcache.DefaultShardCount)
 		fmt.Fprintf(os.Stderr, "\nTQCache options:\n")
@@ -59,9 +76,20 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  -sync-mode <mode>        Sync mode: none, periodic, always (default: periodic)\n")
 		fmt.Fprintf(os.Stderr, "  -sync-interval <dur>     Sync interval for periodic mode (default: %v)\n", defaults.SyncInterval)
 		fmt.Fprintf(os.Stderr, "  -pprof                   Enable pprof profiling server on :6062\n")
+		fmt.Fprintf(os.Stderr, "  -metrics                 Expose Prometheus metrics on :6062/metrics\n")
+		fmt.Fprintf(os.Stderr, "  -health                  Serve /healthz and /readyz checks on :6062\n")
+		fmt.Fprintf(os.Stderr, "  -idle-timeout <dur>      Close connections idle for this long (default: 0, never)\n")
+		fmt.Fprintf(os.Stderr, "  -slow-op-threshold <dur> Log commands taking longer than this (default: 0, off)\n")
+		fmt.Fprintf(os.Stderr, "  -rate-limit <num>        Max commands per second per connection (default: 0, unlimited)\n")
+		fmt.Fprintf(os.Stderr, "  -admin-commands          Accept commands that change settings at runtime (sync_mode)\n")
+		fmt.Fprintf(os.Stderr, "  -log-level <level>       Log level: debug, info, warn, error (default: info)\n")
 	}
 	flag.Parse()
 
+	if err := logging.Setup(os.Stderr, *logLevel); err != nil {
+		fatal("Invalid log-level", "err", err)
+	}
+
 	var cfg tqcache.Config
 	var listenString string
 	var shardCount int
@@ -71,11 +99,11 @@ func main() {
 	if *configFile != "" {
 		fileCfg, err := config.Load(*configFile)
 		if err != nil {
-			log.Fatalf("Failed to load config file: %v", err)
+			fatal("Failed to load config file", "err", err)
 		}
 		cfg, err = fileCfg.ToTQCacheConfig()
 		if err != nil {
-			log.Fatalf("Invalid config: %v", err)
+			fatal("Invalid config", "err", err)
 		}
 		// Build listen string from config
 		serverPort := fileCfg.Server.Listen
@@ -84,8 +112,14 @@ func main() {
 		}
 		listenString = serverPort
 		shardCount = fileCfg.Shards()
-		maxConnections = *connections // Use command-line default
-		log.Printf("Loaded config from %s", *configFile)
+		maxConnections = fileCfg.MaxConnections()
+		if maxConnections == 0 {
+			maxConnections = *connections // Use command-line default
+		}
+		if n := fileCfg.RateLimit(); n > 0 {
+			*rateLimit = n
+		}
+		slog.Info("Loaded config", "file", *configFile)
 	} else {
 		// Use command-line flags, starting from defaults
 		cfg = defaults
@@ -102,7 +136,7 @@ func main() {
 		case "always":
 			cfg.SyncStrategy = tqcache.SyncAlways
 		default:
-			log.Fatalf("Invalid sync-mode: %s (valid: none, periodic, always)", *syncMode)
+			fatal("Invalid sync-mode (valid: none, periodic, always)", "sync_mode", *syncMode)
 		}
 
 		// Build listen string
@@ -115,27 +149,50 @@ func main() {
 		}
 		shardCount = *threads
 		maxConnections = *connections
+		if err := cfg.Validate(); err != nil {
+			fatal("Invalid config", "err", err)
+		}
 	}
 
+	// Size the scheduler for the shards, the server owns the process
+	cfg.SetGOMAXPROCS = true
 	cache, err := tqcache.NewSharded(cfg, shardCount)
 	if err != nil {
-		log.Fatalf("Failed to initialize TQCache: %v", err)
+		fatal("Failed to initialize TQCache", "err", err)
 	}
 	defer cache.Close()
 
 	srv := server.NewWithOptions(cache, listenString, maxConnections)
+	srv.SetIdleTimeout(*idleTimeout)
+	srv.SetSlowOpThreshold(*slowOpThreshold)
+	srv.SetRateLimit(*rateLimit)
+	srv.SetAdminCommands(*adminCommands)
+	if *udpPort > 0 {
+		srv.SetUDPAddr(fmt.Sprintf("%s:%d", *listenAddr, *udpPort))
+	}
 	go func() {
-		if err := srv.Start(); err != nil {
-			log.Fatalf("Server failed: %v", err)
+		if err := srv.Start(); err != nil && err != server.ErrServerClosed {
+			fatal("Server failed", "err", err)
 		}
 	}()
 
-	// Start pprof server if enabled
-	if *pprofEnabled {
+	// Register metrics on the pprof mux
+	if *metricsEnabled {
+		collector := metrics.New(cache, metrics.DefaultInterval)
+		collector.Start()
+		defer collector.Stop()
+		http.Handle("/metrics", collector)
+	}
+	if *healthEnabled {
+		health.Register(http.DefaultServeMux, cache)
+	}
+
+	// Start pprof server if enabled (also serves metrics and health checks)
+	if *pprofEnabled || *metricsEnabled || *healthEnabled {
 		go func() {
-			log.Println("Starting pprof server on :6062")
+			slog.Info("Starting pprof server", "addr", "localhost:6062")
 			if err := http.ListenAndServe("localhost:6062", nil); err != nil {
-				log.Println("Pprof failed:", err)
+				slog.Error("Pprof failed", "err", err)
 			}
 		}()
 	}
@@ -144,10 +201,23 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
-	log.Printf("TQCache started on %s (shards: %d, connections: %d, data-dir: %s)",
-		listenString, shardCount, maxConnections, cfg.DataDir)
-	<-quit
-	log.Println("Shutting down TQCache...")
+	slog.Info("TQCache started", "addr", listenString, "shards", shardCount,
+		"max_connections", maxConnections, "data_dir", cfg.DataDir)
+	sig := <-quit
+	slog.Info("Shutting down TQCache", "signal", sig.String())
+
+	// Let in-flight commands finish before the deferred cache.Close
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("Shutdown did not complete", "err", err)
+	}
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
 // parseDuration parses a duration string allowing for time unit suffixes
@@ -14,7 +14,9 @@ import (
 // It maps to the INI config file and converts to tqcache.Config.
 type Config struct {
 	Server struct {
-		Listen string // Address to listen on (e.g., :11211 or localhost:11211)
+		Listen         string // Address to listen on (e.g., :11211 or localhost:11211)
+		MaxConnections string // e.g., "1024"
+		RateLimit      string // Commands per second per connection, e.g., "1000"
 	}
 	Storage struct {
 		DataDir         string
@@ -71,6 +73,10 @@ func parseINI(data string) (*Config, error) {
 			switch key {
 			case "listen":
 				cfg.Server.Listen = value
+			case "max-connections":
+				cfg.Server.MaxConnections = value
+			case "rate-limit":
+				cfg.Server.RateLimit = value
 			}
 		case "storage":
 			switch key {
@@ -148,7 +154,7 @@ func (c *Config) ToTQCacheConfig() (tqcache.Config, error) {
 		cfg.ChannelCapacity = n
 	}
 
-	return cfg, nil
+	return cfg, cfg.Validate()
 }
 
 // Shards returns the configured number of shards
@@ -162,3 +168,22 @@ func (c *Config) Shards() int {
 	}
 	return n
 }
+
+// MaxConnections returns the configured connection limit, 0 when not set
+func (c *Config) MaxConnections() int {
+	n, err := strconv.Atoi(c.Server.MaxConnections)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
+
+// RateLimit returns the configured commands per second per connection, 0
+// (unlimited) when not set
+func (c *Config) RateLimit() int {
+	n, err := strconv.Atoi(c.Server.RateLimit)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqcache/pkg/tqcache"
+)
+
+func TestParseINI(t *testing.T) {
+	cfg, err := parseINI(`
+[server]
+listen = localhost:11212 # inline comment
+max-connections = 256
+rate-limit = 1000
+
+; storage settings
+[storage]
+data-dir = /tmp/tqcache
+shards = 8
+default-ttl = 1h
+max-ttl = 24h
+sync-mode = none
+sync-interval = 2s
+channel-capacity = 500
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Server.Listen != "localhost:11212" {
+		t.Errorf("Expected listen localhost:11212, got %q", cfg.Server.Listen)
+	}
+	if n := cfg.MaxConnections(); n != 256 {
+		t.Errorf("Expected 256 max connections, got %d", n)
+	}
+	if n := cfg.RateLimit(); n != 1000 {
+		t.Errorf("Expected a rate limit of 1000, got %d", n)
+	}
+	if n := cfg.Shards(); n != 8 {
+		t.Errorf("Expected 8 shards, got %d", n)
+	}
+
+	tqcfg, err := cfg.ToTQCacheConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tqcfg.DataDir != "/tmp/tqcache" {
+		t.Errorf("Expected data dir /tmp/tqcache, got %q", tqcfg.DataDir)
+	}
+	if tqcfg.DefaultTTL != time.Hour || tqcfg.MaxTTL != 24*time.Hour {
+		t.Errorf("Expected TTLs 1h/24h, got %v/%v", tqcfg.DefaultTTL, tqcfg.MaxTTL)
+	}
+	if tqcfg.SyncStrategy != tqcache.SyncNone || tqcfg.SyncInterval != 2*time.Second {
+		t.Errorf("Expected sync none/2s, got %v/%v", tqcfg.SyncStrategy, tqcfg.SyncInterval)
+	}
+	if tqcfg.ChannelCapacity != 500 {
+		t.Errorf("Expected channel capacity 500, got %d", tqcfg.ChannelCapacity)
+	}
+}
+
+func TestParseINIDefaults(t *testing.T) {
+	cfg, err := parseINI("[server]\nlisten = :11211\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := cfg.MaxConnections(); n != 0 {
+		t.Errorf("Expected unset max connections to be 0, got %d", n)
+	}
+	if n := cfg.RateLimit(); n != 0 {
+		t.Errorf("Expected unset rate limit to be 0, got %d", n)
+	}
+	if n := cfg.Shards(); n != tqcache.DefaultShardCount {
+		t.Errorf("Expected default shard count, got %d", n)
+	}
+}
+
+func TestInvalidCombinations(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		storage string
+	}{
+		{"max-ttl below default-ttl", "default-ttl = 2h\nmax-ttl = 1h\n"},
+		{"periodic sync without interval", "sync-mode = periodic\nsync-interval = 0s\n"},
+		{"negative default-ttl", "default-ttl = -1s\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseINI("[storage]\n" + tt.storage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cfg.ToTQCacheConfig(); !errors.Is(err, tqcache.ErrInvalidConfig) {
+				t.Errorf("Expected ErrInvalidConfig, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+// Package logging sets up leveled logging for the tqcache commands.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// ParseLevel returns the level with the given name: debug, info, warn or error
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q (valid: debug, info, warn, error)", name)
+	}
+	return level, nil
+}
+
+// New returns a logger that writes records of at least level to w as
+// key=value text lines
+func New(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// Setup makes a logger for the named level the default, for slog as well as
+// the log package, whose messages are logged at info level
+func Setup(w io.Writer, levelName string) error {
+	level, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(New(w, level))
+	return nil
+}
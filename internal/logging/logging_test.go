@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLevelFiltering(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, slog.LevelWarn)
+	logger.Debug("debug message")
+	logger.Info("info message")
+	logger.Warn("warn message", "shard", 3)
+	logger.Error("error message")
+
+	got := out.String()
+	for _, msg := range []string{"debug message", "info message"} {
+		if strings.Contains(got, msg) {
+			t.Errorf("Expected %q to be filtered, got %q", msg, got)
+		}
+	}
+	if !strings.Contains(got, `level=WARN msg="warn message" shard=3`) {
+		t.Errorf("Expected the structured warning, got %q", got)
+	}
+	if !strings.Contains(got, "level=ERROR") {
+		t.Errorf("Expected the error, got %q", got)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	defer log.SetFlags(log.Flags())
+	defer log.SetOutput(log.Writer())
+
+	var out bytes.Buffer
+	if err := Setup(&out, "debug"); err != nil {
+		t.Fatal(err)
+	}
+	slog.Debug("connection closed")
+	log.Printf("plain message")
+	if got := out.String(); !strings.Contains(got, "level=DEBUG") || !strings.Contains(got, `level=INFO msg="plain message"`) {
+		t.Errorf("Expected debug and log package output, got %q", got)
+	}
+
+	if err := Setup(&out, "loud"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+	for name, want := range map[string]slog.Level{"debug": slog.LevelDebug, "INFO": slog.LevelInfo, "warn": slog.LevelWarn, "error": slog.LevelError} {
+		if level, err := ParseLevel(name); err != nil || level != want {
+			t.Errorf("Expected %v for %q, got %v, %v", want, name, level, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Package client offers the API of the gomemcache client
+// (github.com/bradfitz/gomemcache/memcache) on top of an in-process
+// ShardedCache, so call sites can drop the network round trip by changing
+// the import and the constructor.
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mevdschee/tqcache/pkg/tqcache"
+)
+
+// Errors returned like the gomemcache errors of the same name
+var (
+	ErrCacheMiss = errors.New("memcache: cache miss")
+	ErrNotStored = errors.New("memcache: item not stored")
+)
+
+// maxRelativeExpiration is the largest Expiration in seconds from now, larger
+// values are a Unix timestamp (as in memcached)
+const maxRelativeExpiration = 2592000
+
+// Item is an item to be got or stored
+type Item struct {
+	Key   string
+	Value []byte
+	Flags uint32 // Opaque client flags, stored with the value
+
+	// Expiration in seconds: 0 = no expiration, up to 30 days from now, or
+	// a Unix timestamp. Get leaves it 0 (as gomemcache does).
+	Expiration int32
+}
+
+// Client is a gomemcache compatible client of a ShardedCache
+type Client struct {
+	cache *tqcache.ShardedCache
+}
+
+// New returns a client of cache, closing the cache stays up to the caller
+func New(cache *tqcache.ShardedCache) *Client {
+	return &Client{cache: cache}
+}
+
+// Get gets the item for the given key, ErrCacheMiss is returned for a miss
+func (c *Client) Get(key string) (*Item, error) {
+	item, err := c.cache.GetItem(key)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return &Item{Key: key, Value: item.Value, Flags: item.Flags}, nil
+}
+
+// Set writes the given item, unconditionally
+func (c *Client) Set(item *Item) error {
+	return c.store(tqcache.OpSet, item)
+}
+
+// Add writes the given item, if no value already exists for its key.
+// ErrNotStored is returned if that condition is not met.
+func (c *Client) Add(item *Item) error {
+	return c.store(tqcache.OpAdd, item)
+}
+
+// store applies a storage operation with the flags and expiration of item
+func (c *Client) store(op tqcache.OpType, item *Item) error {
+	_, err := c.cache.Store(tqcache.Op{
+		Op:    op,
+		Key:   item.Key,
+		Value: item.Value,
+		TTL:   ttl(item.Expiration),
+		Flags: item.Flags,
+	})
+	return mapError(err)
+}
+
+// Delete deletes the item with the provided key, ErrCacheMiss is returned
+// if it does not exist
+func (c *Client) Delete(key string) error {
+	return mapError(c.cache.Delete(key))
+}
+
+// Increment atomically increments key by delta and returns the new value.
+// The value must be a decimal number, ErrCacheMiss is returned for a miss.
+func (c *Client) Increment(key string, delta uint64) (newValue uint64, err error) {
+	newValue, _, err = c.cache.Increment(key, delta)
+	return newValue, mapError(err)
+}
+
+// Decrement atomically decrements key by delta and returns the new value,
+// it stops at 0. ErrCacheMiss is returned for a miss.
+func (c *Client) Decrement(key string, delta uint64) (newValue uint64, err error) {
+	newValue, _, err = c.cache.Decrement(key, delta)
+	return newValue, mapError(err)
+}
+
+// Touch updates the expiry of the given key, seconds is an Expiration as in
+// Item. ErrCacheMiss is returned if the key does not exist.
+func (c *Client) Touch(key string, seconds int32) error {
+	_, err := c.cache.Touch(key, ttl(seconds))
+	return mapError(err)
+}
+
+// ttl converts a memcached expiration to a TTL, expirations in the past
+// expire right away
+func ttl(expiration int32) time.Duration {
+	switch {
+	case expiration == 0:
+		return 0
+	case expiration < 0:
+		return time.Nanosecond
+	case expiration > maxRelativeExpiration:
+		if d := time.Until(time.Unix(int64(expiration), 0)); d > 0 {
+			return d
+		}
+		return time.Nanosecond
+	default:
+		return time.Duration(expiration) * time.Second
+	}
+}
+
+// mapError translates cache errors to the gomemcache errors
+func mapError(err error) error {
+	switch {
+	case errors.Is(err, tqcache.ErrKeyNotFound):
+		return ErrCacheMiss
+	case errors.Is(err, tqcache.ErrKeyExists):
+		return ErrNotStored
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqcache/pkg/tqcache"
+)
+
+func newTestClient(t *testing.T) (*Client, *tqcache.ShardedCache) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-client-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	config := tqcache.DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = tqcache.SyncNone
+
+	cache, err := tqcache.NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cache.Close() })
+	return New(cache), cache
+}
+
+func TestGetSet(t *testing.T) {
+	c, cache := newTestClient(t)
+
+	if _, err := c.Get("missing"); err != ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss, got %v", err)
+	}
+	if err := c.Set(&Item{Key: "k", Value: []byte("v"), Flags: 42}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	item, err := c.Get("k")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if item.Key != "k" || string(item.Value) != "v" || item.Flags != 42 || item.Expiration != 0 {
+		t.Errorf("Unexpected item %+v", item)
+	}
+	// The flags are stored in the cache, not in the client
+	if stored, err := cache.GetItem("k"); err != nil || stored.Flags != 42 {
+		t.Errorf("Expected flags 42 in the cache, got %+v (err=%v)", stored, err)
+	}
+
+	if err := c.Add(&Item{Key: "k", Value: []byte("other")}); err != ErrNotStored {
+		t.Errorf("Expected ErrNotStored for Add of an existing key, got %v", err)
+	}
+	if err := c.Add(&Item{Key: "new", Value: []byte("v"), Flags: 7}); err != nil {
+		t.Errorf("Add failed: %v", err)
+	}
+	if item, err := c.Get("new"); err != nil || item.Flags != 7 {
+		t.Errorf("Expected flags 7 after Add, got %+v (err=%v)", item, err)
+	}
+
+	if err := c.Delete("k"); err != nil {
+		t.Errorf("Delete failed: %v", err)
+	}
+	if err := c.Delete("k"); err != ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss for Delete of a missing key, got %v", err)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	c, cache := newTestClient(t)
+
+	tests := []struct {
+		key        string
+		expiration int32
+		ttl        time.Duration // Expected remaining TTL, 0 = expired
+	}{
+		{"forever", 0, tqcache.NoExpiry},
+		{"relative", 100, 100 * time.Second},
+		{"absolute", int32(time.Now().Add(time.Hour).Unix()), time.Hour},
+		{"negative", -1, 0},
+		{"past", int32(time.Now().Add(-time.Hour).Unix()), 0},
+	}
+	for _, tt := range tests {
+		if err := c.Set(&Item{Key: tt.key, Value: []byte("v"), Expiration: tt.expiration}); err != nil {
+			t.Fatalf("Set %s failed: %v", tt.key, err)
+		}
+	}
+	time.Sleep(time.Millisecond)
+	for _, tt := range tests {
+		_, _, ttl, err := cache.GetWithTTL(tt.key)
+		if tt.ttl == 0 {
+			if err != tqcache.ErrKeyNotFound {
+				t.Errorf("%s: expected the item to be expired, got ttl %v (err=%v)", tt.key, ttl, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: GetWithTTL failed: %v", tt.key, err)
+		} else if ttl > tt.ttl || ttl < tt.ttl-2*time.Second {
+			t.Errorf("%s: expected a TTL of about %v, got %v", tt.key, tt.ttl, ttl)
+		}
+	}
+
+	if err := c.Touch("forever", 100); err != nil {
+		t.Fatalf("Touch failed: %v", err)
+	}
+	if _, _, ttl, _ := cache.GetWithTTL("forever"); ttl > 100*time.Second || ttl < 98*time.Second {
+		t.Errorf("Expected a TTL of about 100s after Touch, got %v", ttl)
+	}
+	if err := c.Touch("missing", 100); err != ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss for Touch of a missing key, got %v", err)
+	}
+}
+
+func TestIncrementDecrement(t *testing.T) {
+	c, _ := newTestClient(t)
+
+	if _, err := c.Increment("counter", 1); err != ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss, got %v", err)
+	}
+	if err := c.Set(&Item{Key: "counter", Value: []byte("10")}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Increment("counter", 5); err != nil || n != 15 {
+		t.Errorf("Expected 15, got %d (err=%v)", n, err)
+	}
+	if n, err := c.Decrement("counter", 20); err != nil || n != 0 {
+		t.Errorf("Expected Decrement to stop at 0, got %d (err=%v)", n, err)
+	}
+	if err := c.Set(&Item{Key: "text", Value: []byte("abc")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Increment("text", 1); err != tqcache.ErrNotNumeric {
+		t.Errorf("Expected ErrNotNumeric, got %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+// Package health serves liveness and readiness checks over HTTP, for
+// container orchestrators.
+package health
+
+import "net/http"
+
+// Pinger is the part of the cache the readiness check uses
+type Pinger interface {
+	Ping() error
+}
+
+// Register adds the /healthz and /readyz handlers for cache to mux
+func Register(mux *http.ServeMux, cache Pinger) {
+	mux.HandleFunc("/healthz", Live)
+	mux.Handle("/readyz", Ready(cache))
+}
+
+// Live answers 200 as long as the process serves HTTP
+func Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// Ready returns a handler that answers 200 when every shard of cache answers
+// a ping, and 503 with the error otherwise
+func Ready(cache Pinger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := cache.Ping(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
@@ -0,0 +1,53 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mevdschee/tqcache/pkg/tqcache"
+)
+
+// failingPinger is a cache whose shards do not answer
+type failingPinger struct{}
+
+func (failingPinger) Ping() error {
+	return errors.New("shard 3: shard busy, request timed out")
+}
+
+func TestHandlers(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-health-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := tqcache.DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = tqcache.SyncNone
+
+	cache, err := tqcache.NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	mux := http.NewServeMux()
+	Register(mux, cache)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+			t.Errorf("Expected 200 ok for %s, got %d %q", path, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	Ready(failingPinger{}).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "shard 3") {
+		t.Errorf("Expected 503 naming the shard, got %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,130 @@
+// Package metrics exposes cache statistics in the Prometheus text format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is how often the cache statistics are read
+const DefaultInterval = 5 * time.Second
+
+// Source is the part of the cache the collector reads from
+type Source interface {
+	Stats() map[string]string
+	QueueDepths() []int
+}
+
+// metric maps a stats key to an exported metric
+type metric struct {
+	stat string
+	name string
+	kind string // "gauge" or "counter"
+	help string
+}
+
+var metrics = []metric{
+	{"curr_items", "tqcache_curr_items", "gauge", "Number of items in the cache."},
+	{"bytes", "tqcache_bytes", "gauge", "Bytes of the data files."},
+	{"evictions", "tqcache_evictions_total", "counter", "Items evicted to free space."},
+	{"cmd_get", "tqcache_cmd_get_total", "counter", "Keys requested by get commands."},
+	{"cmd_set", "tqcache_cmd_set_total", "counter", "Storage commands."},
+	{"get_hits", "tqcache_get_hits_total", "counter", "Keys found by get commands."},
+	{"get_misses", "tqcache_get_misses_total", "counter", "Keys not found by get commands."},
+	{"delete_hits", "tqcache_delete_hits_total", "counter", "Deletes of an existing key."},
+	{"delete_misses", "tqcache_delete_misses_total", "counter", "Deletes of a missing key."},
+	{"incr_hits", "tqcache_incr_hits_total", "counter", "Increments and decrements of an existing key."},
+	{"incr_misses", "tqcache_incr_misses_total", "counter", "Increments and decrements of a missing key."},
+}
+
+// Collector periodically reads the cache statistics and serves the last
+// reading as Prometheus text
+type Collector struct {
+	source   Source
+	interval time.Duration
+
+	mu   sync.RWMutex
+	page []byte
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New creates a collector reading source every interval (0 = DefaultInterval)
+func New(source Source, interval time.Duration) *Collector {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	c := &Collector{
+		source:   source,
+		interval: interval,
+		stopChan: make(chan struct{}),
+	}
+	c.collect()
+	return c
+}
+
+// Start starts reading the statistics in the background
+func (c *Collector) Start() {
+	c.wg.Add(1)
+	go c.run()
+}
+
+// Stop stops the background reading
+func (c *Collector) Stop() {
+	close(c.stopChan)
+	c.wg.Wait()
+}
+
+func (c *Collector) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.collect()
+		case <-c.stopChan:
+			return
+		}
+	}
+}
+
+// collect reads the statistics and renders them
+func (c *Collector) collect() {
+	stats := c.source.Stats()
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		value, err := strconv.ParseUint(stats[m.stat], 10, 64)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, value)
+	}
+
+	buf.WriteString("# HELP tqcache_queue_depth Requests waiting in the shard request channel.\n")
+	buf.WriteString("# TYPE tqcache_queue_depth gauge\n")
+	for shard, depth := range c.source.QueueDepths() {
+		fmt.Fprintf(&buf, "tqcache_queue_depth{shard=\"%d\"} %d\n", shard, depth)
+	}
+
+	c.mu.Lock()
+	c.page = buf.Bytes()
+	c.mu.Unlock()
+}
+
+// ServeHTTP writes the last reading in the Prometheus text format
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.RLock()
+	page := c.page
+	c.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(page)
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mevdschee/tqcache/pkg/tqcache"
+)
+
+func TestHandler(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-metrics-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := tqcache.DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = tqcache.SyncNone
+
+	cache, err := tqcache.NewSharded(config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Set("key", []byte("value"), 0)
+	cache.Get("key")
+	cache.Get("missing")
+
+	collector := New(cache, 0)
+	rec := httptest.NewRecorder()
+	collector.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	page := string(body)
+
+	for _, line := range []string{
+		"tqcache_curr_items 1",
+		"tqcache_get_hits_total 1",
+		"tqcache_get_misses_total 1",
+		"tqcache_evictions_total 0",
+		`tqcache_queue_depth{shard="0"} 0`,
+		`tqcache_queue_depth{shard="1"} 0`,
+		"# TYPE tqcache_bytes gauge",
+	} {
+		if !strings.Contains(page, line+"\n") {
+			t.Errorf("Expected %q in metrics:\n%s", line, page)
+		}
+	}
+
+	// Every sample line must be a name (with optional labels) and a value
+	for _, line := range strings.Split(strings.TrimSpace(page), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) != 2 || !strings.HasPrefix(fields[0], "tqcache_") {
+			t.Errorf("Unparseable sample line %q", line)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// Package ratelimit implements a token bucket rate limiter.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter allows rate operations per second on average, with bursts of up to
+// burst operations. It is safe for concurrent use.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64 // Bucket size
+	tokens float64
+	last   time.Time // When tokens was last updated
+}
+
+// New returns a limiter with a full bucket, a burst below 1 is taken as 1
+func New(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token and reports whether there was one
+func (l *Limiter) Allow() bool {
+	return l.allowAt(time.Now())
+}
+
+// allowAt is Allow at the given time
+func (l *Limiter) allowAt(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = min(l.burst, l.tokens+elapsed.Seconds()*l.rate)
+		l.last = now
+	}
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,40 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	l := New(10, 5)
+	now := l.last
+
+	// The full bucket allows a burst
+	for i := 0; i < 5; i++ {
+		if !l.allowAt(now) {
+			t.Fatalf("Expected operation %d of the burst to be allowed", i)
+		}
+	}
+	if l.allowAt(now) {
+		t.Error("Expected the operation past the burst to be limited")
+	}
+
+	// One token per 100ms at 10 per second
+	if l.allowAt(now.Add(50 * time.Millisecond)) {
+		t.Error("Expected no token after 50ms")
+	}
+	if !l.allowAt(now.Add(100 * time.Millisecond)) {
+		t.Error("Expected a token after 100ms")
+	}
+
+	// Refilling stops at the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		if !l.allowAt(later) {
+			t.Fatalf("Expected operation %d after refilling to be allowed", i)
+		}
+	}
+	if l.allowAt(later) {
+		t.Error("Expected the bucket to hold at most the burst")
+	}
+}
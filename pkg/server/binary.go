@@ -4,10 +4,8 @@ import (
 	"bufio"
 	"encoding/binary"
 	"io"
-	"log"
-	"net"
+	"log/slog"
 	"os"
-	"strconv"
 	"time"
 
 	"github.com/mevdschee/tqcache/pkg/tqcache"
@@ -37,6 +35,7 @@ const (
 	opTouch     = 0x1c
 	opGAT       = 0x1d
 	opGATK      = 0x1e
+	opGetDelete = 0x3a // Get and delete, as the gd text command
 )
 
 const (
@@ -46,8 +45,10 @@ const (
 	resValueTooLarge = 0x0003
 	resInvalidArgs   = 0x0004
 	resItemNotStored = 0x0005
+	resNonNumeric    = 0x0006
 	resUnknownCmd    = 0x0081
 	resOOM           = 0x0082
+	resInternalError = 0x0084
 )
 
 type binaryHeader struct {
@@ -62,19 +63,24 @@ type binaryHeader struct {
 	CAS      uint64
 }
 
-func (s *Server) handleBinary(conn net.Conn, reader *bufio.Reader, writer *bufio.Writer) {
+func (s *Server) handleBinary(conn *conn, reader *bufio.Reader, writer *bufio.Writer) {
 	headerBuf := make([]byte, 24)
 
 	for {
-		if _, err := io.ReadFull(reader, headerBuf); err != nil {
-			if err != io.EOF {
-				log.Printf("Binary read header error: %v", err)
+		if !s.nextCommand(conn) {
+			return
+		}
+		_, err := io.ReadFull(reader, headerBuf)
+		conn.idle.Store(false)
+		if err != nil {
+			if s.logReadError(err) {
+				slog.Debug("Binary read header error", "remote", conn.remoteAddr(), "err", err)
 			}
 			return
 		}
 
 		if headerBuf[0] != reqMagic {
-			log.Printf("Invalid magic byte: %x", headerBuf[0])
+			slog.Debug("Invalid magic byte", "remote", conn.remoteAddr(), "magic", headerBuf[0])
 			return
 		}
 
@@ -90,9 +96,35 @@ func (s *Server) handleBinary(conn net.Conn, reader *bufio.Reader, writer *bufio
 			CAS:      binary.BigEndian.Uint64(headerBuf[16:24]),
 		}
 
-		bodyBuf := make([]byte, req.BodyLen)
+		// Extras and key must fit in the body, a client that gets this wrong
+		// cannot be trusted to stay in sync
+		if uint32(req.ExtraLen)+uint32(req.KeyLen) > req.BodyLen {
+			slog.Debug("Invalid binary body length", "remote", conn.remoteAddr(), "body", req.BodyLen)
+			s.sendBinaryResponse(writer, req, resInvalidArgs, nil, nil, nil, 0)
+			writer.Flush()
+			return
+		}
+
+		// Skip an oversized value instead of allocating a buffer for it
+		if s.valueTooLarge(int(req.BodyLen - uint32(req.ExtraLen) - uint32(req.KeyLen))) {
+			if _, err := io.CopyN(io.Discard, reader, int64(req.BodyLen)); err != nil {
+				slog.Debug("Binary read body error", "remote", conn.remoteAddr(), "err", err)
+				return
+			}
+			s.sendBinaryResponse(writer, req, resValueTooLarge, nil, nil, nil, 0)
+			if reader.Buffered() == 0 && !quietOpcode(req.Opcode) {
+				writer.Flush()
+			}
+			continue
+		}
+
+		// The body comes from a pool, the cache does not keep the value after
+		// the call and the writer copies what it is given
+		body := getBuffer(int(req.BodyLen))
+		bodyBuf := *body
 		if _, err := io.ReadFull(reader, bodyBuf); err != nil {
-			log.Printf("Binary read body error: %v", err)
+			slog.Debug("Binary read body error", "remote", conn.remoteAddr(), "err", err)
+			putBuffer(body)
 			return
 		}
 
@@ -100,6 +132,27 @@ func (s *Server) handleBinary(conn net.Conn, reader *bufio.Reader, writer *bufio
 		key := string(bodyBuf[req.ExtraLen : uint32(req.ExtraLen)+uint32(req.KeyLen)])
 		value := bodyBuf[uint32(req.ExtraLen)+uint32(req.KeyLen):]
 
+		if conn.limited() {
+			s.sendBinaryResponse(writer, req, resOOM, nil, nil, []byte("rate limited"), 0)
+			putBuffer(body)
+			if reader.Buffered() == 0 && !quietOpcode(req.Opcode) {
+				writer.Flush()
+			}
+			continue
+		}
+
+		start := time.Now()
+
+		// The key of a stat request names a group of stats
+		if req.KeyLen > 0 && req.Opcode != opStat && s.badKey(key) {
+			s.sendBinaryResponse(writer, req, resInvalidArgs, nil, nil, nil, 0)
+			putBuffer(body)
+			if reader.Buffered() == 0 && !quietOpcode(req.Opcode) {
+				writer.Flush()
+			}
+			continue
+		}
+
 		switch req.Opcode {
 		case opSet:
 			s.handleBinaryStorage(writer, req, extras, key, value, "SET")
@@ -114,18 +167,21 @@ func (s *Server) handleBinary(conn net.Conn, reader *bufio.Reader, writer *bufio
 		case opDecrement:
 			s.handleBinaryIncrDecr(writer, req, extras, key, false)
 		case opFlush:
-			s.handleBinaryFlush(writer, req)
+			s.handleBinaryFlush(writer, req, extras)
 		case opGet:
-			s.handleBinaryGet(writer, req, key, false)
+			s.handleBinaryGetCommon(writer, req, key, false, false)
 		case opGetQ:
-			s.handleBinaryGet(writer, req, key, true)
+			s.handleBinaryGetCommon(writer, req, key, false, true)
 		case opGetK:
-			s.handleBinaryGetK(writer, req, key, false)
+			s.handleBinaryGetCommon(writer, req, key, true, false)
 		case opGetKQ:
-			s.handleBinaryGetK(writer, req, key, true)
+			s.handleBinaryGetCommon(writer, req, key, true, true)
+		case opGetDelete:
+			s.handleBinaryGetCommon(writer, req, key, false, false)
 		case opVersion:
 			s.handleBinaryVersion(writer, req)
 		case opQuit:
+			putBuffer(body)
 			return
 		case opNoop:
 			s.sendBinaryResponse(writer, req, resSuccess, nil, nil, nil, 0)
@@ -142,22 +198,36 @@ func (s *Server) handleBinary(conn net.Conn, reader *bufio.Reader, writer *bufio
 		case opGATK:
 			s.handleBinaryGATK(writer, req, extras, key)
 		default:
-			log.Printf("Binary Unknown Opcode: 0x%02x", req.Opcode)
+			slog.Debug("Unknown binary opcode", "remote", conn.remoteAddr(), "opcode", req.Opcode)
 			s.sendBinaryResponse(writer, req, resUnknownCmd, nil, nil, nil, 0)
 		}
+		putBuffer(body)
 
-		if reader.Buffered() == 0 {
+		if d := s.observe(binaryClass(req.Opcode), start); s.slow(d) {
+			slog.Warn("Slow command", "opcode", req.Opcode, "key", key, "duration", d, "remote", conn.remoteAddr())
+		}
+
+		// Replies to quiet gets are held until a command that is not quiet
+		// (usually a NOOP), so a GETQ...NOOP pipeline is written as one batch
+		if reader.Buffered() == 0 && !quietOpcode(req.Opcode) {
 			writer.Flush()
 		}
 	}
 }
 
+// quietOpcode reports whether an opcode is a quiet get, whose replies the
+// client only expects once it sends a command that is not quiet
+func quietOpcode(opcode byte) bool {
+	return opcode == opGetQ || opcode == opGetKQ
+}
+
 func (s *Server) handleBinaryStorage(writer *bufio.Writer, req binaryHeader, extras []byte, key string, value []byte, op string) {
 	if len(extras) != 8 {
 		s.sendBinaryResponse(writer, req, resInvalidArgs, nil, nil, nil, 0)
 		return
 	}
 
+	flags := binary.BigEndian.Uint32(extras[0:4])
 	expiry := binary.BigEndian.Uint32(extras[4:8])
 
 	var ttl time.Duration
@@ -169,21 +239,26 @@ func (s *Server) handleBinaryStorage(writer *bufio.Writer, req binaryHeader, ext
 		}
 	}
 
-	var err error
-	var newCas uint64
+	// The client's data type is stored with the value and returned by gets
+	storeOp := tqcache.Op{Key: key, Value: value, TTL: ttl, Flags: flags, DataType: req.DataType}
 	if req.CAS > 0 {
-		newCas, err = s.cache.Cas(key, value, ttl, req.CAS)
+		storeOp.Op = tqcache.OpCas
+		storeOp.Cas = req.CAS
 	} else {
 		switch op {
 		case "SET":
-			newCas, err = s.cache.Set(key, value, ttl)
+			storeOp.Op = tqcache.OpSet
 		case "ADD":
-			newCas, err = s.cache.Add(key, value, ttl)
+			storeOp.Op = tqcache.OpAdd
 		case "REPLACE":
-			newCas, err = s.cache.Replace(key, value, ttl)
+			storeOp.Op = tqcache.OpReplace
 		}
 	}
+	newCas, err := s.cache.Store(storeOp)
 
+	if s.sendBinaryBusy(writer, req, err) {
+		return
+	}
 	if err != nil {
 		if err == tqcache.ErrValueTooLarge {
 			s.sendBinaryResponse(writer, req, resValueTooLarge, nil, nil, nil, 0)
@@ -204,39 +279,62 @@ func (s *Server) handleBinaryStorage(writer *bufio.Writer, req binaryHeader, ext
 	s.sendBinaryResponse(writer, req, resSuccess, nil, nil, nil, newCas)
 }
 
-func (s *Server) handleBinaryGet(writer *bufio.Writer, req binaryHeader, key string, quiet bool) {
-	val, cas, err := s.cache.Get(key)
-	if err != nil {
+// handleBinaryGetCommon handles GET, GETQ, GETK, GETKQ and GETDELETE. Quiet
+// gets send nothing for a miss, the K variants return the key with the value.
+func (s *Server) handleBinaryGetCommon(writer *bufio.Writer, req binaryHeader, key string, returnKey, quiet bool) {
+	get := s.cache.GetItem
+	if req.Opcode == opGetDelete {
+		get = s.cache.GetDeleteItem
+	}
+	item, err := get(key)
+	if s.sendBinaryBusy(writer, req, err) {
+		return
+	}
+	if err == tqcache.ErrResponseTooLarge {
+		s.sendBinaryResponse(writer, req, resValueTooLarge, nil, nil, nil, 0)
+		return
+	}
+	if err == tqcache.ErrKeyNotFound {
 		if quiet {
 			return
 		}
 		s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
 		return
 	}
-
-	extras := make([]byte, 4)
-	s.sendBinaryResponse(writer, req, resSuccess, extras, nil, val, cas)
-}
-
-func (s *Server) handleBinaryGetK(writer *bufio.Writer, req binaryHeader, key string, quiet bool) {
-	val, cas, err := s.cache.Get(key)
 	if err != nil {
-		if quiet {
-			return
-		}
-		s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
+		// Storage failure, reported even for quiet gets
+		s.sendBinaryResponse(writer, req, resInternalError, nil, nil, []byte(err.Error()), 0)
 		return
 	}
+
 	extras := make([]byte, 4)
-	s.sendBinaryResponse(writer, req, resSuccess, extras, []byte(key), val, cas)
+	binary.BigEndian.PutUint32(extras, item.Flags)
+	var keyBytes []byte
+	if returnKey {
+		keyBytes = []byte(key)
+	}
+	s.sendBinaryResponseType(writer, req, resSuccess, item.DataType, extras, keyBytes, item.Value, item.Cas)
 }
 
 func (s *Server) handleBinaryDelete(writer *bufio.Writer, req binaryHeader, key string) {
-	err := s.cache.Delete(key)
-	if err == nil {
-		s.sendBinaryResponse(writer, req, resSuccess, nil, nil, nil, 0)
+	var err error
+	if req.CAS > 0 {
+		err = s.cache.DeleteCas(key, req.CAS)
 	} else {
+		err = s.cache.Delete(key)
+	}
+	if s.sendBinaryBusy(writer, req, err) {
+		return
+	}
+	switch err {
+	case nil:
+		s.sendBinaryResponse(writer, req, resSuccess, nil, nil, nil, 0)
+	case tqcache.ErrCasMismatch:
+		s.sendBinaryResponse(writer, req, resKeyExists, nil, nil, nil, 0)
+	case tqcache.ErrKeyNotFound:
 		s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
+	default:
+		s.sendBinaryResponse(writer, req, resInternalError, nil, nil, []byte(err.Error()), 0)
 	}
 }
 
@@ -254,18 +352,15 @@ func (s *Server) handleBinaryIncrDecr(writer *bufio.Writer, req binaryHeader, ex
 	var cas uint64
 	var err error
 
-	if incr {
-		newVal, cas, err = s.cache.Increment(key, delta)
-	} else {
-		newVal, cas, err = s.cache.Decrement(key, delta)
-	}
-
-	if err == os.ErrNotExist {
-		if expiry == 0xFFFFFFFF {
-			s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
-			return
+	// An expiration of 0xFFFFFFFF fails on a missing key, otherwise it is
+	// created with the initial value
+	if expiry == 0xFFFFFFFF {
+		if incr {
+			newVal, cas, err = s.cache.Increment(key, delta)
+		} else {
+			newVal, cas, err = s.cache.Decrement(key, delta)
 		}
-
+	} else {
 		var ttl time.Duration
 		if expiry > 0 {
 			if expiry > 2592000 {
@@ -274,15 +369,24 @@ func (s *Server) handleBinaryIncrDecr(writer *bufio.Writer, req binaryHeader, ex
 				ttl = time.Duration(expiry) * time.Second
 			}
 		}
-
-		initS := strconv.FormatUint(initial, 10)
-		cas, err = s.cache.Set(key, []byte(initS), ttl)
-		if err != nil {
-			s.sendBinaryResponse(writer, req, resItemNotStored, nil, nil, nil, 0)
-			return
+		if incr {
+			newVal, cas, err = s.cache.IncrementInit(key, delta, initial, ttl)
+		} else {
+			newVal, cas, err = s.cache.DecrementInit(key, delta, initial, ttl)
 		}
-		newVal = initial
-	} else if err != nil {
+	}
+	if s.sendBinaryBusy(writer, req, err) {
+		return
+	}
+	switch err {
+	case nil:
+	case tqcache.ErrKeyNotFound:
+		s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
+		return
+	case tqcache.ErrNotNumeric:
+		s.sendBinaryResponse(writer, req, resNonNumeric, nil, nil, nil, 0)
+		return
+	default:
 		s.sendBinaryResponse(writer, req, resInvalidArgs, nil, nil, nil, 0)
 		return
 	}
@@ -292,8 +396,18 @@ func (s *Server) handleBinaryIncrDecr(writer *bufio.Writer, req binaryHeader, ex
 	s.sendBinaryResponse(writer, req, resSuccess, nil, nil, resBody, cas)
 }
 
-func (s *Server) handleBinaryFlush(writer *bufio.Writer, req binaryHeader) {
-	s.cache.FlushAll()
+func (s *Server) handleBinaryFlush(writer *bufio.Writer, req binaryHeader, extras []byte) {
+	// Optional expiration after which the flush takes effect
+	var delay time.Duration
+	if len(extras) == 4 {
+		expiry := binary.BigEndian.Uint32(extras[0:4])
+		if expiry > 2592000 {
+			delay = time.Until(time.Unix(int64(expiry), 0))
+		} else {
+			delay = time.Duration(expiry) * time.Second
+		}
+	}
+	s.cache.FlushAllAfter(delay)
 	s.sendBinaryResponse(writer, req, resSuccess, nil, nil, nil, 0)
 }
 
@@ -303,19 +417,27 @@ func (s *Server) handleBinaryAppendPrepend(writer *bufio.Writer, req binaryHeade
 		return
 	}
 
+	// A nonzero CAS in the header only extends the value it was read with
 	var err error
 	var cas uint64
 	if isAppend {
-		cas, err = s.cache.Append(key, value)
+		cas, err = s.cache.AppendCas(key, value, req.CAS)
 	} else {
-		cas, err = s.cache.Prepend(key, value)
+		cas, err = s.cache.PrependCas(key, value, req.CAS)
 	}
 
+	if s.sendBinaryBusy(writer, req, err) {
+		return
+	}
 	if err != nil {
 		if err == tqcache.ErrValueTooLarge {
 			s.sendBinaryResponse(writer, req, resValueTooLarge, nil, nil, nil, 0)
 			return
 		}
+		if err == tqcache.ErrCasMismatch {
+			s.sendBinaryResponse(writer, req, resKeyExists, nil, nil, nil, 0)
+			return
+		}
 		if err == os.ErrNotExist {
 			s.sendBinaryResponse(writer, req, resItemNotStored, nil, nil, nil, 0)
 			return
@@ -332,7 +454,7 @@ func (s *Server) handleBinaryVersion(writer *bufio.Writer, req binaryHeader) {
 }
 
 func (s *Server) handleBinaryStats(writer *bufio.Writer, req binaryHeader) {
-	stats := s.cache.Stats()
+	stats := s.stats()
 	for k, v := range stats {
 		s.sendBinaryResponse(writer, req, resSuccess, nil, []byte(k), []byte(v), 0)
 	}
@@ -355,10 +477,17 @@ func (s *Server) handleBinaryTouch(writer *bufio.Writer, req binaryHeader, extra
 	}
 
 	cas, err := s.cache.Touch(key, ttl)
-	if err != nil {
+	if s.sendBinaryBusy(writer, req, err) {
+		return
+	}
+	if err == tqcache.ErrKeyNotFound {
 		s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
 		return
 	}
+	if err != nil {
+		s.sendBinaryResponse(writer, req, resInternalError, nil, nil, []byte(err.Error()), 0)
+		return
+	}
 	s.sendBinaryResponse(writer, req, resSuccess, nil, nil, nil, cas)
 }
 
@@ -385,28 +514,50 @@ func (s *Server) handleBinaryGATCommon(writer *bufio.Writer, req binaryHeader, e
 		}
 	}
 
-	cas, err := s.cache.Touch(key, ttl)
-	if err != nil {
+	item, err := s.cache.GetAndTouch(key, ttl)
+	if s.sendBinaryBusy(writer, req, err) {
+		return
+	}
+	if err == tqcache.ErrResponseTooLarge {
+		s.sendBinaryResponse(writer, req, resValueTooLarge, nil, nil, nil, 0)
+		return
+	}
+	if err == tqcache.ErrKeyNotFound {
 		s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
 		return
 	}
-
-	val, _, err := s.cache.Get(key)
 	if err != nil {
-		s.sendBinaryResponse(writer, req, resKeyNotFound, nil, nil, nil, 0)
+		s.sendBinaryResponse(writer, req, resInternalError, nil, nil, []byte(err.Error()), 0)
 		return
 	}
 
 	resExtras := make([]byte, 4)
+	binary.BigEndian.PutUint32(resExtras, item.Flags)
 	var keyBytes []byte
 	if returnKey {
 		keyBytes = []byte(key)
 	}
 
-	s.sendBinaryResponse(writer, req, resSuccess, resExtras, keyBytes, val, cas)
+	s.sendBinaryResponseType(writer, req, resSuccess, item.DataType, resExtras, keyBytes, item.Value, item.Cas)
+}
+
+// sendBinaryBusy answers a request that timed out waiting for its shard with
+// resOOM, like memcached when it is out of resources, and reports whether it
+// did
+func (s *Server) sendBinaryBusy(writer *bufio.Writer, req binaryHeader, err error) bool {
+	if err != tqcache.ErrBusy {
+		return false
+	}
+	s.sendBinaryResponse(writer, req, resOOM, nil, nil, []byte(err.Error()), 0)
+	return true
 }
 
 func (s *Server) sendBinaryResponse(writer *bufio.Writer, req binaryHeader, status uint16, extras []byte, key []byte, value []byte, cas uint64) {
+	s.sendBinaryResponseType(writer, req, status, 0, extras, key, value, cas)
+}
+
+// sendBinaryResponseType sends a response with the data type of the returned value
+func (s *Server) sendBinaryResponseType(writer *bufio.Writer, req binaryHeader, status uint16, dataType uint8, extras []byte, key []byte, value []byte, cas uint64) {
 	totalBodyLen := uint32(len(extras) + len(key) + len(value))
 	// Header is 24 bytes
 	var buf [24]byte
@@ -415,32 +566,32 @@ func (s *Server) sendBinaryResponse(writer *bufio.Writer, req binaryHeader, stat
 	buf[1] = req.Opcode
 	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
 	buf[4] = uint8(len(extras))
-	buf[5] = 0
+	buf[5] = dataType
 	binary.BigEndian.PutUint16(buf[6:8], status)
 	binary.BigEndian.PutUint32(buf[8:12], totalBodyLen)
 	binary.BigEndian.PutUint32(buf[12:16], req.Opaque)
 	binary.BigEndian.PutUint64(buf[16:24], cas)
 
 	if _, err := writer.Write(buf[:]); err != nil {
-		log.Printf("Response Write Error: %v", err)
+		slog.Debug("Response write error", "err", err)
 		return
 	}
 
 	if len(extras) > 0 {
 		if _, err := writer.Write(extras); err != nil {
-			log.Printf("Response Write Extras Error: %v", err)
+			slog.Debug("Response write extras error", "err", err)
 			return
 		}
 	}
 	if len(key) > 0 {
 		if _, err := writer.Write(key); err != nil {
-			log.Printf("Response Write Key Error: %v", err)
+			slog.Debug("Response write key error", "err", err)
 			return
 		}
 	}
 	if len(value) > 0 {
 		if _, err := writer.Write(value); err != nil {
-			log.Printf("Response Write Value Error: %v", err)
+			slog.Debug("Response write value error", "err", err)
 			return
 		}
 	}
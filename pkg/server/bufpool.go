@@ -0,0 +1,42 @@
+package server
+
+import "sync"
+
+// bufferClasses are the capacities of the pooled buffers, larger requests
+// get a buffer of their own
+var bufferClasses = [...]int{256, 4096, 65536, 1 << 20}
+
+var bufferPools [len(bufferClasses)]sync.Pool
+
+func init() {
+	for i, size := range bufferClasses {
+		size := size
+		bufferPools[i].New = func() any {
+			buf := make([]byte, size)
+			return &buf
+		}
+	}
+}
+
+// getBuffer returns a buffer of length n from the smallest class that fits
+func getBuffer(n int) *[]byte {
+	for i, size := range bufferClasses {
+		if n <= size {
+			buf := bufferPools[i].Get().(*[]byte)
+			*buf = (*buf)[:n]
+			return buf
+		}
+	}
+	buf := make([]byte, n)
+	return &buf
+}
+
+// putBuffer returns a buffer to its pool, nothing may reference it afterwards
+func putBuffer(buf *[]byte) {
+	for i, size := range bufferClasses {
+		if cap(*buf) == size {
+			bufferPools[i].Put(buf)
+			return
+		}
+	}
+}
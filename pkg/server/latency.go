@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// opClass groups commands for the latency stats
+type opClass int
+
+const (
+	classOther opClass = iota // Not reported
+	classGet
+	classSet
+	classDelete
+	classIncr
+	classTouch
+	numClasses
+)
+
+// classNames are the stat names of the classes, as in cmd_<name>_time
+var classNames = [numClasses]string{"", "get", "set", "delete", "incr", "touch"}
+
+// latencies holds the total time spent per command class, in nanoseconds
+type latencies [numClasses]atomic.Int64
+
+// textClass returns the class of an upper-case text command
+func textClass(cmd string) opClass {
+	switch cmd {
+	case "GET", "GETS", "GAT", "GATS", "MG":
+		return classGet
+	case "SET", "ADD", "REPLACE", "APPEND", "PREPEND", "CAS", "MS":
+		return classSet
+	case "DELETE", "GD", "MD":
+		return classDelete
+	case "INCR", "DECR":
+		return classIncr
+	case "TOUCH":
+		return classTouch
+	}
+	return classOther
+}
+
+// binaryClass returns the class of a binary opcode
+func binaryClass(opcode byte) opClass {
+	switch opcode {
+	case opGet, opGetQ, opGetK, opGetKQ, opGAT, opGATK:
+		return classGet
+	case opSet, opAdd, opReplace, opAppend, opPrepend:
+		return classSet
+	case opDelete, opGetDelete:
+		return classDelete
+	case opIncrement, opDecrement:
+		return classIncr
+	case opTouch:
+		return classTouch
+	}
+	return classOther
+}
+
+// SetSlowOpThreshold logs commands taking longer than threshold, with their
+// key and duration (0 = off)
+func (s *Server) SetSlowOpThreshold(threshold time.Duration) {
+	s.slowOpThreshold = threshold
+}
+
+// observe adds the time since start to the total of class and returns it
+func (s *Server) observe(class opClass, start time.Time) time.Duration {
+	d := time.Since(start)
+	s.latency[class].Add(int64(d))
+	return d
+}
+
+// slow reports whether a command of duration d must be logged
+func (s *Server) slow(d time.Duration) bool {
+	return s.slowOpThreshold > 0 && d > s.slowOpThreshold
+}
+
+// stats returns the cache stats with the command times of this server, in
+// seconds with microsecond precision
+func (s *Server) stats() map[string]string {
+	stats := s.cache.Stats()
+	for class := classGet; class < numClasses; class++ {
+		d := time.Duration(s.latency[class].Load())
+		stats["cmd_"+classNames[class]+"_time"] = fmt.Sprintf("%d.%06d", d/time.Second, d%time.Second/time.Microsecond)
+	}
+	return stats
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package server
+
+import "os"
+
+// listenNetwork returns the network of a listen address, an absolute path is
+// a Unix socket
+func listenNetwork(addr string) (string, error) {
+	if len(addr) > 0 && addr[0] == '/' {
+		return "unix", nil
+	}
+	return "tcp", nil
+}
+
+// removeSocket removes the socket file a previous run left behind
+func removeSocket(addr string) {
+	os.Remove(addr)
+}
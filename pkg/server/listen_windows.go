@@ -0,0 +1,20 @@
+//go:build windows
+
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// listenNetwork returns the network of a listen address, only TCP is
+// supported on Windows and a path is refused
+func listenNetwork(addr string) (string, error) {
+	if len(addr) > 0 && (addr[0] == '/' || addr[0] == '\\' || filepath.VolumeName(addr) != "") {
+		return "", fmt.Errorf("unix socket %q is not supported on windows, use a TCP address", addr)
+	}
+	return "tcp", nil
+}
+
+// removeSocket does nothing, there are no socket files on Windows
+func removeSocket(addr string) {}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/mevdschee/tqcache/pkg/tqcache"
+)
+
+// Meta commands take their options as flag tokens: one letter, optionally
+// followed by an argument ("T30", "c"). Flags that return data are echoed in
+// the response in the order they were given.
+
+// metaTTL converts a meta T argument, in the exptime format of the classic
+// commands, to a TTL
+func metaTTL(arg string) (time.Duration, bool) {
+	exptime, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	var ttl time.Duration
+	if exptime < 0 {
+		ttl = time.Nanosecond
+	} else if exptime > 0 {
+		if exptime > 2592000 {
+			ttl = time.Until(time.Unix(exptime, 0))
+			if ttl <= 0 {
+				ttl = time.Nanosecond
+			}
+		} else {
+			ttl = time.Duration(exptime) * time.Second
+		}
+	}
+	return ttl, true
+}
+
+// writeMetaFlags writes the return flags of a meta response, each preceded by
+// a space, followed by the line end
+func writeMetaFlags(writer *bufio.Writer, flags []string) {
+	for _, flag := range flags {
+		writer.WriteString(" ")
+		writer.WriteString(flag)
+	}
+	writer.WriteString("\r\n")
+}
+
+// handleMetaGet handles "mg <key> <flags>*", supported flags are v (value),
+// c (cas), f (client flags), s (size), t (remaining TTL in seconds, -1 for
+// none), k (key), O (opaque), q (no EN on a miss) and T (touch with a new TTL)
+func (s *Server) handleMetaGet(writer *bufio.Writer, parts []string) {
+	if len(parts) < 2 {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	key := parts[1]
+	if s.badKey(key) {
+		writer.WriteString("CLIENT_ERROR bad key\r\n")
+		return
+	}
+	withValue, quiet := false, false
+	var ttl time.Duration
+	touch := false
+	for _, token := range parts[2:] {
+		switch token[0] {
+		case 'v':
+			withValue = true
+		case 'q':
+			quiet = true
+		case 'T':
+			var ok bool
+			if ttl, ok = metaTTL(token[1:]); !ok {
+				writer.WriteString("CLIENT_ERROR bad token in command line format\r\n")
+				return
+			}
+			touch = true
+		case 'c', 'f', 's', 't', 'k', 'O':
+		default:
+			writer.WriteString("CLIENT_ERROR invalid flag\r\n")
+			return
+		}
+	}
+
+	// A touch reads and touches in one request, so no write comes between
+	var item *tqcache.Item
+	var err error
+	if touch {
+		item, err = s.cache.GetAndTouch(key, ttl)
+	} else {
+		item, err = s.cache.GetItem(key)
+	}
+	if err == tqcache.ErrKeyNotFound {
+		if !quiet {
+			writer.WriteString("EN\r\n")
+		}
+		return
+	}
+	if err == tqcache.ErrResponseTooLarge {
+		writer.WriteString("SERVER_ERROR object too large to return\r\n")
+		return
+	}
+	if err != nil {
+		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return
+	}
+
+	var ret []string
+	for _, token := range parts[2:] {
+		switch token[0] {
+		case 'c':
+			ret = append(ret, "c"+strconv.FormatUint(item.Cas, 10))
+		case 'f':
+			ret = append(ret, "f"+strconv.FormatUint(uint64(item.Flags), 10))
+		case 's':
+			ret = append(ret, "s"+strconv.Itoa(len(item.Value)))
+		case 't':
+			seconds := int64(-1)
+			if item.TTL != tqcache.NoExpiry {
+				seconds = int64(item.TTL.Round(time.Second) / time.Second)
+			}
+			ret = append(ret, "t"+strconv.FormatInt(seconds, 10))
+		case 'k':
+			ret = append(ret, "k"+key)
+		case 'O':
+			ret = append(ret, token)
+		}
+	}
+	if !withValue {
+		writer.WriteString("HD")
+		writeMetaFlags(writer, ret)
+		return
+	}
+	writer.WriteString("VA ")
+	writer.WriteString(strconv.Itoa(len(item.Value)))
+	writeMetaFlags(writer, ret)
+	writer.Write(item.Value)
+	writer.WriteString("\r\n")
+}
+
+// handleMetaSet handles "ms <key> <datalen> <flags>*" followed by the data,
+// supported flags are T (TTL), F (client flags), C (compare cas), c (return
+// cas), k (key), O (opaque) and q (no HD on success)
+func (s *Server) handleMetaSet(reader *bufio.Reader, writer *bufio.Writer, parts []string) {
+	if len(parts) < 3 {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	key := parts[1]
+	bytes, err := strconv.Atoi(parts[2])
+	if err != nil || bytes < 0 {
+		writer.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return
+	}
+	if s.badKey(key) {
+		s.discardValue(reader, bytes)
+		writer.WriteString("CLIENT_ERROR bad key\r\n")
+		return
+	}
+	if s.valueTooLarge(bytes) {
+		s.discardValue(reader, bytes)
+		writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
+
+	// Read the value before validating the flags to stay in sync
+	value := make([]byte, bytes)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		writer.WriteString("SERVER_ERROR read error\r\n")
+		return
+	}
+	c, _ := reader.ReadByte()
+	if c == '\r' {
+		reader.ReadByte()
+	}
+
+	storeOp := tqcache.Op{Op: tqcache.OpSet, Key: key, Value: value}
+	quiet := false
+	for _, token := range parts[3:] {
+		ok := true
+		switch token[0] {
+		case 'T':
+			storeOp.TTL, ok = metaTTL(token[1:])
+		case 'F':
+			flags, err := strconv.ParseUint(token[1:], 10, 32)
+			storeOp.Flags, ok = uint32(flags), err == nil
+		case 'C':
+			cas, err := strconv.ParseUint(token[1:], 10, 64)
+			storeOp.Op, storeOp.Cas, ok = tqcache.OpCas, cas, err == nil
+		case 'q':
+			quiet = true
+		case 'c', 'k', 'O':
+		default:
+			writer.WriteString("CLIENT_ERROR invalid flag\r\n")
+			return
+		}
+		if !ok {
+			writer.WriteString("CLIENT_ERROR bad token in command line format\r\n")
+			return
+		}
+	}
+
+	cas, err := s.cache.Store(storeOp)
+	switch err {
+	case nil:
+	case tqcache.ErrValueTooLarge:
+		writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	case tqcache.ErrCasMismatch:
+		writer.WriteString("EX\r\n")
+		return
+	case tqcache.ErrKeyNotFound:
+		writer.WriteString("NF\r\n")
+		return
+	case tqcache.ErrKeyExists:
+		writer.WriteString("NS\r\n")
+		return
+	default:
+		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return
+	}
+	if quiet {
+		return
+	}
+
+	var ret []string
+	for _, token := range parts[3:] {
+		switch token[0] {
+		case 'c':
+			ret = append(ret, "c"+strconv.FormatUint(cas, 10))
+		case 'k':
+			ret = append(ret, "k"+key)
+		case 'O':
+			ret = append(ret, token)
+		}
+	}
+	writer.WriteString("HD")
+	writeMetaFlags(writer, ret)
+}
+
+// handleMetaDelete handles "md <key> <flags>*", supported flags are k (key),
+// O (opaque) and q (no HD on success)
+func (s *Server) handleMetaDelete(writer *bufio.Writer, parts []string) {
+	if len(parts) < 2 {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	key := parts[1]
+	if s.badKey(key) {
+		writer.WriteString("CLIENT_ERROR bad key\r\n")
+		return
+	}
+	quiet := false
+	for _, token := range parts[2:] {
+		switch token[0] {
+		case 'q':
+			quiet = true
+		case 'k', 'O':
+		default:
+			writer.WriteString("CLIENT_ERROR invalid flag\r\n")
+			return
+		}
+	}
+
+	err := s.cache.Delete(key)
+	if err == tqcache.ErrKeyNotFound {
+		writer.WriteString("NF\r\n")
+		return
+	}
+	if err != nil {
+		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return
+	}
+	if quiet {
+		return
+	}
+
+	var ret []string
+	for _, token := range parts[2:] {
+		switch token[0] {
+		case 'k':
+			ret = append(ret, "k"+key)
+		case 'O':
+			ret = append(ret, token)
+		}
+	}
+	writer.WriteString("HD")
+	writeMetaFlags(writer, ret)
+}
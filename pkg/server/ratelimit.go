@@ -0,0 +1,47 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/mevdschee/tqcache/pkg/ratelimit"
+)
+
+// SetRateLimit limits every connection to opsPerSec commands per second, with
+// bursts of up to a second of commands (0 = unlimited)
+func (s *Server) SetRateLimit(opsPerSec int) {
+	s.rateLimit = opsPerSec
+}
+
+// newLimiter returns the limiter of a new connection, nil when unlimited
+func (s *Server) newLimiter() *ratelimit.Limiter {
+	if s.rateLimit <= 0 {
+		return nil
+	}
+	return ratelimit.New(float64(s.rateLimit), s.rateLimit)
+}
+
+// limited reports whether the connection is over its rate limit
+func (c *conn) limited() bool {
+	return c.limiter != nil && !c.limiter.Allow()
+}
+
+// textDataLength returns the length of the data block following an upper-case
+// text command, -1 if it has none or the length is invalid
+func textDataLength(cmd string, parts []string) int {
+	i := 4
+	switch cmd {
+	case "SET", "ADD", "REPLACE", "APPEND", "PREPEND", "CAS":
+	case "MS":
+		i = 2
+	default:
+		return -1
+	}
+	if len(parts) <= i {
+		return -1
+	}
+	bytes, err := strconv.Atoi(parts[i])
+	if err != nil || bytes < 0 {
+		return -1
+	}
+	return bytes
+}
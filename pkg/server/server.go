@@ -2,22 +2,68 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net"
-	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/mevdschee/tqcache/pkg/ratelimit"
 	"github.com/mevdschee/tqcache/pkg/tqcache"
 )
 
+// readyPollInterval is how often Start checks whether the cache is ready
+const readyPollInterval = 10 * time.Millisecond
+
+// shutdownPollInterval is how often Shutdown checks for remaining connections
+const shutdownPollInterval = 10 * time.Millisecond
+
+// detectTimeout is how long a new connection may take to send its first byte
+const detectTimeout = 5 * time.Second
+
+// keepAlivePeriod is the TCP keepalive interval of client connections
+const keepAlivePeriod = 60 * time.Second
+
+// ErrServerClosed is returned by Start after Shutdown
+var ErrServerClosed = errors.New("server closed")
+
 // Server represents the TQCache network server.
 type Server struct {
 	cache          tqcache.CacheInterface
 	addr           string
 	maxConnections int32
 	currConns      int32
+	udpAddr        string // Text protocol over UDP ("" = off)
+	idleTimeout    time.Duration
+	rateLimit      int  // Commands per second per connection (0 = unlimited)
+	adminCommands  bool // Accept commands that change the server settings
+
+	slowOpThreshold time.Duration // Log commands taking longer (0 = off)
+	latency         latencies     // Total command time per class
+
+	mu       sync.Mutex
+	listener net.Listener
+	udpConn  net.PacketConn
+	conns    map[*conn]struct{}
+	closing  atomic.Bool
+}
+
+// conn is a client connection, tracked so Shutdown can close idle ones
+type conn struct {
+	net.Conn
+	idle    atomic.Bool        // Waiting for the next command
+	limiter *ratelimit.Limiter // Nil when unlimited
+}
+
+// remoteAddr returns the client address, nil for commands from a datagram
+func (c *conn) remoteAddr() net.Addr {
+	if c.Conn == nil {
+		return nil
+	}
+	return c.RemoteAddr()
 }
 
 // New creates a new Server instance.
@@ -38,14 +84,33 @@ func NewWithOptions(cache tqcache.CacheInterface, addr string, maxConnections in
 	}
 }
 
+// SetIdleTimeout makes connections close when no command arrives within
+// timeout (0 = never)
+func (s *Server) SetIdleTimeout(timeout time.Duration) {
+	s.idleTimeout = timeout
+}
+
+// SetAdminCommands enables the commands that change server settings at
+// runtime, like sync_mode. Any client may send them, so they are off by default.
+func (s *Server) SetAdminCommands(enabled bool) {
+	s.adminCommands = enabled
+}
+
 // Start runs the server (TCP or Unix socket based on address).
 func (s *Server) Start() error {
 	// Determine network type based on address
-	network := "tcp"
-	if len(s.addr) > 0 && s.addr[0] == '/' {
-		network = "unix"
+	network, err := listenNetwork(s.addr)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
 		// Remove existing socket file if present
-		os.Remove(s.addr)
+		removeSocket(s.addr)
+	}
+
+	// Only accept connections once all shards are recovered
+	for !s.cache.Ready() {
+		time.Sleep(readyPollInterval)
 	}
 
 	ln, err := net.Listen(network, s.addr)
@@ -54,42 +119,86 @@ func (s *Server) Start() error {
 	}
 	defer ln.Close()
 
-	log.Printf("Listening on %s %s (max connections: %d)", network, s.addr, s.maxConnections)
+	var pc net.PacketConn
+	if s.udpAddr != "" {
+		pc, err = net.ListenPacket("udp", s.udpAddr)
+		if err != nil {
+			return err
+		}
+		defer pc.Close()
+	}
+
+	s.mu.Lock()
+	if s.closing.Load() {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listener = ln
+	s.udpConn = pc
+	s.conns = make(map[*conn]struct{})
+	s.mu.Unlock()
+
+	slog.Info("Listening", "network", network, "addr", s.addr, "max_connections", s.maxConnections)
+	if pc != nil {
+		slog.Info("Listening", "network", "udp", "addr", pc.LocalAddr())
+		go s.serveUDP(pc)
+	}
 
 	for {
-		conn, err := ln.Accept()
+		nc, err := ln.Accept()
 		if err != nil {
-			log.Printf("Accept error: %v", err)
+			if s.closing.Load() {
+				return ErrServerClosed
+			}
+			slog.Debug("Accept error", "err", err)
 			continue
 		}
 
 		// Check connection limit
 		curr := atomic.LoadInt32(&s.currConns)
 		if curr >= s.maxConnections {
-			log.Printf("Connection limit reached (%d), rejecting %s", s.maxConnections, conn.RemoteAddr())
-			conn.Close()
+			slog.Warn("Connection limit reached", "max_connections", s.maxConnections, "remote", nc.RemoteAddr())
+			nc.Close()
 			continue
 		}
 
+		if tc, ok := nc.(*net.TCPConn); ok {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(keepAlivePeriod)
+		}
+
+		c := &conn{Conn: nc, limiter: s.newLimiter()}
+		c.idle.Store(true)
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
 		atomic.AddInt32(&s.currConns, 1)
-		go s.handleConnection(conn)
+		go s.handleConnection(c)
 	}
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
+func (s *Server) handleConnection(conn *conn) {
 	defer func() {
 		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
 		atomic.AddInt32(&s.currConns, -1)
 	}()
 
 	// Peek first byte to determine protocol
 	reader := bufio.NewReader(conn)
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	timeout := detectTimeout
+	if s.idleTimeout > 0 && s.idleTimeout < timeout {
+		timeout = s.idleTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
 
 	firstByte, err := reader.Peek(1)
 	if err != nil {
-		if err != io.EOF {
-			log.Printf("Peek error from %s: %v", conn.RemoteAddr(), err)
+		if s.logReadError(err) {
+			slog.Debug("Peek error", "remote", conn.RemoteAddr(), "err", err)
 		}
 		return
 	}
@@ -97,12 +206,73 @@ func (s *Server) handleConnection(conn net.Conn) {
 
 	// Use buffered writer for all responses (64KB buffer for better batching)
 	writer := bufio.NewWriterSize(conn, 65536)
+	defer writer.Flush()
 
 	if firstByte[0] == 0x80 {
 		s.handleBinary(conn, reader, writer)
 	} else {
-		s.handleText(reader, writer)
+		s.handleText(conn, reader, writer)
+	}
+}
+
+// nextCommand marks the connection idle before it waits for the next command
+// and reports whether it may continue, it may not once Shutdown started. The
+// deadline is set before the check, so a Shutdown waking the read wins.
+// Commands from a datagram have no connection and no deadline.
+func (s *Server) nextCommand(c *conn) bool {
+	c.idle.Store(true)
+	if s.idleTimeout > 0 && c.Conn != nil {
+		c.SetReadDeadline(time.Now().Add(s.idleTimeout))
+	}
+	return !s.closing.Load()
+}
+
+// logReadError reports whether a read error is worth logging, it is not for
+// clients that disconnect or go idle, or during Shutdown
+func (s *Server) logReadError(err error) bool {
+	var ne net.Error
+	if err == io.EOF || s.closing.Load() || (errors.As(err, &ne) && ne.Timeout()) {
+		return false
+	}
+	return true
+}
+
+// Shutdown stops accepting connections, closes idle ones and waits for the
+// others to finish their current command. When ctx is done first the
+// remaining connections are closed and the context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closing.Store(true)
+
+	s.mu.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+	for c := range s.conns {
+		if c.idle.Load() {
+			c.SetReadDeadline(time.Now()) // Wake the blocked read
+		}
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for s.CurrentConnections() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.mu.Lock()
+			for c := range s.conns {
+				c.Close()
+			}
+			s.mu.Unlock()
+			return ctx.Err()
+		}
 	}
+	return nil
 }
 
 // CurrentConnections returns the current number of connections.
@@ -0,0 +1,1490 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqcache/pkg/ratelimit"
+	"github.com/mevdschee/tqcache/pkg/tqcache"
+)
+
+// startTestServer starts a server on free local TCP and UDP ports
+func startTestServer(t *testing.T, opts ...func(*Server)) (*Server, string, func()) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-server-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := tqcache.DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = tqcache.SyncNone
+	cache, err := tqcache.NewSharded(config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpAddr := pc.LocalAddr().String()
+	pc.Close()
+
+	srv := New(cache, addr)
+	srv.SetUDPAddr(udpAddr)
+	for _, opt := range opts {
+		opt(srv)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Start() }()
+
+	// Wait until the server accepts connections
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return srv, addr, func() {
+		srv.Shutdown(context.Background())
+		if err := <-done; err != ErrServerClosed {
+			t.Errorf("Expected Start to return ErrServerClosed, got %v", err)
+		}
+		cache.Close()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	srv, addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	busy, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	// Start a command on one connection, its data block is still to come
+	idle.Write([]byte("version\r\n"))
+	reader := bufio.NewReader(idle)
+	if line, err := reader.ReadString('\n'); err != nil || line != "VERSION 1.0.0\r\n" {
+		t.Fatalf("Expected VERSION, got %q, %v", line, err)
+	}
+	busy.Write([]byte("set key 0 0 5\r\n"))
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	// The idle connection is closed
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected idle connection to be closed, got %v", err)
+	}
+
+	// The in-flight command completes, then the connection is closed
+	time.Sleep(50 * time.Millisecond)
+	busy.Write([]byte("hello\r\n"))
+	busy.SetReadDeadline(time.Now().Add(time.Second))
+	busyReader := bufio.NewReader(busy)
+	if line, err := busyReader.ReadString('\n'); err != nil || line != "STORED\r\n" {
+		t.Errorf("Expected in-flight set to complete, got %q, %v", line, err)
+	}
+	if _, err := busyReader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected connection to be closed after the command, got %v", err)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if srv.CurrentConnections() != 0 {
+		t.Errorf("Expected no connections after shutdown, got %d", srv.CurrentConnections())
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("Expected new connections to be refused after shutdown")
+	}
+}
+
+func TestUDP(t *testing.T) {
+	srv, _, cleanup := startTestServer(t)
+	defer cleanup()
+
+	c, err := net.Dial("udp", srv.udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	request := func(requestId uint16, command string) []byte {
+		packet := make([]byte, udpHeaderSize+len(command))
+		binary.BigEndian.PutUint16(packet[0:2], requestId)
+		binary.BigEndian.PutUint16(packet[4:6], 1)
+		copy(packet[udpHeaderSize:], command)
+		c.Write(packet)
+
+		buf := make([]byte, maxUDPPayload)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("No response to %q: %v", command, err)
+		}
+		if id := binary.BigEndian.Uint16(buf[0:2]); id != requestId {
+			t.Errorf("Expected request id %d, got %d", requestId, id)
+		}
+		if seq, total := binary.BigEndian.Uint16(buf[2:4]), binary.BigEndian.Uint16(buf[4:6]); seq != 0 || total != 1 {
+			t.Errorf("Expected a single datagram, got sequence %d of %d", seq, total)
+		}
+		return buf[udpHeaderSize:n]
+	}
+
+	if resp := request(7, "set key 5 0 5\r\nhello\r\n"); string(resp) != "STORED\r\n" {
+		t.Errorf("Expected STORED, got %q", resp)
+	}
+	if resp := request(8, "get key missing\r\n"); string(resp) != "VALUE key 5 5\r\nhello\r\nEND\r\n" {
+		t.Errorf("Expected the value, got %q", resp)
+	}
+}
+
+func TestUDPIdleTimeout(t *testing.T) {
+	// Datagrams have no connection to set the idle deadline on
+	srv, _, cleanup := startTestServer(t, func(s *Server) { s.SetIdleTimeout(time.Second) })
+	defer cleanup()
+
+	c, err := net.Dial("udp", srv.udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	packet := make([]byte, udpHeaderSize+len("version\r\n"))
+	binary.BigEndian.PutUint16(packet[4:6], 1)
+	copy(packet[udpHeaderSize:], "version\r\n")
+	c.Write(packet)
+
+	buf := make([]byte, maxUDPPayload)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("No response to version: %v", err)
+	}
+	if resp := string(buf[udpHeaderSize:n]); !strings.HasPrefix(resp, "VERSION ") {
+		t.Errorf("Expected VERSION, got %q", resp)
+	}
+}
+
+func TestCachedump(t *testing.T) {
+	_, addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(c, "set key%04d 0 0 1 noreply\r\nv\r\n", i)
+	}
+
+	seen := make(map[string]bool)
+	cursor := ""
+	for pages := 1; ; pages++ {
+		fmt.Fprintf(c, "stats cachedump 100 key %s\r\n", cursor)
+		cursor = ""
+		items := 0
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSuffix(line, "\r\n")
+			if line == "END" {
+				break
+			}
+			if next, ok := strings.CutPrefix(line, "CURSOR "); ok {
+				cursor = next
+				continue
+			}
+			key, ok := strings.CutPrefix(line, "ITEM ")
+			if !ok || seen[key] {
+				t.Fatalf("Unexpected line %q", line)
+			}
+			seen[key] = true
+			items++
+		}
+		if items > 100 {
+			t.Fatalf("Page %d has %d keys", pages, items)
+		}
+		if cursor == "" {
+			if pages != 10 && pages != 11 {
+				t.Errorf("Expected 10 pages, got %d", pages)
+			}
+			break
+		}
+	}
+	if len(seen) != 1000 {
+		t.Errorf("Expected 1000 keys, got %d", len(seen))
+	}
+
+	// A huge limit is lowered to the cache's maximum, not passed on
+	fmt.Fprintf(c, "stats cachedump 4611686018427387904\r\n")
+	items := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		items++
+	}
+	if items != 1000 {
+		t.Errorf("Expected all 1000 keys for a huge limit, got %d", items)
+	}
+	fmt.Fprintf(c, "version\r\n")
+	if resp, _ := reader.ReadString('\n'); resp != "VERSION 1.0.0\r\n" {
+		t.Errorf("Expected VERSION after the dump, got %q", resp)
+	}
+}
+
+func BenchmarkBinarySet(b *testing.B) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-server-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	config := tqcache.DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = tqcache.SyncNone
+	cache, err := tqcache.NewSharded(config, 2)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cache.Close()
+	srv := New(cache, "")
+
+	// One SET request with 8 bytes of extras, a key and a 1KB value
+	key := "key"
+	value := make([]byte, 1024)
+	request := make([]byte, 24+8+len(key)+len(value))
+	request[0] = reqMagic
+	request[1] = opSet
+	binary.BigEndian.PutUint16(request[2:4], uint16(len(key)))
+	request[4] = 8
+	binary.BigEndian.PutUint32(request[8:12], uint32(8+len(key)+len(value)))
+	copy(request[32:], key)
+	copy(request[32+len(key):], value)
+
+	requests := bytes.Repeat(request, b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	srv.handleBinary(&conn{}, bufio.NewReader(bytes.NewReader(requests)), bufio.NewWriter(io.Discard))
+}
+
+func TestPipelinedStorage(t *testing.T) {
+	_, addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Replies to pipelined storage commands keep their order, also around
+	// noreply, failed and malformed commands and a following get
+	c.Write([]byte("set a 0 0 1\r\n1\r\n" +
+		"set b 0 0 1 noreply\r\n2\r\n" +
+		"add a 0 0 1\r\n3\r\n" +
+		"set d 0 0\r\n" +
+		"replace c 0 0 1\r\n4\r\n" +
+		"set c 5 0 1\r\n5\r\n" +
+		"get a b c\r\n"))
+	want := []string{
+		"STORED", "NOT_STORED", "CLIENT_ERROR bad command line format", "NOT_STORED", "STORED",
+		"VALUE a 0 1", "1", "VALUE b 0 1", "2", "VALUE c 5 1", "5", "END",
+	}
+	for _, w := range want {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != w+"\r\n" {
+			t.Errorf("Expected %q, got %q", w, line)
+		}
+	}
+}
+
+// BenchmarkTextSet compares pipelined sets, applied with one request per
+// shard, with sets that each wait for their reply
+func BenchmarkTextSet(b *testing.B) {
+	const sets = 10000
+	for _, pipelined := range []bool{false, true} {
+		name := "sequential"
+		if pipelined {
+			name = "pipelined"
+		}
+		b.Run(name, func(b *testing.B) {
+			tmpDir, err := os.MkdirTemp("", "tqcache-server-*")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			config := tqcache.DefaultConfig()
+			config.DataDir = tmpDir
+			config.SyncStrategy = tqcache.SyncNone
+			cache, err := tqcache.NewSharded(config, 4)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer cache.Close()
+			srv := New(cache, "")
+
+			var requests bytes.Buffer
+			for i := 0; i < sets; i++ {
+				fmt.Fprintf(&requests, "set key_%d 0 0 100\r\n%s\r\n", i, strings.Repeat("x", 100))
+			}
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if pipelined {
+					reader := bufio.NewReaderSize(bytes.NewReader(requests.Bytes()), 64*1024)
+					srv.handleText(&conn{}, reader, bufio.NewWriter(io.Discard))
+					continue
+				}
+				// A reader holding one command at a time applies each on its own
+				data := requests.Bytes()
+				for len(data) > 0 {
+					end := bytes.Index(data, []byte("\r\n")) + 2
+					end += bytes.Index(data[end:], []byte("\r\n")) + 2
+					srv.handleText(&conn{}, bufio.NewReader(bytes.NewReader(data[:end])), bufio.NewWriter(io.Discard))
+					data = data[end:]
+				}
+			}
+			b.ReportMetric(float64(sets*b.N)/b.Elapsed().Seconds(), "sets/s")
+		})
+	}
+}
+
+func TestMetaCommands(t *testing.T) {
+	_, addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// command sends a command and reads the given number of response lines
+	command := func(cmd string, lines int) string {
+		c.Write([]byte(cmd))
+		var resp string
+		for i := 0; i < lines; i++ {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Reading response to %q: %v", cmd, err)
+			}
+			resp += line
+		}
+		return resp
+	}
+
+	resp := command("ms foo 3 T100 F5 c\r\nbar\r\n", 1)
+	cas, ok := strings.CutPrefix(strings.TrimSuffix(resp, "\r\n"), "HD c")
+	if !ok {
+		t.Fatalf("Expected HD with cas, got %q", resp)
+	}
+	if resp := command("mg foo v c\r\n", 2); resp != "VA 3 c"+cas+"\r\nbar\r\n" {
+		t.Errorf("Expected value and cas %s, got %q", cas, resp)
+	}
+	if resp := command("mg foo f s t k Oabc\r\n", 1); resp != "HD f5 s3 t100 kfoo Oabc\r\n" {
+		t.Errorf("Expected flags, size, ttl, key and opaque, got %q", resp)
+	}
+
+	// Compare and swap
+	if resp := command("ms foo 3 C1\r\nbaz\r\n", 1); resp != "EX\r\n" {
+		t.Errorf("Expected EX for a wrong cas, got %q", resp)
+	}
+	if resp := command("ms foo 3 C"+cas+"\r\nbaz\r\n", 1); resp != "HD\r\n" {
+		t.Errorf("Expected HD for the right cas, got %q", resp)
+	}
+	if resp := command("mg foo v t\r\n", 2); resp != "VA 3 t-1\r\nbaz\r\n" {
+		t.Errorf("Expected the swapped value without expiry, got %q", resp)
+	}
+
+	// A touch returns the item with its new TTL
+	if resp := command("mg foo v t T50\r\n", 2); resp != "VA 3 t50\r\nbaz\r\n" {
+		t.Errorf("Expected the value with the new TTL, got %q", resp)
+	}
+	if resp := command("mg missing v T50\r\n", 1); resp != "EN\r\n" {
+		t.Errorf("Expected EN for touching a missing key, got %q", resp)
+	}
+
+	// Quiet mode leaves out the HD and EN responses
+	command("ms foo 1 q\r\nx\r\n", 0)
+	command("mg missing v q\r\n", 0)
+	if resp := command("mg missing v\r\n", 1); resp != "EN\r\n" {
+		t.Errorf("Expected EN for a missing key, got %q", resp)
+	}
+
+	if resp := command("md foo\r\n", 1); resp != "HD\r\n" {
+		t.Errorf("Expected HD for delete, got %q", resp)
+	}
+	if resp := command("md foo\r\n", 1); resp != "NF\r\n" {
+		t.Errorf("Expected NF for a second delete, got %q", resp)
+	}
+	if resp := command("mg foo x\r\n", 1); resp != "CLIENT_ERROR invalid flag\r\n" {
+		t.Errorf("Expected an invalid flag error, got %q", resp)
+	}
+}
+
+func TestDeleteCas(t *testing.T) {
+	_, addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	command := func(cmd string) string {
+		c.Write([]byte(cmd))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Reading response to %q: %v", cmd, err)
+		}
+		return line
+	}
+
+	command("set key 0 0 5\r\nvalue\r\n")
+	cas := strings.Fields(command("gets key\r\n"))[4]
+	reader.ReadString('\n') // Value
+	reader.ReadString('\n') // END
+
+	if resp := command("delete key 1\r\n"); resp != "EXISTS\r\n" {
+		t.Errorf("Expected EXISTS for a stale cas, got %q", resp)
+	}
+	if resp := command("delete key " + cas + "\r\n"); resp != "DELETED\r\n" {
+		t.Errorf("Expected DELETED for the current cas, got %q", resp)
+	}
+
+	// The old delete time argument 0 still deletes unconditionally
+	command("set key 0 0 5\r\nvalue\r\n")
+	if resp := command("delete key 0\r\n"); resp != "DELETED\r\n" {
+		t.Errorf("Expected DELETED for cas 0, got %q", resp)
+	}
+}
+
+func TestTouchCas(t *testing.T) {
+	_, addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	command := func(cmd string) string {
+		c.Write([]byte(cmd))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Reading response to %q: %v", cmd, err)
+		}
+		return line
+	}
+
+	command("set key 0 0 5\r\nvalue\r\n")
+	cas := strings.Fields(command("gets key\r\n"))[4]
+	reader.ReadString('\n') // Value
+	reader.ReadString('\n') // END
+
+	if resp := command("touch key 100 1\r\n"); resp != "EXISTS\r\n" {
+		t.Errorf("Expected EXISTS for a stale cas, got %q", resp)
+	}
+	if resp := command("touch key 100 " + cas + "\r\n"); resp != "TOUCHED\r\n" {
+		t.Errorf("Expected TOUCHED for the current cas, got %q", resp)
+	}
+	if resp := command("touch key 100 abc\r\n"); resp != "CLIENT_ERROR bad command line format\r\n" {
+		t.Errorf("Expected CLIENT_ERROR for a bad cas, got %q", resp)
+	}
+
+	// Without a cas, and with noreply after the cas
+	if resp := command("touch key 100\r\n"); resp != "TOUCHED\r\n" {
+		t.Errorf("Expected TOUCHED without a cas, got %q", resp)
+	}
+	c.Write([]byte("touch key 100 1 noreply\r\n"))
+	if resp := command("touch missing 100 " + cas + "\r\n"); resp != "NOT_FOUND\r\n" {
+		t.Errorf("Expected NOT_FOUND after the silent mismatch, got %q", resp)
+	}
+}
+
+func TestFlushAllDelay(t *testing.T) {
+	_, addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	command := func(cmd string) string {
+		c.Write([]byte(cmd))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Reading response to %q: %v", cmd, err)
+		}
+		return line
+	}
+
+	command("set key 0 0 5\r\nvalue\r\n")
+	if resp := command("flush_all 60\r\n"); resp != "OK\r\n" {
+		t.Errorf("Expected OK, got %q", resp)
+	}
+	if resp := command("get key\r\n"); resp != "VALUE key 0 5\r\n" {
+		t.Errorf("Expected the key to survive until the delay passed, got %q", resp)
+	}
+	reader.ReadString('\n') // Value
+	reader.ReadString('\n') // END
+
+	if resp := command("flush_all\r\n"); resp != "OK\r\n" {
+		t.Errorf("Expected OK, got %q", resp)
+	}
+	if resp := command("get key\r\n"); resp != "END\r\n" {
+		t.Errorf("Expected the key to be flushed, got %q", resp)
+	}
+	if resp := command("flush_all soon\r\n"); resp != "CLIENT_ERROR bad command line format\r\n" {
+		t.Errorf("Expected an error for a bad delay, got %q", resp)
+	}
+}
+
+func TestStatsSlabs(t *testing.T) {
+	_, addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(c, "set small 0 0 5\r\nvalue\r\n")
+	fmt.Fprintf(c, "set large 0 0 2000\r\n%s\r\n", strings.Repeat("x", 2000))
+	reader.ReadString('\n')
+	reader.ReadString('\n')
+
+	fmt.Fprintf(c, "stats slabs\r\n")
+	stats := make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "STAT" {
+			t.Fatalf("Unexpected line %q", line)
+		}
+		stats[fields[1]] = fields[2]
+	}
+	for name, want := range map[string]string{
+		"bucket:0:slot_size":  "1024",
+		"bucket:0:used_slots": "1",
+		"bucket:1:used_slots": "1",
+		"bucket:1:bytes_used": strconv.Itoa(tqcache.DataHeaderSize + 2048),
+		"bucket:2:used_slots": "0",
+		"buckets":             "16",
+	} {
+		if stats[name] != want {
+			t.Errorf("Expected %s %s, got %q", name, want, stats[name])
+		}
+	}
+}
+
+func TestKeyValidation(t *testing.T) {
+	srv, addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	command := func(cmd string) string {
+		c.Write([]byte(cmd))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Reading response to %q: %v", cmd, err)
+		}
+		return line
+	}
+
+	long := strings.Repeat("k", tqcache.MaxKeySize+1)
+	for _, cmd := range []string{
+		"set " + long + " 0 0 5\r\nvalue\r\n",
+		"set bad\x01key 0 0 5\r\nvalue\r\n",
+		"get ok " + long + "\r\n",
+		"delete bad\x7fkey\r\n",
+		"incr " + long + " 1\r\n",
+		"ms bad\x02key 5\r\nvalue\r\n",
+	} {
+		if resp := command(cmd); resp != "CLIENT_ERROR bad key\r\n" {
+			t.Errorf("Expected CLIENT_ERROR bad key for %q, got %q", cmd[:10], resp)
+		}
+	}
+	// The value of a rejected set was skipped
+	if resp := command("set good 0 0 5\r\nvalue\r\n"); resp != "STORED\r\n" {
+		t.Errorf("Expected STORED, got %q", resp)
+	}
+
+	// Binary requests with a bad key are rejected with invalid arguments
+	for _, key := range []string{long, "bad key", "bad\x00key"} {
+		request := make([]byte, 24+len(key))
+		request[0] = reqMagic
+		request[1] = opGet
+		binary.BigEndian.PutUint16(request[2:4], uint16(len(key)))
+		binary.BigEndian.PutUint32(request[8:12], uint32(len(key)))
+		copy(request[24:], key)
+		var out bytes.Buffer
+		srv.handleBinary(&conn{}, bufio.NewReader(bytes.NewReader(request)), bufio.NewWriter(&out))
+		if out.Len() < 24 || binary.BigEndian.Uint16(out.Bytes()[6:8]) != resInvalidArgs {
+			t.Errorf("Expected invalid arguments for a %d byte key, got %x", len(key), out.Bytes())
+		}
+	}
+}
+
+func TestBinaryBodyLength(t *testing.T) {
+	srv, _, cleanup := startTestServer(t)
+	defer cleanup()
+
+	header := func(opcode uint8, keyLen uint16, extraLen uint8, bodyLen uint32) []byte {
+		h := make([]byte, 24)
+		h[0] = reqMagic
+		h[1] = opcode
+		binary.BigEndian.PutUint16(h[2:4], keyLen)
+		h[4] = extraLen
+		binary.BigEndian.PutUint32(h[8:12], bodyLen)
+		return h
+	}
+	noop := header(opNoop, 0, 0, 0)
+
+	// Extras and key that do not fit in the body close the connection
+	request := append(header(opSet, 4, 8, 2), "xx"...)
+	request = append(request, noop...)
+	var out bytes.Buffer
+	srv.handleBinary(&conn{}, bufio.NewReader(bytes.NewReader(request)), bufio.NewWriter(&out))
+	if out.Len() != 24 || binary.BigEndian.Uint16(out.Bytes()[6:8]) != resInvalidArgs {
+		t.Errorf("Expected a single invalid arguments response, got %x", out.Bytes())
+	}
+
+	// An oversized value is skipped and the connection stays usable
+	size := srv.cache.MaxValueSize() + 1
+	request = header(opSet, 1, 8, uint32(8+1+size))
+	request = append(request, make([]byte, 8)...)
+	request = append(request, 'k')
+	request = append(request, make([]byte, size)...)
+	request = append(request, noop...)
+	out.Reset()
+	srv.handleBinary(&conn{}, bufio.NewReader(bytes.NewReader(request)), bufio.NewWriter(&out))
+	if out.Len() != 48 || binary.BigEndian.Uint16(out.Bytes()[6:8]) != resValueTooLarge {
+		t.Fatalf("Expected value too large and a noop response, got %d bytes", out.Len())
+	}
+	if out.Bytes()[24+1] != opNoop || binary.BigEndian.Uint16(out.Bytes()[24+6:24+8]) != resSuccess {
+		t.Errorf("Expected a successful noop after the skipped value, got %x", out.Bytes()[24:])
+	}
+}
+
+func TestIncrNonNumeric(t *testing.T) {
+	srv, addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(c, "set text 0 0 3\r\nabc\r\nincr text 1\r\n")
+	reader.ReadString('\n')
+	if resp, _ := reader.ReadString('\n'); resp != "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n" {
+		t.Errorf("Expected CLIENT_ERROR for a non-numeric value, got %q", resp)
+	}
+
+	// binaryIncr sends a binary increment and returns the status and value
+	binaryIncr := func(key string, initial uint64, expiry uint32) (uint16, uint64) {
+		request := make([]byte, 24+20+len(key))
+		request[0] = reqMagic
+		request[1] = opIncrement
+		binary.BigEndian.PutUint16(request[2:4], uint16(len(key)))
+		request[4] = 20
+		binary.BigEndian.PutUint32(request[8:12], uint32(20+len(key)))
+		binary.BigEndian.PutUint64(request[24:32], 1)
+		binary.BigEndian.PutUint64(request[32:40], initial)
+		binary.BigEndian.PutUint32(request[40:44], expiry)
+		copy(request[44:], key)
+		var out bytes.Buffer
+		srv.handleBinary(&conn{}, bufio.NewReader(bytes.NewReader(request)), bufio.NewWriter(&out))
+		resp := out.Bytes()
+		status := binary.BigEndian.Uint16(resp[6:8])
+		if status != resSuccess {
+			return status, 0
+		}
+		return status, binary.BigEndian.Uint64(resp[24:32])
+	}
+	if status, _ := binaryIncr("text", 0, 0); status != resNonNumeric {
+		t.Errorf("Expected non-numeric status, got %#x", status)
+	}
+	if status, _ := binaryIncr("missing", 0, 0xFFFFFFFF); status != resKeyNotFound {
+		t.Errorf("Expected key not found, got %#x", status)
+	}
+	if status, val := binaryIncr("counter", 10, 0); status != resSuccess || val != 10 {
+		t.Errorf("Expected a missing counter to be created with 10, got %#x %d", status, val)
+	}
+	if status, val := binaryIncr("counter", 10, 0); status != resSuccess || val != 11 {
+		t.Errorf("Expected 11, got %#x %d", status, val)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	_, addr, cleanup := startTestServer(t, func(s *Server) {
+		s.SetIdleTimeout(100 * time.Millisecond)
+	})
+	defer cleanup()
+
+	// A connection that never sends anything is closed
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	start := time.Now()
+	silent.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := silent.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected silent connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected close after the idle timeout, took %v", elapsed)
+	}
+
+	// A connection that goes idle between commands is closed as well
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte("version\r\n"))
+		if line, err := reader.ReadString('\n'); err != nil || line != "VERSION 1.0.0\r\n" {
+			t.Fatalf("Expected VERSION, got %q, %v", line, err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected idle connection to be closed, got %v", err)
+	}
+}
+
+func TestGetDeleteCommand(t *testing.T) {
+	_, addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	c.Write([]byte("set key 7 0 5\r\nvalue\r\ngd key\r\ngd key\r\nget key\r\n"))
+	var lines []string
+	for i := 0; i < 6; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if lines[0] != "STORED\r\n" {
+		t.Errorf("Expected STORED, got %q", lines[0])
+	}
+	if f := strings.Fields(lines[1]); len(f) != 5 || f[0] != "VALUE" || f[2] != "7" || f[3] != "5" {
+		t.Errorf("Expected VALUE key 7 5 <cas>, got %q", lines[1])
+	}
+	if lines[2] != "value\r\n" || lines[3] != "END\r\n" {
+		t.Errorf("Expected value and END, got %q %q", lines[2], lines[3])
+	}
+	if lines[4] != "END\r\n" || lines[5] != "END\r\n" {
+		t.Errorf("Expected the key to be gone, got %q %q", lines[4], lines[5])
+	}
+}
+
+func TestBinaryAppendCas(t *testing.T) {
+	srv, _, cleanup := startTestServer(t)
+	defer cleanup()
+
+	readCas, _ := srv.cache.Set("key", []byte("a"), 0)
+
+	// binaryAppend sends a binary append with a CAS and returns the status
+	binaryAppend := func(value string, cas uint64) uint16 {
+		key := "key"
+		request := make([]byte, 24+len(key)+len(value))
+		request[0] = reqMagic
+		request[1] = opAppend
+		binary.BigEndian.PutUint16(request[2:4], uint16(len(key)))
+		binary.BigEndian.PutUint32(request[8:12], uint32(len(key)+len(value)))
+		binary.BigEndian.PutUint64(request[16:24], cas)
+		copy(request[24:], key)
+		copy(request[24+len(key):], value)
+		var out bytes.Buffer
+		srv.handleBinary(&conn{}, bufio.NewReader(bytes.NewReader(request)), bufio.NewWriter(&out))
+		return binary.BigEndian.Uint16(out.Bytes()[6:8])
+	}
+	if status := binaryAppend("b", readCas); status != resSuccess {
+		t.Errorf("Expected success for the current cas, got %#x", status)
+	}
+	if status := binaryAppend("x", readCas); status != resKeyExists {
+		t.Errorf("Expected key exists for a stale cas, got %#x", status)
+	}
+	if value, _, _ := srv.cache.Get("key"); string(value) != "ab" {
+		t.Errorf("Expected ab, got %q", value)
+	}
+}
+
+func TestStatsSizes(t *testing.T) {
+	_, addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(c, "set a 0 0 5\r\nvalue\r\nset b 0 0 8\r\nvalue123\r\n")
+	fmt.Fprintf(c, "set c 0 0 2000\r\n%s\r\n", strings.Repeat("x", 2000))
+	for i := 0; i < 3; i++ {
+		reader.ReadString('\n')
+	}
+
+	fmt.Fprintf(c, "stats sizes\r\n")
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		lines = append(lines, line)
+	}
+	want := []string{"STAT sizes 8 2\r\n", "STAT sizes 2048 1\r\n"}
+	if strings.Join(lines, "") != strings.Join(want, "") {
+		t.Errorf("Expected %q, got %q", want, lines)
+	}
+}
+
+func TestValueSizeLimit(t *testing.T) {
+	srv, addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	max := srv.cache.MaxValueSize()
+	fmt.Fprintf(c, "set fits 0 0 %d\r\n%s\r\n", max, strings.Repeat("x", max))
+	if resp, _ := reader.ReadString('\n'); resp != "STORED\r\n" {
+		t.Errorf("Expected STORED for %d bytes, got %q", max, resp)
+	}
+	fmt.Fprintf(c, "set big 0 0 %d\r\n%s\r\n", max+1, strings.Repeat("x", max+1))
+	if resp, _ := reader.ReadString('\n'); resp != "SERVER_ERROR object too large for cache\r\n" {
+		t.Errorf("Expected SERVER_ERROR for %d bytes, got %q", max+1, resp)
+	}
+	fmt.Fprintf(c, "append fits 0 0 1\r\nx\r\n")
+	if resp, _ := reader.ReadString('\n'); resp != "SERVER_ERROR object too large for cache\r\n" {
+		t.Errorf("Expected SERVER_ERROR for an append past the limit, got %q", resp)
+	}
+	for _, cmd := range []string{"set", "append", "cas"} {
+		fmt.Fprintf(c, "%s neg 0 0 -1 1\r\n", cmd)
+		if resp, _ := reader.ReadString('\n'); resp != "CLIENT_ERROR bad command line format\r\n" {
+			t.Errorf("Expected CLIENT_ERROR for a negative %s length, got %q", cmd, resp)
+		}
+	}
+	// The connection stays in sync after the rejected values
+	fmt.Fprintf(c, "version\r\n")
+	if resp, _ := reader.ReadString('\n'); resp != "VERSION 1.0.0\r\n" {
+		t.Errorf("Expected VERSION, got %q", resp)
+	}
+}
+
+// slowCache delays gets, to make them slow commands
+type slowCache struct {
+	tqcache.CacheInterface
+	delay time.Duration
+}
+
+func (c slowCache) GetMulti(keys []string) (map[string]*tqcache.Item, error) {
+	time.Sleep(c.delay)
+	return c.CacheInterface.GetMulti(keys)
+}
+
+func TestSlowCommands(t *testing.T) {
+	srv, _, cleanup := startTestServer(t, func(s *Server) {
+		s.cache = slowCache{CacheInterface: s.cache, delay: 20 * time.Millisecond}
+		s.SetSlowOpThreshold(10 * time.Millisecond)
+	})
+	defer cleanup()
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	var out bytes.Buffer
+	request := "set fast 0 0 1\r\nx\r\nget fast\r\nstats\r\n"
+	srv.handleText(&conn{}, bufio.NewReader(strings.NewReader(request)), bufio.NewWriter(&out))
+
+	if !strings.Contains(logs.String(), `msg="Slow command" command=GET key=fast`) {
+		t.Errorf("Expected a slow command log line for the get, got %q", logs.String())
+	}
+	var getTime float64
+	for _, line := range strings.Split(out.String(), "\r\n") {
+		if strings.HasPrefix(line, "STAT cmd_get_time ") {
+			getTime, _ = strconv.ParseFloat(strings.TrimPrefix(line, "STAT cmd_get_time "), 64)
+		}
+	}
+	if getTime < 0.02 {
+		t.Errorf("Expected cmd_get_time of at least 0.02 seconds, got %v in %q", getTime, out.String())
+	}
+	if !strings.Contains(out.String(), "STAT cmd_set_time ") {
+		t.Errorf("Expected cmd_set_time in stats, got %q", out.String())
+	}
+}
+
+// chunkReader returns one chunk per Read, like packets arriving one by one
+type chunkReader struct {
+	chunks [][]byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+// countingWriter counts the writes of a flushed bufio.Writer
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestBinaryQuietGetBatch(t *testing.T) {
+	srv, _, cleanup := startTestServer(t)
+	defer cleanup()
+
+	srv.cache.Set("a", []byte("1"), 0)
+	srv.cache.Set("c", []byte("3"), 0)
+
+	packet := func(opcode byte, key string, opaque uint32) []byte {
+		request := make([]byte, 24+len(key))
+		request[0] = reqMagic
+		request[1] = opcode
+		binary.BigEndian.PutUint16(request[2:4], uint16(len(key)))
+		binary.BigEndian.PutUint32(request[8:12], uint32(len(key)))
+		binary.BigEndian.PutUint32(request[12:16], opaque)
+		copy(request[24:], key)
+		return request
+	}
+	// Each packet drains the read buffer, the replies must still be batched
+	reader := &chunkReader{chunks: [][]byte{
+		packet(opGetKQ, "a", 1),
+		packet(opGetKQ, "b", 2),
+		packet(opGetKQ, "c", 3),
+		packet(opNoop, "", 4),
+	}}
+	var out countingWriter
+	srv.handleBinary(&conn{}, bufio.NewReader(reader), bufio.NewWriter(&out))
+
+	if out.writes != 1 {
+		t.Errorf("Expected the replies in one write, got %d", out.writes)
+	}
+	// Hits for a and c and the NOOP, the miss of b is quiet
+	var opaques []uint32
+	for data := out.Bytes(); len(data) >= 24; {
+		opaques = append(opaques, binary.BigEndian.Uint32(data[12:16]))
+		data = data[24+binary.BigEndian.Uint32(data[8:12]):]
+	}
+	if fmt.Sprint(opaques) != "[1 3 4]" {
+		t.Errorf("Expected replies to requests [1 3 4], got %v", opaques)
+	}
+}
+
+// unavailableCache fails deletes and touches as a tripped breaker does
+type unavailableCache struct {
+	tqcache.CacheInterface
+}
+
+func (unavailableCache) Delete(key string) error { return tqcache.ErrShardUnavailable }
+
+func (unavailableCache) DeleteCas(key string, cas uint64) error { return tqcache.ErrShardUnavailable }
+
+func (unavailableCache) Touch(key string, ttl time.Duration) (uint64, error) {
+	return 0, tqcache.ErrShardUnavailable
+}
+
+func (unavailableCache) TouchCas(key string, ttl time.Duration, cas uint64) (uint64, error) {
+	return 0, tqcache.ErrShardUnavailable
+}
+
+func TestDeleteTouchErrors(t *testing.T) {
+	srv, addr, cleanup := startTestServer(t, func(s *Server) {
+		s.cache = unavailableCache{CacheInterface: s.cache}
+	})
+	defer cleanup()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// A failing shard is not reported as a missing key
+	want := "SERVER_ERROR " + tqcache.ErrShardUnavailable.Error() + "\r\n"
+	for _, cmd := range []string{"delete key", "delete key 5", "touch key 0", "touch key 0 5"} {
+		fmt.Fprintf(c, "%s\r\n", cmd)
+		if resp, _ := reader.ReadString('\n'); resp != want {
+			t.Errorf("%s: expected %q, got %q", cmd, want, resp)
+		}
+	}
+
+	for _, opcode := range []byte{opDelete, opTouch} {
+		var extras []byte
+		if opcode == opTouch {
+			extras = make([]byte, 4)
+		}
+		request := make([]byte, 24+len(extras)+3)
+		request[0] = reqMagic
+		request[1] = opcode
+		binary.BigEndian.PutUint16(request[2:4], 3)
+		request[4] = byte(len(extras))
+		binary.BigEndian.PutUint32(request[8:12], uint32(len(extras)+3))
+		copy(request[24+len(extras):], "key")
+
+		var out bytes.Buffer
+		srv.handleBinary(&conn{}, bufio.NewReader(bytes.NewReader(request)), bufio.NewWriter(&out))
+		data := out.Bytes()
+		if len(data) < 24 {
+			t.Fatalf("Expected a reply to %#x, got %x", opcode, data)
+		}
+		if status := binary.BigEndian.Uint16(data[6:8]); status != resInternalError {
+			t.Errorf("%#x: expected internal error, got status %#x", opcode, status)
+		}
+	}
+}
+
+func TestBinaryGetVariants(t *testing.T) {
+	srv, _, cleanup := startTestServer(t)
+	defer cleanup()
+
+	if _, err := srv.cache.Store(tqcache.Op{Op: tqcache.OpSet, Key: "hit", Value: []byte("value"), Flags: 42}); err != nil {
+		t.Fatal(err)
+	}
+
+	packet := func(opcode byte, key string) []byte {
+		request := make([]byte, 24+len(key))
+		request[0] = reqMagic
+		request[1] = opcode
+		binary.BigEndian.PutUint16(request[2:4], uint16(len(key)))
+		binary.BigEndian.PutUint32(request[8:12], uint32(len(key)))
+		copy(request[24:], key)
+		return request
+	}
+
+	for _, opcode := range []byte{opGet, opGetQ, opGetK, opGetKQ} {
+		returnKey := opcode == opGetK || opcode == opGetKQ
+		quiet := opcode == opGetQ || opcode == opGetKQ
+		for _, key := range []string{"hit", "miss"} {
+			t.Run(fmt.Sprintf("%#x/%s", opcode, key), func(t *testing.T) {
+				request := append(packet(opcode, key), packet(opNoop, "")...)
+				var out bytes.Buffer
+				srv.handleBinary(&conn{}, bufio.NewReader(bytes.NewReader(request)), bufio.NewWriter(&out))
+
+				data := out.Bytes()
+				if key == "miss" && quiet {
+					if len(data) != 24 || data[1] != opNoop {
+						t.Errorf("Expected only the NOOP reply for a quiet miss, got %x", data)
+					}
+					return
+				}
+				if len(data) < 24 || data[1] != opcode {
+					t.Fatalf("Expected a reply to %#x, got %x", opcode, data)
+				}
+				status := binary.BigEndian.Uint16(data[6:8])
+				keyLen := int(binary.BigEndian.Uint16(data[2:4]))
+				extraLen := int(data[4])
+				bodyLen := int(binary.BigEndian.Uint32(data[8:12]))
+				body := data[24 : 24+bodyLen]
+				if key == "miss" {
+					if status != resKeyNotFound || keyLen != 0 {
+						t.Errorf("Expected key not found without a key, got status %#x key length %d", status, keyLen)
+					}
+					return
+				}
+				if status != resSuccess {
+					t.Fatalf("Expected success, got %#x", status)
+				}
+				if extraLen != 4 || binary.BigEndian.Uint32(body[:4]) != 42 {
+					t.Errorf("Expected flags 42 in the extras, got %x", body[:extraLen])
+				}
+				wantKey := ""
+				if returnKey {
+					wantKey = key
+				}
+				if got := string(body[extraLen : extraLen+keyLen]); got != wantKey {
+					t.Errorf("Expected key %q, got %q", wantKey, got)
+				}
+				if got := string(body[extraLen+keyLen:]); got != "value" {
+					t.Errorf("Expected value, got %q", got)
+				}
+				if binary.BigEndian.Uint64(data[16:24]) == 0 {
+					t.Error("Expected a CAS in the reply")
+				}
+			})
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	_, addr, cleanup := startTestServer(t, func(s *Server) {
+		s.SetRateLimit(5)
+	})
+	defer cleanup()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	expect := func(want string) {
+		t.Helper()
+		if line, err := reader.ReadString('\n'); err != nil || line != want {
+			t.Fatalf("Expected %q, got %q, %v", want, line, err)
+		}
+	}
+
+	// A burst of 5 commands is allowed, the rest is throttled. The value of a
+	// throttled set is skipped and the connection stays open.
+	conn.Write([]byte("set k 0 0 1\r\nx\r\n" + strings.Repeat("version\r\n", 4) +
+		"version\r\nset k 0 0 1\r\ny\r\n"))
+	expect("STORED\r\n")
+	for i := 0; i < 4; i++ {
+		expect("VERSION 1.0.0\r\n")
+	}
+	expect("SERVER_ERROR rate limited\r\n")
+	expect("SERVER_ERROR rate limited\r\n")
+
+	// A token is back after 200ms at 5 per second
+	time.Sleep(250 * time.Millisecond)
+	conn.Write([]byte("get k\r\n"))
+	expect("VALUE k 0 1\r\n")
+	expect("x\r\n")
+	expect("END\r\n")
+}
+
+func TestBinaryRateLimit(t *testing.T) {
+	srv, _, cleanup := startTestServer(t)
+	defer cleanup()
+
+	noop := make([]byte, 24)
+	noop[0] = reqMagic
+	noop[1] = opNoop
+	var out bytes.Buffer
+	c := &conn{limiter: ratelimit.New(1, 1)}
+	srv.handleBinary(c, bufio.NewReader(bytes.NewReader(append(noop, noop...))), bufio.NewWriter(&out))
+
+	data := out.Bytes()
+	if len(data) != 24+24+len("rate limited") {
+		t.Fatalf("Expected two replies, got %x", data)
+	}
+	if status := binary.BigEndian.Uint16(data[6:8]); status != resSuccess {
+		t.Errorf("Expected the first NOOP to succeed, got status %#x", status)
+	}
+	if status := binary.BigEndian.Uint16(data[24+6 : 24+8]); status != resOOM {
+		t.Errorf("Expected the second NOOP to be throttled, got status %#x", status)
+	}
+	if value := string(data[48:]); value != "rate limited" {
+		t.Errorf("Expected value %q, got %q", "rate limited", value)
+	}
+}
+
+func TestFarFutureExptime(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := tqcache.DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = tqcache.SyncNone
+	config.MaxTTL = 0 // No cap, so the far-future exptime is used as-is
+	cache, err := tqcache.NewSharded(config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	srv := New(cache, "")
+
+	// An absolute exptime in the year 9999 is stored and reported as a
+	// (very) positive remaining TTL
+	for i := 0; i < 10; i++ {
+		var out bytes.Buffer
+		request := fmt.Sprintf("set far%d 0 253402300799 1\r\nx\r\nmg far%d t\r\n", i, i)
+		srv.handleText(&conn{}, bufio.NewReader(strings.NewReader(request)), bufio.NewWriter(&out))
+		resp, ok := strings.CutPrefix(out.String(), "STORED\r\nHD t")
+		ttl, err := strconv.ParseInt(strings.TrimSuffix(resp, "\r\n"), 10, 64)
+		if !ok || err != nil || ttl < 100*365*24*3600 {
+			t.Fatalf("Expected a TTL of centuries, got %q", out.String())
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+func TestNegativeExptime(t *testing.T) {
+	srv, _, cleanup := startTestServer(t)
+	defer cleanup()
+
+	// A negative exptime expires the item right away, unlike 0 (no expiry)
+	var out bytes.Buffer
+	request := "set k 0 -1 1\r\nx\r\nget k\r\nset t 0 0 1\r\nx\r\ntouch t -1\r\nget t\r\n"
+	srv.handleText(&conn{}, bufio.NewReader(strings.NewReader(request)), bufio.NewWriter(&out))
+
+	if want := "STORED\r\nEND\r\nSTORED\r\nTOUCHED\r\nEND\r\n"; out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+}
+
+func TestSyncModeCommand(t *testing.T) {
+	srv, _, cleanup := startTestServer(t)
+	defer cleanup()
+	cache := srv.cache.(*tqcache.ShardedCache)
+
+	command := func(request string) string {
+		var out bytes.Buffer
+		srv.handleText(&conn{}, bufio.NewReader(strings.NewReader(request)), bufio.NewWriter(&out))
+		return out.String()
+	}
+
+	if resp := command("sync_mode always\r\n"); resp != "CLIENT_ERROR admin commands disabled\r\n" {
+		t.Errorf("Expected sync_mode to be disabled by default, got %q", resp)
+	}
+	if got := cache.SyncStrategy(); got != tqcache.SyncNone {
+		t.Errorf("Expected the strategy to stay none, got %d", got)
+	}
+
+	srv.SetAdminCommands(true)
+	for _, tt := range []struct {
+		mode     string
+		strategy tqcache.SyncStrategy
+	}{
+		{"always", tqcache.SyncAlways},
+		{"PERIODIC", tqcache.SyncPeriodic},
+		{"none", tqcache.SyncNone},
+	} {
+		if resp := command("sync_mode " + tt.mode + "\r\n"); resp != "OK\r\n" {
+			t.Errorf("sync_mode %s: expected OK, got %q", tt.mode, resp)
+		}
+		if got := cache.SyncStrategy(); got != tt.strategy {
+			t.Errorf("sync_mode %s: expected strategy %d, got %d", tt.mode, tt.strategy, got)
+		}
+	}
+	for _, request := range []string{"sync_mode\r\n", "sync_mode sometimes\r\n", "sync_mode none now\r\n"} {
+		if resp := command(request); resp != "CLIENT_ERROR bad command line format\r\n" {
+			t.Errorf("%q: expected a format error, got %q", request, resp)
+		}
+	}
+}
+
+func TestBinaryGetDelete(t *testing.T) {
+	srv, _, cleanup := startTestServer(t)
+	defer cleanup()
+
+	cas, err := srv.cache.Store(tqcache.Op{Op: tqcache.OpSet, Key: "k", Value: []byte("value"), Flags: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := make([]byte, 24+1)
+	request[0] = reqMagic
+	request[1] = opGetDelete
+	binary.BigEndian.PutUint16(request[2:4], 1)
+	binary.BigEndian.PutUint32(request[8:12], 1)
+	request[24] = 'k'
+	var out bytes.Buffer
+	srv.handleBinary(&conn{}, bufio.NewReader(bytes.NewReader(append(request, request...))), bufio.NewWriter(&out))
+
+	// The first one returns the value with its flags and CAS
+	data := out.Bytes()
+	if len(data) < 24 || data[1] != opGetDelete {
+		t.Fatalf("Expected a reply to %#x, got %x", opGetDelete, data)
+	}
+	if status := binary.BigEndian.Uint16(data[6:8]); status != resSuccess {
+		t.Fatalf("Expected success, got %#x", status)
+	}
+	bodyLen := int(binary.BigEndian.Uint32(data[8:12]))
+	body := data[24 : 24+bodyLen]
+	if data[4] != 4 || binary.BigEndian.Uint32(body[:4]) != 7 || string(body[4:]) != "value" {
+		t.Errorf("Expected flags 7 and the value, got %x", body)
+	}
+	if got := binary.BigEndian.Uint64(data[16:24]); got != cas {
+		t.Errorf("Expected CAS %d, got %d", cas, got)
+	}
+
+	// The second one misses, the key is gone
+	data = data[24+bodyLen:]
+	if len(data) != 24 || binary.BigEndian.Uint16(data[6:8]) != resKeyNotFound {
+		t.Errorf("Expected key not found for the second request, got %x", data)
+	}
+	if _, err := srv.cache.GetItem("k"); err != tqcache.ErrKeyNotFound {
+		t.Errorf("Expected the key to be deleted, got %v", err)
+	}
+}
+
+func TestGatCommands(t *testing.T) {
+	srv, _, cleanup := startTestServer(t)
+	defer cleanup()
+
+	ttl := func(key string) time.Duration {
+		t.Helper()
+		_, _, ttl, err := srv.cache.GetWithTTL(key)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		return ttl
+	}
+
+	var out bytes.Buffer
+	request := "set k 5 10 5\r\nvalue\r\ngat 100 k missing\r\n"
+	srv.handleText(&conn{}, bufio.NewReader(strings.NewReader(request)), bufio.NewWriter(&out))
+	if want := "STORED\r\nVALUE k 5 5\r\nvalue\r\nEND\r\n"; out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+	if d := ttl("k"); d <= 98*time.Second || d > 100*time.Second {
+		t.Errorf("Expected gat to set a TTL of 100s, got %v", d)
+	}
+
+	// Binary GAT with a 200s expiry
+	request2 := make([]byte, 24+4+1)
+	request2[0] = reqMagic
+	request2[1] = opGAT
+	binary.BigEndian.PutUint16(request2[2:4], 1)
+	request2[4] = 4
+	binary.BigEndian.PutUint32(request2[8:12], 5)
+	binary.BigEndian.PutUint32(request2[24:28], 200)
+	request2[28] = 'k'
+	out.Reset()
+	srv.handleBinary(&conn{}, bufio.NewReader(bytes.NewReader(request2)), bufio.NewWriter(&out))
+	data := out.Bytes()
+	if len(data) < 24 || binary.BigEndian.Uint16(data[6:8]) != resSuccess {
+		t.Fatalf("Expected success, got %x", data)
+	}
+	if body := data[24:]; len(body) != 4+5 || binary.BigEndian.Uint32(body[:4]) != 5 || string(body[4:]) != "value" {
+		t.Errorf("Expected flags 5 and the value, got %x", body)
+	}
+	if d := ttl("k"); d <= 198*time.Second || d > 200*time.Second {
+		t.Errorf("Expected binary GAT to set a TTL of 200s, got %v", d)
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	if network, err := listenNetwork("127.0.0.1:11211"); err != nil || network != "tcp" {
+		t.Errorf("Expected tcp for a TCP address, got %q, %v", network, err)
+	}
+
+	if runtime.GOOS != "windows" {
+		if network, err := listenNetwork("/tmp/tqcache.sock"); err != nil || network != "unix" {
+			t.Errorf("Expected unix for a socket path, got %q, %v", network, err)
+		}
+		return
+	}
+
+	// Windows only listens on TCP, Start fails before it uses the cache
+	for _, addr := range []string{"/tmp/tqcache.sock", `C:\tqcache.sock`, `\\.\pipe\tqcache`} {
+		err := New(nil, addr).Start()
+		if err == nil || !strings.Contains(err.Error(), "is not supported on windows, use a TCP address") {
+			t.Errorf("%s: expected a unix socket error, got %v", addr, err)
+		}
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
 	"strings"
@@ -14,17 +14,40 @@ import (
 )
 
 const (
-	maxKeyLength  = 250         // Memcached max key size
-	maxLineLength = 2 * 1024    // Max command line length before closing connection
-	maxValueSize  = 1024 * 1024 // Memcached default max item size (1MB)
+	maxLineLength = 2 * 1024 // Max command line length before closing connection
+
+	// maxPipelinedStores is the most storage commands applied at once
+	maxPipelinedStores = 256
 )
 
-func (s *Server) handleText(reader *bufio.Reader, writer *bufio.Writer) {
+// pendingStore is a parsed storage command waiting to be applied with the
+// other pipelined ones
+type pendingStore struct {
+	op      tqcache.Op
+	noreply bool
+	reply   string // Reply decided while parsing (an error), the op is not applied
+}
+
+func (s *Server) handleText(conn *conn, reader *bufio.Reader, writer *bufio.Writer) {
+	// Storage commands followed by more buffered input are collected and
+	// applied with one request per shard, before any other command runs
+	var pending []pendingStore
+	defer func() {
+		if len(pending) > 0 {
+			s.applyStores(writer, pending)
+			writer.Flush()
+		}
+	}()
+
 	for {
+		if !s.nextCommand(conn) {
+			return
+		}
 		line, err := reader.ReadString('\n')
+		conn.idle.Store(false)
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("Read error: %v", err)
+			if s.logReadError(err) {
+				slog.Debug("Read error", "remote", conn.remoteAddr(), "err", err)
 			}
 			return
 		}
@@ -40,14 +63,38 @@ func (s *Server) handleText(reader *bufio.Reader, writer *bufio.Writer) {
 		}
 
 		cmd := strings.ToUpper(parts[0])
+		if conn.limited() {
+			if len(pending) > 0 {
+				s.applyStores(writer, pending)
+				pending = pending[:0]
+			}
+			if bytes := textDataLength(cmd, parts); bytes >= 0 {
+				s.discardValue(reader, bytes)
+			}
+			writer.WriteString("SERVER_ERROR rate limited\r\n")
+			if reader.Buffered() == 0 {
+				writer.Flush()
+			}
+			continue
+		}
+		start := time.Now()
 
 		switch cmd {
-		case "SET":
-			s.handleTextStorage(reader, writer, parts, "SET")
-		case "ADD":
-			s.handleTextStorage(reader, writer, parts, "ADD")
-		case "REPLACE":
-			s.handleTextStorage(reader, writer, parts, "REPLACE")
+		case "SET", "ADD", "REPLACE":
+		default:
+			if len(pending) > 0 {
+				s.applyStores(writer, pending)
+				pending = pending[:0]
+			}
+		}
+
+		switch cmd {
+		case "SET", "ADD", "REPLACE":
+			pending = append(pending, s.parseTextStorage(reader, parts, cmd))
+			if reader.Buffered() == 0 || len(pending) == maxPipelinedStores {
+				s.applyStores(writer, pending)
+				pending = pending[:0]
+			}
 		case "APPEND":
 			s.handleTextAppendPrepend(reader, writer, parts, false)
 		case "PREPEND":
@@ -60,6 +107,10 @@ func (s *Server) handleText(reader *bufio.Reader, writer *bufio.Writer) {
 			s.handleTextGet(writer, parts, true)
 		case "DELETE":
 			s.handleTextDelete(writer, parts)
+		case "GD":
+			s.handleTextGetDelete(writer, parts)
+		case "EXISTS":
+			s.handleTextExists(writer, parts)
 		case "INCR":
 			s.handleTextIncrDecr(writer, parts, true)
 		case "DECR":
@@ -72,6 +123,8 @@ func (s *Server) handleText(reader *bufio.Reader, writer *bufio.Writer) {
 			s.handleTextGat(writer, parts, true)
 		case "FLUSH_ALL":
 			s.handleTextFlushAll(writer, parts)
+		case "SYNC_MODE":
+			s.handleTextSyncMode(writer, parts)
 		case "VERBOSITY":
 			// Silently accept verbosity command (noreply handled implicitly)
 		case "QUIT":
@@ -79,11 +132,36 @@ func (s *Server) handleText(reader *bufio.Reader, writer *bufio.Writer) {
 		case "VERSION":
 			writer.WriteString("VERSION 1.0.0\r\n")
 		case "STATS":
-			s.handleTextStats(writer)
+			if len(parts) > 1 && strings.ToLower(parts[1]) == "cachedump" {
+				s.handleTextCachedump(writer, parts[2:])
+			} else if len(parts) > 1 && strings.ToLower(parts[1]) == "slabs" {
+				s.handleTextStatsSlabs(writer)
+			} else if len(parts) > 1 && strings.ToLower(parts[1]) == "sizes" {
+				s.handleTextStatsSizes(writer)
+			} else {
+				s.handleTextStats(writer)
+			}
+		case "ME":
+			s.handleTextMe(writer, parts)
+		case "MG":
+			s.handleMetaGet(writer, parts)
+		case "MS":
+			s.handleMetaSet(reader, writer, parts)
+		case "MD":
+			s.handleMetaDelete(writer, parts)
 		default:
 			writer.WriteString("ERROR\r\n")
 		}
 
+		// Pipelined stores are timed with the command that applies them
+		if d := s.observe(textClass(cmd), start); s.slow(d) {
+			var key string
+			if len(parts) > 1 {
+				key = parts[1]
+			}
+			slog.Warn("Slow command", "command", cmd, "key", key, "duration", d, "remote", conn.remoteAddr())
+		}
+
 		// Flush once per command (batched writes)
 		if reader.Buffered() == 0 {
 			writer.Flush()
@@ -91,48 +169,43 @@ func (s *Server) handleText(reader *bufio.Reader, writer *bufio.Writer) {
 	}
 }
 
-func (s *Server) handleTextStorage(reader *bufio.Reader, writer *bufio.Writer, parts []string, op string) {
+// parseTextStorage reads a set, add or replace command and its value
+func (s *Server) parseTextStorage(reader *bufio.Reader, parts []string, op string) pendingStore {
 	if len(parts) < 5 {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
-		return
+		return pendingStore{reply: "CLIENT_ERROR bad command line format\r\n"}
 	}
 
 	key := parts[1]
 	// Validate flags (must be numeric)
-	_, err := strconv.ParseUint(parts[2], 10, 32)
+	flags, err := strconv.ParseUint(parts[2], 10, 32)
 	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
-		return
+		return pendingStore{reply: "CLIENT_ERROR bad command line format\r\n"}
 	}
 	// Validate exptime (must be numeric)
 	exptime, err := strconv.ParseInt(parts[3], 10, 64)
 	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
-		return
+		return pendingStore{reply: "CLIENT_ERROR bad command line format\r\n"}
 	}
-	// Validate bytes (must be numeric)
+	// Validate bytes (must be a non-negative number)
 	bytes, err := strconv.Atoi(parts[4])
-	if err != nil {
-		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
-		return
+	if err != nil || bytes < 0 {
+		return pendingStore{reply: "CLIENT_ERROR bad command line format\r\n"}
 	}
-	// Check value size limit (Memcached default is 1MB)
-	if bytes > maxValueSize {
-		// Still need to read and discard the data
-		discard := make([]byte, bytes)
-		io.ReadFull(reader, discard)
-		reader.ReadByte() // \r
-		reader.ReadByte() // \n
-		writer.WriteString("SERVER_ERROR object too large for cache\r\n")
-		return
+	if s.badKey(key) {
+		s.discardValue(reader, bytes)
+		return pendingStore{reply: "CLIENT_ERROR bad key\r\n"}
+	}
+	// Check value size limit (Config.MaxValueSize, memcached default is 1MB)
+	if s.valueTooLarge(bytes) {
+		s.discardValue(reader, bytes)
+		return pendingStore{reply: "SERVER_ERROR object too large for cache\r\n"}
 	}
 	noreply := len(parts) > 5 && parts[5] == "noreply"
 
 	// Read value
 	value := make([]byte, bytes)
 	if _, err := io.ReadFull(reader, value); err != nil {
-		writer.WriteString("SERVER_ERROR read error\r\n")
-		return
+		return pendingStore{reply: "SERVER_ERROR read error\r\n"}
 	}
 
 	// Read \r\n
@@ -159,15 +232,55 @@ func (s *Server) handleTextStorage(reader *bufio.Reader, writer *bufio.Writer, p
 		}
 	}
 
+	storeOp := tqcache.Op{Key: key, Value: value, TTL: ttl, Flags: uint32(flags)}
 	switch op {
 	case "SET":
-		_, err = s.cache.Set(key, value, ttl)
+		storeOp.Op = tqcache.OpSet
 	case "ADD":
-		_, err = s.cache.Add(key, value, ttl)
+		storeOp.Op = tqcache.OpAdd
 	case "REPLACE":
-		_, err = s.cache.Replace(key, value, ttl)
+		storeOp.Op = tqcache.OpReplace
+	}
+	return pendingStore{op: storeOp, noreply: noreply}
+}
+
+// applyStores applies parsed storage commands and writes their replies in
+// order, a single command is stored directly
+func (s *Server) applyStores(writer *bufio.Writer, pending []pendingStore) {
+	if len(pending) == 1 {
+		p := pending[0]
+		if p.reply != "" {
+			writer.WriteString(p.reply)
+			return
+		}
+		_, err := s.cache.Store(p.op)
+		writeStoreReply(writer, err, p.noreply)
+		return
+	}
+
+	ops := make([]tqcache.Op, 0, len(pending))
+	for _, p := range pending {
+		if p.reply == "" {
+			ops = append(ops, p.op)
+		}
+	}
+	results := s.cache.StoreMulti(ops)
+	for _, p := range pending {
+		if p.reply != "" {
+			writer.WriteString(p.reply)
+			continue
+		}
+		writeStoreReply(writer, results[0].Err, p.noreply)
+		results = results[1:]
 	}
+}
 
+// writeStoreReply writes the reply to a set, add or replace command
+func writeStoreReply(writer *bufio.Writer, err error, noreply bool) {
+	if err == tqcache.ErrValueTooLarge {
+		writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
 	if err != nil {
 		if err == tqcache.ErrKeyExists || err == tqcache.ErrKeyNotFound {
 			if !noreply {
@@ -193,7 +306,7 @@ func (s *Server) handleTextCas(reader *bufio.Reader, writer *bufio.Writer, parts
 
 	key := parts[1]
 	// Validate flags (must be numeric)
-	_, err := strconv.ParseUint(parts[2], 10, 32)
+	flags, err := strconv.ParseUint(parts[2], 10, 32)
 	if err != nil {
 		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
@@ -204,13 +317,25 @@ func (s *Server) handleTextCas(reader *bufio.Reader, writer *bufio.Writer, parts
 		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
-	// Validate bytes (must be numeric)
+	// Validate bytes (must be a non-negative number)
 	bytes, err := strconv.Atoi(parts[4])
-	if err != nil {
+	if err != nil || bytes < 0 {
 		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
 
+	if s.badKey(key) {
+		s.discardValue(reader, bytes)
+		writer.WriteString("CLIENT_ERROR bad key\r\n")
+		return
+	}
+	// Check value size limit before reading it
+	if s.valueTooLarge(bytes) {
+		s.discardValue(reader, bytes)
+		writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
+
 	// Read value (must always consume the data to stay in sync)
 	value := make([]byte, bytes)
 	if _, err2 := io.ReadFull(reader, value); err2 != nil {
@@ -253,7 +378,11 @@ func (s *Server) handleTextCas(reader *bufio.Reader, writer *bufio.Writer, parts
 		}
 	}
 
-	_, err = s.cache.Cas(key, value, ttl, casToken)
+	_, err = s.cache.Store(tqcache.Op{Op: tqcache.OpCas, Key: key, Value: value, TTL: ttl, Cas: casToken, Flags: uint32(flags)})
+	if err == tqcache.ErrValueTooLarge {
+		writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
 	if err != nil {
 		if err == tqcache.ErrCasMismatch {
 			if !noreply {
@@ -276,48 +405,160 @@ func (s *Server) handleTextCas(reader *bufio.Reader, writer *bufio.Writer, parts
 	}
 }
 
+// badKey reports whether a key is too long for the cache or contains
+// whitespace or control characters
+func (s *Server) badKey(key string) bool {
+	return tqcache.ValidateKey(key, s.cache.MaxKeySize()) != nil
+}
+
+// valueTooLarge reports whether a value of the given size exceeds the cache limit
+func (s *Server) valueTooLarge(bytes int) bool {
+	return bytes > s.cache.MaxValueSize()
+}
+
+// discardValue skips a value and its trailing \r\n to stay in sync with the client
+func (s *Server) discardValue(reader *bufio.Reader, bytes int) {
+	io.CopyN(io.Discard, reader, int64(bytes))
+	c, _ := reader.ReadByte()
+	if c == '\r' {
+		reader.ReadByte()
+	}
+}
+
 func (s *Server) handleTextGet(writer *bufio.Writer, parts []string, withCas bool) {
 	if len(parts) < 2 {
 		writer.WriteString("ERROR\r\n")
 		return
 	}
 
-	for _, key := range parts[1:] {
-		value, cas, err := s.cache.Get(key)
-		if err == nil {
-			writer.WriteString("VALUE ")
-			writer.WriteString(key)
-			writer.WriteString(" 0 ")
-			writer.WriteString(strconv.Itoa(len(value)))
-			if withCas {
-				writer.WriteString(" ")
-				writer.WriteString(strconv.FormatUint(cas, 10))
-			}
-			writer.WriteString("\r\n")
-			writer.Write(value)
-			writer.WriteString("\r\n")
+	// Read all keys at once for a consistent view per shard
+	keys := parts[1:]
+	for _, key := range keys {
+		if s.badKey(key) {
+			writer.WriteString("CLIENT_ERROR bad key\r\n")
+			return
 		}
 	}
+	items, err := s.cache.GetMulti(keys)
+	if err == tqcache.ErrResponseTooLarge {
+		writer.WriteString("SERVER_ERROR object too large to return\r\n")
+		return
+	}
+	if err != nil {
+		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return
+	}
+
+	for _, key := range keys {
+		item, ok := items[key]
+		if !ok {
+			continue
+		}
+		writer.WriteString("VALUE ")
+		writer.WriteString(key)
+		writer.WriteString(" ")
+		writer.WriteString(strconv.FormatUint(uint64(item.Flags), 10))
+		writer.WriteString(" ")
+		writer.WriteString(strconv.Itoa(len(item.Value)))
+		if withCas {
+			writer.WriteString(" ")
+			writer.WriteString(strconv.FormatUint(item.Cas, 10))
+		}
+		writer.WriteString("\r\n")
+		writer.Write(item.Value)
+		writer.WriteString("\r\n")
+	}
 	writer.WriteString("END\r\n")
 }
 
+// handleTextGetDelete handles "gd <key>", it returns the value like gets and
+// removes the key
+func (s *Server) handleTextGetDelete(writer *bufio.Writer, parts []string) {
+	if len(parts) != 2 {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	key := parts[1]
+	if s.badKey(key) {
+		writer.WriteString("CLIENT_ERROR bad key\r\n")
+		return
+	}
+	item, err := s.cache.GetDeleteItem(key)
+	if err == tqcache.ErrKeyNotFound {
+		writer.WriteString("END\r\n")
+		return
+	}
+	if err == tqcache.ErrResponseTooLarge {
+		writer.WriteString("SERVER_ERROR object too large to return\r\n")
+		return
+	}
+	if err != nil {
+		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return
+	}
+	writer.WriteString("VALUE ")
+	writer.WriteString(key)
+	writer.WriteString(" ")
+	writer.WriteString(strconv.FormatUint(uint64(item.Flags), 10))
+	writer.WriteString(" ")
+	writer.WriteString(strconv.Itoa(len(item.Value)))
+	writer.WriteString(" ")
+	writer.WriteString(strconv.FormatUint(item.Cas, 10))
+	writer.WriteString("\r\n")
+	writer.Write(item.Value)
+	writer.WriteString("\r\nEND\r\n")
+}
+
 func (s *Server) handleTextDelete(writer *bufio.Writer, parts []string) {
 	if len(parts) < 2 {
 		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
 	key := parts[1]
-	noreply := len(parts) > 2 && parts[2] == "noreply"
+	if s.badKey(key) {
+		writer.WriteString("CLIENT_ERROR bad key\r\n")
+		return
+	}
 
-	err := s.cache.Delete(key)
-	if err == nil {
-		if !noreply {
-			writer.WriteString("DELETED\r\n")
+	// Extension: an optional cas token only deletes the value it was read
+	// with (0 deletes unconditionally, like the old delete time argument)
+	var cas uint64
+	args := parts[2:]
+	if len(args) > 0 && args[0] != "noreply" {
+		var err error
+		cas, err = strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return
 		}
+		args = args[1:]
+	}
+	noreply := len(args) > 0 && args[0] == "noreply"
+
+	var err error
+	if cas > 0 {
+		err = s.cache.DeleteCas(key, cas)
 	} else {
+		err = s.cache.Delete(key)
+	}
+	if err == tqcache.ErrCasMismatch {
+		if !noreply {
+			writer.WriteString("EXISTS\r\n")
+		}
+		return
+	}
+	if err == tqcache.ErrKeyNotFound {
 		if !noreply {
 			writer.WriteString("NOT_FOUND\r\n")
 		}
+		return
+	}
+	if err != nil {
+		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return
+	}
+	if !noreply {
+		writer.WriteString("DELETED\r\n")
 	}
 }
 
@@ -327,18 +568,41 @@ func (s *Server) handleTextIncrDecr(writer *bufio.Writer, parts []string, incr b
 		return
 	}
 	key := parts[1]
+	if s.badKey(key) {
+		writer.WriteString("CLIENT_ERROR bad key\r\n")
+		return
+	}
 	valStr := parts[2]
 	delta, err := strconv.ParseUint(valStr, 10, 64)
 	if err != nil {
 		writer.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
 		return
 	}
-	noreply := len(parts) > 3 && parts[3] == "noreply"
+
+	// Extension: an optional initial value creates a missing key
+	var initial uint64
+	hasInitial := false
+	args := parts[3:]
+	if len(args) > 0 && args[0] != "noreply" {
+		initial, err = strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			writer.WriteString("CLIENT_ERROR invalid numeric initial argument\r\n")
+			return
+		}
+		hasInitial = true
+		args = args[1:]
+	}
+	noreply := len(args) > 0 && args[0] == "noreply"
 
 	var newVal uint64
-	if incr {
+	switch {
+	case incr && hasInitial:
+		newVal, _, err = s.cache.IncrementInit(key, delta, initial, 0)
+	case incr:
 		newVal, _, err = s.cache.Increment(key, delta)
-	} else {
+	case hasInitial:
+		newVal, _, err = s.cache.DecrementInit(key, delta, initial, 0)
+	default:
 		newVal, _, err = s.cache.Decrement(key, delta)
 	}
 
@@ -349,6 +613,10 @@ func (s *Server) handleTextIncrDecr(writer *bufio.Writer, parts []string, incr b
 			}
 			return
 		}
+		if err == tqcache.ErrBusy {
+			writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+			return
+		}
 		writer.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
 		return
 	}
@@ -365,8 +633,26 @@ func (s *Server) handleTextTouch(writer *bufio.Writer, parts []string) {
 	}
 
 	key := parts[1]
+	if s.badKey(key) {
+		writer.WriteString("CLIENT_ERROR bad key\r\n")
+		return
+	}
 	exptime, _ := strconv.ParseInt(parts[2], 10, 64)
-	noreply := len(parts) > 3 && parts[3] == "noreply"
+
+	// Extension: an optional cas token only extends the value it was read
+	// with (0 touches unconditionally)
+	var cas uint64
+	args := parts[3:]
+	if len(args) > 0 && args[0] != "noreply" {
+		var err error
+		cas, err = strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+		args = args[1:]
+	}
+	noreply := len(args) > 0 && args[0] == "noreply"
 
 	var ttl time.Duration
 	if exptime < 0 {
@@ -385,10 +671,17 @@ func (s *Server) handleTextTouch(writer *bufio.Writer, parts []string) {
 		}
 	}
 
-	_, err := s.cache.Touch(key, ttl)
+	var err error
+	if cas > 0 {
+		_, err = s.cache.TouchCas(key, ttl, cas)
+	} else {
+		_, err = s.cache.Touch(key, ttl)
+	}
 	if err != nil {
 		if !noreply {
-			if err == tqcache.ErrKeyNotFound {
+			if err == tqcache.ErrCasMismatch {
+				writer.WriteString("EXISTS\r\n")
+			} else if err == tqcache.ErrKeyNotFound {
 				writer.WriteString("NOT_FOUND\r\n")
 			} else {
 				writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
@@ -414,6 +707,12 @@ func (s *Server) handleTextGat(writer *bufio.Writer, parts []string, withCas boo
 		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
+	for _, key := range parts[2:] {
+		if s.badKey(key) {
+			writer.WriteString("CLIENT_ERROR bad key\r\n")
+			return
+		}
+	}
 
 	// Calculate TTL
 	var ttl time.Duration
@@ -432,45 +731,97 @@ func (s *Server) handleTextGat(writer *bufio.Writer, parts []string, withCas boo
 
 	// Process each key
 	for _, key := range parts[2:] {
-		// Get the value first (before touching with potentially expired TTL)
-		value, cas, err := s.cache.Get(key)
-		if err != nil {
+		// The value is read before a TTL in the past expires it
+		item, err := s.cache.GetAndTouch(key, ttl)
+		if err == tqcache.ErrResponseTooLarge {
+			writer.WriteString("SERVER_ERROR object too large to return\r\n")
+			return
+		}
+		if err == tqcache.ErrKeyNotFound {
 			continue // Key not found, skip
 		}
-
-		// Now touch with new expiry
-		s.cache.Touch(key, ttl)
+		if err != nil {
+			// Storage failure, don't let it look like a miss
+			writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+			return
+		}
 
 		// Output the value
 		writer.WriteString("VALUE ")
 		writer.WriteString(key)
-		writer.WriteString(" 0 ")
-		writer.WriteString(strconv.Itoa(len(value)))
+		writer.WriteString(" ")
+		writer.WriteString(strconv.FormatUint(uint64(item.Flags), 10))
+		writer.WriteString(" ")
+		writer.WriteString(strconv.Itoa(len(item.Value)))
 		if withCas {
 			writer.WriteString(" ")
-			writer.WriteString(strconv.FormatUint(cas, 10))
+			writer.WriteString(strconv.FormatUint(item.Cas, 10))
 		}
 		writer.WriteString("\r\n")
-		writer.Write(value)
+		writer.Write(item.Value)
 		writer.WriteString("\r\n")
 	}
 	writer.WriteString("END\r\n")
 }
 
 func (s *Server) handleTextFlushAll(writer *bufio.Writer, parts []string) {
+	// flush_all [delay] [noreply]
 	noreply := false
+	var delay time.Duration
 	for _, p := range parts[1:] {
 		if p == "noreply" {
 			noreply = true
+			continue
+		}
+		exptime, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+		if exptime > 2592000 {
+			// Unix timestamp
+			delay = time.Until(time.Unix(exptime, 0))
+		} else {
+			delay = time.Duration(exptime) * time.Second
 		}
 	}
 
-	s.cache.FlushAll()
+	s.cache.FlushAllAfter(delay)
 	if !noreply {
 		writer.WriteString("OK\r\n")
 	}
 }
 
+func (s *Server) handleTextSyncMode(writer *bufio.Writer, parts []string) {
+	// sync_mode <none|periodic|always>
+	if !s.adminCommands {
+		writer.WriteString("CLIENT_ERROR admin commands disabled\r\n")
+		return
+	}
+	if len(parts) != 2 {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	var strategy tqcache.SyncStrategy
+	switch strings.ToLower(parts[1]) {
+	case "none":
+		strategy = tqcache.SyncNone
+	case "periodic":
+		strategy = tqcache.SyncPeriodic
+	case "always":
+		strategy = tqcache.SyncAlways
+	default:
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	if err := s.cache.SetSyncStrategy(strategy); err != nil {
+		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return
+	}
+	slog.Info("Sync mode changed", "sync_mode", parts[1])
+	writer.WriteString("OK\r\n")
+}
+
 func (s *Server) handleTextAppendPrepend(reader *bufio.Reader, writer *bufio.Writer, parts []string, prepend bool) {
 	// append/prepend <key> <flags> <exptime> <bytes> [noreply]\r\n<data>\r\n
 	if len(parts) < 5 {
@@ -479,13 +830,23 @@ func (s *Server) handleTextAppendPrepend(reader *bufio.Reader, writer *bufio.Wri
 	}
 
 	key := parts[1]
-	// Validate bytes (must be numeric)
+	// Validate bytes (must be a non-negative number)
 	bytes, err := strconv.Atoi(parts[4])
-	if err != nil {
+	if err != nil || bytes < 0 {
 		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
 		return
 	}
 	noreply := len(parts) > 5 && parts[5] == "noreply"
+	if s.badKey(key) {
+		s.discardValue(reader, bytes)
+		writer.WriteString("CLIENT_ERROR bad key\r\n")
+		return
+	}
+	if s.valueTooLarge(bytes) {
+		s.discardValue(reader, bytes)
+		writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
 
 	// Read value
 	value := make([]byte, bytes)
@@ -507,6 +868,10 @@ func (s *Server) handleTextAppendPrepend(reader *bufio.Reader, writer *bufio.Wri
 		_, err = s.cache.Append(key, value)
 	}
 
+	if err == tqcache.ErrValueTooLarge {
+		writer.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return
+	}
 	if err != nil {
 		if err == tqcache.ErrKeyNotFound {
 			if !noreply {
@@ -524,7 +889,7 @@ func (s *Server) handleTextAppendPrepend(reader *bufio.Reader, writer *bufio.Wri
 }
 
 func (s *Server) handleTextStats(writer *bufio.Writer) {
-	stats := s.cache.Stats()
+	stats := s.stats()
 	writer.WriteString(fmt.Sprintf("STAT pid %d\r\n", os.Getpid()))
 	writer.WriteString(fmt.Sprintf("STAT uptime %d\r\n", int64(time.Since(s.cache.GetStartTime()).Seconds())))
 	writer.WriteString(fmt.Sprintf("STAT time %d\r\n", time.Now().Unix()))
@@ -534,3 +899,132 @@ func (s *Server) handleTextStats(writer *bufio.Writer) {
 	}
 	writer.WriteString("END\r\n")
 }
+
+// handleTextStatsSlabs handles "stats slabs", it reports the disk usage of
+// each data bucket summed over the shards
+func (s *Server) handleTextStatsSlabs(writer *bufio.Writer) {
+	buckets, err := s.cache.BucketStats()
+	if err != nil {
+		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return
+	}
+	for _, b := range buckets {
+		writer.WriteString(fmt.Sprintf("STAT bucket:%d:slot_size %d\r\n", b.Bucket, b.SlotSize))
+		writer.WriteString(fmt.Sprintf("STAT bucket:%d:total_slots %d\r\n", b.Bucket, b.TotalSlots))
+		writer.WriteString(fmt.Sprintf("STAT bucket:%d:used_slots %d\r\n", b.Bucket, b.UsedSlots))
+		writer.WriteString(fmt.Sprintf("STAT bucket:%d:bytes_used %d\r\n", b.Bucket, b.BytesUsed))
+		writer.WriteString(fmt.Sprintf("STAT bucket:%d:bytes_allocated %d\r\n", b.Bucket, b.BytesAllocated))
+	}
+	writer.WriteString(fmt.Sprintf("STAT buckets %d\r\n", len(buckets)))
+	writer.WriteString("END\r\n")
+}
+
+// handleTextStatsSizes handles "stats sizes", it reports the number of values
+// per power-of-two size band as "STAT sizes <band upper bound> <count>"
+func (s *Server) handleTextStatsSizes(writer *bufio.Writer) {
+	counts, err := s.cache.SizeHistogram()
+	if err != nil {
+		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return
+	}
+	for band, n := range counts {
+		if n > 0 {
+			writer.WriteString(fmt.Sprintf("STAT sizes %d %d\r\n", 1<<band, n))
+		}
+	}
+	writer.WriteString("END\r\n")
+}
+
+// handleTextExists handles "exists <key>", answering without reading the value
+func (s *Server) handleTextExists(writer *bufio.Writer, parts []string) {
+	if len(parts) != 2 {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	if s.badKey(parts[1]) {
+		writer.WriteString("CLIENT_ERROR bad key\r\n")
+		return
+	}
+	exists, err := s.cache.Exists(parts[1])
+	if err != nil {
+		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return
+	}
+	if exists {
+		writer.WriteString("EXISTS\r\n")
+	} else {
+		writer.WriteString("NOT_FOUND\r\n")
+	}
+}
+
+// handleTextCachedump handles "stats cachedump <limit> [prefix] [cursor]", it
+// lists one page of keys in sorted order followed by the cursor of the next
+// page, if any
+func (s *Server) handleTextCachedump(writer *bufio.Writer, args []string) {
+	if len(args) < 1 || len(args) > 3 {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	limit, err := strconv.Atoi(args[0])
+	if err != nil || limit < 0 {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	if max := s.cache.MaxScanLimit(); limit > max {
+		limit = max // A page, the cursor continues from it
+	}
+	var prefix, cursor string
+	if len(args) > 1 {
+		prefix = args[1]
+	}
+	if len(args) > 2 {
+		cursor = args[2]
+	}
+
+	keys, next, err := s.cache.Scan(prefix, cursor, limit)
+	if err != nil {
+		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return
+	}
+	for _, key := range keys {
+		writer.WriteString("ITEM " + key + "\r\n")
+	}
+	if next != "" {
+		writer.WriteString("CURSOR " + next + "\r\n")
+	}
+	writer.WriteString("END\r\n")
+}
+
+// handleTextMe handles the ME (meta-debug) command
+func (s *Server) handleTextMe(writer *bufio.Writer, parts []string) {
+	if len(parts) < 2 {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+
+	key := parts[1]
+	if s.badKey(key) {
+		writer.WriteString("CLIENT_ERROR bad key\r\n")
+		return
+	}
+	meta, err := s.cache.Meta(key)
+	if err != nil {
+		if err == tqcache.ErrKeyNotFound {
+			writer.WriteString("EN\r\n")
+			return
+		}
+		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+		return
+	}
+
+	exp := int64(-1)
+	if meta.TTL > 0 {
+		exp = int64(meta.TTL.Seconds())
+	}
+	fetch := "no"
+	if meta.Fetched {
+		fetch = "yes"
+	}
+	writer.WriteString(fmt.Sprintf("ME %s exp=%d la=%d cas=%d fetch=%s cls=%d size=%d\r\n",
+		key, exp, int64(time.Since(meta.LastAccess).Seconds()), meta.Cas, fetch, meta.Bucket, meta.Size))
+}
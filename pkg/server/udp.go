@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net"
+)
+
+// UDP frame header: request id, sequence number, total datagrams, reserved
+const udpHeaderSize = 8
+
+// maxUDPPayload is the largest datagram sent, like memcached
+const maxUDPPayload = 1400
+
+// SetUDPAddr makes Start also serve the text protocol over UDP on addr ("" = off)
+func (s *Server) SetUDPAddr(addr string) {
+	s.udpAddr = addr
+}
+
+// serveUDP reads datagrams until the connection is closed
+func (s *Server) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if s.closing.Load() {
+				return
+			}
+			slog.Warn("UDP read error", "err", err)
+			continue
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		go s.handleUDP(pc, addr, datagram)
+	}
+}
+
+// handleUDP runs the text commands of one datagram and sends the responses
+// back in datagrams carrying the request id
+func (s *Server) handleUDP(pc net.PacketConn, addr net.Addr, datagram []byte) {
+	if len(datagram) < udpHeaderSize {
+		return
+	}
+	requestId := binary.BigEndian.Uint16(datagram[0:2])
+	total := binary.BigEndian.Uint16(datagram[4:6])
+	if total != 1 {
+		return // Requests spanning several datagrams are not supported
+	}
+
+	var out bytes.Buffer
+	reader := bufio.NewReader(bytes.NewReader(datagram[udpHeaderSize:]))
+	writer := bufio.NewWriter(&out)
+	s.handleText(&conn{}, reader, writer)
+	writer.Flush()
+
+	// Split the response over as many datagrams as needed
+	response := out.Bytes()
+	chunk := maxUDPPayload - udpHeaderSize
+	count := (len(response) + chunk - 1) / chunk
+	if count > 0xFFFF {
+		slog.Debug("UDP response too large", "remote", addr, "bytes", len(response))
+		return
+	}
+	for seq := 0; seq < count; seq++ {
+		part := response[seq*chunk : min((seq+1)*chunk, len(response))]
+		packet := make([]byte, udpHeaderSize+len(part))
+		binary.BigEndian.PutUint16(packet[0:2], requestId)
+		binary.BigEndian.PutUint16(packet[2:4], uint16(seq))
+		binary.BigEndian.PutUint16(packet[4:6], uint16(count))
+		copy(packet[udpHeaderSize:], part)
+		if _, err := pc.WriteTo(packet, addr); err != nil {
+			slog.Debug("UDP write error", "remote", addr, "err", err)
+			return
+		}
+	}
+}
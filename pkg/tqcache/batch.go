@@ -0,0 +1,173 @@
+package tqcache
+
+import (
+	"fmt"
+	"time"
+)
+
+// Op is one operation of a Transact batch
+type Op struct {
+	Op    OpType
+	Key   string
+	Value []byte
+	TTL   time.Duration
+	Cas   uint64 // Expected CAS for OpCas, optional for OpAppend and OpPrepend
+	Delta uint64 // Delta for OpIncr and OpDecr
+
+	DataType byte   // Client data type hint for storage operations
+	Flags    uint32 // Opaque client flags for storage operations
+}
+
+// Result is the outcome of one operation of a Transact batch
+type Result struct {
+	Value []byte
+	Cas   uint64
+	Err   error
+}
+
+// batchUndo holds the state of a key before a batch first changed it
+type batchUndo struct {
+	key    string
+	exists bool
+	value  []byte
+	expiry int64
+	cas    uint64
+	tags   []string
+
+	dataType byte
+	flags    uint32
+}
+
+// Transact applies operations on keys of the same shard atomically: the
+// worker runs them in one turn and, if one fails, rolls back the changes of
+// the earlier ones. Keys on different shards are rejected with ErrCrossShard.
+// Items evicted to make room during the batch are not restored on rollback.
+// On failure the results up to and including the failed operation are returned.
+func (sc *ShardedCache) Transact(ops []Op) ([]Result, error) {
+	if len(ops) == 0 {
+		return nil, nil
+	}
+	if sc.config.KeyNormalizer != nil {
+		normalized := make([]Op, len(ops))
+		for i, op := range ops {
+			op.Key = sc.normalize(op.Key)
+			normalized[i] = op
+		}
+		ops = normalized
+	}
+	shardIdx := sc.shardFor(ops[0].Key)
+	for _, op := range ops {
+		switch op.Op {
+		case OpGet, OpSet, OpAdd, OpReplace, OpDelete, OpTouch, OpCas, OpIncr, OpDecr, OpAppend, OpPrepend:
+		default:
+			return nil, fmt.Errorf("operation %d not allowed in a transaction", op.Op)
+		}
+		if sc.shardFor(op.Key) != shardIdx {
+			return nil, ErrCrossShard
+		}
+	}
+
+	resp := sc.sendRequest(shardIdx, &Request{
+		Op:    OpBatch,
+		Batch: ops,
+	})
+	return resp.Results, resp.Err
+}
+
+// handleBatch applies the operations of a batch, undoing all of them when one fails
+func (w *Worker) handleBatch(req *Request) *Response {
+	w.inBatch = true
+	defer func() { w.inBatch = false }()
+
+	var undo []*batchUndo
+	saved := make(map[string]bool)
+	results := make([]Result, 0, len(req.Batch))
+
+	for _, op := range req.Batch {
+		if !saved[op.Key] && op.Op != OpGet {
+			u, err := w.saveUndo(op.Key)
+			if err != nil {
+				w.rollback(undo)
+				return &Response{Results: results, Err: err}
+			}
+			undo = append(undo, u)
+			saved[op.Key] = true
+		}
+
+		resp := w.process(&Request{
+			Op:    op.Op,
+			Key:   op.Key,
+			Value: op.Value,
+			TTL:   op.TTL,
+			Cas:   op.Cas,
+			Delta: op.Delta,
+
+			DataType: op.DataType,
+			Flags:    op.Flags,
+		})
+		results = append(results, Result{Value: resp.Value, Cas: resp.Cas, Err: resp.Err})
+		if resp.Err != nil {
+			w.rollback(undo)
+			return &Response{Results: results, Err: resp.Err}
+		}
+	}
+	return &Response{Results: results}
+}
+
+// saveUndo records the current state of a key
+func (w *Worker) saveUndo(key string) (*batchUndo, error) {
+	entry, ok := w.index.Get(key)
+	if !ok {
+		return &batchUndo{key: key}, nil
+	}
+	data, err := w.storage.ReadDataSlot(entry.Bucket, entry.SlotIdx)
+	if err != nil {
+		return nil, err
+	}
+	return &batchUndo{
+		key:    key,
+		exists: true,
+		value:  data,
+		expiry: entry.Expiry,
+		cas:    entry.Cas,
+		tags:   w.index.keyTags[key],
+
+		dataType: entry.DataType,
+		flags:    entry.Flags,
+	}, nil
+}
+
+// rollback restores the saved keys in reverse order
+func (w *Worker) rollback(undo []*batchUndo) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		u := undo[i]
+		if !u.exists {
+			if entry, ok := w.index.Get(u.key); ok {
+				w.deleteEntry(entry)
+			}
+			continue
+		}
+
+		if resp := w.doSet(u.key, u.value, 0, u.tags, u.flags, u.dataType, 0, false); resp.Err != nil {
+			continue
+		}
+
+		// Put back the original expiry and CAS
+		entry, _ := w.index.Get(u.key)
+		entry.Expiry = u.expiry
+		entry.Cas = u.cas
+		rec := &KeyRecord{
+			KeyLen:   uint16(len(u.key)),
+			Cas:      u.cas,
+			Expiry:   u.expiry,
+			Bucket:   byte(entry.Bucket),
+			SlotIdx:  entry.SlotIdx,
+			DataType: u.dataType,
+			Flags:    u.flags,
+		}
+		copy(rec.Key[:], u.key)
+		w.storage.WriteKeyRecord(entry.KeyId, rec)
+		w.index.Set(entry)
+	}
+	w.checkSync()
+}
@@ -0,0 +1,89 @@
+package tqcache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"    // Requests flow normally
+	breakerOpen     = "open"      // Requests fail fast until the cooldown has passed
+	breakerHalfOpen = "half-open" // One trial request tests whether storage recovered
+)
+
+// breaker is a per-shard circuit breaker that trips after consecutive storage errors
+type breaker struct {
+	mu       sync.Mutex
+	state    string
+	failures int // Consecutive storage errors
+	openedAt time.Time
+	trial    bool // A half-open trial request is in flight
+}
+
+// allow reports whether a request may be sent to the shard
+func (b *breaker) allow(cooldown time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < cooldown {
+			return ErrShardUnavailable
+		}
+		b.state = breakerHalfOpen
+		b.trial = true
+		return nil
+	case breakerHalfOpen:
+		if b.trial {
+			return ErrShardUnavailable // Wait for the trial request
+		}
+		b.trial = true
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of an allowed request
+func (b *breaker) record(err error, threshold int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if !isStorageError(err) {
+		b.failures = 0
+		b.state = breakerClosed
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// State returns the current breaker state
+func (b *breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// isStorageError reports whether err comes from the storage rather than being
+// an expected result of the operation (miss, CAS mismatch, limits, ...) or of
+// load (timeouts, recovery)
+func isStorageError(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, expected := range []error{
+		ErrKeyNotFound, ErrKeyTooLarge, ErrValueTooLarge, ErrKeyExists, ErrCasMismatch,
+		ErrNotNumeric, ErrResponseTooLarge, ErrSnapshotClosed, ErrCrossShard,
+		ErrBusy, ErrNotReady,
+	} {
+		if errors.Is(err, expected) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,11 @@
 package tqcache
 
-import "time"
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
 
 // SyncStrategy defines how strictly the cache should be persisted to disk
 type SyncStrategy int
@@ -14,23 +19,250 @@ const (
 	SyncPeriodic
 )
 
+// EvictionPolicy defines how items are evicted when MaxDataSize is exceeded
+type EvictionPolicy int
+
+const (
+	// EvictionNone never evicts, data files grow without limit. As the zero
+	// value it stands for EvictionSampled when MaxDataSize is set.
+	EvictionNone EvictionPolicy = iota
+	// EvictionSampled evicts the least recently used of a few randomly sampled items
+	EvictionSampled
+	// EvictionLRU evicts the least recently used item, tracked exactly in a
+	// list at the cost of some memory per key
+	EvictionLRU
+)
+
+// EvictReason tells why a key was dropped, see Config.OnEvict
+type EvictReason int
+
+const (
+	// ReasonExpired is a key whose TTL passed
+	ReasonExpired EvictReason = iota
+	// ReasonLRU is a key evicted to stay below MaxDataSize
+	ReasonLRU
+	// ReasonIdle is a key not accessed within IdleTimeout
+	ReasonIdle
+	// ReasonCorrupt is a key whose value failed its checksum on read
+	ReasonCorrupt
+)
+
+// String returns the name of the reason
+func (r EvictReason) String() string {
+	switch r {
+	case ReasonLRU:
+		return "lru"
+	case ReasonIdle:
+		return "idle"
+	case ReasonCorrupt:
+		return "corrupt"
+	}
+	return "expired"
+}
+
+// KeyFormat defines the layout of the records in the keys file
+type KeyFormat int
+
+const (
+	// KeyFormatFixed stores every key in a fixed-size record of KeyRecordSize bytes
+	KeyFormatFixed KeyFormat = iota
+	// KeyFormatPacked stores keys with their actual length, which is much
+	// smaller for short keys. Deleted records are reclaimed by rewriting the file.
+	KeyFormatPacked
+)
+
+// String returns the name of the key format as stored in the format file
+func (f KeyFormat) String() string {
+	if f == KeyFormatPacked {
+		return "packed"
+	}
+	return "fixed"
+}
+
+// Compression defines how large values are compressed in the data files
+type Compression int
+
+const (
+	// CompressionNone stores values as given
+	CompressionNone Compression = iota
+	// CompressionFlate compresses values with DEFLATE (compress/flate)
+	CompressionFlate
+)
+
 // Default configuration values (single source of truth)
 const (
-	DefaultShardCount      = 16
-	DefaultChannelCapacity = 1000
-	DefaultSyncInterval    = 1 * time.Second
+	DefaultShardCount          = 16
+	DefaultChannelCapacity     = 1000
+	DefaultSyncInterval        = 1 * time.Second
+	DefaultEvictionSamples     = 5
+	DefaultBreakerCooldown     = 5 * time.Second
+	DefaultScanLimit           = 1000
+	DefaultMaxScanLimit        = 100000
+	DefaultExpirySweepInterval = 100 * time.Millisecond
+	DefaultDirMode             = os.FileMode(0755)
+	DefaultFileMode            = os.FileMode(0644)
+	DefaultLargeReaders        = 2
+	DefaultWALCheckpointSize   = 64 << 20
 )
 
 // Config holds the configuration for TQCache
 type Config struct {
-	DataDir         string
-	DefaultTTL      time.Duration
-	MaxTTL          time.Duration
-	MaxKeySize      int
-	MaxValueSize    int
-	SyncStrategy    SyncStrategy
-	SyncInterval    time.Duration
-	ChannelCapacity int // Request channel capacity per worker (default 1000)
+	DataDir      string
+	DefaultTTL   time.Duration
+	MaxTTL       time.Duration
+	MaxKeySize   int
+	MaxValueSize int
+	SyncStrategy SyncStrategy
+	SyncInterval time.Duration
+	// ShardSyncInterval overrides SyncInterval per shard in periodic mode
+	// (nil or a zero result = SyncInterval)
+	ShardSyncInterval func(shard int) time.Duration
+	ChannelCapacity   int // Request channel capacity per worker (default 1000)
+
+	// DirMode and FileMode are the permissions of the shard dirs and their
+	// files (0 = 0755 and 0644). The umask applies to new ones, existing ones
+	// with more permissions are narrowed to them.
+	DirMode  os.FileMode
+	FileMode os.FileMode
+
+	// SetGOMAXPROCS makes NewSharded set GOMAXPROCS to
+	// max(min(cpu_count, shards/4), 1). Off by default so embedding
+	// programs keep their own setting, the standalone server turns it on.
+	SetGOMAXPROCS bool
+
+	// RequestTimeout fails requests with ErrBusy when they do not get buffer
+	// room and are not taken and answered by their worker in time (0 = wait
+	// forever). A request that timed out may still be applied later.
+	RequestTimeout time.Duration
+
+	// MaxBufferedBytes caps the value bytes queued in all request channels
+	// combined. Callers block until there is room, or fail with ErrBusy once
+	// RequestTimeout has passed (0 = unlimited).
+	MaxBufferedBytes int64
+
+	// MaxDataSize caps the data file bytes of all shards combined, items are
+	// evicted according to EvictionPolicy (default EvictionSampled) to stay
+	// below it (0 = unlimited)
+	MaxDataSize     int64
+	EvictionPolicy  EvictionPolicy
+	EvictionSamples int // Items sampled per eviction (default 5)
+
+	// EvictionGrace suppresses eviction for this long after a shard starts,
+	// so freshly recovered items are not evicted before the access pattern
+	// re-establishes. Shards may exceed MaxDataSize meanwhile (0 = no grace).
+	EvictionGrace time.Duration
+
+	// CompactionRatio compacts the data files of a shard in the background
+	// once this fraction of their slots is free. Deletes already compact, free
+	// slots are left by failed moves and by items that expired while the cache
+	// was closed (0 = only on Compact).
+	CompactionRatio float64
+
+	// ExpirySweepInterval is how often each shard deletes the keys whose TTL
+	// passed. With 0 expired keys are only deleted when they are accessed and
+	// keep their disk space until then (default 100ms).
+	ExpirySweepInterval time.Duration
+
+	// ServeStale keeps items this long past their expiry, GetStale returns
+	// them marked as expired (serve-stale-while-revalidate) while other reads
+	// miss. Expired items are not recovered after a restart (0 = off).
+	ServeStale time.Duration
+
+	// IdleTimeout makes the expiry sweep delete items that were not read or
+	// written for this long, regardless of their TTL. The access order is
+	// tracked like for EvictionLRU (0 = off).
+	IdleTimeout time.Duration
+
+	// OnEvict is called with the (normalized) key of every item dropped by
+	// expiry or eviction, not for deletes and flushes. It runs in a single
+	// goroutine after the fact, events beyond 1024 waiting for it
+	// are dropped so the workers never block.
+	OnEvict func(key string, reason EvictReason)
+
+	// MaxResponseSize rejects gets of values larger than this many bytes,
+	// regardless of when they were stored (0 = unlimited)
+	MaxResponseSize int
+
+	// MaxScanLimit caps the keys a Scan returns per call, larger limits are
+	// lowered to it so each shard's walk stays bounded (0 = 100000)
+	MaxScanLimit int
+
+	// ByteOrder of the on-disk records for new data dirs, existing data dirs
+	// must match it (nil = little-endian)
+	ByteOrder binary.ByteOrder
+
+	// KeyFormat of the keys file, existing data dirs are migrated on open
+	KeyFormat KeyFormat
+
+	// Compression of values of at least CompressionThreshold bytes, a value
+	// is stored as given when it does not get smaller. Reads decompress
+	// transparently, also values stored with another setting.
+	Compression          Compression
+	CompressionThreshold int
+
+	// UseMmap reads values from memory-mapped data files instead of with a
+	// read call each, which helps read-heavy workloads. Values are still
+	// copied out of the mapping. Ignored where mmap is not available.
+	UseMmap bool
+
+	// LargeReadThreshold hands gets of values in buckets with slots of at
+	// least this many bytes to reader goroutines of the shard, so copying a
+	// large value does not hold up the other requests of the shard. A value
+	// that changed during the read is read again by the shard (0 = off).
+	LargeReadThreshold int
+	LargeReaders       int // Reader goroutines per shard (default 2)
+
+	// Preallocated sizes of new shard files, for a known large working set.
+	// Files are extended with truncate, which creates sparse files on most
+	// filesystems; note that the slot count applies to every bucket, up to
+	// 64MB per slot.
+	InitialKeysCapacity   int64 // Key records per shard (fixed key format only)
+	InitialSlotsPerBucket int64 // Slots per data bucket file per shard
+
+	// Bucket layout of the data files: BucketCount buckets with slots of
+	// BucketMinSize bytes, each BucketGrowthFactor times the previous one
+	// (0 = 16 buckets from 1KB doubling up to 64MB). The layout is recorded
+	// in the data dir, reopening it with another layout fails.
+	BucketMinSize      int
+	BucketGrowthFactor float64
+	BucketCount        int
+
+	// KeyNormalizer is applied to keys before hashing and storage, so for
+	// example a lowercasing normalizer makes keys case-insensitive. Stored
+	// keys are the normalized form. It must be idempotent (nil = keys are
+	// used as given).
+	KeyNormalizer func(key string) string
+
+	// PersistDerivedState saves in-memory state derived from use (access
+	// times for eviction, hit counts, tags) to a sidecar file on Close and
+	// reloads it on open, for a warm start. It is best-effort: after an
+	// unclean shutdown or for changed keys the state starts cold.
+	PersistDerivedState bool
+
+	// CoalesceGets lets concurrent gets of the same key share one worker request
+	CoalesceGets bool
+
+	// FlushBarrier makes FlushAll block requests on all shards until every
+	// shard is flushed, so each write lands either before the flush (cleared)
+	// or after it (kept). Without it shards are flushed one by one.
+	FlushBarrier bool
+
+	// ReplicationEnabled logs every mutation to a write-ahead log in each
+	// shard dir before it is acknowledged, for a ReplicaClient to apply to a
+	// warm standby. Every record is fsynced before the mutation is
+	// acknowledged, whatever the SyncStrategy of the data files.
+	ReplicationEnabled bool
+
+	// WALCheckpointSize rewrites the write-ahead log of a shard as a
+	// checkpoint of its live keys once the log has grown past this many bytes
+	// and to twice the size of the last checkpoint (0 = 64MB)
+	WALCheckpointSize int64
+
+	// BreakerThreshold trips a shard's circuit breaker after this many
+	// consecutive storage errors, requests then fail fast with
+	// ErrShardUnavailable until BreakerCooldown has passed (0 = disabled)
+	BreakerThreshold int
+	BreakerCooldown  time.Duration // Default 5s
 }
 
 // DefaultConfig returns sensible defaults
@@ -44,5 +276,64 @@ func DefaultConfig() Config {
 		SyncStrategy:    SyncPeriodic,
 		SyncInterval:    DefaultSyncInterval,
 		ChannelCapacity: DefaultChannelCapacity,
+		EvictionSamples: DefaultEvictionSamples,
+		DirMode:         DefaultDirMode,
+		FileMode:        DefaultFileMode,
+
+		ExpirySweepInterval: DefaultExpirySweepInterval,
+	}
+}
+
+// Validate reports combinations of settings that cannot work, NewSharded
+// refuses a config it rejects
+func (c Config) Validate() error {
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w: "+format, append([]any{ErrInvalidConfig}, args...)...)
+	}
+	if c.DefaultTTL < 0 {
+		return invalid("DefaultTTL %v is negative", c.DefaultTTL)
+	}
+	if c.MaxTTL < 0 {
+		return invalid("MaxTTL %v is negative", c.MaxTTL)
+	}
+	if c.MaxTTL > 0 && c.DefaultTTL > c.MaxTTL {
+		return invalid("DefaultTTL %v exceeds MaxTTL %v", c.DefaultTTL, c.MaxTTL)
+	}
+	if c.SyncStrategy == SyncPeriodic && c.SyncInterval <= 0 {
+		return invalid("SyncInterval %v must be positive with periodic sync", c.SyncInterval)
+	}
+	if c.MaxDataSize < 0 {
+		return invalid("MaxDataSize %d is negative", c.MaxDataSize)
+	}
+	if c.MaxValueSize < 0 {
+		return invalid("MaxValueSize %d is negative", c.MaxValueSize)
+	}
+	if c.MaxScanLimit < 0 {
+		return invalid("MaxScanLimit %d is negative", c.MaxScanLimit)
+	}
+	if c.WALCheckpointSize < 0 {
+		return invalid("WALCheckpointSize %d is negative", c.WALCheckpointSize)
+	}
+	largest, err := c.largestBucket()
+	if err != nil {
+		return invalid("%v", err)
+	}
+	if c.MaxValueSize > largest {
+		return invalid("MaxValueSize %d exceeds the largest bucket of %d bytes", c.MaxValueSize, largest)
+	}
+	return nil
+}
+
+// largestBucket returns the slot size of the largest bucket of the layout
+func (c Config) largestBucket() (int, error) {
+	layout, err := newBucketLayout(StorageOptions{
+		BucketMinSize:      c.BucketMinSize,
+		BucketGrowthFactor: c.BucketGrowthFactor,
+		BucketCount:        c.BucketCount,
+	})
+	if err != nil {
+		return 0, err
 	}
+	sizes := layout.sizes()
+	return sizes[len(sizes)-1], nil
 }
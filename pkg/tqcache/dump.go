@@ -0,0 +1,119 @@
+package tqcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Dump format: the magic and a uint32 version, then one record per item
+//
+//	keyLen   2  (0 = end of dump, keys are never empty)
+//	key      keyLen
+//	flags    4
+//	dataType 1
+//	expiry   8  Unix milliseconds, 0 = no expiry
+//	valueLen 4
+//	value    valueLen
+//
+// All integers are big-endian.
+const (
+	dumpMagic   = "TQCDUMP\n"
+	dumpVersion = 1
+)
+
+var (
+	ErrDumpFormat = errors.New("not a tqcache dump or unsupported version")
+	ErrNotEmpty   = errors.New("cache is not empty")
+)
+
+// Dump writes every item with its value, flags, data type hint and expiry to
+// w, as it was at one point in time per shard (see Snapshot). Writes keep
+// flowing while the dump runs.
+func (sc *ShardedCache) Dump(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(dumpMagic)
+	binary.Write(bw, binary.BigEndian, uint32(dumpVersion))
+
+	var hdr [19]byte
+	err := sc.Snapshot(func(item *SnapshotItem) error {
+		binary.BigEndian.PutUint16(hdr[0:2], uint16(len(item.Key)))
+		bw.Write(hdr[0:2])
+		bw.WriteString(item.Key)
+		binary.BigEndian.PutUint32(hdr[2:6], item.Flags)
+		hdr[6] = item.DataType
+		binary.BigEndian.PutUint64(hdr[7:15], uint64(item.Expiry))
+		binary.BigEndian.PutUint32(hdr[15:19], uint32(len(item.Value)))
+		bw.Write(hdr[2:19])
+		_, err := bw.Write(item.Value)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	bw.Write([]byte{0, 0})
+	return bw.Flush()
+}
+
+// Restore loads a dump written by Dump into the cache, which must be empty.
+// Items keep their flags, data type hint and expiry, items that expired
+// since the dump are skipped. Like Set, items without expiry get DefaultTTL
+// and expiries are capped to MaxTTL. CAS tokens are not restored.
+func (sc *ShardedCache) Restore(r io.Reader) error {
+	if keys, _, err := sc.Scan("", "", 1); err != nil {
+		return err
+	} else if len(keys) > 0 {
+		return ErrNotEmpty
+	}
+
+	br := bufio.NewReader(r)
+	var head [len(dumpMagic) + 4]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return ErrDumpFormat
+	}
+	if string(head[:len(dumpMagic)]) != dumpMagic || binary.BigEndian.Uint32(head[len(dumpMagic):]) != dumpVersion {
+		return ErrDumpFormat
+	}
+
+	var hdr [19]byte
+	for n := 0; ; n++ {
+		if _, err := io.ReadFull(br, hdr[0:2]); err != nil {
+			return fmt.Errorf("dump item %d: %w", n, err)
+		}
+		keyLen := int(binary.BigEndian.Uint16(hdr[0:2]))
+		if keyLen == 0 {
+			return nil
+		}
+		key := make([]byte, keyLen)
+		if _, err := io.ReadFull(br, key); err != nil {
+			return fmt.Errorf("dump item %d: %w", n, err)
+		}
+		if _, err := io.ReadFull(br, hdr[2:19]); err != nil {
+			return fmt.Errorf("dump item %d: %w", n, err)
+		}
+		value := make([]byte, binary.BigEndian.Uint32(hdr[15:19]))
+		if _, err := io.ReadFull(br, value); err != nil {
+			return fmt.Errorf("dump item %d: %w", n, err)
+		}
+
+		op := Op{
+			Op:       OpSet,
+			Key:      string(key),
+			Value:    value,
+			Flags:    binary.BigEndian.Uint32(hdr[2:6]),
+			DataType: hdr[6],
+		}
+		if expiry := int64(binary.BigEndian.Uint64(hdr[7:15])); expiry > 0 {
+			op.TTL = time.Until(time.UnixMilli(expiry))
+			if op.TTL <= 0 {
+				continue // Expired since the dump
+			}
+		}
+		if _, err := sc.Store(op); err != nil {
+			return fmt.Errorf("dump item %d (%s): %w", n, key, err)
+		}
+	}
+}
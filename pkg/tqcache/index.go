@@ -2,6 +2,8 @@ package tqcache
 
 import (
 	"container/heap"
+	"container/list"
+	"sort"
 
 	"github.com/google/btree"
 )
@@ -15,6 +17,14 @@ type IndexEntry struct {
 	Length  int
 	Expiry  int64 // Unix timestamp, 0 = no expiry
 	Cas     uint64
+
+	DataType byte   // Client data type hint
+	Flags    uint32 // Opaque client flags
+
+	// In-memory only (not persisted, unless Config.PersistDerivedState)
+	LastAccess int64  // Unix milliseconds of last read or write
+	Fetched    bool   // Whether the item was read since it was stored
+	Hits       uint64 // Number of reads since the item was stored
 }
 
 // Less implements btree.Item
@@ -104,6 +114,18 @@ type Index struct {
 	expiryHeap *ExpiryHeap
 	keyIdMap   map[int64]string         // keyId → key for reverse lookup
 	slotIndex  map[int]map[int64]string // bucket → slotIdx → key for defrag
+
+	// Inverted tag index (in-memory only, lost on restart unless Config.PersistDerivedState)
+	tagKeys map[string]map[string]struct{} // tag → keys
+	keyTags map[string][]string            // key → tags
+
+	lru *LRUList // Access order for EvictionLRU (nil = not tracked)
+}
+
+// LRUList orders keys from most to least recently used
+type LRUList struct {
+	list  *list.List               // Keys, front = most recently used
+	elems map[string]*list.Element // key → list element
 }
 
 func NewIndex() *Index {
@@ -112,14 +134,13 @@ func NewIndex() *Index {
 		expiryHeap: NewExpiryHeap(),
 		keyIdMap:   make(map[int64]string),
 		slotIndex:  make(map[int]map[int64]string),
-	}
-	for i := 0; i < NumBuckets; i++ {
-		idx.slotIndex[i] = make(map[int64]string)
+		tagKeys:    make(map[string]map[string]struct{}),
+		keyTags:    make(map[string][]string),
 	}
 	return idx
 }
 
-// Get retrieves an entry by key
+// Get retrieves a copy of an entry by key, changes to it are stored with Set
 func (idx *Index) Get(key string) (*IndexEntry, bool) {
 	item := idx.btree.Get(IndexEntry{Key: key})
 	if item == nil {
@@ -129,17 +150,25 @@ func (idx *Index) Get(key string) (*IndexEntry, bool) {
 	return &entry, true
 }
 
-// Set inserts or updates an entry
+// Set inserts or updates an entry. Entries returned by the index are copies,
+// the stored entry is the reference for the lookups being replaced.
 func (idx *Index) Set(entry *IndexEntry) {
-	// Remove old slot index entry if bucket/slot changed
+	// Remove old lookups if bucket/slot or keyId changed
 	if oldEntry, ok := idx.Get(entry.Key); ok {
 		if oldEntry.Bucket != entry.Bucket || oldEntry.SlotIdx != entry.SlotIdx {
-			delete(idx.slotIndex[oldEntry.Bucket], oldEntry.SlotIdx)
+			idx.unmapSlot(oldEntry.Bucket, oldEntry.SlotIdx, entry.Key)
+		}
+		if oldEntry.KeyId != entry.KeyId && idx.keyIdMap[oldEntry.KeyId] == entry.Key {
+			delete(idx.keyIdMap, oldEntry.KeyId)
+			idx.expiryHeap.Remove(oldEntry.KeyId)
 		}
 	}
 
 	idx.btree.ReplaceOrInsert(*entry)
 	idx.keyIdMap[entry.KeyId] = entry.Key
+	if idx.slotIndex[entry.Bucket] == nil {
+		idx.slotIndex[entry.Bucket] = make(map[int64]string)
+	}
 	idx.slotIndex[entry.Bucket][entry.SlotIdx] = entry.Key
 
 	// Update expiry heap
@@ -157,12 +186,112 @@ func (idx *Index) Delete(key string) *IndexEntry {
 		return nil
 	}
 	entry := item.(IndexEntry)
-	delete(idx.keyIdMap, entry.KeyId)
-	delete(idx.slotIndex[entry.Bucket], entry.SlotIdx)
-	idx.expiryHeap.Remove(entry.KeyId)
+	if idx.keyIdMap[entry.KeyId] == key {
+		delete(idx.keyIdMap, entry.KeyId)
+		idx.expiryHeap.Remove(entry.KeyId)
+	}
+	idx.unmapSlot(entry.Bucket, entry.SlotIdx, key)
+	idx.SetTags(key, nil)
+	if idx.lru != nil {
+		if elem, ok := idx.lru.elems[key]; ok {
+			idx.lru.list.Remove(elem)
+			delete(idx.lru.elems, key)
+		}
+	}
 	return &entry
 }
 
+// unmapSlot removes a slot index entry, unless the slot was given to another key
+// since (compaction moves keys into freed slots)
+func (idx *Index) unmapSlot(bucket int, slotIdx int64, key string) {
+	if idx.slotIndex[bucket][slotIdx] == key {
+		delete(idx.slotIndex[bucket], slotIdx)
+	}
+}
+
+// SetTags replaces the tags of a key (nil removes all tags)
+func (idx *Index) SetTags(key string, tags []string) {
+	for _, tag := range idx.keyTags[key] {
+		keys := idx.tagKeys[tag]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(idx.tagKeys, tag)
+		}
+	}
+	if len(tags) == 0 {
+		delete(idx.keyTags, key)
+		return
+	}
+	idx.keyTags[key] = tags
+	for _, tag := range tags {
+		if idx.tagKeys[tag] == nil {
+			idx.tagKeys[tag] = make(map[string]struct{})
+		}
+		idx.tagKeys[tag][key] = struct{}{}
+	}
+}
+
+// KeysByTag returns the keys that have the given tag
+func (idx *Index) KeysByTag(tag string) []string {
+	keys := make([]string, 0, len(idx.tagKeys[tag]))
+	for key := range idx.tagKeys[tag] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// MarkFetched records a read access for an entry
+func (idx *Index) MarkFetched(entry *IndexEntry, now int64) {
+	entry.LastAccess = now
+	entry.Fetched = true
+	entry.Hits++
+	idx.btree.ReplaceOrInsert(*entry)
+	idx.MarkUsed(entry.Key)
+}
+
+// EnableLRU starts tracking the access order, existing entries are ordered
+// by their last access
+func (idx *Index) EnableLRU() {
+	entries := idx.Entries()
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastAccess > entries[j].LastAccess
+	})
+	idx.lru = &LRUList{list: list.New(), elems: make(map[string]*list.Element, len(entries))}
+	for _, entry := range entries {
+		idx.lru.elems[entry.Key] = idx.lru.list.PushBack(entry.Key)
+	}
+}
+
+// MarkUsed moves a key to the front of the LRU list (if tracked)
+func (idx *Index) MarkUsed(key string) {
+	if idx.lru == nil {
+		return
+	}
+	if elem, ok := idx.lru.elems[key]; ok {
+		idx.lru.list.MoveToFront(elem)
+		return
+	}
+	idx.lru.elems[key] = idx.lru.list.PushFront(key)
+}
+
+// LeastRecentlyUsed returns the least recently used entry other than skip
+// (nil if the access order is not tracked or there is none)
+func (idx *Index) LeastRecentlyUsed(skip string) *IndexEntry {
+	if idx.lru == nil {
+		return nil
+	}
+	for elem := idx.lru.list.Back(); elem != nil; elem = elem.Prev() {
+		key := elem.Value.(string)
+		if key == skip {
+			continue
+		}
+		if entry, ok := idx.Get(key); ok {
+			return entry
+		}
+	}
+	return nil
+}
+
 // GetByKeyId retrieves an entry by keyId
 func (idx *Index) GetByKeyId(keyId int64) *IndexEntry {
 	key, ok := idx.keyIdMap[keyId]
@@ -173,11 +302,74 @@ func (idx *Index) GetByKeyId(keyId int64) *IndexEntry {
 	return entry
 }
 
+// Entries returns all entries in key order
+func (idx *Index) Entries() []*IndexEntry {
+	entries := make([]*IndexEntry, 0, idx.btree.Len())
+	idx.btree.Ascend(func(item btree.Item) bool {
+		entry := item.(IndexEntry)
+		entries = append(entries, &entry)
+		return true
+	})
+	return entries
+}
+
+// Range calls fn for the entries with start <= key < end in key order
+// (empty end = no upper bound) until fn returns false
+func (idx *Index) Range(start, end string, fn func(entry *IndexEntry) bool) {
+	iter := func(item btree.Item) bool {
+		entry := item.(IndexEntry)
+		return fn(&entry)
+	}
+	if end == "" {
+		idx.btree.AscendGreaterOrEqual(IndexEntry{Key: start}, iter)
+		return
+	}
+	idx.btree.AscendRange(IndexEntry{Key: start}, IndexEntry{Key: end}, iter)
+}
+
+// Sample returns up to n entries in map iteration order, which Go randomizes
+func (idx *Index) Sample(n int) []*IndexEntry {
+	entries := make([]*IndexEntry, 0, n)
+	for _, key := range idx.keyIdMap {
+		if len(entries) == n {
+			break
+		}
+		if entry, ok := idx.Get(key); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// RenumberKeyIds assigns new keyIds to the given entries at once (used when
+// the keys file is rewritten, old and new keyIds may overlap)
+func (idx *Index) RenumberKeyIds(entries []*IndexEntry, keyIds []int64) {
+	renumbered := make(map[int64]int64, len(entries))
+	idx.keyIdMap = make(map[int64]string, len(entries))
+	for i, entry := range entries {
+		renumbered[entry.KeyId] = keyIds[i]
+		entry.KeyId = keyIds[i]
+		idx.keyIdMap[entry.KeyId] = entry.Key
+		idx.btree.ReplaceOrInsert(*entry)
+	}
+	keyIndex := make(map[int64]int, len(idx.expiryHeap.entries))
+	for i, e := range idx.expiryHeap.entries {
+		e.KeyId = renumbered[e.KeyId]
+		keyIndex[e.KeyId] = i
+	}
+	idx.expiryHeap.keyIndex = keyIndex
+}
+
 // Count returns the number of entries
 func (idx *Index) Count() int {
 	return idx.btree.Len()
 }
 
+// BucketEntries returns the number of entries stored in a bucket
+func (idx *Index) BucketEntries(bucket int) int {
+	return len(idx.slotIndex[bucket])
+}
+
 // GetByBucketSlot retrieves an entry by bucket and slot index
 func (idx *Index) GetByBucketSlot(bucket int, slotIdx int64) *IndexEntry {
 	key, ok := idx.slotIndex[bucket][slotIdx]
@@ -191,7 +383,7 @@ func (idx *Index) GetByBucketSlot(bucket int, slotIdx int64) *IndexEntry {
 // UpdateSlotIdx updates the slot index for an entry (used during defrag)
 func (idx *Index) UpdateSlotIdx(entry *IndexEntry, newSlotIdx int64) {
 	// Remove old slot index
-	delete(idx.slotIndex[entry.Bucket], entry.SlotIdx)
+	idx.unmapSlot(entry.Bucket, entry.SlotIdx, entry.Key)
 	// Update entry
 	entry.SlotIdx = newSlotIdx
 	// Add new slot index
@@ -202,19 +394,15 @@ func (idx *Index) UpdateSlotIdx(entry *IndexEntry, newSlotIdx int64) {
 
 // UpdateKeyId updates the keyId for an entry (used during key file defrag)
 func (idx *Index) UpdateKeyId(entry *IndexEntry, newKeyId int64) {
-	// Remove old keyId mapping
-	delete(idx.keyIdMap, entry.KeyId)
-	// Update expiry heap
-	if heapIdx, ok := idx.expiryHeap.keyIndex[entry.KeyId]; ok {
-		delete(idx.expiryHeap.keyIndex, entry.KeyId)
-		idx.expiryHeap.entries[heapIdx].KeyId = newKeyId
-		idx.expiryHeap.keyIndex[newKeyId] = heapIdx
-	}
-	// Update expiry heap
-	if heapIdx, ok := idx.expiryHeap.keyIndex[entry.KeyId]; ok {
-		delete(idx.expiryHeap.keyIndex, entry.KeyId)
-		idx.expiryHeap.entries[heapIdx].KeyId = newKeyId
-		idx.expiryHeap.keyIndex[newKeyId] = heapIdx
+	// Move the keyId mapping and expiry heap entry, unless the old keyId was
+	// given to another key since
+	if idx.keyIdMap[entry.KeyId] == entry.Key {
+		delete(idx.keyIdMap, entry.KeyId)
+		if heapIdx, ok := idx.expiryHeap.keyIndex[entry.KeyId]; ok {
+			delete(idx.expiryHeap.keyIndex, entry.KeyId)
+			idx.expiryHeap.entries[heapIdx].KeyId = newKeyId
+			idx.expiryHeap.keyIndex[newKeyId] = heapIdx
+		}
 	}
 	// Update entry
 	entry.KeyId = newKeyId
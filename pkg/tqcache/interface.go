@@ -6,20 +6,45 @@ import "time"
 // Allows server to work with the cache implementation.
 type CacheInterface interface {
 	Get(key string) ([]byte, uint64, error)
+	GetItem(key string) (*Item, error)
+	GetWithTTL(key string) ([]byte, uint64, time.Duration, error)
+	GetMulti(keys []string) (map[string]*Item, error)
+	Exists(key string) (bool, error)
 	Set(key string, value []byte, ttl time.Duration) (uint64, error)
 	Add(key string, value []byte, ttl time.Duration) (uint64, error)
 	Replace(key string, value []byte, ttl time.Duration) (uint64, error)
 	Cas(key string, value []byte, ttl time.Duration, cas uint64) (uint64, error)
+	Store(op Op) (uint64, error)
+	StoreMulti(ops []Op) []Result
 	Delete(key string) error
+	GetDelete(key string) ([]byte, uint64, error)
+	GetDeleteItem(key string) (*Item, error)
+	DeleteCas(key string, cas uint64) error
 	Touch(key string, ttl time.Duration) (uint64, error)
+	TouchCas(key string, ttl time.Duration, cas uint64) (uint64, error)
+	GetAndTouch(key string, ttl time.Duration) (*Item, error)
 	Increment(key string, delta uint64) (uint64, uint64, error)
 	Decrement(key string, delta uint64) (uint64, uint64, error)
+	IncrementInit(key string, delta, initial uint64, ttl time.Duration) (uint64, uint64, error)
+	DecrementInit(key string, delta, initial uint64, ttl time.Duration) (uint64, uint64, error)
 	Append(key string, value []byte) (uint64, error)
 	Prepend(key string, value []byte) (uint64, error)
+	AppendCas(key string, value []byte, cas uint64) (uint64, error)
+	PrependCas(key string, value []byte, cas uint64) (uint64, error)
+	Meta(key string) (*KeyMeta, error)
+	Scan(prefix, cursor string, limit int) (keys []string, nextCursor string, err error)
 	FlushAll()
+	FlushAllAfter(delay time.Duration)
 	Stats() map[string]string
+	BucketStats() ([]BucketStat, error)
+	SizeHistogram() ([]int64, error)
 	Close() error
 	GetStartTime() time.Time
+	MaxKeySize() int
+	MaxValueSize() int
+	MaxScanLimit() int
+	Ready() bool
+	SetSyncStrategy(strategy SyncStrategy) error
 }
 
 // Ensure ShardedCache implements CacheInterface
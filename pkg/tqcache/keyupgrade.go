@@ -0,0 +1,178 @@
+package tqcache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+)
+
+// Key record layouts. Later versions appended fields to the record, the
+// format file records the version of the keys file since version 4.
+const (
+	keyRecordV1      = 1 // keyLen, key, cas, expiry, bucket, slotIdx
+	keyRecordV2      = 2 // + dataType
+	keyRecordV3      = 3 // + flags
+	keyRecordVersion = 4 // + crc, the layout of KeyRecordSize
+)
+
+// keyRecordTail returns the size of the fields following the key in a
+// record of a key record version
+func keyRecordTail(version int) int {
+	switch version {
+	case keyRecordV1:
+		return 25
+	case keyRecordV2:
+		return 26
+	case keyRecordV3:
+		return 30
+	}
+	return 34
+}
+
+// upgradeKeys rewrites a keys file written with an older key record layout
+// in the current one. Keys files of data dirs that do not record their
+// version are detected from their records. A keys file that matches no
+// layout is refused and left as it is.
+func (s *Storage) upgradeKeys(format map[string]string) error {
+	size, err := s.KeysFileSize()
+	if err != nil {
+		return err
+	}
+	version := keyRecordVersion
+	stored, recorded := format["keyrecord"]
+	if recorded {
+		version, err = strconv.Atoi(stored)
+		if err != nil || version < keyRecordV1 || version > keyRecordVersion {
+			return fmt.Errorf("%w: unknown key record version %q", ErrKeyRecordLayout, stored)
+		}
+	}
+	if size == 0 || (recorded && version == keyRecordVersion) {
+		return nil
+	}
+
+	var recs []*KeyRecord
+	if recorded {
+		if recs, err = s.readKeysVersion(version, size); err != nil {
+			return fmt.Errorf("%w: keys file is not key record version %d: %v", ErrKeyRecordLayout, version, err)
+		}
+	} else {
+		if s.hasCurrentKeys() {
+			return nil // Written before the version was recorded
+		}
+		if version, recs, err = s.detectKeysVersion(size); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Upgrading key records", "file", s.keysFile.Name(), "from", version, "to", keyRecordVersion, "keys", len(recs))
+	_, _, err = s.RewriteKeys(recs)
+	return err
+}
+
+// hasCurrentKeys reports whether the first record of the keys file passes
+// the CRC of the current layout, which records of older layouts do not
+// have. A torn record further on is cut off by ScanKeyRecords as usual.
+func (s *Storage) hasCurrentKeys() bool {
+	rec, err := s.ReadKeyRecord(0)
+	return err == nil && !isUnusedKeyRecord(rec)
+}
+
+// detectKeysVersion finds the newest older key record layout the keys file
+// parses as and returns its records
+func (s *Storage) detectKeysVersion(size int64) (int, []*KeyRecord, error) {
+	var errs []error
+	for version := keyRecordV3; version >= keyRecordV1; version-- {
+		recs, err := s.readKeysVersion(version, size)
+		if err == nil {
+			return version, recs, nil
+		}
+		errs = append(errs, fmt.Errorf("version %d: %w", version, err))
+	}
+	return 0, nil, fmt.Errorf("%w: keys file matches no known key record layout (%v)", ErrKeyRecordLayout, errors.Join(errs...))
+}
+
+// readKeysVersion decodes the keys file in a key record version and returns
+// its live records. It fails when any record cannot be of that version.
+func (s *Storage) readKeysVersion(version int, size int64) ([]*KeyRecord, error) {
+	r := bufio.NewReader(io.NewSectionReader(s.keysFile, 0, size))
+	tail := keyRecordTail(version)
+	packed := s.keyFormat == KeyFormatPacked
+	if !packed && size%int64(2+MaxKeySize+tail) != 0 {
+		return nil, fmt.Errorf("size %d is not a multiple of %d", size, 2+MaxKeySize+tail)
+	}
+
+	var recs []*KeyRecord
+	for offset := int64(0); offset < size; {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(r, head); err != nil {
+			return nil, fmt.Errorf("offset %d: %w", offset, err)
+		}
+		keyArea := MaxKeySize
+		if packed {
+			keyArea = int(s.order.Uint16(head))
+		}
+		if keyArea > MaxKeySize {
+			return nil, fmt.Errorf("offset %d: invalid key length %d", offset, keyArea)
+		}
+		buf := make([]byte, 2+keyArea+tail)
+		copy(buf, head)
+		if _, err := io.ReadFull(r, buf[2:]); err != nil {
+			return nil, fmt.Errorf("offset %d: %w", offset, err)
+		}
+		rec, err := s.decodeKeyRecordVersion(buf, keyArea, version)
+		if err != nil {
+			return nil, fmt.Errorf("offset %d: %w", offset, err)
+		}
+		if !isUnusedKeyRecord(rec) && rec.Expiry != tombstoneExpiry {
+			recs = append(recs, rec)
+		}
+		offset += int64(len(buf))
+	}
+	return recs, nil
+}
+
+// decodeKeyRecordVersion decodes a record of a key record version whose key
+// takes keyArea bytes, it fails for a record that cannot be valid
+func (s *Storage) decodeKeyRecordVersion(buf []byte, keyArea, version int) (*KeyRecord, error) {
+	keyLen := int(s.order.Uint16(buf[0:2]))
+	t := buf[2+keyArea:]
+	rec := &KeyRecord{
+		KeyLen:  uint16(keyLen),
+		Cas:     s.order.Uint64(t[0:8]),
+		Expiry:  int64(s.order.Uint64(t[8:16])),
+		Bucket:  t[16],
+		SlotIdx: int64(s.order.Uint64(t[17:25])),
+	}
+	if version >= keyRecordV2 {
+		rec.DataType = t[25]
+	}
+	if version >= keyRecordV3 {
+		rec.Flags = s.order.Uint32(t[26:30])
+	}
+	if isUnusedKeyRecord(rec) {
+		return rec, nil
+	}
+
+	if keyLen == 0 || keyLen > keyArea {
+		return nil, fmt.Errorf("invalid key length %d", keyLen)
+	}
+	for _, b := range buf[2+keyLen : 2+keyArea] {
+		if b != 0 {
+			return nil, errors.New("key not zero-padded")
+		}
+	}
+	if int(rec.Bucket) >= s.layout.count || rec.SlotIdx < 0 || rec.Expiry < 0 {
+		return nil, fmt.Errorf("invalid bucket %d, slot %d or expiry %d", rec.Bucket, rec.SlotIdx, rec.Expiry)
+	}
+	if version >= keyRecordVersion {
+		rec.CRC = s.order.Uint32(t[30:34])
+		if err := checkKeyRecord(rec, buf); err != nil {
+			return nil, err
+		}
+	}
+	copy(rec.Key[:], buf[2:2+keyLen])
+	return rec, nil
+}
@@ -0,0 +1,102 @@
+package tqcache
+
+import "time"
+
+// largeRead is a get handed to a reader goroutine of the shard
+type largeRead struct {
+	req  *Request
+	resp *Response // Response without the value, filled in by the worker
+
+	// Slot of the value and the CAS of the entry when the read was handed off
+	bucket  int
+	slotIdx int64
+	cas     uint64
+
+	data []byte
+	err  error
+}
+
+// startReaders starts the reader goroutines when LargeReadThreshold is set
+func (w *Worker) startReaders() {
+	if w.LargeReadThreshold <= 0 {
+		return
+	}
+	n := w.LargeReaders
+	if n <= 0 {
+		n = DefaultLargeReaders
+	}
+	w.largeReads = make(chan *largeRead, n)
+	w.readsDone = make(chan *largeRead, n)
+	for i := 0; i < n; i++ {
+		w.wg.Add(1)
+		go w.runReader()
+	}
+}
+
+// runReader reads the values of large gets from the data files, it only
+// touches the storage with ReadDataSlotFile
+func (w *Worker) runReader() {
+	defer w.wg.Done()
+	for {
+		select {
+		case read := <-w.largeReads:
+			read.data, read.err = w.storage.ReadDataSlotFile(read.bucket, read.slotIdx)
+			select {
+			case w.readsDone <- read:
+			case <-w.stopChan:
+				return
+			}
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+// deferGet hands a get of a value in a bucket of at least LargeReadThreshold
+// to a reader. It reports false when the worker should serve the get itself:
+// for missing, expired, small or too large values, or when all readers are busy.
+func (w *Worker) deferGet(req *Request) bool {
+	entry, ok := w.liveEntry(req.Key)
+	if !ok {
+		return false
+	}
+	size := w.storage.BucketSize(entry.Bucket)
+	if size < w.LargeReadThreshold || (w.MaxResponseSize > 0 && size > w.MaxResponseSize) {
+		return false
+	}
+
+	now := time.Now().UnixMilli()
+	ttl := NoExpiry
+	if entry.Expiry > 0 {
+		ttl = time.Duration(entry.Expiry-now) * time.Millisecond
+	}
+	read := &largeRead{
+		req:     req,
+		resp:    &Response{Cas: entry.Cas, DataType: entry.DataType, Flags: entry.Flags, TTLRemaining: ttl},
+		bucket:  entry.Bucket,
+		slotIdx: entry.SlotIdx,
+		cas:     entry.Cas,
+	}
+	select {
+	case w.largeReads <- read:
+	default:
+		return false
+	}
+	w.index.MarkFetched(entry, now)
+	return true
+}
+
+// finishRead answers a get read by a reader. Slots are only rewritten with a
+// new CAS or after their entry moved, so the value is current when the entry
+// still has the slot and CAS it was read with. Otherwise the get is served again.
+func (w *Worker) finishRead(read *largeRead) {
+	resp := read.resp
+	entry, ok := w.index.Get(read.req.Key)
+	if read.err != nil || !ok || entry.Bucket != read.bucket || entry.SlotIdx != read.slotIdx || entry.Cas != read.cas {
+		resp = w.doGet(read.req.Key, false)
+	} else {
+		resp.Value = read.data
+	}
+	w.countCommand(read.req, resp)
+	read.req.RespChan <- resp
+}
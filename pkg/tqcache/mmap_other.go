@@ -0,0 +1,18 @@
+//go:build !unix
+
+package tqcache
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile is not supported on this platform, reads fall back to ReadAt
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mmap not supported")
+}
+
+// munmapFile releases a mapping made by mmapFile
+func munmapFile(m []byte) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package tqcache
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps size bytes of a file read-only into memory
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmapFile releases a mapping made by mmapFile
+func munmapFile(m []byte) error {
+	return syscall.Munmap(m)
+}
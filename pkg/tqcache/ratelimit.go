@@ -0,0 +1,28 @@
+package tqcache
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// RateLimit counts a request against key in the current fixed window of the
+// given length and reports whether it is within limit. Windows are aligned to
+// the Unix epoch, each has its own counter that is created with the window
+// length as TTL, so it expires on its own. remaining is the number of requests
+// still allowed in the window.
+func (sc *ShardedCache) RateLimit(key string, limit uint64, window time.Duration) (allowed bool, remaining uint64, err error) {
+	if window <= 0 {
+		return false, 0, errors.New("rate limit window must be positive")
+	}
+	windowKey := key + ":" + strconv.FormatInt(time.Now().UnixNano()/int64(window), 10)
+
+	count, _, err := sc.IncrementInit(windowKey, 1, 1, window)
+	if err != nil {
+		return false, 0, err
+	}
+	if count > limit {
+		return false, 0, nil
+	}
+	return true, limit - count, nil
+}
@@ -0,0 +1,141 @@
+package tqcache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultReplicaInterval is how often a started ReplicaClient reads the logs
+const DefaultReplicaInterval = 100 * time.Millisecond
+
+// ReplicaClient tails the write-ahead logs of a primary with
+// Config.ReplicationEnabled and applies them to a follower. The follower must
+// have the same number of shards, the log of each primary shard is applied to
+// the same follower shard, so records of one shard stay in order.
+//
+// Positions are kept in memory only: a new client replays the logs from the
+// start, which converges to the same state as records describe the state of a
+// key rather than a change to it. A log replaced by a checkpoint is replayed
+// from its start as well, the checkpoint begins with a flush.
+type ReplicaClient struct {
+	dataDir  string
+	follower *ShardedCache
+
+	mu      sync.Mutex            // Serializes Sync
+	offsets []int64               // Applied bytes of the log of each shard
+	heads   [][walHeaderSize]byte // First record header of the log of each shard
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewReplicaClient creates a client applying the logs in the primary's
+// dataDir to follower
+func NewReplicaClient(dataDir string, follower *ShardedCache) *ReplicaClient {
+	return &ReplicaClient{
+		dataDir:  dataDir,
+		follower: follower,
+		offsets:  make([]int64, len(follower.workers)),
+		heads:    make([][walHeaderSize]byte, len(follower.workers)),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Sync applies the records written to the logs since the last call. A record
+// that is still being written is left for the next call.
+func (rc *ReplicaClient) Sync() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	// The shard of a key depends on the shard count
+	if _, err := os.Stat(shardPath(rc.dataDir, len(rc.offsets)-1)); err != nil {
+		return fmt.Errorf("primary has fewer than %d shards: %w", len(rc.offsets), err)
+	}
+	if _, err := os.Stat(shardPath(rc.dataDir, len(rc.offsets))); err == nil {
+		return fmt.Errorf("primary has more than %d shards", len(rc.offsets))
+	}
+	for i := range rc.offsets {
+		if err := rc.syncShard(i); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// syncShard applies the new records of the log of shard i
+func (rc *ReplicaClient) syncShard(i int) error {
+	f, err := os.Open(filepath.Join(shardPath(rc.dataDir, i), WALFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// A checkpoint starts with a record of its own, a log that starts with
+	// another record than before has been replaced by a checkpoint
+	var head [walHeaderSize]byte
+	if _, err := f.ReadAt(head[:], 0); err != nil && err != io.EOF {
+		return err
+	}
+	if head != rc.heads[i] {
+		rc.offsets[i] = 0
+		rc.heads[i] = head
+	}
+	if info.Size() < rc.offsets[i] {
+		return fmt.Errorf("log shrank from %d to %d bytes", rc.offsets[i], info.Size())
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(f, rc.offsets[i], info.Size()-rc.offsets[i]))
+	for {
+		rec, n, err := ReadWALRecord(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if resp := rc.follower.sendRequest(i, &Request{Op: OpApplyWAL, WAL: rec}); resp.Err != nil {
+			return resp.Err
+		}
+		rc.offsets[i] += n
+	}
+}
+
+// Start applies new records every interval in the background until Stop
+// (0 = DefaultReplicaInterval). Failures are retried on the next interval.
+func (rc *ReplicaClient) Start(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultReplicaInterval
+	}
+	rc.wg.Add(1)
+	go func() {
+		defer rc.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rc.Sync()
+			case <-rc.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background applying started by Start
+func (rc *ReplicaClient) Stop() {
+	close(rc.stopChan)
+	rc.wg.Wait()
+}
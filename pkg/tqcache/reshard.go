@@ -0,0 +1,136 @@
+package tqcache
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// reshardDirName is the dir in DataDir that holds the shards of the old
+// layout while their keys move to a new shard count. An interrupted move
+// leaves it in place and the next start begins again from it.
+const reshardDirName = "resharding"
+
+// reshardTmpDirName is the dir the shard dirs are moved into one by one,
+// before it is renamed to reshardDirName in one step. A crash halfway leaves
+// it in place and the next start moves its shard dirs back.
+const reshardTmpDirName = "resharding.tmp"
+
+// shardDirCount returns the number of shard dirs in dataDir, counting from
+// shard_00 up to the first one missing
+func shardDirCount(dataDir string) int {
+	n := 0
+	for {
+		info, err := os.Stat(shardPath(dataDir, n))
+		if err != nil || !info.IsDir() {
+			return n
+		}
+		n++
+	}
+}
+
+// prepareReshard moves the shard dirs aside when DataDir was written with a
+// different shard count and returns that count (0 = nothing to move). The
+// shard dirs of an interrupted move are incomplete and are removed.
+func prepareReshard(dataDir string, shardCount int, dirMode os.FileMode) (int, error) {
+	oldDir := filepath.Join(dataDir, reshardDirName)
+	tmpDir := filepath.Join(dataDir, reshardTmpDirName)
+	if _, err := os.Stat(tmpDir); err == nil {
+		// Moved back from the last one, so both dirs keep an unbroken
+		// sequence of shard dirs should this be interrupted too
+		for i := shardDirCount(tmpDir) - 1; i >= 0; i-- {
+			if err := os.Rename(shardPath(tmpDir, i), shardPath(dataDir, i)); err != nil {
+				return 0, err
+			}
+		}
+		if err := os.Remove(tmpDir); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := os.Stat(oldDir); err == nil {
+		for i := shardDirCount(dataDir) - 1; i >= 0; i-- {
+			if err := os.RemoveAll(shardPath(dataDir, i)); err != nil {
+				return 0, err
+			}
+		}
+		return shardDirCount(oldDir), nil
+	}
+
+	oldCount := shardDirCount(dataDir)
+	if oldCount == 0 || oldCount == shardCount {
+		return 0, nil
+	}
+	if err := os.Mkdir(tmpDir, dirMode); err != nil {
+		return 0, err
+	}
+	for i := 0; i < oldCount; i++ {
+		if err := os.Rename(shardPath(dataDir, i), shardPath(tmpDir, i)); err != nil {
+			return 0, err
+		}
+	}
+	if err := os.Rename(tmpDir, oldDir); err != nil {
+		return 0, err
+	}
+	return oldCount, nil
+}
+
+// reshard copies the items of the oldCount shards moved aside by
+// prepareReshard into the shards of sc and removes the old shards. Like
+// Restore, items keep their flags, data type hint and expiry, but not their
+// CAS tokens.
+func (sc *ShardedCache) reshard(oldCount int) error {
+	oldDir := filepath.Join(sc.config.DataDir, reshardDirName)
+	slog.Info("Resharding", "from", oldCount, "to", len(sc.workers))
+
+	oldCfg := sc.config
+	oldCfg.DataDir = oldDir
+	oldCfg.SyncStrategy = SyncNone
+	oldCfg.MaxDataSize = 0
+	oldCfg.CompactionRatio = 0
+	oldCfg.OnEvict = nil
+	oldCfg.SetGOMAXPROCS = false
+	old, err := NewSharded(oldCfg, oldCount)
+	if err != nil {
+		return fmt.Errorf("failed to open the %d old shards: %w", oldCount, err)
+	}
+
+	moved := 0
+	err = old.Snapshot(func(item *SnapshotItem) error {
+		req := &Request{
+			Op:       OpSet,
+			Key:      item.Key, // Normalized when it was stored
+			Value:    item.Value,
+			DataType: item.DataType,
+			Flags:    item.Flags,
+		}
+		if item.Expiry > 0 {
+			req.TTL = time.Until(time.UnixMilli(item.Expiry))
+			if req.TTL <= 0 {
+				return nil // Expired
+			}
+		}
+		if resp := sc.sendRequest(sc.shardFor(item.Key), req); resp.Err != nil {
+			return fmt.Errorf("failed to move %s: %w", item.Key, resp.Err)
+		}
+		moved++
+		return nil
+	})
+	if closeErr := old.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// The old shards are only removed once the new ones are on disk
+	if err := sc.Sync(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(oldDir); err != nil {
+		return err
+	}
+	slog.Info("Resharded", "from", oldCount, "to", len(sc.workers), "items", moved)
+	return nil
+}
@@ -1,104 +1,310 @@
 package tqcache
 
 import (
+	"bytes"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// PingTimeout is how long Ping waits for a worker to answer
+const PingTimeout = time.Second
+
 // ShardedCache wraps multiple Worker instances for concurrent access.
 // Keys are distributed across shards using FNV-1a hash.
 // Each shard is operated by a dedicated goroutine, eliminating lock contention.
 type ShardedCache struct {
-	workers   []*Worker
-	config    Config
-	syncChan  chan int // Channel for sync requests (worker index)
-	stopSync  chan struct{}
-	StartTime time.Time
+	workers    []*Worker
+	shardLocks []sync.RWMutex // Held for writing while a shard is reloaded
+	config     Config
+	maxValue   int             // MaxValueSize or else the largest bucket
+	syncChan   chan int        // Channel for sync requests (worker index)
+	evictChan  chan evictEvent // Events for Config.OnEvict (nil = no hook)
+	evictDone  chan struct{}   // Closed when the hook goroutine is done
+	StartTime  time.Time
+
+	// The sync strategy can change at runtime, see SetSyncStrategy
+	syncMu       sync.Mutex    // Serializes strategy changes
+	stopSync     chan struct{} // Stops runSyncWorker (nil = not running)
+	syncStrategy atomic.Int32
+
+	// Global accounting of value bytes buffered in request channels
+	bufMu         sync.Mutex
+	bufCond       *sync.Cond
+	bufferedBytes int64
+	peakBuffered  int64
+
+	// Per-shard in-flight gets for request coalescing
+	inflightMu []sync.Mutex
+	inflight   []map[string]*inflightGet
+
+	recovering atomic.Int32 // Shards currently being (re)opened and recovered
+
+	breakers []breaker // Per-shard circuit breakers (nil = disabled)
+
+	// In-flight loader calls of GetOrLoad
+	loadMu  sync.Mutex
+	loading map[string]*inflightGet
+}
+
+// inflightGet is a get request shared by concurrent callers of the same key
+type inflightGet struct {
+	done  chan struct{}
+	value []byte
+	cas   uint64
+	err   error
 }
 
 // NewSharded creates a new sharded cache with the number of shards from config.
 // Each shard gets its own subfolder (shard_00, shard_01, ...) and a dedicated worker goroutine.
+// Data written with another number of shards is moved to the new shards first.
 func NewSharded(cfg Config, shardCount int) (*ShardedCache, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 	if shardCount <= 0 {
 		shardCount = DefaultShardCount
 	}
 
 	// Set GOMAXPROCS for optimal parallelism: max(min(cpucount,shards/4), 1)
-	gomaxprocs := runtime.NumCPU()
-	if gomaxprocs > shardCount/4 {
-		gomaxprocs = shardCount / 4
-	}
-	if gomaxprocs < 1 {
-		gomaxprocs = 1
+	if cfg.SetGOMAXPROCS {
+		gomaxprocs := runtime.NumCPU()
+		if gomaxprocs > shardCount/4 {
+			gomaxprocs = shardCount / 4
+		}
+		if gomaxprocs < 1 {
+			gomaxprocs = 1
+		}
+		runtime.GOMAXPROCS(gomaxprocs)
 	}
-	runtime.GOMAXPROCS(gomaxprocs)
 
 	sc := &ShardedCache{
-		workers:   make([]*Worker, shardCount),
-		config:    cfg,
-		syncChan:  make(chan int, shardCount*2), // Buffered to avoid blocking workers
-		stopSync:  make(chan struct{}),
-		StartTime: time.Now(),
+		workers:    make([]*Worker, shardCount),
+		shardLocks: make([]sync.RWMutex, shardCount),
+		config:     cfg,
+		maxValue:   cfg.MaxValueSize,
+		syncChan:   make(chan int, shardCount*2), // Buffered to avoid blocking workers
+		StartTime:  time.Now(),
+		loading:    make(map[string]*inflightGet),
+	}
+	if sc.maxValue == 0 {
+		sc.maxValue, _ = cfg.largestBucket() // Validated above
+	}
+	sc.bufCond = sync.NewCond(&sc.bufMu)
+	sc.syncStrategy.Store(int32(cfg.SyncStrategy))
+	if cfg.OnEvict != nil {
+		sc.evictChan = make(chan evictEvent, evictQueueSize)
+		sc.evictDone = make(chan struct{})
+	}
+	sc.recovering.Store(int32(shardCount))
+	if cfg.BreakerThreshold > 0 {
+		sc.breakers = make([]breaker, shardCount)
+		for i := range sc.breakers {
+			sc.breakers[i].state = breakerClosed
+		}
+		if sc.config.BreakerCooldown <= 0 {
+			sc.config.BreakerCooldown = DefaultBreakerCooldown
+		}
+	}
+	if cfg.CoalesceGets {
+		sc.inflightMu = make([]sync.Mutex, shardCount)
+		sc.inflight = make([]map[string]*inflightGet, shardCount)
+		for i := range sc.inflight {
+			sc.inflight[i] = make(map[string]*inflightGet)
+		}
+	}
+
+	// Keys are hashed to a shard by the shard count, so a DataDir written
+	// with another count is moved to the new shards
+	if sc.config.DirMode == 0 {
+		sc.config.DirMode = DefaultDirMode
+	}
+	oldCount, err := prepareReshard(cfg.DataDir, shardCount, sc.config.DirMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare resharding: %w", err)
 	}
 
 	// Create a worker for each shard
 	for i := 0; i < shardCount; i++ {
-		shardDir := filepath.Join(cfg.DataDir, fmt.Sprintf("shard_%02d", i))
-		if err := os.MkdirAll(shardDir, 0755); err != nil {
+		worker, err := sc.openShard(i)
+		if err != nil {
 			// Cleanup on failure
 			for j := 0; j < i; j++ {
 				sc.workers[j].Close()
 			}
-			return nil, fmt.Errorf("failed to create shard dir %d: %w", i, err)
+			return nil, err
 		}
+		sc.workers[i] = worker
+		sc.recovering.Add(-1)
+	}
 
-		// Create storage for this shard
-		storage, err := NewStorage(shardDir, cfg.SyncStrategy == SyncAlways)
-		if err != nil {
-			for j := 0; j < i; j++ {
-				sc.workers[j].Close()
+	if oldCount > 0 {
+		if err := sc.reshard(oldCount); err != nil {
+			for _, worker := range sc.workers {
+				worker.Close()
 			}
-			return nil, fmt.Errorf("failed to create storage for shard %d: %w", i, err)
+			return nil, fmt.Errorf("failed to reshard from %d to %d shards: %w", oldCount, shardCount, err)
 		}
+	}
 
-		worker, err := NewWorker(storage, cfg.DefaultTTL, cfg.MaxTTL, cfg.ChannelCapacity)
-		if err != nil {
-			storage.Close()
-			for j := 0; j < i; j++ {
-				sc.workers[j].Close()
+	// Start sync worker if periodic
+	if cfg.SyncStrategy == SyncPeriodic {
+		sc.startSyncWorker()
+	}
+	if sc.evictChan != nil {
+		go sc.evictLoop()
+	}
+
+	return sc, nil
+}
+
+// openShard opens the storage of shard i, recovers it and starts its worker.
+func (sc *ShardedCache) openShard(i int) (*Worker, error) {
+	cfg := sc.config
+	strategy := sc.SyncStrategy()
+	shardDir := shardPath(cfg.DataDir, i)
+	if err := os.MkdirAll(shardDir, cfg.DirMode); err != nil {
+		return nil, fmt.Errorf("failed to create shard dir %d: %w", i, err)
+	}
+
+	// Create storage for this shard
+	storage, err := NewStorage(shardDir, StorageOptions{
+		SyncAlways: strategy == SyncAlways,
+		ByteOrder:  cfg.ByteOrder,
+		KeyFormat:  cfg.KeyFormat,
+
+		Compression:          cfg.Compression,
+		CompressionThreshold: cfg.CompressionThreshold,
+		UseMmap:              cfg.UseMmap,
+		DirMode:              cfg.DirMode,
+		FileMode:             cfg.FileMode,
+
+		InitialKeysCapacity:   cfg.InitialKeysCapacity,
+		InitialSlotsPerBucket: cfg.InitialSlotsPerBucket,
+
+		BucketMinSize:      cfg.BucketMinSize,
+		BucketGrowthFactor: cfg.BucketGrowthFactor,
+		BucketCount:        cfg.BucketCount,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage for shard %d: %w", i, err)
+	}
+
+	worker, err := NewWorker(storage, cfg.DefaultTTL, cfg.MaxTTL, cfg.ChannelCapacity)
+	if err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to create worker for shard %d: %w", i, err)
+	}
+
+	if cfg.ReplicationEnabled {
+		worker.WALCheckpointSize = cfg.WALCheckpointSize
+		if err := worker.openWAL(filepath.Join(shardDir, WALFileName)); err != nil {
+			worker.Close()
+			return nil, fmt.Errorf("failed to open write-ahead log for shard %d: %w", i, err)
+		}
+	}
+
+	worker.MaxResponseSize = cfg.MaxResponseSize
+	worker.MaxDataSize = cfg.MaxDataSize / int64(len(sc.workers))
+	worker.EvictionPolicy = cfg.EvictionPolicy
+	if cfg.EvictionPolicy == EvictionNone && cfg.MaxDataSize > 0 {
+		worker.EvictionPolicy = EvictionSampled
+	}
+	worker.EvictionSamples = cfg.EvictionSamples
+	worker.MaxValueSize = cfg.MaxValueSize
+	worker.MaxKeySize = cfg.MaxKeySize
+	worker.EvictionGrace = cfg.EvictionGrace
+	worker.CompactionRatio = cfg.CompactionRatio
+	worker.ExpirySweepInterval = cfg.ExpirySweepInterval
+	worker.ServeStale = cfg.ServeStale
+	worker.IdleTimeout = cfg.IdleTimeout
+	worker.LargeReadThreshold = cfg.LargeReadThreshold
+	worker.LargeReaders = cfg.LargeReaders
+	if sc.evictChan != nil {
+		worker.SetEvictNotify(func(key string, reason EvictReason) {
+			// Non-blocking send, the event is dropped when the hook falls behind
+			select {
+			case sc.evictChan <- evictEvent{key: key, reason: reason}:
+			default:
 			}
-			return nil, fmt.Errorf("failed to create worker for shard %d: %w", i, err)
-		}
-
-		// Set up sync notification for periodic mode
-		if cfg.SyncStrategy == SyncPeriodic {
-			workerIdx := i // Capture for closure
-			worker.SetSyncInterval(cfg.SyncInterval)
-			worker.SetSyncNotify(func() {
-				// Non-blocking send to sync channel
-				select {
-				case sc.syncChan <- workerIdx:
-				default:
-					// Channel full, sync already pending
-				}
-			})
+		})
+	}
+	worker.PersistState = cfg.PersistDerivedState
+	if cfg.PersistDerivedState {
+		worker.loadState()
+	}
+	if cfg.EvictionPolicy == EvictionLRU || cfg.IdleTimeout > 0 {
+		worker.Index().EnableLRU()
+	}
+
+	// Set up sync notification for periodic mode, paused in the other modes
+	// so SetSyncStrategy can switch to it
+	interval := cfg.SyncInterval
+	if cfg.ShardSyncInterval != nil {
+		if d := cfg.ShardSyncInterval(i); d > 0 {
+			interval = d
 		}
+	}
+	worker.SetSyncInterval(interval)
+	worker.SetSyncNotify(func() {
+		// Non-blocking send to sync channel
+		select {
+		case sc.syncChan <- i:
+		default:
+			// Channel full, sync already pending
+		}
+	})
+	worker.syncPaused = strategy != SyncPeriodic
 
-		// Start the worker goroutine
-		worker.Start()
-		sc.workers[i] = worker
+	// Start the worker goroutine
+	worker.Start()
+	return worker, nil
+}
+
+// ReloadShard stops the worker of shard i, closes and reopens its storage
+// (re-running recovery) and restarts it. Requests for the shard block until
+// the reload is done, other shards keep serving.
+func (sc *ShardedCache) ReloadShard(i int) error {
+	if i < 0 || i >= len(sc.workers) {
+		return fmt.Errorf("invalid shard %d", i)
 	}
 
-	// Start sync worker if periodic
-	if cfg.SyncStrategy == SyncPeriodic {
-		go sc.runSyncWorker()
+	sc.recovering.Add(1)
+	defer sc.recovering.Add(-1)
+
+	sc.shardLocks[i].Lock()
+	defer sc.shardLocks[i].Unlock()
+
+	if err := sc.workers[i].Close(); err != nil {
+		return fmt.Errorf("failed to close shard %d: %w", i, err)
+	}
+	worker, err := sc.openShard(i)
+	if err != nil {
+		return err
 	}
+	sc.workers[i] = worker
+	return nil
+}
 
-	return sc, nil
+// shardPath returns the dir of shard i in dataDir
+func shardPath(dataDir string, i int) string {
+	return filepath.Join(dataDir, fmt.Sprintf("shard_%02d", i))
+}
+
+// normalize applies Config.KeyNormalizer to a key before hashing and storage
+func (sc *ShardedCache) normalize(key string) string {
+	if sc.config.KeyNormalizer == nil {
+		return key
+	}
+	return sc.config.KeyNormalizer(key)
 }
 
 // shardFor returns the shard index for the given key using FNV-1a hash.
@@ -108,25 +314,131 @@ func (sc *ShardedCache) shardFor(key string) int {
 	return int(h.Sum32()) % len(sc.workers)
 }
 
-// runSyncWorker processes sync requests from workers
-func (sc *ShardedCache) runSyncWorker() {
+// SyncStrategy returns the current sync strategy
+func (sc *ShardedCache) SyncStrategy() SyncStrategy {
+	return SyncStrategy(sc.syncStrategy.Load())
+}
+
+// SetSyncStrategy changes the sync strategy without a restart, for example to
+// import data with SyncNone and return to SyncPeriodic afterwards. Switching
+// to SyncPeriodic or SyncAlways first syncs what was written so far.
+func (sc *ShardedCache) SetSyncStrategy(strategy SyncStrategy) error {
+	switch strategy {
+	case SyncNone, SyncAlways, SyncPeriodic:
+	default:
+		return fmt.Errorf("invalid sync strategy %d", strategy)
+	}
+
+	sc.syncMu.Lock()
+	defer sc.syncMu.Unlock()
+
+	sc.syncStrategy.Store(int32(strategy))
+	if strategy == SyncPeriodic {
+		sc.startSyncWorker()
+	} else {
+		sc.stopSyncWorker()
+	}
+	var err error
+	for i := range sc.workers {
+		if resp := sc.sendRequest(i, &Request{Op: OpSetSyncStrategy, SyncStrategy: strategy}); resp.Err != nil && err == nil {
+			err = fmt.Errorf("shard %d: %w", i, resp.Err)
+		}
+	}
+	return err
+}
+
+// startSyncWorker starts runSyncWorker if it is not running, syncMu must be
+// held unless the cache is being created
+func (sc *ShardedCache) startSyncWorker() {
+	if sc.stopSync == nil {
+		sc.stopSync = make(chan struct{})
+		go sc.runSyncWorker(sc.stopSync)
+	}
+}
+
+// stopSyncWorker stops runSyncWorker if it is running, syncMu must be held
+func (sc *ShardedCache) stopSyncWorker() {
+	if sc.stopSync != nil {
+		close(sc.stopSync)
+		sc.stopSync = nil
+	}
+}
+
+// runSyncWorker processes sync requests from workers until stop is closed
+func (sc *ShardedCache) runSyncWorker(stop chan struct{}) {
 	for {
 		select {
 		case workerIdx := <-sc.syncChan:
+			sc.shardLocks[workerIdx].RLock()
 			worker := sc.workers[workerIdx]
 			worker.Sync()
 			worker.MarkSynced()
-		case <-sc.stopSync:
+			sc.shardLocks[workerIdx].RUnlock()
+		case <-stop:
 			return
 		}
 	}
 }
 
+// Sync writes all shards to disk, regardless of the SyncStrategy. Each worker
+// syncs between two requests.
+func (sc *ShardedCache) Sync() error {
+	var err error
+	for i := range sc.workers {
+		if resp := sc.sendRequest(i, &Request{Op: OpSync}); resp.Err != nil && err == nil {
+			err = fmt.Errorf("shard %d: %w", i, resp.Err)
+		}
+	}
+	return err
+}
+
+// Ping sends a no-op request to every worker, it returns ErrNotReady while
+// shards are recovered and ErrBusy for a shard that does not answer within
+// PingTimeout.
+func (sc *ShardedCache) Ping() error {
+	if !sc.Ready() {
+		return ErrNotReady
+	}
+	errs := make(chan error, len(sc.workers))
+	for i := range sc.workers {
+		go func(i int) { errs <- sc.ping(i) }(i)
+	}
+	var err error
+	for range sc.workers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ping round-trips a no-op request through the worker of shard i
+func (sc *ShardedCache) ping(i int) error {
+	timeout := time.NewTimer(PingTimeout)
+	defer timeout.Stop()
+
+	sc.shardLocks[i].RLock()
+	defer sc.shardLocks[i].RUnlock()
+
+	req := &Request{Op: OpNoop, RespChan: make(chan *Response, 1)}
+	select {
+	case sc.workers[i].RequestChan() <- req:
+	case <-timeout.C:
+		return fmt.Errorf("shard %d: %w", i, ErrBusy)
+	}
+	select {
+	case <-req.RespChan:
+		return nil
+	case <-timeout.C:
+		return fmt.Errorf("shard %d: %w", i, ErrBusy)
+	}
+}
+
 // Close closes all workers.
 func (sc *ShardedCache) Close() error {
-	if sc.config.SyncStrategy == SyncPeriodic {
-		close(sc.stopSync)
-	}
+	sc.syncMu.Lock()
+	sc.stopSyncWorker()
+	sc.syncMu.Unlock()
 
 	var err error
 	for _, worker := range sc.workers {
@@ -134,18 +446,161 @@ func (sc *ShardedCache) Close() error {
 			err = e
 		}
 	}
+	if sc.evictChan != nil {
+		close(sc.evictChan)
+		<-sc.evictDone
+	}
 	return err
 }
 
+// evictQueueSize is the number of OnEvict events buffered for the hook
+const evictQueueSize = 1024
+
+// evictEvent is a key dropped by expiry or eviction
+type evictEvent struct {
+	key    string
+	reason EvictReason
+}
+
+// evictLoop calls the OnEvict hook for queued events until Close
+func (sc *ShardedCache) evictLoop() {
+	defer close(sc.evictDone)
+	for ev := range sc.evictChan {
+		sc.config.OnEvict(ev.key, ev.reason)
+	}
+}
+
 // sendRequest sends a request to the appropriate worker and waits for response.
 func (sc *ShardedCache) sendRequest(shardIdx int, req *Request) *Response {
+	if sc.breakers != nil {
+		b := &sc.breakers[shardIdx]
+		if err := b.allow(sc.config.BreakerCooldown); err != nil {
+			return &Response{Err: err}
+		}
+		resp := sc.dispatch(shardIdx, req)
+		b.record(resp.Err, sc.config.BreakerThreshold)
+		return resp
+	}
+	return sc.dispatch(shardIdx, req)
+}
+
+// dispatch sends a request to a worker and waits for the response.
+func (sc *ShardedCache) dispatch(shardIdx int, req *Request) *Response {
+	var deadline time.Time
+	if sc.config.RequestTimeout > 0 {
+		deadline = time.Now().Add(sc.config.RequestTimeout)
+	}
+	size := int64(len(req.Value))
+	for _, op := range req.Batch {
+		size += int64(len(op.Value))
+	}
+	if !sc.acquireBuffer(size, deadline) {
+		return &Response{Err: ErrBusy}
+	}
+	// The worker returns the budget when it takes the request, so a request
+	// that timed out keeps it for as long as it is queued
+	if sc.config.MaxBufferedBytes > 0 && size > 0 {
+		req.release = func() { sc.releaseBuffer(size) }
+	}
+
+	sc.shardLocks[shardIdx].RLock()
+	defer sc.shardLocks[shardIdx].RUnlock()
+
 	req.RespChan = make(chan *Response, 1)
-	sc.workers[shardIdx].RequestChan() <- req
-	return <-req.RespChan
+	if deadline.IsZero() {
+		sc.workers[shardIdx].RequestChan() <- req
+		return <-req.RespChan
+	}
+
+	// The worker may still process a request after it timed out, so it must
+	// not share the caller's value buffer
+	if req.Value != nil {
+		req.Value = bytes.Clone(req.Value)
+	}
+	if req.Batch != nil {
+		batch := make([]Op, len(req.Batch))
+		for i, op := range req.Batch {
+			op.Value = bytes.Clone(op.Value)
+			batch[i] = op
+		}
+		req.Batch = batch
+	}
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+	select {
+	case sc.workers[shardIdx].RequestChan() <- req:
+	case <-timeout.C:
+		req.taken() // Never queued
+		return &Response{Err: ErrBusy}
+	}
+	select {
+	case resp := <-req.RespChan:
+		return resp
+	case <-timeout.C:
+		return &Response{Err: ErrBusy}
+	}
+}
+
+// acquireBuffer blocks until size bytes fit in the global buffer budget, or
+// returns false when the deadline passes first (zero = no deadline). A
+// request larger than the whole budget is admitted when nothing else is
+// buffered.
+func (sc *ShardedCache) acquireBuffer(size int64, deadline time.Time) bool {
+	if sc.config.MaxBufferedBytes <= 0 || size == 0 {
+		return true
+	}
+	sc.bufMu.Lock()
+	defer sc.bufMu.Unlock()
+	full := func() bool {
+		return sc.bufferedBytes > 0 && sc.bufferedBytes+size > sc.config.MaxBufferedBytes
+	}
+	if full() && !deadline.IsZero() {
+		// A sync.Cond cannot time out, wake the wait at the deadline instead
+		wake := time.AfterFunc(time.Until(deadline), func() {
+			sc.bufMu.Lock()
+			sc.bufCond.Broadcast()
+			sc.bufMu.Unlock()
+		})
+		defer wake.Stop()
+	}
+	for full() {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return false
+		}
+		sc.bufCond.Wait()
+	}
+	sc.bufferedBytes += size
+	if sc.bufferedBytes > sc.peakBuffered {
+		sc.peakBuffered = sc.bufferedBytes
+	}
+	return true
+}
+
+// releaseBuffer returns size bytes to the global buffer budget.
+func (sc *ShardedCache) releaseBuffer(size int64) {
+	if sc.config.MaxBufferedBytes <= 0 || size == 0 {
+		return
+	}
+	sc.bufMu.Lock()
+	sc.bufferedBytes -= size
+	sc.bufMu.Unlock()
+	sc.bufCond.Broadcast()
+}
+
+// BufferedBytes returns the current and peak value bytes buffered in request channels.
+// Only tracked when MaxBufferedBytes is set.
+func (sc *ShardedCache) BufferedBytes() (current, peak int64) {
+	sc.bufMu.Lock()
+	defer sc.bufMu.Unlock()
+	return sc.bufferedBytes, sc.peakBuffered
 }
 
 // Get retrieves a value from the cache.
 func (sc *ShardedCache) Get(key string) ([]byte, uint64, error) {
+	key = sc.normalize(key)
+	if sc.config.CoalesceGets {
+		return sc.coalescedGet(sc.shardFor(key), key)
+	}
 	resp := sc.sendRequest(sc.shardFor(key), &Request{
 		Op:  OpGet,
 		Key: key,
@@ -153,8 +608,186 @@ func (sc *ShardedCache) Get(key string) ([]byte, uint64, error) {
 	return resp.Value, resp.Cas, resp.Err
 }
 
+// GetStale retrieves a value like Get, with Config.ServeStale it also returns
+// a value up to that long past its expiry, with expired set.
+func (sc *ShardedCache) GetStale(key string) (value []byte, cas uint64, expired bool, err error) {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:    OpGet,
+		Key:   key,
+		Stale: true,
+	})
+	return resp.Value, resp.Cas, resp.Expired, resp.Err
+}
+
+// GetItem retrieves a value with its CAS token, data type hint and client flags.
+func (sc *ShardedCache) GetItem(key string) (*Item, error) {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:  OpGet,
+		Key: key,
+	})
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &Item{Value: resp.Value, Cas: resp.Cas, DataType: resp.DataType, Flags: resp.Flags, TTL: resp.TTLRemaining}, nil
+}
+
+// GetWithTTL retrieves a value with its CAS token and remaining TTL, which is
+// NoExpiry for a value that does not expire.
+func (sc *ShardedCache) GetWithTTL(key string) ([]byte, uint64, time.Duration, error) {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:  OpGet,
+		Key: key,
+	})
+	return resp.Value, resp.Cas, resp.TTLRemaining, resp.Err
+}
+
+// GetMulti retrieves several keys at once, missing keys are left out of the result.
+// Keys of the same shard are read in one worker turn, so their values and CAS
+// tokens form a consistent point-in-time view within the shard.
+func (sc *ShardedCache) GetMulti(keys []string) (map[string]*Item, error) {
+	// Results are keyed by the keys as given, not their normalized form
+	var original map[string][]string
+	if sc.config.KeyNormalizer != nil {
+		original = make(map[string][]string, len(keys))
+		normalized := make([]string, len(keys))
+		for i, key := range keys {
+			normalized[i] = sc.normalize(key)
+			original[normalized[i]] = append(original[normalized[i]], key)
+		}
+		keys = normalized
+	}
+
+	shardKeys := make(map[int][]string)
+	for _, key := range keys {
+		shardIdx := sc.shardFor(key)
+		shardKeys[shardIdx] = append(shardKeys[shardIdx], key)
+	}
+
+	// Query the shards in parallel
+	resps := make(chan *Response, len(shardKeys))
+	for shardIdx, keys := range shardKeys {
+		go func(shardIdx int, keys []string) {
+			resps <- sc.sendRequest(shardIdx, &Request{
+				Op:   OpGetMulti,
+				Keys: keys,
+			})
+		}(shardIdx, keys)
+	}
+
+	items := make(map[string]*Item, len(keys))
+	var err error
+	for range shardKeys {
+		resp := <-resps
+		if resp.Err != nil {
+			if err == nil {
+				err = resp.Err
+			}
+			continue
+		}
+		for key, item := range resp.Items {
+			if original == nil {
+				items[key] = item
+				continue
+			}
+			for _, orig := range original[key] {
+				items[orig] = item
+			}
+		}
+	}
+	return items, err
+}
+
+// coalescedGet joins an in-flight get for the same key or starts a new one.
+// Callers that join receive their own copy of the value.
+func (sc *ShardedCache) coalescedGet(shardIdx int, key string) ([]byte, uint64, error) {
+	sc.inflightMu[shardIdx].Lock()
+	if call, ok := sc.inflight[shardIdx][key]; ok {
+		sc.inflightMu[shardIdx].Unlock()
+		<-call.done
+		var value []byte
+		if call.value != nil {
+			value = make([]byte, len(call.value))
+			copy(value, call.value)
+		}
+		return value, call.cas, call.err
+	}
+	call := &inflightGet{done: make(chan struct{})}
+	sc.inflight[shardIdx][key] = call
+	sc.inflightMu[shardIdx].Unlock()
+
+	resp := sc.sendRequest(shardIdx, &Request{
+		Op:  OpGet,
+		Key: key,
+	})
+	call.value, call.cas, call.err = resp.Value, resp.Cas, resp.Err
+
+	sc.inflightMu[shardIdx].Lock()
+	delete(sc.inflight[shardIdx], key)
+	sc.inflightMu[shardIdx].Unlock()
+	close(call.done)
+
+	return call.value, call.cas, call.err
+}
+
+// GetOrLoad returns the cached value of key or, on a miss, calls loader and
+// stores its result with ttl (read-through). Concurrent misses for the same
+// key share one loader call. loaded reports whether this call ran the loader:
+// it is false on a cache hit and for callers that waited for another caller's
+// load (they receive the same value), so hits plus loads count every request once.
+// When the loader panics, the panic goes on in the caller that ran it and the
+// waiting callers get ErrLoaderPanic.
+func (sc *ShardedCache) GetOrLoad(key string, ttl time.Duration, loader func(key string) ([]byte, error)) (value []byte, cas uint64, loaded bool, err error) {
+	key = sc.normalize(key)
+	value, cas, err = sc.Get(key)
+	if err != ErrKeyNotFound {
+		return value, cas, false, err
+	}
+
+	sc.loadMu.Lock()
+	if call, ok := sc.loading[key]; ok {
+		sc.loadMu.Unlock()
+		<-call.done
+		if call.value != nil {
+			value = make([]byte, len(call.value))
+			copy(value, call.value)
+		}
+		return value, call.cas, false, call.err
+	}
+	call := &inflightGet{done: make(chan struct{})}
+	sc.loading[key] = call
+	sc.loadMu.Unlock()
+
+	finished := false
+	defer func() {
+		if !finished {
+			call.value, call.cas, call.err = nil, 0, ErrLoaderPanic
+		}
+		sc.loadMu.Lock()
+		delete(sc.loading, key)
+		sc.loadMu.Unlock()
+		close(call.done)
+	}()
+
+	// Another caller may have finished loading between the miss and here
+	call.value, call.cas, call.err = sc.Get(key)
+	if call.err == ErrKeyNotFound {
+		loaded = true
+		call.value, call.err = loader(key)
+		if call.err == nil {
+			call.cas, call.err = sc.Set(key, call.value, ttl)
+		}
+	}
+	finished = true
+
+	return call.value, call.cas, loaded && call.err == nil, call.err
+}
+
 // Set stores a value in the cache.
 func (sc *ShardedCache) Set(key string, value []byte, ttl time.Duration) (uint64, error) {
+	key = sc.normalize(key)
 	resp := sc.sendRequest(sc.shardFor(key), &Request{
 		Op:    OpSet,
 		Key:   key,
@@ -164,8 +797,154 @@ func (sc *ShardedCache) Set(key string, value []byte, ttl time.Duration) (uint64
 	return resp.Cas, resp.Err
 }
 
+// GetSet stores a value and returns the value it replaced (nil if the key did not exist).
+func (sc *ShardedCache) GetSet(key string, value []byte, ttl time.Duration) ([]byte, uint64, error) {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:             OpSet,
+		Key:            key,
+		Value:          value,
+		TTL:            ttl,
+		ReturnPrevious: true,
+	})
+	return resp.Value, resp.Cas, resp.Err
+}
+
+// SetWithTags stores a value and tags it for lookup with KeysByTag.
+// Tags are kept in memory only and are lost on restart, unless
+// Config.PersistDerivedState is set and the cache was closed cleanly.
+func (sc *ShardedCache) SetWithTags(key string, value []byte, ttl time.Duration, tags []string) (uint64, error) {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:    OpSet,
+		Key:   key,
+		Value: value,
+		TTL:   ttl,
+		Tags:  tags,
+	})
+	return resp.Cas, resp.Err
+}
+
+// KeysByTag returns the sorted keys across all shards that have the given tag.
+func (sc *ShardedCache) KeysByTag(tag string) []string {
+	var keys []string
+	for i := range sc.workers {
+		resp := sc.sendRequest(i, &Request{
+			Op:   OpKeysByTag,
+			Tags: []string{tag},
+		})
+		keys = append(keys, resp.Keys...)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Scan returns up to limit keys with the given prefix in sorted order,
+// starting after cursor ("" = from the start). nextCursor is the cursor for
+// the next page, "" when there are no more keys. Each shard walks at most
+// limit keys per call, so a page never blocks a worker for long. Limits
+// above Config.MaxScanLimit are lowered to it.
+func (sc *ShardedCache) Scan(prefix, cursor string, limit int) (keys []string, nextCursor string, err error) {
+	if limit <= 0 {
+		limit = DefaultScanLimit
+	}
+	if max := sc.MaxScanLimit(); limit > max {
+		limit = max
+	}
+	prefix = sc.normalize(prefix)
+	for i := range sc.workers {
+		resp := sc.sendRequest(i, &Request{
+			Op:     OpScan,
+			Key:    cursor,
+			Prefix: prefix,
+			Limit:  limit,
+		})
+		if resp.Err != nil {
+			return nil, "", resp.Err
+		}
+		keys = append(keys, resp.Keys...)
+	}
+	sort.Strings(keys)
+	if len(keys) < limit {
+		return keys, "", nil
+	}
+	keys = keys[:limit]
+	return keys, keys[limit-1], nil
+}
+
+// MaxScanLimit returns the most keys a Scan returns per call
+func (sc *ShardedCache) MaxScanLimit() int {
+	if sc.config.MaxScanLimit <= 0 {
+		return DefaultMaxScanLimit
+	}
+	return sc.config.MaxScanLimit
+}
+
+// Store applies a storage operation (OpSet, OpAdd, OpReplace or OpCas) and
+// keeps the client flags and data type hint of op with the value, GetItem
+// and GetMulti return them.
+func (sc *ShardedCache) Store(op Op) (uint64, error) {
+	switch op.Op {
+	case OpSet, OpAdd, OpReplace, OpCas:
+	default:
+		return 0, fmt.Errorf("operation %d is not a storage operation", op.Op)
+	}
+	key := sc.normalize(op.Key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:       op.Op,
+		Key:      key,
+		Value:    op.Value,
+		TTL:      op.TTL,
+		Cas:      op.Cas,
+		DataType: op.DataType,
+		Flags:    op.Flags,
+	})
+	return resp.Cas, resp.Err
+}
+
+// StoreMulti applies storage operations like Store, with one request per
+// shard instead of one per operation. Operations on the same key are applied
+// in order, each has its own result and failures do not affect the others.
+func (sc *ShardedCache) StoreMulti(ops []Op) []Result {
+	results := make([]Result, len(ops))
+	shardOps := make(map[int][]Op)
+	shardIdxs := make(map[int][]int) // Position of each shard op in ops
+	for i, op := range ops {
+		switch op.Op {
+		case OpSet, OpAdd, OpReplace, OpCas:
+		default:
+			results[i].Err = fmt.Errorf("operation %d is not a storage operation", op.Op)
+			continue
+		}
+		op.Key = sc.normalize(op.Key)
+		shardIdx := sc.shardFor(op.Key)
+		shardOps[shardIdx] = append(shardOps[shardIdx], op)
+		shardIdxs[shardIdx] = append(shardIdxs[shardIdx], i)
+	}
+
+	// Send to the shards in parallel
+	var wg sync.WaitGroup
+	for shardIdx, batch := range shardOps {
+		wg.Add(1)
+		go func(shardIdx int, batch []Op) {
+			defer wg.Done()
+			resp := sc.sendRequest(shardIdx, &Request{Op: OpSetMulti, Batch: batch})
+			for j, i := range shardIdxs[shardIdx] {
+				if resp.Err != nil {
+					results[i].Err = resp.Err
+				} else {
+					results[i] = resp.Results[j]
+				}
+			}
+		}(shardIdx, batch)
+	}
+	wg.Wait()
+	return results
+}
+
 // Add stores a value only if it doesn't already exist.
 func (sc *ShardedCache) Add(key string, value []byte, ttl time.Duration) (uint64, error) {
+	key = sc.normalize(key)
 	resp := sc.sendRequest(sc.shardFor(key), &Request{
 		Op:    OpAdd,
 		Key:   key,
@@ -177,6 +956,7 @@ func (sc *ShardedCache) Add(key string, value []byte, ttl time.Duration) (uint64
 
 // Replace stores a value only if it already exists.
 func (sc *ShardedCache) Replace(key string, value []byte, ttl time.Duration) (uint64, error) {
+	key = sc.normalize(key)
 	resp := sc.sendRequest(sc.shardFor(key), &Request{
 		Op:    OpReplace,
 		Key:   key,
@@ -188,6 +968,7 @@ func (sc *ShardedCache) Replace(key string, value []byte, ttl time.Duration) (ui
 
 // Cas stores a value only if CAS matches.
 func (sc *ShardedCache) Cas(key string, value []byte, ttl time.Duration, cas uint64) (uint64, error) {
+	key = sc.normalize(key)
 	resp := sc.sendRequest(sc.shardFor(key), &Request{
 		Op:    OpCas,
 		Key:   key,
@@ -200,25 +981,95 @@ func (sc *ShardedCache) Cas(key string, value []byte, ttl time.Duration, cas uin
 
 // Delete removes a key from the cache.
 func (sc *ShardedCache) Delete(key string) error {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:  OpDelete,
+		Key: key,
+	})
+	return resp.Err
+}
+
+// GetDelete retrieves a value with its CAS token and removes the key, in one
+// step so no other request can change the value in between.
+func (sc *ShardedCache) GetDelete(key string) ([]byte, uint64, error) {
+	item, err := sc.GetDeleteItem(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return item.Value, item.Cas, nil
+}
+
+// GetDeleteItem is GetDelete returning the item with its data type hint and
+// client flags.
+func (sc *ShardedCache) GetDeleteItem(key string) (*Item, error) {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:  OpGetDelete,
+		Key: key,
+	})
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &Item{Value: resp.Value, Cas: resp.Cas, DataType: resp.DataType, Flags: resp.Flags, TTL: resp.TTLRemaining}, nil
+}
+
+// DeleteCas removes a key only if its CAS token still matches cas, so a value
+// stored since it was read is kept. It returns ErrCasMismatch otherwise.
+func (sc *ShardedCache) DeleteCas(key string, cas uint64) error {
+	key = sc.normalize(key)
 	resp := sc.sendRequest(sc.shardFor(key), &Request{
 		Op:  OpDelete,
 		Key: key,
+		Cas: cas,
 	})
 	return resp.Err
 }
 
-// Touch updates the TTL of an existing item.
+// Touch updates the TTL of an existing item. Like Set, a zero TTL means
+// DefaultTTL and the TTL is capped to MaxTTL.
 func (sc *ShardedCache) Touch(key string, ttl time.Duration) (uint64, error) {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:  OpTouch,
+		Key: key,
+		TTL: ttl,
+	})
+	return resp.Cas, resp.Err
+}
+
+// TouchCas updates the TTL like Touch, but only if the CAS token still
+// matches cas, so a value stored since it was read is not extended. It
+// returns ErrCasMismatch otherwise.
+func (sc *ShardedCache) TouchCas(key string, ttl time.Duration, cas uint64) (uint64, error) {
+	key = sc.normalize(key)
 	resp := sc.sendRequest(sc.shardFor(key), &Request{
 		Op:  OpTouch,
 		Key: key,
 		TTL: ttl,
+		Cas: cas,
 	})
 	return resp.Cas, resp.Err
 }
 
-// Increment increments a numeric value.
+// GetAndTouch retrieves an item and updates its expiry like Touch, in one
+// step. The returned item has the new TTL.
+func (sc *ShardedCache) GetAndTouch(key string, ttl time.Duration) (*Item, error) {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:  OpGat,
+		Key: key,
+		TTL: ttl,
+	})
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return &Item{Value: resp.Value, Cas: resp.Cas, DataType: resp.DataType, Flags: resp.Flags, TTL: resp.TTLRemaining}, nil
+}
+
+// Increment increments a numeric value, wrapping around at 2^64. Values
+// that are not a decimal 64-bit unsigned number return ErrNotNumeric.
 func (sc *ShardedCache) Increment(key string, delta uint64) (uint64, uint64, error) {
+	key = sc.normalize(key)
 	resp := sc.sendRequest(sc.shardFor(key), &Request{
 		Op:    OpIncr,
 		Key:   key,
@@ -234,8 +1085,27 @@ func (sc *ShardedCache) Increment(key string, delta uint64) (uint64, uint64, err
 	return val, resp.Cas, resp.Err
 }
 
-// Decrement decrements a numeric value.
+// IncrementInit increments a numeric value, a missing (or expired) key is
+// created with initial and ttl in the same worker turn, so concurrent callers
+// never race between the miss and the create.
+func (sc *ShardedCache) IncrementInit(key string, delta, initial uint64, ttl time.Duration) (uint64, uint64, error) {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:         OpIncr,
+		Key:        key,
+		Delta:      delta,
+		TTL:        ttl,
+		Initial:    initial,
+		HasInitial: true,
+	})
+	val, _ := strconv.ParseUint(string(resp.Value), 10, 64)
+	return val, resp.Cas, resp.Err
+}
+
+// Decrement decrements a numeric value, stopping at 0. Values that are not
+// a decimal 64-bit unsigned number return ErrNotNumeric.
 func (sc *ShardedCache) Decrement(key string, delta uint64) (uint64, uint64, error) {
+	key = sc.normalize(key)
 	resp := sc.sendRequest(sc.shardFor(key), &Request{
 		Op:    OpDecr,
 		Key:   key,
@@ -251,8 +1121,25 @@ func (sc *ShardedCache) Decrement(key string, delta uint64) (uint64, uint64, err
 	return val, resp.Cas, resp.Err
 }
 
+// DecrementInit decrements a numeric value, a missing (or expired) key is
+// created with initial and ttl like IncrementInit.
+func (sc *ShardedCache) DecrementInit(key string, delta, initial uint64, ttl time.Duration) (uint64, uint64, error) {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:         OpDecr,
+		Key:        key,
+		Delta:      delta,
+		TTL:        ttl,
+		Initial:    initial,
+		HasInitial: true,
+	})
+	val, _ := strconv.ParseUint(string(resp.Value), 10, 64)
+	return val, resp.Cas, resp.Err
+}
+
 // Append appends data to an existing value.
 func (sc *ShardedCache) Append(key string, value []byte) (uint64, error) {
+	key = sc.normalize(key)
 	resp := sc.sendRequest(sc.shardFor(key), &Request{
 		Op:    OpAppend,
 		Key:   key,
@@ -263,6 +1150,7 @@ func (sc *ShardedCache) Append(key string, value []byte) (uint64, error) {
 
 // Prepend prepends data to an existing value.
 func (sc *ShardedCache) Prepend(key string, value []byte) (uint64, error) {
+	key = sc.normalize(key)
 	resp := sc.sendRequest(sc.shardFor(key), &Request{
 		Op:    OpPrepend,
 		Key:   key,
@@ -271,27 +1159,270 @@ func (sc *ShardedCache) Prepend(key string, value []byte) (uint64, error) {
 	return resp.Cas, resp.Err
 }
 
+// AppendCas appends data to an existing value only if its CAS token still
+// matches cas. It returns ErrCasMismatch otherwise.
+func (sc *ShardedCache) AppendCas(key string, value []byte, cas uint64) (uint64, error) {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:    OpAppend,
+		Key:   key,
+		Value: value,
+		Cas:   cas,
+	})
+	return resp.Cas, resp.Err
+}
+
+// PrependCas prepends data to an existing value only if its CAS token still
+// matches cas. It returns ErrCasMismatch otherwise.
+func (sc *ShardedCache) PrependCas(key string, value []byte, cas uint64) (uint64, error) {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:    OpPrepend,
+		Key:   key,
+		Value: value,
+		Cas:   cas,
+	})
+	return resp.Cas, resp.Err
+}
+
+// Exists reports whether a key is present, without reading its value.
+func (sc *ShardedCache) Exists(key string) (bool, error) {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:  OpExists,
+		Key: key,
+	})
+	if resp.Err == ErrKeyNotFound {
+		return false, nil
+	}
+	return resp.Err == nil, resp.Err
+}
+
+// Meta returns debug metadata for a key without marking it as fetched.
+func (sc *ShardedCache) Meta(key string) (*KeyMeta, error) {
+	key = sc.normalize(key)
+	resp := sc.sendRequest(sc.shardFor(key), &Request{
+		Op:  OpMeta,
+		Key: key,
+	})
+	return resp.Meta, resp.Err
+}
+
+// ExportRange writes the entries of one shard with startKey <= key < endKey
+// (empty endKey = no upper bound) to w, one line per entry with its full
+// metadata, for debugging a suspected bad shard or hot key.
+func (sc *ShardedCache) ExportRange(shard int, startKey, endKey string, w io.Writer) error {
+	if shard < 0 || shard >= len(sc.workers) {
+		return fmt.Errorf("invalid shard %d", shard)
+	}
+	resp := sc.sendRequest(shard, &Request{
+		Op:     OpExportRange,
+		Key:    startKey,
+		EndKey: endKey,
+	})
+	if resp.Err != nil {
+		return resp.Err
+	}
+	for _, entry := range resp.Entries {
+		_, err := fmt.Fprintf(w, "%s key_id=%d bucket=%d slot=%d cas=%d expiry=%d length=%d last_access=%d\n",
+			entry.Key, entry.KeyId, entry.Bucket, entry.SlotIdx, entry.Cas, entry.Expiry, entry.Length, entry.LastAccess)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // FlushAll invalidates all items.
+//
+// Each shard processes its requests in FIFO order, so a write that completed
+// before FlushAll was called is always cleared. By default the shards are
+// flushed one after another: a write that runs concurrently with FlushAll may
+// survive on a shard that was already flushed, while an earlier concurrent
+// write on a shard flushed later is cleared. With Config.FlushBarrier all
+// shards are flushed at one point in time instead.
 func (sc *ShardedCache) FlushAll() {
+	if !sc.config.FlushBarrier {
+		for i := range sc.workers {
+			sc.sendRequest(i, &Request{Op: OpFlushAll})
+		}
+		return
+	}
+
+	// Wait for in-flight requests and hold off new ones on every shard
+	for i := range sc.shardLocks {
+		sc.shardLocks[i].Lock()
+	}
+	defer func() {
+		for i := range sc.shardLocks {
+			sc.shardLocks[i].Unlock()
+		}
+	}()
+
+	reqs := make([]*Request, len(sc.workers))
+	for i, worker := range sc.workers {
+		reqs[i] = &Request{Op: OpFlushAll, RespChan: make(chan *Response, 1)}
+		worker.RequestChan() <- reqs[i]
+	}
+	for _, req := range reqs {
+		<-req.RespChan
+	}
+}
+
+// FlushAllAfter invalidates all items written before delay has passed, items
+// written later are kept. Each shard flushes before it handles a request after
+// that time, so all shards flush at the same point in time. A delay of 0 or
+// less flushes now, a later call replaces an earlier scheduled flush.
+func (sc *ShardedCache) FlushAllAfter(delay time.Duration) {
+	if delay <= 0 {
+		sc.FlushAll()
+		return
+	}
+	flushAt := time.Now().Add(delay).UnixNano()
+	for i := range sc.workers {
+		sc.sendRequest(i, &Request{Op: OpFlushAll, FlushAt: flushAt})
+	}
+}
+
+// BucketStats returns the disk usage of each data bucket summed over the shards
+func (sc *ShardedCache) BucketStats() ([]BucketStat, error) {
+	var stats []BucketStat
+	for i := range sc.workers {
+		resp := sc.sendRequest(i, &Request{Op: OpBucketStats})
+		if resp.Err != nil {
+			return nil, resp.Err
+		}
+		if stats == nil {
+			stats = resp.Buckets
+			continue
+		}
+		for bucket, b := range resp.Buckets {
+			stats[bucket].TotalSlots += b.TotalSlots
+			stats[bucket].UsedSlots += b.UsedSlots
+			stats[bucket].BytesUsed += b.BytesUsed
+			stats[bucket].BytesAllocated += b.BytesAllocated
+		}
+	}
+	return stats, nil
+}
+
+// SizeHistogram returns the number of values per power-of-two size band
+// summed over the shards, element i counts the values of more than
+// 1<<(i-1) and at most 1<<i bytes
+func (sc *ShardedCache) SizeHistogram() ([]int64, error) {
+	var counts []int64
+	for i := range sc.workers {
+		resp := sc.sendRequest(i, &Request{Op: OpSizeHistogram})
+		if resp.Err != nil {
+			return nil, resp.Err
+		}
+		for band, n := range resp.Sizes {
+			if band == len(counts) {
+				counts = append(counts, 0)
+			}
+			counts[band] += n
+		}
+	}
+	return counts, nil
+}
+
+// Compact moves live data slots into the free slots of every shard and
+// truncates the data files. Deletes compact as they go, this reclaims the
+// slots they could not.
+func (sc *ShardedCache) Compact() error {
 	for i := range sc.workers {
-		sc.sendRequest(i, &Request{Op: OpFlushAll})
+		if resp := sc.sendRequest(i, &Request{Op: OpCompact}); resp.Err != nil {
+			return resp.Err
+		}
 	}
+	return nil
 }
 
 // Stats returns cache statistics.
 func (sc *ShardedCache) Stats() map[string]string {
 	totalItems := 0
+	var totalBytes int64
+	var compactions, bytesMoved, evictions uint64
+	var freeSlots, totalSlots int64
+	commands := make(map[string]uint64)
 
-	for _, worker := range sc.workers {
+	for i := range sc.workers {
+		sc.shardLocks[i].RLock()
+		worker := sc.workers[i]
 		totalItems += worker.Index().Count()
+		for bucket := 0; bucket < worker.Storage().NumBuckets(); bucket++ {
+			size, _ := worker.Storage().DataFileSize(bucket)
+			totalBytes += size
+		}
+		c, b, e := worker.CompactionStats()
+		compactions += c
+		bytesMoved += b
+		evictions += e
+		free, total := worker.SlotStats()
+		freeSlots += free
+		totalSlots += total
+		for name, n := range worker.CommandStats() {
+			commands[name] += n
+		}
+		sc.shardLocks[i].RUnlock()
 	}
 
 	stats := make(map[string]string)
 	stats["curr_items"] = fmt.Sprintf("%d", totalItems)
+	stats["bytes"] = fmt.Sprintf("%d", totalBytes)
+	stats["compactions_performed"] = fmt.Sprintf("%d", compactions)
+	stats["bytes_moved_during_compaction"] = fmt.Sprintf("%d", bytesMoved)
+	stats["evictions"] = fmt.Sprintf("%d", evictions)
+	stats["compaction_ratio"] = "0"
+	if totalSlots > 0 {
+		stats["compaction_ratio"] = strconv.FormatFloat(float64(freeSlots)/float64(totalSlots), 'f', -1, 64)
+	}
+	for name, n := range commands {
+		stats[name] = fmt.Sprintf("%d", n)
+	}
+	if sc.Ready() {
+		stats["ready"] = "1"
+	} else {
+		stats["ready"] = "0"
+	}
+	for i := range sc.breakers {
+		stats[fmt.Sprintf("shard_%02d_breaker", i)] = sc.breakers[i].State()
+	}
 	return stats
 }
 
+// QueueDepths returns the number of requests waiting in each shard's channel
+func (sc *ShardedCache) QueueDepths() []int {
+	depths := make([]int, len(sc.workers))
+	for i := range sc.workers {
+		sc.shardLocks[i].RLock()
+		depths[i] = len(sc.workers[i].RequestChan())
+		sc.shardLocks[i].RUnlock()
+	}
+	return depths
+}
+
+// Ready reports whether all shards are recovered and serving, it is false
+// while a shard is being reloaded
+func (sc *ShardedCache) Ready() bool {
+	return sc.recovering.Load() == 0
+}
+
 // GetStartTime returns when the cache was started
 func (sc *ShardedCache) GetStartTime() time.Time {
 	return sc.StartTime
 }
+
+// MaxKeySize returns the longest key accepted (at most MaxKeySize)
+func (sc *ShardedCache) MaxKeySize() int {
+	if sc.config.MaxKeySize <= 0 || sc.config.MaxKeySize > MaxKeySize {
+		return MaxKeySize
+	}
+	return sc.config.MaxKeySize
+}
+
+// MaxValueSize returns the largest value accepted by storage commands, the
+// size of the largest bucket when Config.MaxValueSize is 0
+func (sc *ShardedCache) MaxValueSize() int {
+	return sc.maxValue
+}
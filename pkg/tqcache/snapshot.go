@@ -0,0 +1,183 @@
+package tqcache
+
+import (
+	"time"
+
+	"github.com/google/btree"
+)
+
+// snapshotBatchSize is the number of keys read per worker request during a snapshot
+const snapshotBatchSize = 100
+
+// SnapshotItem is an item as it was when the snapshot of its shard was taken
+type SnapshotItem struct {
+	Key    string
+	Value  []byte
+	Cas    uint64
+	Expiry int64 // Unix milliseconds, 0 = no expiry
+
+	DataType byte   // Client data type hint
+	Flags    uint32 // Opaque client flags
+}
+
+// indexSnapshot is a point-in-time copy of a shard index. Values that change
+// before the snapshot has read them are copied into saved (copy-on-write).
+type indexSnapshot struct {
+	tree   *btree.BTree      // Clone of the index btree
+	now    int64             // Unix milliseconds when the snapshot was taken
+	cursor string            // Last key read, keys up to it need no copy
+	saved  map[string][]byte // Values changed after the snapshot, not yet read
+}
+
+// Snapshot calls fn for every item in the cache as it was at one point in
+// time per shard. The index is cloned (cheap, structural sharing) and walked
+// off the worker goroutine, values are read in small batches, so writes keep
+// flowing while the snapshot runs. Values overwritten or deleted before the
+// snapshot reached them are kept in memory until they are read.
+func (sc *ShardedCache) Snapshot(fn func(item *SnapshotItem) error) error {
+	for i := range sc.workers {
+		if err := sc.snapshotShard(i, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotShard runs a snapshot of one shard
+func (sc *ShardedCache) snapshotShard(shardIdx int, fn func(item *SnapshotItem) error) error {
+	resp := sc.sendRequest(shardIdx, &Request{Op: OpSnapshot})
+	if resp.Err != nil {
+		return resp.Err
+	}
+	snap := resp.Snapshot
+	defer sc.sendRequest(shardIdx, &Request{Op: OpSnapshotEnd, Snapshot: snap})
+
+	batch := make([]IndexEntry, 0, snapshotBatchSize)
+	emit := func() error {
+		keys := make([]string, len(batch))
+		for i, entry := range batch {
+			keys[i] = entry.Key
+		}
+		resp := sc.sendRequest(shardIdx, &Request{Op: OpSnapshotRead, Snapshot: snap, Keys: keys})
+		if resp.Err != nil {
+			return resp.Err
+		}
+		for _, entry := range batch {
+			item, ok := resp.Items[entry.Key]
+			if !ok {
+				continue
+			}
+			snapItem := &SnapshotItem{
+				Key:      entry.Key,
+				Value:    item.Value,
+				Cas:      entry.Cas,
+				Expiry:   entry.Expiry,
+				DataType: entry.DataType,
+				Flags:    entry.Flags,
+			}
+			if err := fn(snapItem); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	var err error
+	snap.tree.Ascend(func(item btree.Item) bool {
+		entry := item.(IndexEntry)
+		if entry.Expiry > 0 && entry.Expiry <= snap.now {
+			return true // Already expired when the snapshot was taken
+		}
+		batch = append(batch, entry)
+		if len(batch) == snapshotBatchSize {
+			err = emit()
+		}
+		return err == nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = emit()
+	}
+	return err
+}
+
+// handleSnapshot clones the index and registers the snapshot for copy-on-write
+func (w *Worker) handleSnapshot(req *Request) *Response {
+	snap := &indexSnapshot{
+		tree:  w.index.btree.Clone(),
+		now:   time.Now().UnixMilli(),
+		saved: make(map[string][]byte),
+	}
+	w.snapshots = append(w.snapshots, snap)
+	return &Response{Snapshot: snap}
+}
+
+// handleSnapshotRead returns the snapshot values of a batch of keys (in key order)
+func (w *Worker) handleSnapshotRead(req *Request) *Response {
+	snap := req.Snapshot
+	if !w.hasSnapshot(snap) {
+		return &Response{Err: ErrSnapshotClosed}
+	}
+
+	items := make(map[string]*Item, len(req.Keys))
+	for _, key := range req.Keys {
+		value, ok := snap.saved[key]
+		if ok {
+			delete(snap.saved, key)
+		} else if entry, found := w.index.Get(key); found {
+			// Unchanged since the snapshot, otherwise it would have been saved
+			data, err := w.storage.ReadDataSlot(entry.Bucket, entry.SlotIdx)
+			if err != nil {
+				return &Response{Err: err}
+			}
+			value = data
+		}
+		if value != nil {
+			items[key] = &Item{Value: value}
+		}
+		snap.cursor = key
+	}
+	return &Response{Items: items}
+}
+
+// handleSnapshotEnd unregisters a snapshot and drops its saved values
+func (w *Worker) handleSnapshotEnd(req *Request) *Response {
+	for i, snap := range w.snapshots {
+		if snap == req.Snapshot {
+			w.snapshots = append(w.snapshots[:i], w.snapshots[i+1:]...)
+			break
+		}
+	}
+	return &Response{}
+}
+
+// hasSnapshot reports whether the snapshot is registered with this worker
+func (w *Worker) hasSnapshot(snap *indexSnapshot) bool {
+	for _, s := range w.snapshots {
+		if s == snap {
+			return true
+		}
+	}
+	return false
+}
+
+// preserve saves the current value of an entry into active snapshots that
+// still need it, must be called before the value is changed or deleted
+func (w *Worker) preserve(entry *IndexEntry) {
+	for _, snap := range w.snapshots {
+		if snap.cursor != "" && entry.Key <= snap.cursor {
+			continue // Already read
+		}
+		if _, ok := snap.saved[entry.Key]; ok {
+			continue // Snapshot value already saved
+		}
+		if !snap.tree.Has(IndexEntry{Key: entry.Key}) {
+			continue // Not part of the snapshot
+		}
+		data, err := w.storage.ReadDataSlot(entry.Bucket, entry.SlotIdx)
+		if err != nil {
+			continue
+		}
+		snap.saved[entry.Key] = data
+	}
+}
@@ -0,0 +1,97 @@
+package tqcache
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// StateFile is the name of the sidecar file holding the derived in-memory
+// state of a shard (access times, hit counts, tags) across a clean restart
+const StateFile = "state"
+
+// derivedState is the sidecar record of one key
+type derivedState struct {
+	Key        string   `json:"key"`
+	Cas        uint64   `json:"cas"` // CAS the state belongs to, other values are stale
+	LastAccess int64    `json:"last_access"`
+	Fetched    bool     `json:"fetched,omitempty"`
+	Hits       uint64   `json:"hits,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+}
+
+// saveState writes the derived state of all entries to the sidecar file,
+// must only be called when the worker is stopped
+func (w *Worker) saveState() error {
+	path := filepath.Join(w.storage.dataDir, StateFile)
+	tmpPath := path + ".tmp"
+	f, err := w.storage.openFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+
+	buf := bufio.NewWriter(f)
+	enc := json.NewEncoder(buf)
+	for _, entry := range w.index.Entries() {
+		state := derivedState{
+			Key:        entry.Key,
+			Cas:        entry.Cas,
+			LastAccess: entry.LastAccess,
+			Fetched:    entry.Fetched,
+			Hits:       entry.Hits,
+			Tags:       w.index.keyTags[entry.Key],
+		}
+		if err := enc.Encode(&state); err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// loadState applies the sidecar file to the recovered index and removes it,
+// so a later unclean shutdown starts cold. The file is only used if it reads
+// completely and only for keys whose CAS is unchanged, a missing or damaged
+// file leaves the derived state cold.
+func (w *Worker) loadState() {
+	path := filepath.Join(w.storage.dataDir, StateFile)
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer os.Remove(path)
+	defer f.Close()
+
+	var states []derivedState
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var state derivedState
+		if err := dec.Decode(&state); err != nil {
+			return
+		}
+		states = append(states, state)
+	}
+
+	for _, state := range states {
+		entry, ok := w.index.Get(state.Key)
+		if !ok || entry.Cas != state.Cas {
+			continue
+		}
+		entry.LastAccess = state.LastAccess
+		entry.Fetched = state.Fetched
+		entry.Hits = state.Hits
+		w.index.Set(entry)
+		w.index.SetTags(entry.Key, state.Tags)
+	}
+}
@@ -1,93 +1,264 @@
 package tqcache
 
 import (
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // Record sizes
 const (
-	KeyRecordSize  = 1051 // 2 + 1024 + 8 + 8 + 1 + 8 (keyLen, key, cas, expiry, bucket, slotIdx)
+	KeyRecordSize  = 1060 // 2 + 1024 + 8 + 8 + 1 + 8 + 1 + 4 + 4 (keyLen, key, cas, expiry, bucket, slotIdx, dataType, flags, crc)
 	MaxKeySize     = 1024
-	DataHeaderSize = 1 + 4 // free + length (data files still have free flag)
+	DataHeaderSize = 1 + 4 + 4 // free + length + crc (data files still have free flag)
+
+	// legacyDataHeaderSize is the header of data dirs created before values
+	// had a checksum, they are read and written without one
+	legacyDataHeaderSize = 1 + 4
 )
 
-// Bucket configuration: 16 buckets from 1KB to 64MB (doubling each time)
+// Default bucket layout: 16 buckets from 1KB to 64MB (doubling each time)
 const (
-	NumBuckets    = 16
-	MinBucketSize = 1024             // 1KB
-	MaxBucketSize = 64 * 1024 * 1024 // 64MB
+	NumBuckets          = 16
+	MinBucketSize       = 1024             // 1KB
+	MaxBucketSize       = 64 * 1024 * 1024 // 64MB
+	BucketGrowthFactor  = 2.0
+	MaxBucketCount      = 256 // Bucket numbers are stored in a byte
+	maxBucketSlotLength = math.MaxUint32
 )
 
 // Free flags (for data files only - key files use continuous compaction)
 const (
 	FlagInUse   = 0x00
 	FlagDeleted = 0x01
+
+	// FlagCompressed marks a slot in use holding a DEFLATE-compressed value,
+	// prefixed with the uncompressed length (uint32)
+	FlagCompressed = 0x02
 )
 
 var (
-	ErrKeyNotFound   = errors.New("key not found")
-	ErrKeyTooLarge   = errors.New("key too large")
-	ErrValueTooLarge = errors.New("value too large")
-	ErrKeyExists     = errors.New("key already exists")
-	ErrCasMismatch   = errors.New("cas mismatch")
-	ErrNotNumeric    = errors.New("cannot increment or decrement non-numeric value")
+	ErrKeyNotFound      = errors.New("key not found")
+	ErrKeyTooLarge      = errors.New("key too large")
+	ErrInvalidKey       = errors.New("key contains whitespace or control characters")
+	ErrValueTooLarge    = errors.New("value too large")
+	ErrKeyExists        = errors.New("key already exists")
+	ErrCasMismatch      = errors.New("cas mismatch")
+	ErrNotNumeric       = errors.New("cannot increment or decrement non-numeric value")
+	ErrResponseTooLarge = errors.New("object too large to return")
+	ErrByteOrder        = errors.New("data dir byte order does not match configuration")
+	ErrSnapshotClosed   = errors.New("snapshot is no longer valid")
+	ErrCrossShard       = errors.New("keys span multiple shards")
+	ErrShardUnavailable = errors.New("shard unavailable after repeated storage errors")
+	ErrKeyChecksum      = errors.New("key record checksum mismatch")
+	ErrBusy             = errors.New("shard busy, request timed out")
+	ErrBucketLayout     = errors.New("data dir bucket layout does not match configuration")
+	ErrNotReady         = errors.New("shards are still being recovered")
+	ErrCorrupt          = errors.New("data slot checksum mismatch")
+	ErrInvalidConfig    = errors.New("invalid config")
+	ErrKeyRecordLayout  = errors.New("keys file record layout is not supported")
+	ErrLoaderPanic      = errors.New("loader panicked")
 )
 
-// KeyRecord represents a fixed-size record in the keys file
+// FormatFile is the name of the file recording the on-disk format of a data dir
+const FormatFile = "format"
+
+// tombstoneExpiry marks a key record as deleted (expired in 1970), recovery skips it
+const tombstoneExpiry = 1
+
+// KeyRecord represents a record in the keys file
 type KeyRecord struct {
-	KeyLen  uint16 // Actual key length (0-1024)
-	Key     [MaxKeySize]byte
-	Cas     uint64
-	Expiry  int64
-	Bucket  byte
-	SlotIdx int64
+	KeyLen   uint16 // Actual key length (0-1024)
+	Key      [MaxKeySize]byte
+	Cas      uint64
+	Expiry   int64
+	Bucket   byte
+	SlotIdx  int64
+	DataType byte   // Client data type hint (binary protocol), 0 = raw bytes
+	Flags    uint32 // Opaque client flags (memcached)
+	CRC      uint32 // CRC-32 of the preceding record bytes, computed on write
+}
+
+// ValidateKey checks that a key is not empty, at most maxSize bytes and free
+// of whitespace and control characters, as the memcached protocols require.
+// Keys stored through the API only need to fit maxSize, see checkKeySize.
+func ValidateKey(key string, maxSize int) error {
+	if err := checkKeySize(key, maxSize); err != nil {
+		return err
+	}
+	if key == "" {
+		return ErrInvalidKey
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
+
+// checkKeySize checks that a key is at most maxSize bytes (0 or more than
+// MaxKeySize = MaxKeySize)
+func checkKeySize(key string, maxSize int) error {
+	if maxSize <= 0 || maxSize > MaxKeySize {
+		maxSize = MaxKeySize
+	}
+	if len(key) > maxSize {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// PackedKeyRecordSize returns the size of a packed key record for a key length
+// (keyLen, key, cas, expiry, bucket, slotIdx, dataType, flags, crc)
+func PackedKeyRecordSize(keyLen int) int64 {
+	return int64(2 + keyLen + 8 + 8 + 1 + 8 + 1 + 4 + 4)
+}
+
+// StorageOptions holds the settings used to open a Storage
+type StorageOptions struct {
+	SyncAlways bool             // If true, fsync after every write
+	ByteOrder  binary.ByteOrder // For new data dirs, existing ones must match (nil = little-endian)
+	KeyFormat  KeyFormat        // Keys file layout, existing data dirs are migrated to it
+
+	Compression          Compression // Compression of values written by EncodeValue
+	CompressionThreshold int         // Smallest value compressed
+
+	UseMmap bool // Read data slots from memory-mapped data files
+
+	DirMode  os.FileMode // Permissions of the data dir (0 = DefaultDirMode)
+	FileMode os.FileMode // Permissions of its files (0 = DefaultFileMode)
+
+	// Preallocated sizes of new (empty) files, unused space is zero-filled
+	InitialKeysCapacity   int64 // Key records (fixed key format only)
+	InitialSlotsPerBucket int64 // Slots in each data bucket file
+
+	// Bucket layout, fixed when the data dir is created (0 = defaults)
+	BucketMinSize      int     // Slot size of the smallest bucket
+	BucketGrowthFactor float64 // Slot size ratio of consecutive buckets
+	BucketCount        int     // Number of buckets (at most MaxBucketCount)
 }
 
 // Storage handles all file I/O for the cache
 type Storage struct {
 	dataDir    string
 	keysFile   *os.File
-	dataFiles  [NumBuckets]*os.File
+	dataFiles  []*os.File
 	syncAlways bool // If true, fsync after every write
+	order      binary.ByteOrder
+	keyFormat  KeyFormat
+	fileMode   os.FileMode
+	headerSize int // DataHeaderSize, or legacyDataHeaderSize without checksums
+
+	compression          Compression
+	compressionThreshold int
+
+	// Read-only mappings of the data files when UseMmap is set, remapped
+	// when a read goes past the end and dropped before a file shrinks
+	useMmap bool
+	maps    [][]byte
 
-	// Bucket sizes: 1KB, 2KB, 4KB, ..., 64MB
-	bucketSizes [NumBuckets]int
+	// Bucket sizes, by default 1KB, 2KB, 4KB, ..., 64MB
+	layout      bucketLayout
+	bucketSizes []int
+
+	// Held by Sync, which also runs on the sync goroutine, and by the worker
+	// while it replaces a file handle
+	filesMu sync.RWMutex
+
+	dataReads atomic.Uint64 // Number of ReadDataSlot calls
+	syncs     atomic.Uint64 // Number of Sync calls
+
+	// truncate shrinks a file, can be replaced to inject faults (nil = os.File.Truncate)
+	truncate func(f *os.File, size int64) error
 }
 
 // NewStorage creates a new storage instance
-func NewStorage(dataDir string, syncAlways bool) (*Storage, error) {
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+func NewStorage(dataDir string, opts StorageOptions) (*Storage, error) {
+	dirMode, fileMode := opts.DirMode, opts.FileMode
+	if dirMode == 0 {
+		dirMode = DefaultDirMode
+	}
+	if fileMode == 0 {
+		fileMode = DefaultFileMode
+	}
+	if err := os.MkdirAll(dataDir, dirMode); err != nil {
 		return nil, fmt.Errorf("failed to create data dir: %w", err)
 	}
+	if err := narrowMode(dataDir, dirMode); err != nil {
+		return nil, err
+	}
+	order := opts.ByteOrder
+	if order == nil {
+		order = binary.LittleEndian
+	}
+	format, err := readFormat(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkByteOrder(dataDir, format, order); err != nil {
+		return nil, err
+	}
+	layout, err := newBucketLayout(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBucketLayout(dataDir, format, layout); err != nil {
+		return nil, err
+	}
 
 	s := &Storage{
 		dataDir:    dataDir,
-		syncAlways: syncAlways,
-	}
+		syncAlways: opts.SyncAlways,
+		order:      order,
+		keyFormat:  KeyFormatFixed,
+		fileMode:   fileMode,
 
-	// Calculate bucket sizes
-	size := MinBucketSize
-	for i := 0; i < NumBuckets; i++ {
-		s.bucketSizes[i] = size
-		size *= 2
+		compression:          opts.Compression,
+		compressionThreshold: opts.CompressionThreshold,
+
+		useMmap: opts.UseMmap,
+		maps:    make([][]byte, layout.count),
+
+		dataFiles:   make([]*os.File, layout.count),
+		layout:      layout,
+		bucketSizes: layout.sizes(),
+	}
+	if format["keyformat"] == KeyFormatPacked.String() {
+		s.keyFormat = KeyFormatPacked
+	}
+	if s.headerSize, err = dataHeaderSize(dataDir, format); err != nil {
+		return nil, err
 	}
 
 	// Open keys file
 	keysPath := filepath.Join(dataDir, "keys")
-	keysFile, err := os.OpenFile(keysPath, os.O_RDWR|os.O_CREATE, 0644)
+	keysFile, err := s.openFile(keysPath, os.O_RDWR|os.O_CREATE)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open keys file: %w", err)
 	}
 	s.keysFile = keysFile
+	if err := s.upgradeKeys(format); err != nil {
+		s.Close()
+		return nil, err
+	}
 
 	// Open data bucket files
-	for i := 0; i < NumBuckets; i++ {
+	for i := range s.dataFiles {
 		dataPath := filepath.Join(dataDir, fmt.Sprintf("data_%02d", i))
-		dataFile, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE, 0644)
+		dataFile, err := s.openFile(dataPath, os.O_RDWR|os.O_CREATE)
 		if err != nil {
 			s.Close()
 			return nil, fmt.Errorf("failed to open data file %d: %w", i, err)
@@ -95,9 +266,280 @@ func NewStorage(dataDir string, syncAlways bool) (*Storage, error) {
 		s.dataFiles[i] = dataFile
 	}
 
+	if err := s.preallocate(opts); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	// Convert the keys file when the configured layout differs
+	if s.keyFormat != opts.KeyFormat {
+		if err := s.migrateKeys(opts.KeyFormat); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to migrate keys file to %s format: %w", opts.KeyFormat, err)
+		}
+	}
+
+	if err := s.writeFormat(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
 	return s, nil
 }
 
+// preallocate grows empty files to their initial size to avoid extending them
+// during the initial load. Recovery skips the zero-filled space.
+func (s *Storage) preallocate(opts StorageOptions) error {
+	if opts.InitialKeysCapacity > 0 && s.keyFormat == KeyFormatFixed && opts.KeyFormat == KeyFormatFixed {
+		if size, err := s.KeysFileSize(); err == nil && size == 0 {
+			if err := s.keysFile.Truncate(opts.InitialKeysCapacity * KeyRecordSize); err != nil {
+				return fmt.Errorf("failed to preallocate keys file: %w", err)
+			}
+		}
+	}
+	if opts.InitialSlotsPerBucket > 0 {
+		for bucket := range s.dataFiles {
+			if size, err := s.DataFileSize(bucket); err == nil && size == 0 {
+				if err := s.dataFiles[bucket].Truncate(opts.InitialSlotsPerBucket * int64(s.SlotSize(bucket))); err != nil {
+					return fmt.Errorf("failed to preallocate data file %d: %w", bucket, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// readFormat reads the key=value lines of the format file (empty if missing)
+func readFormat(dataDir string) (map[string]string, error) {
+	format := make(map[string]string)
+	data, err := os.ReadFile(filepath.Join(dataDir, FormatFile))
+	if os.IsNotExist(err) {
+		return format, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read format file: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			format[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return format, nil
+}
+
+// ReadStorageOptions returns the byte order, key format and bucket layout
+// recorded in the format file of a data dir, to open it with NewStorage
+// without its configuration. Legacy data dirs get the defaults.
+func ReadStorageOptions(dataDir string) (StorageOptions, error) {
+	var opts StorageOptions
+	format, err := readFormat(dataDir)
+	if err != nil {
+		return opts, err
+	}
+	switch format["byteorder"] {
+	case "", binary.LittleEndian.String():
+		opts.ByteOrder = binary.LittleEndian
+	case binary.BigEndian.String():
+		opts.ByteOrder = binary.BigEndian
+	default:
+		return opts, fmt.Errorf("unknown byte order %q in format file", format["byteorder"])
+	}
+	if format["keyformat"] == KeyFormatPacked.String() {
+		opts.KeyFormat = KeyFormatPacked
+	}
+	if stored, ok := format["bucketlayout"]; ok {
+		parts := strings.Split(stored, ",")
+		if len(parts) != 3 {
+			return opts, fmt.Errorf("invalid bucket layout %q in format file", stored)
+		}
+		minSize, err1 := strconv.Atoi(parts[0])
+		growth, err2 := strconv.ParseFloat(parts[1], 64)
+		count, err3 := strconv.Atoi(parts[2])
+		if err1 != nil || err2 != nil || err3 != nil {
+			return opts, fmt.Errorf("invalid bucket layout %q in format file", stored)
+		}
+		opts.BucketMinSize, opts.BucketGrowthFactor, opts.BucketCount = minSize, growth, count
+	}
+	return opts, nil
+}
+
+// checkByteOrder verifies the byte order recorded in the format file.
+// Data dirs without a format file are little-endian.
+func checkByteOrder(dataDir string, format map[string]string, order binary.ByteOrder) error {
+	stored, ok := format["byteorder"]
+	if !ok {
+		// Only a legacy data dir with existing keys has a byte order
+		info, err := os.Stat(filepath.Join(dataDir, "keys"))
+		if err != nil || info.Size() == 0 {
+			return nil
+		}
+		stored = binary.LittleEndian.String()
+	}
+	if stored != order.String() {
+		return fmt.Errorf("%w: stored %q, configured %q", ErrByteOrder, stored, order.String())
+	}
+	return nil
+}
+
+// bucketLayout describes the slot sizes of the data buckets
+type bucketLayout struct {
+	minSize int
+	growth  float64
+	count   int
+}
+
+// defaultBucketLayout is the layout of data dirs created before it was recorded
+var defaultBucketLayout = bucketLayout{minSize: MinBucketSize, growth: BucketGrowthFactor, count: NumBuckets}
+
+// newBucketLayout returns the configured bucket layout, zero options are defaults
+func newBucketLayout(opts StorageOptions) (bucketLayout, error) {
+	layout := defaultBucketLayout
+	if opts.BucketMinSize != 0 {
+		layout.minSize = opts.BucketMinSize
+	}
+	if opts.BucketGrowthFactor != 0 {
+		layout.growth = opts.BucketGrowthFactor
+	}
+	if opts.BucketCount != 0 {
+		layout.count = opts.BucketCount
+	}
+	if layout.minSize <= 0 {
+		return layout, fmt.Errorf("bucket min size must be positive, got %d", layout.minSize)
+	}
+	if layout.growth <= 1 {
+		return layout, fmt.Errorf("bucket growth factor must be greater than 1, got %g", layout.growth)
+	}
+	if layout.count < 1 || layout.count > MaxBucketCount {
+		return layout, fmt.Errorf("bucket count must be between 1 and %d, got %d", MaxBucketCount, layout.count)
+	}
+	if sizes := layout.sizes(); sizes == nil {
+		return layout, fmt.Errorf("bucket layout exceeds the maximum slot size of %d bytes", maxBucketSlotLength)
+	}
+	return layout, nil
+}
+
+// sizes returns the slot size of each bucket, or nil if the largest does not
+// fit the length in a slot header. Each size is at least one byte larger than
+// the previous one.
+func (l bucketLayout) sizes() []int {
+	sizes := make([]int, l.count)
+	size := float64(l.minSize)
+	for i := range sizes {
+		if size > maxBucketSlotLength {
+			return nil
+		}
+		sizes[i] = int(size)
+		if i > 0 && sizes[i] <= sizes[i-1] {
+			sizes[i] = sizes[i-1] + 1
+		}
+		size = float64(sizes[i]) * l.growth
+	}
+	return sizes
+}
+
+// String returns the layout as stored in the format file
+func (l bucketLayout) String() string {
+	return fmt.Sprintf("%d,%s,%d", l.minSize, strconv.FormatFloat(l.growth, 'g', -1, 64), l.count)
+}
+
+// checkBucketLayout verifies the bucket layout recorded in the format file.
+// Data dirs without one use the default layout.
+func checkBucketLayout(dataDir string, format map[string]string, layout bucketLayout) error {
+	stored, ok := format["bucketlayout"]
+	if !ok {
+		// Only a legacy data dir with existing keys has a layout
+		info, err := os.Stat(filepath.Join(dataDir, "keys"))
+		if err != nil || info.Size() == 0 {
+			return nil
+		}
+		stored = defaultBucketLayout.String()
+	}
+	if stored != layout.String() {
+		return fmt.Errorf("%w: stored %q, configured %q", ErrBucketLayout, stored, layout.String())
+	}
+	return nil
+}
+
+// dataHeaderSize returns the slot header size recorded in the format file.
+// Legacy data dirs with existing keys have no value checksums.
+func dataHeaderSize(dataDir string, format map[string]string) (int, error) {
+	stored, ok := format["datachecksum"]
+	if !ok {
+		info, err := os.Stat(filepath.Join(dataDir, "keys"))
+		if err != nil || info.Size() == 0 {
+			return DataHeaderSize, nil
+		}
+		return legacyDataHeaderSize, nil
+	}
+	switch stored {
+	case "crc32":
+		return DataHeaderSize, nil
+	case "none":
+		return legacyDataHeaderSize, nil
+	}
+	return 0, fmt.Errorf("unknown data checksum %q in format file", stored)
+}
+
+// writeFormat records the byte order, key format and record version, bucket
+// layout and data checksum in the format file
+func (s *Storage) writeFormat() error {
+	checksum := "crc32"
+	if s.headerSize == legacyDataHeaderSize {
+		checksum = "none"
+	}
+	content := "byteorder=" + s.order.String() + "\n" +
+		"keyformat=" + s.keyFormat.String() + "\n" +
+		"keyrecord=" + strconv.Itoa(keyRecordVersion) + "\n" +
+		"bucketlayout=" + s.layout.String() + "\n" +
+		"datachecksum=" + checksum + "\n"
+	path := filepath.Join(s.dataDir, FormatFile)
+	if err := os.WriteFile(path, []byte(content), s.fileMode); err != nil {
+		return fmt.Errorf("failed to write format file: %w", err)
+	}
+	return narrowMode(path, s.fileMode)
+}
+
+// openFile opens a file of the data dir, creating it with the file mode
+func (s *Storage) openFile(path string, flag int) (*os.File, error) {
+	f, err := os.OpenFile(path, flag, s.fileMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := narrowMode(path, s.fileMode); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// narrowMode removes the permissions of path that mode does not have, it
+// never adds any (the umask may have removed them on purpose)
+func narrowMode(path string, mode os.FileMode) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if perm := info.Mode().Perm(); perm&^mode != 0 {
+		return os.Chmod(path, perm&mode)
+	}
+	return nil
+}
+
+// migrateKeys rewrites the keys file in another key format
+func (s *Storage) migrateKeys(to KeyFormat) error {
+	var recs []*KeyRecord
+	if _, err := s.ScanKeyRecords(func(keyId int64, rec *KeyRecord) {
+		if rec.Expiry != tombstoneExpiry {
+			recs = append(recs, rec)
+		}
+	}); err != nil {
+		return err
+	}
+	s.keyFormat = to
+	_, _, err := s.RewriteKeys(recs)
+	return err
+}
+
 // Close closes all file handles
 func (s *Storage) Close() error {
 	var firstErr error
@@ -106,7 +548,8 @@ func (s *Storage) Close() error {
 			firstErr = err
 		}
 	}
-	for i := 0; i < NumBuckets; i++ {
+	for i := range s.dataFiles {
+		s.unmap(i)
 		if s.dataFiles[i] != nil {
 			if err := s.dataFiles[i].Close(); err != nil && firstErr == nil {
 				firstErr = err
@@ -118,10 +561,13 @@ func (s *Storage) Close() error {
 
 // Sync fsyncs all files
 func (s *Storage) Sync() error {
+	s.syncs.Add(1)
+	s.filesMu.RLock()
+	defer s.filesMu.RUnlock()
 	if err := s.keysFile.Sync(); err != nil {
 		return err
 	}
-	for i := 0; i < NumBuckets; i++ {
+	for i := range s.dataFiles {
 		if err := s.dataFiles[i].Sync(); err != nil {
 			return err
 		}
@@ -131,7 +577,7 @@ func (s *Storage) Sync() error {
 
 // BucketForSize returns the bucket index for a given value size
 func (s *Storage) BucketForSize(size int) (int, error) {
-	for i := 0; i < NumBuckets; i++ {
+	for i := range s.bucketSizes {
 		if size <= s.bucketSizes[i] {
 			return i, nil
 		}
@@ -139,6 +585,11 @@ func (s *Storage) BucketForSize(size int) (int, error) {
 	return -1, ErrValueTooLarge
 }
 
+// NumBuckets returns the number of data buckets
+func (s *Storage) NumBuckets() int {
+	return len(s.bucketSizes)
+}
+
 // BucketSize returns the slot size for a bucket (excluding header)
 func (s *Storage) BucketSize(bucket int) int {
 	return s.bucketSizes[bucket]
@@ -146,11 +597,37 @@ func (s *Storage) BucketSize(bucket int) int {
 
 // SlotSize returns the total slot size for a bucket (including header)
 func (s *Storage) SlotSize(bucket int) int {
-	return DataHeaderSize + s.bucketSizes[bucket]
+	return s.headerSize + s.bucketSizes[bucket]
+}
+
+// KeyFormat returns the layout of the keys file
+func (s *Storage) KeyFormat() KeyFormat {
+	return s.keyFormat
+}
+
+// KeyIdSpan returns how far a new record for a key of the given length
+// advances the next key id (1 in the fixed format, its size in bytes when packed)
+func (s *Storage) KeyIdSpan(keyLen int) int64 {
+	if s.keyFormat == KeyFormatPacked {
+		return PackedKeyRecordSize(keyLen)
+	}
+	return 1
+}
+
+// keyOffset returns the file offset of a key record
+func (s *Storage) keyOffset(keyId int64) int64 {
+	if s.keyFormat == KeyFormatPacked {
+		return keyId // Packed key ids are byte offsets
+	}
+	return keyId * KeyRecordSize
 }
 
 // ReadKeyRecord reads a key record at the given keyId
 func (s *Storage) ReadKeyRecord(keyId int64) (*KeyRecord, error) {
+	if s.keyFormat == KeyFormatPacked {
+		return s.readPackedKeyRecord(keyId)
+	}
+
 	offset := keyId * KeyRecordSize
 	buf := make([]byte, KeyRecordSize)
 
@@ -163,78 +640,410 @@ func (s *Storage) ReadKeyRecord(keyId int64) (*KeyRecord, error) {
 	}
 
 	rec := &KeyRecord{
-		KeyLen:  binary.LittleEndian.Uint16(buf[0:2]),
-		Cas:     binary.LittleEndian.Uint64(buf[1026:1034]),
-		Expiry:  int64(binary.LittleEndian.Uint64(buf[1034:1042])),
-		Bucket:  buf[1042],
-		SlotIdx: int64(binary.LittleEndian.Uint64(buf[1043:1051])),
+		KeyLen:   s.order.Uint16(buf[0:2]),
+		Cas:      s.order.Uint64(buf[1026:1034]),
+		Expiry:   int64(s.order.Uint64(buf[1034:1042])),
+		Bucket:   buf[1042],
+		SlotIdx:  int64(s.order.Uint64(buf[1043:1051])),
+		DataType: buf[1051],
+		Flags:    s.order.Uint32(buf[1052:1056]),
+		CRC:      s.order.Uint32(buf[1056:1060]),
 	}
 	copy(rec.Key[:], buf[2:1026])
 
+	if err := checkKeyRecord(rec, buf); err != nil {
+		return nil, fmt.Errorf("key id %d: %w", keyId, err)
+	}
 	return rec, nil
 }
 
-// WriteKeyRecord writes a key record at the given keyId
-func (s *Storage) WriteKeyRecord(keyId int64, rec *KeyRecord) error {
-	offset := keyId * KeyRecordSize
-	buf := make([]byte, KeyRecordSize)
+// readPackedKeyRecord reads a variable-length key record at the given byte offset
+func (s *Storage) readPackedKeyRecord(offset int64) (*KeyRecord, error) {
+	lenBuf := make([]byte, 2)
+	if _, err := s.keysFile.ReadAt(lenBuf, offset); err != nil {
+		return nil, err
+	}
+	keyLen := int(s.order.Uint16(lenBuf))
+	if keyLen > MaxKeySize {
+		return nil, fmt.Errorf("invalid key length %d at offset %d", keyLen, offset)
+	}
+
+	buf := make([]byte, PackedKeyRecordSize(keyLen))
+	if _, err := s.keysFile.ReadAt(buf[2:], offset+2); err != nil {
+		return nil, err
+	}
+	copy(buf[0:2], lenBuf)
+	body := buf[2:]
+
+	rec := &KeyRecord{
+		KeyLen:   uint16(keyLen),
+		Cas:      s.order.Uint64(body[keyLen : keyLen+8]),
+		Expiry:   int64(s.order.Uint64(body[keyLen+8 : keyLen+16])),
+		Bucket:   body[keyLen+16],
+		SlotIdx:  int64(s.order.Uint64(body[keyLen+17 : keyLen+25])),
+		DataType: body[keyLen+25],
+		Flags:    s.order.Uint32(body[keyLen+26 : keyLen+30]),
+		CRC:      s.order.Uint32(body[keyLen+30 : keyLen+34]),
+	}
+	copy(rec.Key[:], body[:keyLen])
+
+	if err := checkKeyRecord(rec, buf); err != nil {
+		return nil, fmt.Errorf("offset %d: %w", offset, err)
+	}
+	return rec, nil
+}
+
+// checkKeyRecord verifies the CRC of an encoded record, zero-filled
+// (preallocated) records carry no CRC and are passed as unused
+func checkKeyRecord(rec *KeyRecord, buf []byte) error {
+	if rec.CRC == 0 && isUnusedKeyRecord(rec) {
+		return nil
+	}
+	if crc32.ChecksumIEEE(buf[:len(buf)-4]) != rec.CRC {
+		return ErrKeyChecksum
+	}
+	return nil
+}
+
+// encodeKeyRecord serializes a key record in the current key format
+func (s *Storage) encodeKeyRecord(rec *KeyRecord) []byte {
+	if s.keyFormat == KeyFormatPacked {
+		keyLen := int(rec.KeyLen)
+		buf := make([]byte, PackedKeyRecordSize(keyLen))
+		s.order.PutUint16(buf[0:2], rec.KeyLen)
+		copy(buf[2:2+keyLen], rec.Key[:keyLen])
+		s.order.PutUint64(buf[2+keyLen:10+keyLen], rec.Cas)
+		s.order.PutUint64(buf[10+keyLen:18+keyLen], uint64(rec.Expiry))
+		buf[18+keyLen] = rec.Bucket
+		s.order.PutUint64(buf[19+keyLen:27+keyLen], uint64(rec.SlotIdx))
+		buf[27+keyLen] = rec.DataType
+		s.order.PutUint32(buf[28+keyLen:32+keyLen], rec.Flags)
+		s.order.PutUint32(buf[32+keyLen:36+keyLen], crc32.ChecksumIEEE(buf[:32+keyLen]))
+		return buf
+	}
 
-	binary.LittleEndian.PutUint16(buf[0:2], rec.KeyLen)
+	buf := make([]byte, KeyRecordSize)
+	s.order.PutUint16(buf[0:2], rec.KeyLen)
 	copy(buf[2:1026], rec.Key[:])
-	binary.LittleEndian.PutUint64(buf[1026:1034], rec.Cas)
-	binary.LittleEndian.PutUint64(buf[1034:1042], uint64(rec.Expiry))
+	s.order.PutUint64(buf[1026:1034], rec.Cas)
+	s.order.PutUint64(buf[1034:1042], uint64(rec.Expiry))
 	buf[1042] = rec.Bucket
-	binary.LittleEndian.PutUint64(buf[1043:1051], uint64(rec.SlotIdx))
+	s.order.PutUint64(buf[1043:1051], uint64(rec.SlotIdx))
+	buf[1051] = rec.DataType
+	s.order.PutUint32(buf[1052:1056], rec.Flags)
+	s.order.PutUint32(buf[1056:1060], crc32.ChecksumIEEE(buf[:1056]))
+	return buf
+}
+
+// WriteKeyRecord writes a key record at the given keyId.
+// In the packed format an existing record may only be overwritten with the same key length.
+func (s *Storage) WriteKeyRecord(keyId int64, rec *KeyRecord) error {
+	_, err := s.keysFile.WriteAt(s.encodeKeyRecord(rec), s.keyOffset(keyId))
+	return s.syncWrite(s.keysFile, err)
+}
 
-	_, err := s.keysFile.WriteAt(buf, offset)
+// syncWrite fsyncs f after a successful write or truncate in SyncAlways mode
+func (s *Storage) syncWrite(f *os.File, err error) error {
 	if err == nil && s.syncAlways {
-		err = s.keysFile.Sync()
+		err = f.Sync()
 	}
 	return err
 }
 
+// ScanKeyRecords calls fn for every record in the keys file and returns the
+// key id following the last record. Unreadable fixed records are skipped, a
+// packed file is cut off at the first unreadable record. Both are cut off at
+// the first record failing its CRC (a torn write), a fixed file also at a
+// partial record (an interrupted append). Zero-filled (preallocated) records
+// are unused and not passed to fn.
+func (s *Storage) ScanKeyRecords(fn func(keyId int64, rec *KeyRecord)) (int64, error) {
+	size, err := s.KeysFileSize()
+	if err != nil {
+		return 0, err
+	}
+
+	if s.keyFormat != KeyFormatPacked {
+		if partial := size % KeyRecordSize; partial != 0 {
+			slog.Warn("Truncating partial key record", "file", s.keysFile.Name(), "bytes", partial)
+			if err := s.TruncateKeysFile(size / KeyRecordSize); err != nil {
+				return 0, err
+			}
+		}
+		var keyCount int64
+		for keyId := int64(0); keyId < size/KeyRecordSize; keyId++ {
+			rec, err := s.ReadKeyRecord(keyId)
+			if errors.Is(err, ErrKeyChecksum) {
+				slog.Warn("Truncating torn key record", "file", s.keysFile.Name(), "key_id", keyId)
+				if err := s.TruncateKeysFile(keyId); err != nil {
+					return 0, err
+				}
+				return keyId, nil
+			}
+			if err != nil {
+				keyCount = keyId + 1
+				continue // Skip unreadable records
+			}
+			if isUnusedKeyRecord(rec) {
+				continue
+			}
+			fn(keyId, rec)
+			keyCount = keyId + 1
+		}
+		return keyCount, nil
+	}
+
+	var offset int64
+	for offset < size {
+		rec, err := s.readPackedKeyRecord(offset)
+		if err != nil || isUnusedKeyRecord(rec) {
+			break // Truncated or damaged tail
+		}
+		fn(offset, rec)
+		offset += PackedKeyRecordSize(int(rec.KeyLen))
+	}
+	if offset < size {
+		slog.Warn("Truncating damaged key records", "file", s.keysFile.Name(), "bytes", size-offset)
+		if err := s.TruncateKeysFile(offset); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// isUnusedKeyRecord reports whether a record is zero-filled space (keys are never empty)
+func isUnusedKeyRecord(rec *KeyRecord) bool {
+	return rec.KeyLen == 0 && rec.Expiry == 0 && rec.Cas == 0
+}
+
+// RewriteKeys replaces the keys file with the given records in the current
+// key format. It returns the new key id of each record and the next key id.
+func (s *Storage) RewriteKeys(recs []*KeyRecord) ([]int64, int64, error) {
+	keysPath := filepath.Join(s.dataDir, "keys")
+	tmpPath := keysPath + ".tmp"
+	tmpFile, err := s.openFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	keyIds := make([]int64, len(recs))
+	var nextKeyId, offset int64
+	for i, rec := range recs {
+		buf := s.encodeKeyRecord(rec)
+		if _, err := tmpFile.WriteAt(buf, offset); err != nil {
+			tmpFile.Close()
+			os.Remove(tmpPath)
+			return nil, 0, err
+		}
+		keyIds[i] = nextKeyId
+		nextKeyId += s.KeyIdSpan(int(rec.KeyLen))
+		offset += int64(len(buf))
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return nil, 0, err
+	}
+	if err := os.Rename(tmpPath, keysPath); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return nil, 0, err
+	}
+
+	s.filesMu.Lock()
+	s.keysFile.Close()
+	s.keysFile = tmpFile
+	s.filesMu.Unlock()
+	return keyIds, nextKeyId, nil
+}
+
 // ReadDataSlot reads data from a bucket slot
 func (s *Storage) ReadDataSlot(bucket int, slotIdx int64) ([]byte, error) {
+	s.dataReads.Add(1)
 	slotSize := s.SlotSize(bucket)
 	offset := slotIdx * int64(slotSize)
 
-	// Read header
-	header := make([]byte, DataHeaderSize)
-	if _, err := s.dataFiles[bucket].ReadAt(header, offset); err != nil {
+	data, flag, err := s.readSlot(bucket, offset, false)
+	if err != nil {
+		return nil, err
+	}
+	if flag == FlagCompressed {
+		return s.decompress(data)
+	}
+	return data, nil
+}
+
+// ReadDataSlotFile is ReadDataSlot without the mappings of UseMmap, so it
+// may run outside the worker goroutine. It can read a slot that is being
+// rewritten, callers must check the slot did not change meanwhile.
+func (s *Storage) ReadDataSlotFile(bucket int, slotIdx int64) ([]byte, error) {
+	s.dataReads.Add(1)
+	data, flag, err := s.readSlot(bucket, slotIdx*int64(s.SlotSize(bucket)), true)
+	if err != nil {
 		return nil, err
 	}
+	if flag == FlagCompressed {
+		return s.decompress(data)
+	}
+	return data, nil
+}
 
-	if header[0] == FlagDeleted {
-		return nil, ErrKeyNotFound
+// readSlot reads the data and flag of the slot at offset, verifying its
+// length and, unless the data dir is legacy, its checksum. With fromFile
+// it reads with ReadAt only.
+func (s *Storage) readSlot(bucket int, offset int64, fromFile bool) ([]byte, byte, error) {
+	read := func(buf []byte, offset int64) error {
+		if fromFile {
+			_, err := s.dataFiles[bucket].ReadAt(buf, offset)
+			return err
+		}
+		return s.readData(bucket, buf, offset)
 	}
 
-	length := binary.LittleEndian.Uint32(header[1:5])
+	header := make([]byte, s.headerSize)
+	if err := read(header, offset); err != nil {
+		return nil, 0, err
+	}
+	if header[0] == FlagDeleted {
+		return nil, 0, ErrKeyNotFound
+	}
 
-	// Read data
+	length := s.order.Uint32(header[1:5])
+	if int64(length) > int64(s.bucketSizes[bucket]) {
+		return nil, 0, fmt.Errorf("%w: length %d exceeds slot size %d", ErrCorrupt, length, s.bucketSizes[bucket])
+	}
 	data := make([]byte, length)
-	if _, err := s.dataFiles[bucket].ReadAt(data, offset+DataHeaderSize); err != nil {
-		return nil, err
+	if err := read(data, offset+int64(s.headerSize)); err != nil {
+		return nil, 0, err
+	}
+	if s.headerSize == DataHeaderSize && crc32.ChecksumIEEE(data) != s.order.Uint32(header[5:9]) {
+		return nil, 0, ErrCorrupt
 	}
+	return data, header[0], nil
+}
 
-	return data, nil
+// readData fills buf from a data file at offset, copying from the mapping
+// when UseMmap is set and falling back to ReadAt when it cannot be mapped
+func (s *Storage) readData(bucket int, buf []byte, offset int64) error {
+	if s.useMmap {
+		if m := s.mapped(bucket, offset+int64(len(buf))); m != nil {
+			copy(buf, m[offset:])
+			return nil
+		}
+	}
+	_, err := s.dataFiles[bucket].ReadAt(buf, offset)
+	return err
+}
+
+// mapped returns a mapping of a data file covering at least end bytes,
+// remapping the file when it has grown, or nil if the file is shorter
+func (s *Storage) mapped(bucket int, end int64) []byte {
+	if int64(len(s.maps[bucket])) >= end {
+		return s.maps[bucket]
+	}
+	size, err := s.DataFileSize(bucket)
+	if err != nil || size < end {
+		return nil
+	}
+	s.unmap(bucket)
+	m, err := mmapFile(s.dataFiles[bucket], size)
+	if err != nil {
+		s.useMmap = false // Not available, keep using ReadAt
+		return nil
+	}
+	s.maps[bucket] = m
+	return m
+}
+
+// unmap drops the mapping of a data file, it must be called before the
+// file shrinks as reading mapped pages past the end of a file faults
+func (s *Storage) unmap(bucket int) {
+	if s.maps[bucket] != nil {
+		munmapFile(s.maps[bucket])
+		s.maps[bucket] = nil
+	}
+}
+
+// ReadRawDataSlot reads the data of a bucket slot as stored, with its flag
+func (s *Storage) ReadRawDataSlot(bucket int, slotIdx int64) ([]byte, byte, error) {
+	return s.readSlot(bucket, slotIdx*int64(s.SlotSize(bucket)), false)
+}
+
+// EncodeValue returns the slot data and flag to store a value with,
+// compressed when enabled, large enough and smaller for it
+func (s *Storage) EncodeValue(value []byte) ([]byte, byte) {
+	if s.compression != CompressionFlate || len(value) < s.compressionThreshold {
+		return value, FlagInUse
+	}
+
+	var buf bytes.Buffer
+	lenBuf := make([]byte, 4)
+	s.order.PutUint32(lenBuf, uint32(len(value)))
+	buf.Write(lenBuf)
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return value, FlagInUse
+	}
+	if _, err := fw.Write(value); err != nil || fw.Close() != nil {
+		return value, FlagInUse
+	}
+	if buf.Len() >= len(value) {
+		return value, FlagInUse // Incompressible
+	}
+	return buf.Bytes(), FlagCompressed
 }
 
-// WriteDataSlot writes data to a bucket slot
-func (s *Storage) WriteDataSlot(bucket int, slotIdx int64, data []byte) error {
+// decompress restores a value stored with FlagCompressed
+func (s *Storage) decompress(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("compressed value too short: %d bytes", len(data))
+	}
+	value := make([]byte, s.order.Uint32(data[0:4]))
+	fr := flate.NewReader(bytes.NewReader(data[4:]))
+	defer fr.Close()
+	if _, err := io.ReadFull(fr, value); err != nil {
+		return nil, fmt.Errorf("decompressing value: %w", err)
+	}
+	return value, nil
+}
+
+// ReadDataLength reads only the (uncompressed) value length from a bucket slot
+func (s *Storage) ReadDataLength(bucket int, slotIdx int64) (int, error) {
+	offset := slotIdx * int64(s.SlotSize(bucket))
+
+	header := make([]byte, s.headerSize)
+	if err := s.readData(bucket, header, offset); err != nil {
+		return 0, err
+	}
+	if header[0] == FlagDeleted {
+		return 0, ErrKeyNotFound
+	}
+	if header[0] == FlagCompressed {
+		lenBuf := make([]byte, 4)
+		if err := s.readData(bucket, lenBuf, offset+int64(s.headerSize)); err != nil {
+			return 0, err
+		}
+		return int(s.order.Uint32(lenBuf)), nil
+	}
+	return int(s.order.Uint32(header[1:5])), nil
+}
+
+// WriteDataSlot writes data to a bucket slot with its flag (FlagInUse for a
+// value as given, or the flag returned by EncodeValue)
+func (s *Storage) WriteDataSlot(bucket int, slotIdx int64, data []byte, flag byte) error {
 	slotSize := s.SlotSize(bucket)
 	offset := slotIdx * int64(slotSize)
 
 	// Prepare buffer with header + data (padded to slot size)
 	buf := make([]byte, slotSize)
-	buf[0] = FlagInUse
-	binary.LittleEndian.PutUint32(buf[1:5], uint32(len(data)))
-	copy(buf[DataHeaderSize:], data)
+	buf[0] = flag
+	s.order.PutUint32(buf[1:5], uint32(len(data)))
+	if s.headerSize == DataHeaderSize {
+		s.order.PutUint32(buf[5:9], crc32.ChecksumIEEE(data))
+	}
+	copy(buf[s.headerSize:], data)
 
 	_, err := s.dataFiles[bucket].WriteAt(buf, offset)
-	if err == nil && s.syncAlways {
-		err = s.dataFiles[bucket].Sync()
-	}
-	return err
+	return s.syncWrite(s.dataFiles[bucket], err)
 }
 
 // MarkDataFree marks a data slot as free
@@ -242,7 +1051,17 @@ func (s *Storage) MarkDataFree(bucket int, slotIdx int64) error {
 	slotSize := s.SlotSize(bucket)
 	offset := slotIdx * int64(slotSize)
 	_, err := s.dataFiles[bucket].WriteAt([]byte{FlagDeleted}, offset)
-	return err
+	return s.syncWrite(s.dataFiles[bucket], err)
+}
+
+// DataReads returns the number of data slot reads since the storage was opened
+func (s *Storage) DataReads() uint64 {
+	return s.dataReads.Load()
+}
+
+// Syncs returns the number of Sync calls since the storage was opened
+func (s *Storage) Syncs() uint64 {
+	return s.syncs.Load()
 }
 
 // KeysFileSize returns the current size of the keys file
@@ -263,7 +1082,7 @@ func (s *Storage) DataFileSize(bucket int) (int64, error) {
 	return info.Size(), nil
 }
 
-// KeyCount returns the number of key slots in the file
+// KeyCount returns the number of key slots in the file (fixed key format)
 func (s *Storage) KeyCount() (int64, error) {
 	size, err := s.KeysFileSize()
 	if err != nil {
@@ -281,23 +1100,35 @@ func (s *Storage) SlotCount(bucket int) (int64, error) {
 	return size / int64(s.SlotSize(bucket)), nil
 }
 
-// UpdateSlotIdx updates only the slotIdx field in a key record
+// UpdateSlotIdx updates the slotIdx field in a key record, the whole record
+// is rewritten to keep its CRC valid
 func (s *Storage) UpdateSlotIdx(keyId int64, slotIdx int64) error {
-	offset := keyId*KeyRecordSize + 2 + MaxKeySize + 8 + 8 + 1 // Skip keyLen + key + cas + expiry + bucket
-	buf := make([]byte, 8)
-	binary.LittleEndian.PutUint64(buf, uint64(slotIdx))
-	_, err := s.keysFile.WriteAt(buf, offset)
-	return err
+	rec, err := s.ReadKeyRecord(keyId)
+	if err != nil {
+		return err
+	}
+	rec.SlotIdx = slotIdx
+	_, err = s.keysFile.WriteAt(s.encodeKeyRecord(rec), s.keyOffset(keyId))
+	return s.syncWrite(s.keysFile, err)
 }
 
 // TruncateDataFile truncates a data bucket file to the given slot count
 func (s *Storage) TruncateDataFile(bucket int, slotCount int64) error {
 	newSize := slotCount * int64(s.SlotSize(bucket))
-	return s.dataFiles[bucket].Truncate(newSize)
+	if int64(len(s.maps[bucket])) > newSize {
+		s.unmap(bucket)
+	}
+	return s.syncWrite(s.dataFiles[bucket], s.truncateFile(s.dataFiles[bucket], newSize))
+}
+
+// TruncateKeysFile truncates the keys file at the given key id (the key count in the fixed format)
+func (s *Storage) TruncateKeysFile(keyId int64) error {
+	return s.syncWrite(s.keysFile, s.truncateFile(s.keysFile, s.keyOffset(keyId)))
 }
 
-// TruncateKeysFile truncates the keys file to the given key count
-func (s *Storage) TruncateKeysFile(keyCount int64) error {
-	newSize := keyCount * KeyRecordSize
-	return s.keysFile.Truncate(newSize)
+func (s *Storage) truncateFile(f *os.File, size int64) error {
+	if s.truncate != nil {
+		return s.truncate(f, size)
+	}
+	return f.Truncate(size)
 }
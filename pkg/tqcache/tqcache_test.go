@@ -1,8 +1,19 @@
 package tqcache
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -297,6 +308,47 @@ func TestTouch(t *testing.T) {
 	}
 }
 
+func TestGetAndTouch(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	if _, err := c.GetAndTouch("key1", time.Hour); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for a missing key, got %v", err)
+	}
+
+	cas, err := c.Store(Op{Op: OpSet, Key: "key1", Value: []byte("value"), TTL: time.Second, Flags: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := c.GetAndTouch("key1", time.Hour)
+	if err != nil {
+		t.Fatalf("GetAndTouch failed: %v", err)
+	}
+	if string(item.Value) != "value" || item.Flags != 3 || item.Cas != cas {
+		t.Errorf("Unexpected item %+v", item)
+	}
+	// The returned TTL is the new one, as stored
+	if item.TTL <= 59*time.Minute || item.TTL > time.Hour {
+		t.Errorf("Expected a TTL of about 1h, got %v", item.TTL)
+	}
+	if _, _, ttl, err := c.GetWithTTL("key1"); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("Expected the stored TTL to be about 1h, got %v (err=%v)", ttl, err)
+	}
+
+	// A TTL in the past returns the value and expires the key
+	if item, err := c.GetAndTouch("key1", time.Nanosecond); err != nil || string(item.Value) != "value" {
+		t.Errorf("Expected the value, got %+v (err=%v)", item, err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := c.GetAndTouch("key1", time.Hour); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for the expired key, got %v", err)
+	}
+	// Two hits of GetAndTouch and one of GetWithTTL
+	if hits := c.Stats()["get_hits"]; hits != "3" {
+		t.Errorf("Expected GetAndTouch to count as get, got %s hits", hits)
+	}
+}
+
 func TestFlushAll(t *testing.T) {
 	c, cleanup := setupTestCache(t)
 	defer cleanup()
@@ -330,6 +382,47 @@ func TestFlushAll(t *testing.T) {
 	}
 }
 
+func TestFlushAllPersists(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprintf("key_%d", i), []byte("value"), 0)
+	}
+	c.FlushAll()
+	c.Close()
+
+	// Flushed records must not be recovered
+	c, err = NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if items := c.Stats()["curr_items"]; items != "0" {
+		t.Errorf("Expected 0 items after flush and restart, got %s", items)
+	}
+	for i := 0; i < 4; i++ {
+		info, err := os.Stat(fmt.Sprintf("%s/shard_%02d/keys", tmpDir, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != 0 {
+			t.Errorf("Expected empty keys file for shard %d, got %d bytes", i, info.Size())
+		}
+	}
+}
+
 func TestIncrement(t *testing.T) {
 	c, cleanup := setupTestCache(t)
 	defer cleanup()
@@ -362,6 +455,37 @@ func TestIncrement(t *testing.T) {
 	}
 }
 
+func TestIncrDecrLimits(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	// Values that are not a 64-bit unsigned number are rejected
+	for _, value := range []string{"abc", "12abc", " 12", "-1", "+1", "", "18446744073709551616"} {
+		c.Set("counter", []byte(value), 0)
+		if _, _, err := c.Increment("counter", 1); err != ErrNotNumeric {
+			t.Errorf("Increment of %q: expected ErrNotNumeric, got %v", value, err)
+		}
+		if _, _, err := c.Decrement("counter", 1); err != ErrNotNumeric {
+			t.Errorf("Decrement of %q: expected ErrNotNumeric, got %v", value, err)
+		}
+	}
+
+	// Increments wrap around at 2^64
+	c.Set("counter", []byte("18446744073709551615"), 0)
+	if val, _, err := c.Increment("counter", 2); err != nil || val != 1 {
+		t.Errorf("Expected the increment to wrap to 1, got %d (err=%v)", val, err)
+	}
+
+	// Decrements stop at 0
+	c.Set("counter", []byte("5"), 0)
+	if val, _, err := c.Decrement("counter", 10); err != nil || val != 0 {
+		t.Errorf("Expected the decrement to stop at 0, got %d (err=%v)", val, err)
+	}
+	if val, _, _ := c.Get("counter"); string(val) != "0" {
+		t.Errorf("Expected stored value 0, got %q", val)
+	}
+}
+
 func TestDecrement(t *testing.T) {
 	c, cleanup := setupTestCache(t)
 	defer cleanup()
@@ -507,7 +631,18 @@ func TestExpiry(t *testing.T) {
 	}
 }
 
-func TestMaxTTL(t *testing.T) {
+// currItems returns the item count of all shards, asked of the workers so it
+// does not race with their background sweeps
+func currItems(c *ShardedCache) string {
+	total := 0
+	for i := range c.workers {
+		n, _ := strconv.Atoi(c.sendRequest(i, &Request{Op: OpStats}).Stats["curr_items"])
+		total += n
+	}
+	return strconv.Itoa(total)
+}
+
+func TestExpirySweep(t *testing.T) {
 	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
 	if err != nil {
 		t.Fatal(err)
@@ -517,95 +652,222 @@ func TestMaxTTL(t *testing.T) {
 	config := DefaultConfig()
 	config.DataDir = tmpDir
 	config.SyncStrategy = SyncNone
-	config.MaxTTL = 200 * time.Millisecond // Max TTL of 200ms
 
-	c, err := NewSharded(config, 4)
+	c, err := NewSharded(config, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer c.Close()
 
-	// Set with TTL larger than max - should be capped
-	_, err = c.Set("capped_key", []byte("capped_value"), 10*time.Second)
-	if err != nil {
+	if _, err := c.Set("sweep_key", []byte("sweep_value"), time.Second); err != nil {
 		t.Fatalf("Set failed: %v", err)
 	}
 
-	// Key should exist initially
-	val, _, err := c.Get("capped_key")
+	// Never read the key, the periodic sweep must delete it
+	time.Sleep(1500 * time.Millisecond)
+
+	if items := currItems(c); items != "0" {
+		t.Errorf("Expected 0 items after sweep, got %s", items)
+	}
+	files, err := filepath.Glob(filepath.Join(tmpDir, "shard_00", "data_*"))
 	if err != nil {
-		t.Fatalf("Get failed: %v", err)
+		t.Fatal(err)
 	}
-	if string(val) != "capped_value" {
-		t.Errorf("Expected 'capped_value', got '%s'", val)
+	for _, file := range append(files, filepath.Join(tmpDir, "shard_00", "keys")) {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != 0 {
+			t.Errorf("Expected %s to be truncated after sweep, got %d bytes", filepath.Base(file), info.Size())
+		}
 	}
+}
 
-	// Wait for max TTL to expire (not the requested 10s)
-	time.Sleep(300 * time.Millisecond)
-
-	// Should be gone because TTL was capped to 200ms
-	_, _, err = c.Get("capped_key")
-	if err != ErrKeyNotFound {
-		t.Errorf("Expected ErrKeyNotFound after max TTL expiry, got %v (MaxTTL cap not applied?)", err)
+func TestCompact(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(tmpDir)
 
-	t.Log("MaxTTL correctly caps requested TTL values")
-}
-
-func TestLargeValue(t *testing.T) {
-	c, cleanup := setupTestCache(t)
-	defer cleanup()
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
 
-	// Test with 1KB value (should fit in bucket 0)
-	val1K := make([]byte, 1024)
-	for i := range val1K {
-		val1K[i] = byte(i % 256)
+	dataSize := func(c *ShardedCache) int64 {
+		size, err := c.workers[0].Storage().DataFileSize(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return size
+	}
+	// Half the keys expire while the cache is closed, recovery skips them
+	// and leaves their data slots free
+	fill := func() {
+		c, err := NewSharded(config, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 200; i++ {
+			ttl := time.Duration(0)
+			if i%2 == 0 {
+				ttl = 500 * time.Millisecond
+			}
+			if _, err := c.Set(fmt.Sprintf("key_%d", i), []byte(fmt.Sprintf("value_%d", i)), ttl); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c.Close()
+		time.Sleep(600 * time.Millisecond)
+	}
+	check := func(c *ShardedCache) {
+		for i := 1; i < 200; i += 2 {
+			val, _, err := c.Get(fmt.Sprintf("key_%d", i))
+			if err != nil || string(val) != fmt.Sprintf("value_%d", i) {
+				t.Errorf("key_%d damaged by compaction: %q (err=%v)", i, val, err)
+			}
+		}
 	}
 
-	cas, err := c.Set("key1k", val1K, 0)
+	fill()
+	c, err := NewSharded(config, 1)
 	if err != nil {
-		t.Fatalf("Set 1K value failed: %v", err)
+		t.Fatal(err)
 	}
-	if cas == 0 {
-		t.Error("Expected non-zero CAS")
+	time.Sleep(150 * time.Millisecond) // Let the worker count the free slots
+	if ratio := c.Stats()["compaction_ratio"]; ratio != "0.5" {
+		t.Errorf("Expected compaction_ratio 0.5, got %s", ratio)
 	}
-
-	retrieved, _, err := c.Get("key1k")
+	before := dataSize(c)
+	if err := c.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if after := dataSize(c); after*2 != before {
+		t.Errorf("Expected the data file to shrink from %d to %d bytes, got %d", before, before/2, after)
+	}
+	if ratio := c.Stats()["compaction_ratio"]; ratio != "0" {
+		t.Errorf("Expected compaction_ratio 0 after Compact, got %s", ratio)
+	}
+	check(c)
+	c.Close()
+
+	// Above CompactionRatio the worker compacts by itself
+	os.RemoveAll(tmpDir)
+	fill()
+	config.CompactionRatio = 0.25
+	c, err = NewSharded(config, 1)
 	if err != nil {
-		t.Fatalf("Get 1K value failed: %v", err)
+		t.Fatal(err)
 	}
-	if len(retrieved) != 1024 {
-		t.Errorf("Expected 1024 bytes, got %d", len(retrieved))
+	defer c.Close()
+	before = dataSize(c)
+	time.Sleep(150 * time.Millisecond)
+	if after := dataSize(c); after*2 != before {
+		t.Errorf("Expected background compaction to shrink the data file from %d to %d bytes, got %d", before, before/2, after)
 	}
-	for i := 0; i < 1024; i++ {
-		if retrieved[i] != byte(i%256) {
-			t.Errorf("Byte mismatch at %d: expected %d, got %d", i, byte(i%256), retrieved[i])
-			break
+	check(c)
+}
+
+func TestExpirySweepInterval(t *testing.T) {
+	for _, interval := range []time.Duration{10 * time.Millisecond, 0} {
+		tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+		if err != nil {
+			t.Fatal(err)
 		}
-	}
+		defer os.RemoveAll(tmpDir)
 
-	// Test with 10KB value (should fit in bucket 3: 8KB < 10KB <= 16KB)
-	val10K := make([]byte, 10*1024)
-	for i := range val10K {
-		val10K[i] = byte((i * 7) % 256)
+		config := DefaultConfig()
+		config.DataDir = tmpDir
+		config.SyncStrategy = SyncNone
+		config.ExpirySweepInterval = interval
+
+		c, err := NewSharded(config, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if _, err := c.Set("short", []byte("value"), 20*time.Millisecond); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+		// Longer than the TTL and the sweep interval, shorter than the default
+		time.Sleep(60 * time.Millisecond)
+
+		items := currItems(c)
+		if interval > 0 && items != "0" {
+			t.Errorf("Expected the sweep every %v to delete the key, got %s items", interval, items)
+		}
+		if interval == 0 {
+			time.Sleep(DefaultExpirySweepInterval) // No sweep at the default interval either
+			if items := currItems(c); items != "1" {
+				t.Errorf("Expected the key to stay without a sweep, got %s items", items)
+			}
+			if _, _, err := c.Get("short"); err != ErrKeyNotFound {
+				t.Errorf("Expected ErrKeyNotFound for the expired key, got %v", err)
+			}
+			if items := currItems(c); items != "0" {
+				t.Errorf("Expected the get to delete the expired key, got %s items", items)
+			}
+		}
 	}
+}
 
-	_, err = c.Set("key10k", val10K, 0)
+func TestIdleTimeout(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
 	if err != nil {
-		t.Fatalf("Set 10K value failed: %v", err)
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(tmpDir)
 
-	retrieved, _, err = c.Get("key10k")
+	idle := make(chan string, 10)
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.ExpirySweepInterval = 10 * time.Millisecond
+	config.IdleTimeout = 100 * time.Millisecond
+	config.OnEvict = func(key string, reason EvictReason) {
+		if reason == ReasonIdle {
+			idle <- key
+		}
+	}
+
+	c, err := NewSharded(config, 1)
 	if err != nil {
-		t.Fatalf("Get 10K value failed: %v", err)
+		t.Fatal(err)
 	}
-	if len(retrieved) != 10*1024 {
-		t.Errorf("Expected 10240 bytes, got %d", len(retrieved))
+	defer c.Close()
+
+	for _, key := range []string{"read", "untouched"} {
+		if _, err := c.Set(key, []byte("value"), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reads keep a key alive, well past the idle timeout
+	for i := 0; i < 8; i++ {
+		time.Sleep(25 * time.Millisecond)
+		if _, _, err := c.Get("read"); err != nil {
+			t.Fatalf("Expected the read key to survive, got %v", err)
+		}
+	}
+	if items := c.Stats()["curr_items"]; items != "1" {
+		t.Errorf("Expected only the read key left, got %s items", items)
+	}
+	select {
+	case key := <-idle:
+		if key != "untouched" {
+			t.Errorf("Expected the untouched key to be swept, got %q", key)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected an idle event for the untouched key")
+	}
+	if _, _, err := c.Get("untouched"); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for the idle key, got %v", err)
 	}
 }
 
-func TestPersistence(t *testing.T) {
-	tmpDir, err := os.MkdirTemp("", "tqcache_persistence_test")
+func TestGetStale(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -613,61 +875,384 @@ func TestPersistence(t *testing.T) {
 
 	config := DefaultConfig()
 	config.DataDir = tmpDir
-	config.SyncStrategy = SyncAlways // Ensure persistence
+	config.SyncStrategy = SyncNone
+	config.ServeStale = 300 * time.Millisecond
 
-	// Phase 1: Create cache, write items
-	c, err := NewSharded(config, 4)
+	c, err := NewSharded(config, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer c.Close()
 
-	// Write some items
-	c.Set("key1", []byte("value1"), 0)
-	c.Set("key2", []byte("value2"), 0)
-	c.Set("key3", []byte("value3"), 0)
+	c.Set("key", []byte("value"), 50*time.Millisecond)
+	c.Set("other", []byte("old"), 50*time.Millisecond)
 
-	// Close the cache
-	if err := c.Close(); err != nil {
-		t.Fatal(err)
+	// Fresh
+	if val, _, expired, err := c.GetStale("key"); err != nil || string(val) != "value" || expired {
+		t.Errorf("Expected a fresh value, got %q expired=%v (err=%v)", val, expired, err)
 	}
 
-	// Phase 2: Reopen cache and verify data persisted
-	c2, err := NewSharded(config, 4)
+	// Within the grace window, past a sweep
+	time.Sleep(150 * time.Millisecond)
+	if _, _, err := c.Get("key"); err != ErrKeyNotFound {
+		t.Errorf("Expected Get to miss an expired key, got %v", err)
+	}
+	if val, _, expired, err := c.GetStale("key"); err != nil || string(val) != "value" || !expired {
+		t.Errorf("Expected a stale value, got %q expired=%v (err=%v)", val, expired, err)
+	}
+	// Other commands see the stale key as missing
+	if _, err := c.Add("other", []byte("new"), 0); err != nil {
+		t.Errorf("Expected Add over a stale key to succeed, got %v", err)
+	}
+	if val, _, expired, err := c.GetStale("other"); err != nil || string(val) != "new" || expired {
+		t.Errorf("Expected the added value, got %q expired=%v (err=%v)", val, expired, err)
+	}
+
+	// Past the grace window the sweep deletes it
+	time.Sleep(300 * time.Millisecond)
+	if _, _, _, err := c.GetStale("key"); err != ErrKeyNotFound {
+		t.Errorf("Expected GetStale to miss past the grace window, got %v", err)
+	}
+	if items := c.Stats()["curr_items"]; items != "1" {
+		t.Errorf("Expected 1 item after the grace window, got %s", items)
+	}
+}
+
+func TestMaxTTL(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer c2.Close()
+	defer os.RemoveAll(tmpDir)
 
-	// Verify all items exist
-	val, _, err := c2.Get("key1")
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.MaxTTL = 200 * time.Millisecond // Max TTL of 200ms
+
+	c, err := NewSharded(config, 4)
 	if err != nil {
-		t.Errorf("key1 should exist after restart: %v", err)
-	} else if string(val) != "value1" {
-		t.Errorf("key1 value mismatch: expected 'value1', got '%s'", val)
+		t.Fatal(err)
 	}
+	defer c.Close()
 
-	val, _, err = c2.Get("key2")
+	// Set with TTL larger than max - should be capped
+	_, err = c.Set("capped_key", []byte("capped_value"), 10*time.Second)
 	if err != nil {
-		t.Errorf("key2 should exist after restart: %v", err)
-	} else if string(val) != "value2" {
-		t.Errorf("key2 value mismatch: expected 'value2', got '%s'", val)
+		t.Fatalf("Set failed: %v", err)
 	}
 
-	val, _, err = c2.Get("key3")
+	// Key should exist initially
+	val, _, err := c.Get("capped_key")
 	if err != nil {
-		t.Errorf("key3 should exist after restart: %v", err)
-	} else if string(val) != "value3" {
-		t.Errorf("key3 value mismatch: expected 'value3', got '%s'", val)
+		t.Fatalf("Get failed: %v", err)
+	}
+	if string(val) != "capped_value" {
+		t.Errorf("Expected 'capped_value', got '%s'", val)
 	}
 
-	t.Log("Persistence test passed: data survives restart")
-}
+	// Wait for max TTL to expire (not the requested 10s)
+	time.Sleep(300 * time.Millisecond)
 
-func TestMultipleKeys(t *testing.T) {
-	c, cleanup := setupTestCache(t)
-	defer cleanup()
+	// Should be gone because TTL was capped to 200ms
+	_, _, err = c.Get("capped_key")
+	if err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound after max TTL expiry, got %v (MaxTTL cap not applied?)", err)
+	}
 
-	// Write 100 items
+	t.Log("MaxTTL correctly caps requested TTL values")
+}
+
+func TestTouchMaxTTL(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.MaxTTL = time.Hour
+	config.DefaultTTL = 30 * time.Minute
+
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ttl := func(key string) time.Duration {
+		meta, err := c.Meta(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta.TTL
+	}
+
+	// Set and touch beyond MaxTTL are capped the same way
+	c.Set("set", []byte("v"), 10*time.Hour)
+	c.Set("touched", []byte("v"), time.Minute)
+	if _, err := c.Touch("touched", 10*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"set", "touched"} {
+		if d := ttl(key); d <= 59*time.Minute || d > time.Hour {
+			t.Errorf("%s: expected TTL capped to 1h, got %v", key, d)
+		}
+	}
+
+	// A zero TTL means DefaultTTL for touch as for set
+	if _, err := c.Touch("touched", 0); err != nil {
+		t.Fatal(err)
+	}
+	if d := ttl("touched"); d <= 29*time.Minute || d > 30*time.Minute {
+		t.Errorf("Expected DefaultTTL after touch with 0, got %v", d)
+	}
+}
+
+func TestDefaultTTLMaxTTL(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.MaxTTL = time.Hour
+
+	// A DefaultTTL above MaxTTL is refused instead of being capped
+	config.DefaultTTL = 10 * time.Hour
+	if _, err := NewSharded(config, 4); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Expected ErrInvalidConfig, got %v", err)
+	}
+
+	config.DefaultTTL = time.Hour
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// A zero TTL gets DefaultTTL, explicit TTLs are capped to MaxTTL
+	if _, err := c.Set("default", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Set("long", []byte("v"), 10*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"default", "long"} {
+		meta, err := c.Meta(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.TTL <= 59*time.Minute || meta.TTL > time.Hour {
+			t.Errorf("%s: expected a TTL of 1h, got %v", key, meta.TTL)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	sizes := defaultBucketLayout.sizes()
+	largest := sizes[len(sizes)-1]
+
+	for _, tt := range []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{"MaxTTL below DefaultTTL", func(c *Config) { c.DefaultTTL, c.MaxTTL = 2*time.Hour, time.Hour }},
+		{"negative DefaultTTL", func(c *Config) { c.DefaultTTL = -time.Second }},
+		{"negative MaxTTL", func(c *Config) { c.MaxTTL = -time.Second }},
+		{"periodic sync without interval", func(c *Config) { c.SyncStrategy, c.SyncInterval = SyncPeriodic, 0 }},
+		{"periodic sync with negative interval", func(c *Config) { c.SyncStrategy, c.SyncInterval = SyncPeriodic, -time.Second }},
+		{"MaxValueSize above the largest bucket", func(c *Config) { c.MaxValueSize = largest + 1 }},
+		{"MaxValueSize above a custom layout", func(c *Config) { c.BucketMinSize, c.BucketCount = 1024, 4 }},
+		{"negative MaxValueSize", func(c *Config) { c.MaxValueSize = -1 }},
+		{"negative MaxDataSize", func(c *Config) { c.MaxDataSize = -1 }},
+		{"invalid bucket layout", func(c *Config) { c.BucketGrowthFactor = 1 }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.DataDir = t.TempDir()
+			tt.modify(&config)
+			if err := config.Validate(); !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("Expected ErrInvalidConfig, got %v", err)
+			}
+			if _, err := NewSharded(config, 1); !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("Expected NewSharded to refuse the config, got %v", err)
+			}
+		})
+	}
+
+	// Limits that are off or at the boundary are valid
+	config := DefaultConfig()
+	config.MaxTTL = 0
+	config.DefaultTTL = time.Hour
+	config.MaxValueSize = largest
+	config.SyncStrategy, config.SyncInterval = SyncNone, 0
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected a valid config, got %v", err)
+	}
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("Expected DefaultConfig to be valid, got %v", err)
+	}
+}
+
+func TestLargeValue(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	// Test with 1KB value (should fit in bucket 0)
+	val1K := make([]byte, 1024)
+	for i := range val1K {
+		val1K[i] = byte(i % 256)
+	}
+
+	cas, err := c.Set("key1k", val1K, 0)
+	if err != nil {
+		t.Fatalf("Set 1K value failed: %v", err)
+	}
+	if cas == 0 {
+		t.Error("Expected non-zero CAS")
+	}
+
+	retrieved, _, err := c.Get("key1k")
+	if err != nil {
+		t.Fatalf("Get 1K value failed: %v", err)
+	}
+	if len(retrieved) != 1024 {
+		t.Errorf("Expected 1024 bytes, got %d", len(retrieved))
+	}
+	for i := 0; i < 1024; i++ {
+		if retrieved[i] != byte(i%256) {
+			t.Errorf("Byte mismatch at %d: expected %d, got %d", i, byte(i%256), retrieved[i])
+			break
+		}
+	}
+
+	// Test with 10KB value (should fit in bucket 3: 8KB < 10KB <= 16KB)
+	val10K := make([]byte, 10*1024)
+	for i := range val10K {
+		val10K[i] = byte((i * 7) % 256)
+	}
+
+	_, err = c.Set("key10k", val10K, 0)
+	if err != nil {
+		t.Fatalf("Set 10K value failed: %v", err)
+	}
+
+	retrieved, _, err = c.Get("key10k")
+	if err != nil {
+		t.Fatalf("Get 10K value failed: %v", err)
+	}
+	if len(retrieved) != 10*1024 {
+		t.Errorf("Expected 10240 bytes, got %d", len(retrieved))
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache_persistence_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncAlways // Ensure persistence
+
+	// Phase 1: Create cache, write items
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write some items
+	c.Set("key1", []byte("value1"), 0)
+	c.Set("key2", []byte("value2"), 0)
+	c.Set("key3", []byte("value3"), 0)
+
+	// Close the cache
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Phase 2: Reopen cache and verify data persisted
+	c2, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	// Verify all items exist
+	val, _, err := c2.Get("key1")
+	if err != nil {
+		t.Errorf("key1 should exist after restart: %v", err)
+	} else if string(val) != "value1" {
+		t.Errorf("key1 value mismatch: expected 'value1', got '%s'", val)
+	}
+
+	val, _, err = c2.Get("key2")
+	if err != nil {
+		t.Errorf("key2 should exist after restart: %v", err)
+	} else if string(val) != "value2" {
+		t.Errorf("key2 value mismatch: expected 'value2', got '%s'", val)
+	}
+
+	val, _, err = c2.Get("key3")
+	if err != nil {
+		t.Errorf("key3 should exist after restart: %v", err)
+	} else if string(val) != "value3" {
+		t.Errorf("key3 value mismatch: expected 'value3', got '%s'", val)
+	}
+
+	t.Log("Persistence test passed: data survives restart")
+}
+
+func TestSyncRecovery(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 20; i++ {
+		c.Set(fmt.Sprintf("key_%d", i), []byte(fmt.Sprintf("value_%d", i)), 0)
+	}
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recover from the files as a crash would leave them, without Close
+	c2, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	for i := 0; i < 20; i++ {
+		val, _, err := c2.Get(fmt.Sprintf("key_%d", i))
+		if err != nil || string(val) != fmt.Sprintf("value_%d", i) {
+			t.Errorf("key_%d not recovered: %q (err=%v)", i, val, err)
+		}
+	}
+}
+
+func TestMultipleKeys(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	// Write 100 items
 	for i := 0; i < 100; i++ {
 		key := fmt.Sprintf("key%02d", i)
 		value := []byte("value" + key)
@@ -863,3 +1448,4250 @@ func TestKeyNotTrimmed(t *testing.T) {
 
 	t.Log("Keys are preserved exactly without trimming")
 }
+
+func TestFarFutureExpiry(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.MaxTTL = 0 // No cap, so the far-future TTL is used as-is
+
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Year 9999 timestamp, as a client would send it (saturates the duration)
+	ttl := time.Until(time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC))
+	if _, err := c.Set("far_key", []byte("far_value"), ttl); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if _, err := c.Touch("far_key", ttl); err != nil {
+		t.Fatalf("Touch failed: %v", err)
+	}
+
+	time.Sleep(150 * time.Millisecond) // Let the expiry cleanup run
+
+	val, _, err := c.Get("far_key")
+	if err != nil {
+		t.Fatalf("Key with far-future expiry vanished: %v", err)
+	}
+	if string(val) != "far_value" {
+		t.Errorf("Expected 'far_value', got '%s'", val)
+	}
+
+	// The remaining TTL must not overflow to a negative duration, whatever
+	// the sub-millisecond part of the clock was when the expiry was set
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("far%d", i)
+		if _, err := c.Set(key, []byte("v"), ttl); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+		if _, _, remaining, err := c.GetWithTTL(key); err != nil || remaining <= 0 {
+			t.Fatalf("Expected a positive remaining TTL for %s, got %v (%v)", key, remaining, err)
+		}
+		item, err := c.GetAndTouch(key, ttl)
+		if err != nil || item.TTL <= 0 {
+			t.Fatalf("Expected a positive TTL after touching %s, got %v", key, err)
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+func TestMaxBufferedBytes(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.MaxBufferedBytes = 256 * 1024 // 256KB across all shards
+
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Saturate all shards with 64KB values from many goroutines
+	value := make([]byte, 64*1024)
+	var wg sync.WaitGroup
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if _, err := c.Set(fmt.Sprintf("key_%d_%d", g, i), value, 0); err != nil {
+					t.Errorf("Set failed: %v", err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	current, peak := c.BufferedBytes()
+	if current != 0 {
+		t.Errorf("Expected 0 buffered bytes after burst, got %d", current)
+	}
+	if peak > config.MaxBufferedBytes {
+		t.Errorf("Peak buffered bytes %d exceeded cap %d", peak, config.MaxBufferedBytes)
+	}
+	if peak == 0 {
+		t.Error("Expected buffered bytes to be tracked")
+	}
+}
+
+func TestMeta(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	// Missing key
+	if _, err := c.Meta("missing"); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	cas, err := c.Set("meta_key", []byte("meta_value"), 0)
+	if err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	storage := c.workers[c.shardFor("meta_key")].Storage()
+	reads := storage.DataReads()
+	meta, err := c.Meta("meta_key")
+	if err != nil {
+		t.Fatalf("Meta failed: %v", err)
+	}
+	if n := storage.DataReads() - reads; n != 0 {
+		t.Errorf("Expected Meta not to read the value, got %d reads", n)
+	}
+	if meta.TTL != 0 {
+		t.Errorf("Expected no TTL, got %v", meta.TTL)
+	}
+	if meta.Fetched {
+		t.Error("Expected fetched=false before any get")
+	}
+	if meta.Cas != cas {
+		t.Errorf("Expected CAS %d, got %d", cas, meta.Cas)
+	}
+	if meta.Bucket != 0 || meta.Size != len("meta_value") {
+		t.Errorf("Expected bucket 0 size %d, got bucket %d size %d", len("meta_value"), meta.Bucket, meta.Size)
+	}
+
+	// Touch sets a TTL but does not count as a fetch
+	if _, err := c.Touch("meta_key", time.Hour); err != nil {
+		t.Fatalf("Touch failed: %v", err)
+	}
+	meta, _ = c.Meta("meta_key")
+	if meta.TTL <= 59*time.Minute || meta.TTL > time.Hour {
+		t.Errorf("Expected TTL close to 1h, got %v", meta.TTL)
+	}
+	if meta.Fetched {
+		t.Error("Expected fetched=false after touch")
+	}
+
+	// Get marks the key as fetched
+	c.Get("meta_key")
+	meta, _ = c.Meta("meta_key")
+	if !meta.Fetched {
+		t.Error("Expected fetched=true after get")
+	}
+	if time.Since(meta.LastAccess) > time.Second {
+		t.Errorf("Expected recent last access, got %v", meta.LastAccess)
+	}
+}
+
+func TestCoalesceGets(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.CoalesceGets = true
+
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Set("hot_key", []byte("hot_value"), 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	shardIdx := c.shardFor("hot_key")
+	worker := c.workers[shardIdx]
+	readsBefore := worker.Storage().DataReads()
+
+	// Block the worker: it stalls sending a response nobody reads yet
+	block := make(chan *Response)
+	worker.RequestChan() <- &Request{Op: OpStats, RespChan: block}
+
+	const readers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, _, err := c.Get("hot_key")
+			if err != nil || string(val) != "hot_value" {
+				t.Errorf("Get failed: val=%q err=%v", val, err)
+			}
+		}()
+	}
+
+	// Let all readers join the in-flight get, then unblock the worker
+	time.Sleep(100 * time.Millisecond)
+	<-block
+	wg.Wait()
+
+	if reads := worker.Storage().DataReads() - readsBefore; reads != 1 {
+		t.Errorf("Expected 1 data read for %d concurrent gets, got %d", readers, reads)
+	}
+}
+
+func TestTruncateFailure(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	// Single shard so all keys share one keys file
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Set("a", []byte("value_a"), 0)
+	c.Set("b", []byte("value_b"), 0)
+	c.Set("c", []byte("value_c"), 0)
+
+	// Inject truncate failures
+	c.workers[0].Storage().truncate = func(f *os.File, size int64) error {
+		return fmt.Errorf("injected truncate failure")
+	}
+
+	if err := c.Delete("a"); err != nil {
+		t.Fatalf("Delete a failed: %v", err)
+	}
+	if err := c.Delete("c"); err != nil {
+		t.Fatalf("Delete c failed: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen without faults: deleted keys must not be resurrected
+	c2, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	for _, key := range []string{"a", "c"} {
+		if _, _, err := c2.Get(key); err != ErrKeyNotFound {
+			t.Errorf("Deleted key %s resurrected after restart: err=%v", key, err)
+		}
+	}
+	val, _, err := c2.Get("b")
+	if err != nil || string(val) != "value_b" {
+		t.Errorf("Expected 'value_b', got %q (err=%v)", val, err)
+	}
+	if items := c2.Stats()["curr_items"]; items != "1" {
+		t.Errorf("Expected 1 item after restart, got %s", items)
+	}
+
+	// New writes after recovery still work
+	c2.Set("d", []byte("value_d"), 0)
+	val, _, err = c2.Get("d")
+	if err != nil || string(val) != "value_d" {
+		t.Errorf("Expected 'value_d', got %q (err=%v)", val, err)
+	}
+}
+
+func TestByteOrder(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Write a record with the big-endian marker
+	s, err := NewStorage(tmpDir, StorageOptions{ByteOrder: binary.BigEndian})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &KeyRecord{KeyLen: 3, Cas: 42, Expiry: 0, Bucket: 1, SlotIdx: 7}
+	copy(rec.Key[:], "key")
+	if err := s.WriteKeyRecord(0, rec); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Reading with the other byte order must be detected
+	if _, err := NewStorage(tmpDir, StorageOptions{ByteOrder: binary.LittleEndian}); !errors.Is(err, ErrByteOrder) {
+		t.Fatalf("Expected ErrByteOrder, got %v", err)
+	}
+
+	// Reading with the stored byte order returns the record intact
+	s, err = NewStorage(tmpDir, StorageOptions{ByteOrder: binary.BigEndian})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	got, err := s.ReadKeyRecord(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.KeyLen != 3 || got.Cas != 42 || got.Bucket != 1 || got.SlotIdx != 7 {
+		t.Errorf("Record mismatch: %+v", got)
+	}
+}
+
+func TestBucketLayout(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Slots of 256, 384, 576, 864, 1296, 1944, 2916 and 4374 bytes
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.BucketMinSize = 256
+	config.BucketGrowthFactor = 1.5
+	config.BucketCount = 8
+	config.MaxValueSize = 0 // Up to the largest bucket
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := []int{1, 256, 257, 384, 385, 576, 577, 2916, 2917, 4374}
+	for _, size := range sizes {
+		key := fmt.Sprintf("key_%d", size)
+		if _, err := c.Set(key, bytes.Repeat([]byte{byte(size)}, size), 0); err != nil {
+			t.Fatalf("Set %d bytes failed: %v", size, err)
+		}
+	}
+	if _, err := c.Set("too_large", make([]byte, 4375), 0); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+	if max := c.MaxValueSize(); max != 4374 {
+		t.Errorf("Expected MaxValueSize to be the largest bucket, got %d", max)
+	}
+	storage := c.workers[0].Storage()
+	if n := storage.NumBuckets(); n != 8 {
+		t.Errorf("Expected 8 buckets, got %d", n)
+	}
+	for size, want := range map[int]int{256: 0, 257: 1, 576: 2, 577: 3, 4374: 7} {
+		if bucket, _ := storage.BucketForSize(size); bucket != want {
+			t.Errorf("Expected %d bytes in bucket %d, got %d", size, want, bucket)
+		}
+	}
+	c.Close()
+
+	// Opening with another layout must be detected
+	other := config
+	other.BucketGrowthFactor = 2
+	if _, err := NewSharded(other, 1); !errors.Is(err, ErrBucketLayout) {
+		t.Fatalf("Expected ErrBucketLayout, got %v", err)
+	}
+
+	// Reopening with the stored layout recovers the values intact
+	c, err = NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, size := range sizes {
+		val, _, err := c.Get(fmt.Sprintf("key_%d", size))
+		if err != nil || !bytes.Equal(val, bytes.Repeat([]byte{byte(size)}, size)) {
+			t.Errorf("Value of %d bytes not intact after reopen (len=%d, err=%v)", size, len(val), err)
+		}
+	}
+
+	// Invalid layouts are rejected
+	for _, opts := range []StorageOptions{
+		{BucketGrowthFactor: 1},
+		{BucketCount: MaxBucketCount + 1},
+		{BucketMinSize: -1},
+		{BucketCount: MaxBucketCount},
+	} {
+		if _, err := NewStorage(t.TempDir(), opts); err == nil {
+			t.Errorf("Expected an error for layout %+v", opts)
+		}
+	}
+}
+
+func TestBucketStats(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	// Values per bucket: 3 of up to 1KB, 2 of up to 2KB, 1 of up to 8KB
+	for i, size := range []int{1, 100, 1024, 1025, 2048, 5000} {
+		if _, err := c.Set(fmt.Sprintf("key_%d", i), make([]byte, size), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Delete("key_1")
+
+	stats, err := c.BucketStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != NumBuckets {
+		t.Fatalf("Expected %d buckets, got %d", NumBuckets, len(stats))
+	}
+	for bucket, want := range map[int]int64{0: 2, 1: 2, 2: 0, 3: 1, 4: 0} {
+		b := stats[bucket]
+		if b.UsedSlots != want {
+			t.Errorf("Bucket %d: expected %d used slots, got %d", bucket, want, b.UsedSlots)
+		}
+		slotSize := int64(DataHeaderSize + b.SlotSize)
+		if b.BytesUsed != want*slotSize {
+			t.Errorf("Bucket %d: expected %d bytes used, got %d", bucket, want*slotSize, b.BytesUsed)
+		}
+		if b.BytesAllocated != b.TotalSlots*slotSize || b.TotalSlots < b.UsedSlots {
+			t.Errorf("Bucket %d: %d slots with %d bytes allocated for %d used", bucket, b.TotalSlots, b.BytesAllocated, b.UsedSlots)
+		}
+	}
+	if stats[0].SlotSize != MinBucketSize || stats[3].SlotSize != 8*MinBucketSize {
+		t.Errorf("Unexpected slot sizes %d and %d", stats[0].SlotSize, stats[3].SlotSize)
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	// Store a large value before the limit is in place
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("big", make([]byte, 100*1024), 0)
+	c.Set("small", []byte("small value"), 0)
+	c.Close()
+
+	config.MaxResponseSize = 64 * 1024
+	c, err = NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.Get("big"); err != ErrResponseTooLarge {
+		t.Errorf("Expected ErrResponseTooLarge, got %v", err)
+	}
+	val, _, err := c.Get("small")
+	if err != nil || string(val) != "small value" {
+		t.Errorf("Expected 'small value', got %q (err=%v)", val, err)
+	}
+
+	// A value just under the limit in a larger bucket is still returned
+	c.Set("edge", make([]byte, 60*1024), 0)
+	if val, _, err := c.Get("edge"); err != nil || len(val) != 60*1024 {
+		t.Errorf("Expected 60KB value, got %d bytes (err=%v)", len(val), err)
+	}
+}
+
+func TestCompactionStats(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	stats := c.Stats()
+	if stats["compactions_performed"] != "0" || stats["bytes_moved_during_compaction"] != "0" {
+		t.Errorf("Expected zero compaction stats, got %v", stats)
+	}
+	if stats["evictions"] != "0" {
+		t.Errorf("Expected 0 evictions, got %s", stats["evictions"])
+	}
+
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprintf("key_%d", i), []byte("some value"), 0)
+	}
+	// Delete from the front so tail entries are moved into freed slots
+	for i := 0; i < 50; i++ {
+		if err := c.Delete(fmt.Sprintf("key_%d", i)); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+
+	stats = c.Stats()
+	compactions, _ := strconv.Atoi(stats["compactions_performed"])
+	bytesMoved, _ := strconv.Atoi(stats["bytes_moved_during_compaction"])
+	if compactions == 0 {
+		t.Error("Expected compactions_performed to grow after deletes")
+	}
+	if bytesMoved < compactions/2*KeyRecordSize {
+		t.Errorf("Expected bytes_moved_during_compaction to grow, got %d for %d compactions", bytesMoved, compactions)
+	}
+
+	// Remaining keys are intact after the moves
+	for i := 50; i < 100; i++ {
+		if val, _, err := c.Get(fmt.Sprintf("key_%d", i)); err != nil || string(val) != "some value" {
+			t.Errorf("key_%d damaged by compaction: %q (err=%v)", i, val, err)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	c.SetWithTags("sess_1", []byte("a"), 0, []string{"user:42", "admin"})
+	c.SetWithTags("sess_2", []byte("b"), 0, []string{"user:42"})
+	c.SetWithTags("sess_3", []byte("c"), 0, []string{"user:7"})
+	c.Set("sess_4", []byte("d"), 0)
+
+	keys := c.KeysByTag("user:42")
+	if fmt.Sprint(keys) != "[sess_1 sess_2]" {
+		t.Errorf("Expected [sess_1 sess_2], got %v", keys)
+	}
+	if keys := c.KeysByTag("admin"); fmt.Sprint(keys) != "[sess_1]" {
+		t.Errorf("Expected [sess_1], got %v", keys)
+	}
+	if keys := c.KeysByTag("unknown"); len(keys) != 0 {
+		t.Errorf("Expected no keys, got %v", keys)
+	}
+
+	// Deleting a key removes it from its tags
+	c.Delete("sess_1")
+	if keys := c.KeysByTag("user:42"); fmt.Sprint(keys) != "[sess_2]" {
+		t.Errorf("Expected [sess_2] after delete, got %v", keys)
+	}
+	if keys := c.KeysByTag("admin"); len(keys) != 0 {
+		t.Errorf("Expected no admin keys after delete, got %v", keys)
+	}
+
+	// Overwriting without tags clears them
+	c.Set("sess_2", []byte("b2"), 0)
+	if keys := c.KeysByTag("user:42"); len(keys) != 0 {
+		t.Errorf("Expected no keys after untagged overwrite, got %v", keys)
+	}
+
+	// Expired keys are not returned
+	c.SetWithTags("sess_5", []byte("e"), 100*time.Millisecond, []string{"user:7"})
+	time.Sleep(200 * time.Millisecond)
+	if keys := c.KeysByTag("user:7"); fmt.Sprint(keys) != "[sess_3]" {
+		t.Errorf("Expected [sess_3] after expiry, got %v", keys)
+	}
+
+	// Group invalidation
+	for _, key := range c.KeysByTag("user:7") {
+		c.Delete(key)
+	}
+	if _, _, err := c.Get("sess_3"); err != ErrKeyNotFound {
+		t.Errorf("Expected sess_3 deleted, got %v", err)
+	}
+}
+
+func TestSampledEviction(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	value := make([]byte, 1000) // Bucket 0
+	slotSize := int64(DataHeaderSize + MinBucketSize)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.MaxDataSize = 200 * slotSize // Room for 200 items
+	config.EvictionPolicy = EvictionSampled
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 200; i++ {
+		c.Set(fmt.Sprintf("key_%d", i), value, 0)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// Access the first half so the second half becomes least recently used
+	for i := 0; i < 100; i++ {
+		c.Get(fmt.Sprintf("key_%d", i))
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// Force 50 evictions
+	for i := 200; i < 250; i++ {
+		c.Set(fmt.Sprintf("key_%d", i), value, 0)
+	}
+
+	if items := c.Stats()["curr_items"]; items != "200" {
+		t.Errorf("Expected 200 items after eviction, got %s", items)
+	}
+	if evictions := c.Stats()["evictions"]; evictions != "50" {
+		t.Errorf("Expected 50 evictions, got %s", evictions)
+	}
+
+	hot, cold := 0, 0
+	for i := 0; i < 100; i++ {
+		if _, _, err := c.Get(fmt.Sprintf("key_%d", i)); err == nil {
+			hot++
+		}
+		if _, _, err := c.Get(fmt.Sprintf("key_%d", i+100)); err == nil {
+			cold++
+		}
+	}
+	if hot <= cold {
+		t.Errorf("Expected recently used keys to survive eviction: hot=%d cold=%d", hot, cold)
+	}
+}
+
+func TestDefaultEvictionPolicy(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	value := make([]byte, 1000) // Bucket 0
+	slotSize := int64(DataHeaderSize + MinBucketSize)
+
+	// MaxDataSize alone evicts, sampled
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.MaxDataSize = 10 * slotSize // Room for 10 items
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 20; i++ {
+		c.Set(fmt.Sprintf("key_%d", i), value, 0)
+	}
+	if items := c.Stats()["curr_items"]; items != "10" {
+		t.Errorf("Expected 10 items after eviction, got %s", items)
+	}
+	if evictions := c.Stats()["evictions"]; evictions != "10" {
+		t.Errorf("Expected 10 evictions, got %s", evictions)
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	value := make([]byte, 1000) // Bucket 0
+	slotSize := int64(DataHeaderSize + MinBucketSize)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.MaxDataSize = 10 * slotSize // Room for 10 items
+	config.EvictionPolicy = EvictionLRU
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		c.Set(fmt.Sprintf("key_%d", i), value, 0)
+	}
+	// Reading key_0 makes key_1 the least recently used
+	c.Get("key_0")
+
+	// Each new key evicts exactly the least recently used one
+	for i := 10; i < 13; i++ {
+		c.Set(fmt.Sprintf("key_%d", i), value, 0)
+	}
+	for _, key := range []string{"key_1", "key_2", "key_3"} {
+		if _, _, err := c.Get(key); err != ErrKeyNotFound {
+			t.Errorf("Expected %s to be evicted, got %v", key, err)
+		}
+	}
+	for _, key := range []string{"key_0", "key_4", "key_12"} {
+		if _, _, err := c.Get(key); err != nil {
+			t.Errorf("Expected %s to be kept, got %v", key, err)
+		}
+	}
+	if evictions := c.Stats()["evictions"]; evictions != "3" {
+		t.Errorf("Expected 3 evictions, got %s", evictions)
+	}
+
+	// The order is kept across a flush
+	c.FlushAll()
+	for i := 0; i < 11; i++ {
+		c.Set(fmt.Sprintf("new_%d", i), value, 0)
+	}
+	if _, _, err := c.Get("new_0"); err != ErrKeyNotFound {
+		t.Errorf("Expected new_0 to be evicted after flush, got %v", err)
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix permissions")
+	}
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	open := func(dirMode, fileMode os.FileMode) {
+		t.Helper()
+		config.DirMode = dirMode
+		config.FileMode = fileMode
+		c, err := NewSharded(config, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Set("key", []byte("value"), 0)
+		c.Close()
+	}
+	check := func(dirMode, fileMode os.FileMode) {
+		t.Helper()
+		for i := 0; i < 2; i++ {
+			dir := shardPath(tmpDir, i)
+			if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != dirMode {
+				t.Errorf("%s: expected mode %v, got %v (err=%v)", dir, dirMode, info.Mode().Perm(), err)
+			}
+			files, _ := filepath.Glob(filepath.Join(dir, "*"))
+			if len(files) == 0 {
+				t.Fatalf("Expected files in %s", dir)
+			}
+			for _, file := range files {
+				if info, err := os.Stat(file); err != nil || info.Mode().Perm() != fileMode {
+					t.Errorf("%s: expected mode %v, got %v (err=%v)", file, fileMode, info.Mode().Perm(), err)
+				}
+			}
+		}
+	}
+
+	// Created with the requested modes
+	open(0700, 0600)
+	check(0700, 0600)
+
+	// Existing files are never widened...
+	open(DefaultDirMode, DefaultFileMode)
+	check(0700, 0600)
+
+	// ...but narrowed
+	os.RemoveAll(tmpDir)
+	open(0777, 0666) // As far as the umask allows
+	open(0700, 0600)
+	check(0700, 0600)
+}
+
+func TestReshard(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		op := Op{Op: OpSet, Key: fmt.Sprintf("key_%d", i), Value: []byte(fmt.Sprintf("value_%d", i)), Flags: uint32(i)}
+		if i%2 == 0 {
+			op.TTL = time.Hour
+		}
+		if _, err := c.Store(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Close()
+
+	check := func(shards int) {
+		t.Helper()
+		c, err := NewSharded(config, shards)
+		if err != nil {
+			t.Fatalf("Reopen with %d shards failed: %v", shards, err)
+		}
+		defer c.Close()
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key_%d", i)
+			item, err := c.GetItem(key)
+			if err != nil || string(item.Value) != fmt.Sprintf("value_%d", i) || item.Flags != uint32(i) {
+				t.Fatalf("%d shards: %s: unexpected item %+v, %v", shards, key, item, err)
+			}
+			_, _, ttl, _ := c.GetWithTTL(key)
+			if hasTTL := ttl != NoExpiry; hasTTL != (i%2 == 0) {
+				t.Errorf("%d shards: %s: unexpected TTL %v", shards, key, ttl)
+			}
+		}
+		if n := shardDirCount(tmpDir); n != shards {
+			t.Errorf("Expected %d shard dirs, got %d", shards, n)
+		}
+		if _, err := os.Stat(filepath.Join(tmpDir, reshardDirName)); !os.IsNotExist(err) {
+			t.Errorf("Expected the old shards to be removed, got %v", err)
+		}
+	}
+	check(8)
+	check(2)
+
+	// An interrupted move starts again from the old shards
+	if _, err := prepareReshard(tmpDir, 3, DefaultDirMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(shardPath(tmpDir, 0), 0755); err != nil {
+		t.Fatal(err)
+	}
+	check(3)
+
+	// A crash while the shard dirs are moved aside leaves some of them in
+	// the temp dir, they are moved back before the move starts again
+	moving := filepath.Join(tmpDir, reshardTmpDirName)
+	if err := os.Mkdir(moving, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := os.Rename(shardPath(tmpDir, i), shardPath(moving, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(5)
+	if _, err := os.Stat(moving); !os.IsNotExist(err) {
+		t.Errorf("Expected the temp dir to be removed, got %v", err)
+	}
+}
+
+func TestReloadShard(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	for i := 0; i < 200; i++ {
+		c.Set(fmt.Sprintf("key_%d", i), []byte(fmt.Sprintf("value_%d", i)), 0)
+	}
+
+	// Concurrent traffic on all shards while shard 0 is reloaded
+	var wg sync.WaitGroup
+	var failures atomic.Int64
+	stop := make(chan struct{})
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key_%d", (g*31+n)%200)
+				if _, _, err := c.Get(key); err != nil {
+					failures.Add(1)
+				}
+				if _, err := c.Set(fmt.Sprintf("live_%d_%d", g, n%50), []byte("live"), 0); err != nil {
+					failures.Add(1)
+				}
+			}
+		}(g)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := c.ReloadShard(0); err != nil {
+			t.Fatalf("ReloadShard failed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	if n := failures.Load(); n != 0 {
+		t.Errorf("Expected no failed requests during reload, got %d", n)
+	}
+	for i := 0; i < 200; i++ {
+		val, _, err := c.Get(fmt.Sprintf("key_%d", i))
+		if err != nil || string(val) != fmt.Sprintf("value_%d", i) {
+			t.Errorf("key_%d lost after reload: %q (err=%v)", i, val, err)
+		}
+	}
+
+	if err := c.ReloadShard(len(c.workers)); err == nil {
+		t.Error("Expected error for invalid shard index")
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	// First set returns no previous value
+	prev, cas, err := c.GetSet("key1", []byte("value1"), 0)
+	if err != nil {
+		t.Fatalf("GetSet failed: %v", err)
+	}
+	if prev != nil {
+		t.Errorf("Expected nil previous value, got %q", prev)
+	}
+	if cas == 0 {
+		t.Error("Expected non-zero CAS")
+	}
+
+	// Overwrite returns the previous value
+	prev, _, err = c.GetSet("key1", []byte("value2"), 0)
+	if err != nil {
+		t.Fatalf("GetSet failed: %v", err)
+	}
+	if string(prev) != "value1" {
+		t.Errorf("Expected previous 'value1', got %q", prev)
+	}
+	val, _, _ := c.Get("key1")
+	if string(val) != "value2" {
+		t.Errorf("Expected 'value2', got %q", val)
+	}
+
+	// Plain Set does not read the old value
+	storage := c.workers[c.shardFor("key1")].Storage()
+	readsBefore := storage.DataReads()
+	c.Set("key1", []byte("value3"), 0)
+	if reads := storage.DataReads() - readsBefore; reads != 0 {
+		t.Errorf("Expected no data reads for plain Set, got %d", reads)
+	}
+}
+
+func TestShardSyncInterval(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncPeriodic
+	config.SyncInterval = 250 * time.Millisecond
+	config.ShardSyncInterval = func(shard int) time.Duration {
+		if shard == 0 {
+			return 25 * time.Millisecond // Hot shard
+		}
+		return 0 // Use SyncInterval
+	}
+
+	c, err := NewSharded(config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Find a key for each shard
+	keys := make([]string, 2)
+	for i := 0; keys[0] == "" || keys[1] == ""; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if keys[c.shardFor(key)] == "" {
+			keys[c.shardFor(key)] = key
+		}
+	}
+
+	// Write steadily to both shards
+	deadline := time.Now().Add(600 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		c.Set(keys[0], []byte("value"), 0)
+		c.Set(keys[1], []byte("value"), 0)
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // Let pending syncs finish
+
+	hot := c.workers[0].Storage().Syncs()
+	cold := c.workers[1].Storage().Syncs()
+	// A due sync may be requested more than once before it runs
+	if cold == 0 || cold > 6 {
+		t.Errorf("Expected 1-6 syncs for the 250ms shard, got %d", cold)
+	}
+	if hot < 3*cold {
+		t.Errorf("Expected hot shard to sync much more often: hot=%d cold=%d", hot, cold)
+	}
+}
+
+func TestGetMultiConsistent(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	// Single shard so both keys are read in one worker turn
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Set("k1", []byte("0"), 0)
+	c.Set("k2", []byte("0"), 0)
+
+	// Writer always updates k1 before k2, so a snapshot has k1-k2 in {0, 1}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 1; ; n++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.Set("k1", []byte(strconv.Itoa(n)), 0)
+			c.Set("k2", []byte(strconv.Itoa(n)), 0)
+		}
+	}()
+
+	for i := 0; i < 500; i++ {
+		items, err := c.GetMulti([]string{"k1", "k2", "missing"})
+		if err != nil {
+			t.Fatalf("GetMulti failed: %v", err)
+		}
+		if len(items) != 2 {
+			t.Fatalf("Expected 2 items, got %d", len(items))
+		}
+		v1, _ := strconv.Atoi(string(items["k1"].Value))
+		v2, _ := strconv.Atoi(string(items["k2"].Value))
+		if v1-v2 != 0 && v1-v2 != 1 {
+			t.Fatalf("Inconsistent snapshot: k1=%d k2=%d", v1, v2)
+		}
+		if items["k1"].Cas == items["k2"].Cas {
+			t.Fatalf("Expected distinct CAS values, got %d for both", items["k1"].Cas)
+		}
+	}
+	close(stop)
+	<-done
+
+	// CAS values match what a single get returns
+	items, _ := c.GetMulti([]string{"k1", "k2"})
+	for _, key := range []string{"k1", "k2"} {
+		_, cas, _ := c.Get(key)
+		if items[key].Cas != cas {
+			t.Errorf("%s: GetMulti CAS %d != Get CAS %d", key, items[key].Cas, cas)
+		}
+	}
+}
+
+func TestPackedKeyFormat(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	keysPath := tmpDir + "/shard_00/keys"
+
+	keysSize := func() int64 {
+		info, err := os.Stat(keysPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	check := func(c *ShardedCache, from, to int) {
+		for i := from; i < to; i++ {
+			key := fmt.Sprintf("key%d", i)
+			val, _, err := c.Get(key)
+			if err != nil || string(val) != "v"+strconv.Itoa(i) {
+				t.Fatalf("%s: got %q, %v", key, val, err)
+			}
+		}
+	}
+
+	// Fill a fixed-format cache
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprintf("key%d", i), []byte("v"+strconv.Itoa(i)), 0)
+	}
+	c.Close()
+	fixedSize := keysSize()
+
+	// Reopening packed migrates the records
+	config.KeyFormat = KeyFormatPacked
+	c, err = NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c, 0, 100)
+	if packedSize := keysSize(); packedSize*10 > fixedSize {
+		t.Errorf("Packed keys file %d bytes, fixed %d bytes", packedSize, fixedSize)
+	}
+
+	// Deletes tombstone records until the file is rewritten
+	for i := 0; i < 60; i++ {
+		c.Delete(fmt.Sprintf("key%d", i))
+	}
+	c.Set("key100", []byte("v100"), 0)
+	check(c, 60, 101)
+	c.Close()
+
+	c, err = NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c, 60, 101)
+	if _, _, err := c.Get("key0"); err != ErrKeyNotFound {
+		t.Errorf("Deleted key came back: %v", err)
+	}
+	if size, want := keysSize(), 41*PackedKeyRecordSize(len("key60")); size > 2*want {
+		t.Errorf("Packed keys file %d bytes after deletes, expected about %d", size, want)
+	}
+	c.Close()
+
+	// And back to the fixed format
+	config.KeyFormat = KeyFormatFixed
+	c, err = NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	check(c, 60, 101)
+	if size := keysSize(); size != 41*KeyRecordSize {
+		t.Errorf("Fixed keys file %d bytes, expected %d", size, 41*KeyRecordSize)
+	}
+}
+
+func TestPackedRewritePeriodicSync(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Head deletes rewrite the packed keys file while the sync goroutine
+	// syncs all the time (go test -race)
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncPeriodic
+	config.SyncInterval = time.Microsecond
+	config.KeyFormat = KeyFormatPacked
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 50; i++ {
+			c.Set(fmt.Sprintf("key%d", i), []byte("value"), 0)
+		}
+		for i := 0; i < 50; i++ {
+			if err := c.Delete(fmt.Sprintf("key%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if items := currItems(c); items != "0" {
+		t.Errorf("Expected 0 items, got %s", items)
+	}
+}
+
+func TestFlushAllOrdering(t *testing.T) {
+	for _, barrier := range []bool{false, true} {
+		tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		config := DefaultConfig()
+		config.DataDir = tmpDir
+		config.SyncStrategy = SyncNone
+		config.FlushBarrier = barrier
+
+		c, err := NewSharded(config, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		// Writes completed before FlushAll are always cleared
+		for i := 0; i < 100; i++ {
+			c.Set(fmt.Sprintf("before%d", i), []byte("v"), 0)
+		}
+
+		// Writers keep storing keys (spread over the shards) during the flush
+		const writers = 4
+		var written [writers]atomic.Int64
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for n := 0; ; n++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					c.Set(fmt.Sprintf("w%d-%d", w, n), []byte("v"), 0)
+					written[w].Store(int64(n + 1))
+				}
+			}(w)
+		}
+		time.Sleep(10 * time.Millisecond)
+		c.FlushAll()
+		close(stop)
+		wg.Wait()
+
+		for i := 0; i < 100; i++ {
+			if _, _, err := c.Get(fmt.Sprintf("before%d", i)); err != ErrKeyNotFound {
+				t.Fatalf("barrier=%v: write before FlushAll survived", barrier)
+			}
+		}
+
+		if !barrier {
+			continue
+		}
+		// With a barrier each writer's surviving keys are a suffix of its writes
+		for w := 0; w < writers; w++ {
+			survived := false
+			for n := 0; n < int(written[w].Load()); n++ {
+				_, _, err := c.Get(fmt.Sprintf("w%d-%d", w, n))
+				if err == nil {
+					survived = true
+				} else if survived {
+					t.Fatalf("writer %d: key %d cleared after a later key survived", w, n)
+				}
+			}
+		}
+	}
+}
+
+func TestStorageErrorNotMiss(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Set("key", []byte("value"), 0)
+
+	// Fail data reads by closing the bucket file underneath the worker
+	storage := c.workers[0].Storage()
+	bucket, _ := storage.BucketForSize(len("value"))
+	storage.dataFiles[bucket].Close()
+
+	if _, _, err := c.Get("key"); err == nil || err == ErrKeyNotFound {
+		t.Errorf("Expected storage error from Get, got %v", err)
+	}
+	if _, err := c.GetMulti([]string{"key"}); err == nil || err == ErrKeyNotFound {
+		t.Errorf("Expected storage error from GetMulti, got %v", err)
+	}
+	if _, _, err := c.Get("missing"); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for missing key, got %v", err)
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	value := make([]byte, 1000) // Bucket 0
+	slotSize := int64(DataHeaderSize + MinBucketSize)
+
+	type event struct {
+		key    string
+		reason EvictReason
+	}
+	events := make(chan event, 10)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.MaxDataSize = 3 * slotSize // Room for 3 items
+	config.EvictionPolicy = EvictionLRU
+	config.OnEvict = func(key string, reason EvictReason) {
+		events <- event{key, reason}
+	}
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	expect := func(want event) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if got != want {
+				t.Errorf("Expected OnEvict(%q, %v), got OnEvict(%q, %v)", want.key, want.reason, got.key, got.reason)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected OnEvict(%q, %v), got no call", want.key, want.reason)
+		}
+	}
+
+	// Deletes do not call the hook
+	c.Set("deleted", value, 0)
+	c.Delete("deleted")
+
+	// The sweep expires the key without it being read
+	c.Set("short", value, 50*time.Millisecond)
+	expect(event{"short", ReasonExpired})
+
+	// The fourth item evicts the least recently used one
+	for i := 0; i < 4; i++ {
+		c.Set(fmt.Sprintf("key_%d", i), value, 0)
+	}
+	expect(event{"key_0", ReasonLRU})
+
+	select {
+	case got := <-events:
+		t.Errorf("Unexpected OnEvict(%q, %v)", got.key, got.reason)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEvictionGrace(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	value := make([]byte, 1000) // Bucket 0
+	slotSize := int64(DataHeaderSize + MinBucketSize)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.MaxDataSize = 10 * slotSize // Room for 10 items
+	config.EvictionPolicy = EvictionSampled
+	config.EvictionGrace = 100 * time.Millisecond
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Over budget during the grace window, nothing is evicted
+	for i := 0; i < 20; i++ {
+		c.Set(fmt.Sprintf("key_%d", i), value, 0)
+	}
+	if evictions := c.Stats()["evictions"]; evictions != "0" {
+		t.Errorf("Expected no evictions during grace, got %s", evictions)
+	}
+	if items := c.Stats()["curr_items"]; items != "20" {
+		t.Errorf("Expected 20 items during grace, got %s", items)
+	}
+
+	// After the window the next write evicts back to the budget
+	time.Sleep(150 * time.Millisecond)
+	c.Set("key_20", value, 0)
+	if items := c.Stats()["curr_items"]; items != "10" {
+		t.Errorf("Expected 10 items after grace, got %s", items)
+	}
+	if evictions := c.Stats()["evictions"]; evictions != "11" {
+		t.Errorf("Expected 11 evictions after grace, got %s", evictions)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	const count = 2000
+	for i := 0; i < count; i++ {
+		c.Set(fmt.Sprintf("key%05d", i), []byte("v"+strconv.Itoa(i)), 0)
+	}
+
+	// Writers change and delete items while the snapshot is read
+	stop := make(chan struct{})
+	var writes atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; ; n++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			i := n % count
+			switch n % 3 {
+			case 0:
+				c.Set(fmt.Sprintf("key%05d", i), make([]byte, 2000), 0) // Moves bucket
+			case 1:
+				c.Delete(fmt.Sprintf("key%05d", i))
+			case 2:
+				c.Set(fmt.Sprintf("new%05d", i), []byte("new"), 0)
+			}
+			writes.Add(1)
+		}
+	}()
+
+	seen := 0
+	err = c.Snapshot(func(item *SnapshotItem) error {
+		if seen == 0 {
+			// Writes keep completing while the snapshot is in progress
+			before := writes.Load()
+			deadline := time.Now().Add(time.Second)
+			for writes.Load() < before+10 {
+				if time.Now().After(deadline) {
+					t.Fatal("Writes blocked during snapshot")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+		want := fmt.Sprintf("key%05d", seen)
+		if item.Key != want {
+			return fmt.Errorf("got key %s, want %s", item.Key, want)
+		}
+		if string(item.Value) != "v"+strconv.Itoa(seen) {
+			return fmt.Errorf("%s: got value %q", item.Key, item.Value)
+		}
+		seen++
+		return nil
+	})
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != count {
+		t.Errorf("Snapshot returned %d items, expected %d", seen, count)
+	}
+	if len(c.workers[0].snapshots) != 0 {
+		t.Errorf("Snapshot still registered after completion")
+	}
+}
+
+func TestCasAfterRestart(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := make(map[uint64]bool)
+	for i := 0; i < 100; i++ {
+		cas, _ := c.Set(fmt.Sprintf("key%d", i), []byte("v"), 0)
+		before[cas] = true
+	}
+
+	// A counter whose CAS is only changed by an increment
+	staleCas, err := c.Set("n", []byte("1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Increment("n", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a clock that ran ahead before the restart
+	storage := c.workers[0].Storage()
+	entry, _ := c.workers[0].Index().Get("key0")
+	rec, err := storage.ReadKeyRecord(entry.KeyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Cas = uint64(time.Now().Add(time.Hour).UnixNano())
+	storage.WriteKeyRecord(entry.KeyId, rec)
+	before[rec.Cas] = true
+	c.Close()
+
+	c, err = NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 100; i++ {
+		cas, err := c.Set(fmt.Sprintf("new%d", i), []byte("v"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if before[cas] || cas <= rec.Cas {
+			t.Fatalf("CAS %d after restart collides with or regresses below %d", cas, rec.Cas)
+		}
+	}
+
+	if _, err := c.Cas("n", []byte("5"), 0, staleCas); err != ErrCasMismatch {
+		t.Fatalf("Cas with pre-increment CAS after restart: got %v, want ErrCasMismatch", err)
+	}
+	if val, _, _ := c.Get("n"); string(val) != "2" {
+		t.Fatalf("Expected 2 after restart, got %q", val)
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.MaxValueSize = 4096
+
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.MaxValueSize() != 4096 {
+		t.Errorf("Expected MaxValueSize 4096, got %d", c.MaxValueSize())
+	}
+	if _, err := c.Set("fits", make([]byte, 4096), 0); err != nil {
+		t.Errorf("Value at the limit rejected: %v", err)
+	}
+	if _, err := c.Set("big", make([]byte, 4097), 0); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge for Set, got %v", err)
+	}
+	if _, err := c.Add("big", make([]byte, 4097), 0); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge for Add, got %v", err)
+	}
+
+	// Appending past the limit is rejected and leaves the value intact
+	if _, err := c.Append("fits", []byte("x")); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge for Append, got %v", err)
+	}
+	if val, _, _ := c.Get("fits"); len(val) != 4096 {
+		t.Errorf("Expected 4096 bytes after rejected append, got %d", len(val))
+	}
+}
+
+func TestExportRange(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		c.Set(key, make([]byte, 500*(i+1)), time.Hour)
+	}
+
+	var out strings.Builder
+	if err := c.ExportRange(0, "b", "e", &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 entries, got %d:\n%s", len(lines), out.String())
+	}
+	for i, key := range []string{"b", "c", "d"} {
+		entry, _ := c.workers[0].Index().Get(key)
+		want := fmt.Sprintf("%s key_id=%d bucket=%d slot=%d cas=%d expiry=%d length=%d last_access=%d",
+			key, entry.KeyId, entry.Bucket, entry.SlotIdx, entry.Cas, entry.Expiry, 500*(i+2), entry.LastAccess)
+		if lines[i] != want {
+			t.Errorf("Entry %d:\n got  %s\n want %s", i, lines[i], want)
+		}
+	}
+
+	// An empty end key exports to the end of the shard
+	out.Reset()
+	if err := c.ExportRange(0, "e", "", &out); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out.String(), "\n"); n != 2 {
+		t.Errorf("Expected 2 entries from e, got %d", n)
+	}
+	if err := c.ExportRange(1, "", "", &out); err == nil {
+		t.Error("Expected error for invalid shard")
+	}
+}
+
+func TestReady(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if !c.Ready() || c.Stats()["ready"] != "1" {
+		t.Fatal("Expected cache to be ready after NewSharded")
+	}
+
+	// Hold the shard busy so the reload (and its recovery) is slow
+	c.shardLocks[0].RLock()
+	done := make(chan error)
+	go func() { done <- c.ReloadShard(0) }()
+	deadline := time.Now().Add(time.Second)
+	for c.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected cache not to be ready during reload")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.shardLocks[0].RUnlock()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !c.Ready() || c.Stats()["ready"] != "1" {
+		t.Error("Expected cache to be ready after reload")
+	}
+}
+
+// sameShardKeys returns n keys that map to the same shard
+func sameShardKeys(c *ShardedCache, n int) []string {
+	keys := []string{"k0"}
+	for i := 1; len(keys) < n; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if c.shardFor(key) == c.shardFor(keys[0]) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestTransact(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	keys := sameShardKeys(c, 3)
+	a, b, d := keys[0], keys[1], keys[2]
+
+	// Same-shard batch: set A and delete B atomically
+	c.Set(b, []byte("old"), 0)
+	results, err := c.Transact([]Op{
+		{Op: OpSet, Key: a, Value: []byte("session")},
+		{Op: OpDelete, Key: b},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Cas == 0 {
+		t.Errorf("Unexpected results %+v", results)
+	}
+	if val, _, _ := c.Get(a); string(val) != "session" {
+		t.Errorf("Expected A set, got %q", val)
+	}
+	if _, _, err := c.Get(b); err != ErrKeyNotFound {
+		t.Errorf("Expected B deleted, got %v", err)
+	}
+
+	// Mid-batch failure rolls back the earlier operations
+	casA, _ := c.Set(a, []byte("before"), time.Hour)
+	index := c.workers[c.shardFor(a)].Index()
+	entryA, _ := index.Get(a)
+	results, err = c.Transact([]Op{
+		{Op: OpSet, Key: a, Value: []byte("changed")},
+		{Op: OpSet, Key: d, Value: []byte("new")},
+		{Op: OpReplace, Key: b, Value: []byte("missing")}, // Fails
+	})
+	if err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if len(results) != 3 || results[2].Err != ErrKeyNotFound {
+		t.Errorf("Unexpected results %+v", results)
+	}
+	val, cas, _ := c.Get(a)
+	if string(val) != "before" || cas != casA {
+		t.Errorf("Expected A rolled back to %q/%d, got %q/%d", "before", casA, val, cas)
+	}
+	if entry, _ := index.Get(a); entry.Expiry != entryA.Expiry {
+		t.Errorf("Expected A expiry %d after rollback, got %d", entryA.Expiry, entry.Expiry)
+	}
+	if _, _, err := c.Get(d); err != ErrKeyNotFound {
+		t.Errorf("Expected D rolled back, got %v", err)
+	}
+
+	// Keys on different shards are rejected
+	other := "x"
+	for i := 0; c.shardFor(other) == c.shardFor(a); i++ {
+		other = fmt.Sprintf("x%d", i)
+	}
+	if _, err := c.Transact([]Op{{Op: OpSet, Key: a, Value: []byte("v")}, {Op: OpDelete, Key: other}}); err != ErrCrossShard {
+		t.Errorf("Expected ErrCrossShard, got %v", err)
+	}
+}
+
+func TestMillisecondExpiry(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sub-second TTLs survive a restart with their millisecond expiry
+	c.Set("set", []byte("v"), 200*time.Millisecond)
+	c.Set("touched", []byte("v"), time.Hour)
+	c.Touch("touched", 200*time.Millisecond)
+	c.Close()
+
+	c, err = NewSharded(config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, key := range []string{"set", "touched"} {
+		meta, err := c.Meta(key)
+		if err != nil {
+			t.Fatalf("%s: expected key after restart, got %v", key, err)
+		}
+		if meta.TTL <= 0 || meta.TTL > 200*time.Millisecond {
+			t.Errorf("%s: expected remaining TTL within 200ms, got %v", key, meta.TTL)
+		}
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	for _, key := range []string{"set", "touched"} {
+		if _, _, err := c.Get(key); err != ErrKeyNotFound {
+			t.Errorf("%s: expected expiry after 200ms, got %v", key, err)
+		}
+	}
+}
+
+func TestShardBreaker(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.BreakerThreshold = 3
+	config.BreakerCooldown = 50 * time.Millisecond
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Set("key", []byte("value"), 0)
+
+	// Misses are not storage errors
+	for i := 0; i < 5; i++ {
+		c.Get("missing")
+	}
+	if state := c.Stats()["shard_00_breaker"]; state != "closed" {
+		t.Fatalf("Expected closed breaker after misses, got %s", state)
+	}
+
+	// Fail data reads by closing the bucket file underneath the worker
+	storage := c.workers[0].Storage()
+	bucket, _ := storage.BucketForSize(len("value"))
+	path := storage.dataFiles[bucket].Name()
+	storage.dataFiles[bucket].Close()
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := c.Get("key"); err == nil || err == ErrShardUnavailable {
+			t.Fatalf("Expected storage error %d, got %v", i, err)
+		}
+	}
+	if state := c.Stats()["shard_00_breaker"]; state != "open" {
+		t.Fatalf("Expected open breaker, got %s", state)
+	}
+	if _, _, err := c.Get("key"); err != ErrShardUnavailable {
+		t.Errorf("Expected fast failure, got %v", err)
+	}
+
+	// A failing trial after the cooldown opens the breaker again
+	time.Sleep(60 * time.Millisecond)
+	if _, _, err := c.Get("key"); err == nil || err == ErrShardUnavailable {
+		t.Errorf("Expected trial request to reach storage, got %v", err)
+	}
+	if _, _, err := c.Get("key"); err != ErrShardUnavailable {
+		t.Errorf("Expected fast failure after failed trial, got %v", err)
+	}
+
+	// Once storage recovers the next trial closes the breaker
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.dataFiles[bucket] = f
+	time.Sleep(60 * time.Millisecond)
+	if val, _, err := c.Get("key"); err != nil || string(val) != "value" {
+		t.Fatalf("Expected value after recovery, got %q, %v", val, err)
+	}
+	if state := c.Stats()["shard_00_breaker"]; state != "closed" {
+		t.Errorf("Expected closed breaker after recovery, got %s", state)
+	}
+}
+
+func TestShardBreakerBusy(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.ChannelCapacity = 1
+	config.RequestTimeout = 10 * time.Millisecond
+	config.BreakerThreshold = 3
+	config.BreakerCooldown = time.Hour
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Block the worker: it stalls sending a response nobody reads yet
+	worker := c.workers[0]
+	block := make(chan *Response)
+	worker.RequestChan() <- &Request{Op: OpStats, RespChan: block}
+	for len(worker.RequestChan()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Timeouts of a busy shard are no storage errors
+	for i := 0; i < 5; i++ {
+		if _, err := c.Set("key", []byte("value"), 0); err != ErrBusy {
+			t.Fatalf("Expected ErrBusy %d, got %v", i, err)
+		}
+	}
+	if state := c.Stats()["shard_00_breaker"]; state != "closed" {
+		t.Errorf("Expected closed breaker after timeouts, got %s", state)
+	}
+	<-block
+	if _, err := c.Set("key", []byte("value"), 0); err != nil {
+		t.Errorf("Expected the shard to take requests again, got %v", err)
+	}
+}
+
+func TestPreallocation(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.InitialKeysCapacity = 100
+	config.InitialSlotsPerBucket = 100
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := c.workers[0].Storage()
+	if size, _ := storage.KeysFileSize(); size != 100*KeyRecordSize {
+		t.Errorf("Expected preallocated keys file of %d bytes, got %d", 100*KeyRecordSize, size)
+	}
+	if size, _ := storage.DataFileSize(0); size != 100*int64(storage.SlotSize(0)) {
+		t.Errorf("Expected preallocated data file of %d bytes, got %d", 100*storage.SlotSize(0), size)
+	}
+
+	for i := 0; i < 10; i++ {
+		c.Set(fmt.Sprintf("key%d", i), []byte("v"+strconv.Itoa(i)), 0)
+	}
+	c.Close()
+
+	// Recovery ignores the preallocated unused space
+	c, err = NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if items := c.Stats()["curr_items"]; items != "10" {
+		t.Errorf("Expected 10 items after restart, got %s", items)
+	}
+	if c.workers[0].nextKeyId != 10 || c.workers[0].nextSlotId[0] != 10 {
+		t.Errorf("Expected 10 keys and slots in use, got %d and %d", c.workers[0].nextKeyId, c.workers[0].nextSlotId[0])
+	}
+
+	// New writes continue after the recovered items without clobbering them
+	c.Set("key10", []byte("v10"), 0)
+	for i := 0; i <= 10; i++ {
+		val, _, err := c.Get(fmt.Sprintf("key%d", i))
+		if err != nil || string(val) != "v"+strconv.Itoa(i) {
+			t.Errorf("key%d: got %q, %v", i, val, err)
+		}
+	}
+}
+
+func BenchmarkInitialLoad(b *testing.B) {
+	for _, prealloc := range []bool{false, true} {
+		b.Run(fmt.Sprintf("prealloc=%v", prealloc), func(b *testing.B) {
+			value := make([]byte, 100)
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				tmpDir, err := os.MkdirTemp("", "tqcache-bench-*")
+				if err != nil {
+					b.Fatal(err)
+				}
+				config := DefaultConfig()
+				config.DataDir = tmpDir
+				config.SyncStrategy = SyncNone
+				if prealloc {
+					config.InitialKeysCapacity = 10000
+					config.InitialSlotsPerBucket = 10000
+				}
+				c, err := NewSharded(config, 1)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				for i := 0; i < 10000; i++ {
+					c.Set("key"+strconv.Itoa(i), value, 0)
+				}
+
+				b.StopTimer()
+				c.Close()
+				os.RemoveAll(tmpDir)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestGetOrLoad(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	loads := 0
+	loader := func(key string) ([]byte, error) {
+		loads++
+		return []byte("loaded " + key), nil
+	}
+
+	// Read-through on a miss
+	val, cas, loaded, err := c.GetOrLoad("key", 0, loader)
+	if err != nil || string(val) != "loaded key" || cas == 0 || !loaded {
+		t.Fatalf("Expected read-through load, got %q, %d, %v, %v", val, cas, loaded, err)
+	}
+
+	// Hit afterwards
+	val, cas2, loaded, err := c.GetOrLoad("key", 0, loader)
+	if err != nil || string(val) != "loaded key" || cas2 != cas || loaded {
+		t.Errorf("Expected cache hit, got %q, %d, %v, %v", val, cas2, loaded, err)
+	}
+	if loads != 1 {
+		t.Errorf("Expected 1 loader call, got %d", loads)
+	}
+
+	// Loader errors are returned and nothing is stored
+	_, _, loaded, err = c.GetOrLoad("failing", 0, func(key string) ([]byte, error) {
+		return nil, errors.New("backend down")
+	})
+	if err == nil || loaded {
+		t.Errorf("Expected loader error, got loaded=%v err=%v", loaded, err)
+	}
+	if _, _, err := c.Get("failing"); err != ErrKeyNotFound {
+		t.Errorf("Expected nothing stored after loader error, got %v", err)
+	}
+}
+
+func TestGetOrLoadSingleFlight(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	var loads atomic.Int32
+	release := make(chan struct{})
+	loader := func(key string) ([]byte, error) {
+		loads.Add(1)
+		<-release
+		return []byte("value"), nil
+	}
+
+	const callers = 10
+	var loadedCount atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, _, loaded, err := c.GetOrLoad("shared", 0, loader)
+			if err != nil || string(val) != "value" {
+				t.Errorf("Expected loaded value, got %q, %v", val, err)
+			}
+			if loaded {
+				loadedCount.Add(1)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // Let the callers pile up on the load
+	close(release)
+	wg.Wait()
+
+	if n := loads.Load(); n != 1 {
+		t.Errorf("Expected 1 loader call, got %d", n)
+	}
+	if n := loadedCount.Load(); n != 1 {
+		t.Errorf("Expected loaded=true for exactly 1 caller, got %d", n)
+	}
+}
+
+func TestGetOrLoadPanic(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	release := make(chan struct{})
+	panicking := func(key string) ([]byte, error) {
+		<-release
+		panic("loader failed")
+	}
+
+	// The panic goes on in the caller running the loader
+	panicked := make(chan any, 1)
+	go func() {
+		defer func() { panicked <- recover() }()
+		c.GetOrLoad("key", 0, panicking)
+	}()
+	time.Sleep(20 * time.Millisecond) // Let the load start
+
+	// A caller waiting for the load gets an error instead of blocking
+	waited := make(chan error, 1)
+	go func() {
+		_, _, _, err := c.GetOrLoad("key", 0, panicking)
+		waited <- err
+	}()
+	time.Sleep(20 * time.Millisecond) // Let the caller wait
+	close(release)
+	if r := <-panicked; r != "loader failed" {
+		t.Errorf("Expected the loader panic, got %v", r)
+	}
+	select {
+	case err := <-waited:
+		if err != ErrLoaderPanic {
+			t.Errorf("Expected ErrLoaderPanic for the waiting caller, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waiting caller blocked after the loader panicked")
+	}
+
+	// Later loads of the key are not blocked by the failed one
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		val, _, loaded, err := c.GetOrLoad("key", 0, func(key string) ([]byte, error) {
+			return []byte("value"), nil
+		})
+		if err != nil || !loaded || string(val) != "value" {
+			t.Errorf("Expected a new load, got %q, %v, %v", val, loaded, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetOrLoad blocked after the loader panicked")
+	}
+}
+
+func TestScan(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	const count = 2500
+	for i := 0; i < count; i++ {
+		c.Set(fmt.Sprintf("user:%05d", i), []byte("v"), 0)
+	}
+	c.Set("other", []byte("v"), 0)
+	c.Set("user:expired", []byte("v"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	seen := make(map[string]bool)
+	cursor, pages := "", 0
+	for {
+		keys, next, err := c.Scan("user:", cursor, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) > 100 {
+			t.Fatalf("Page of %d keys exceeds limit", len(keys))
+		}
+		for _, key := range keys {
+			if seen[key] {
+				t.Fatalf("Duplicate key %s", key)
+			}
+			seen[key] = true
+		}
+		pages++
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if len(seen) != count {
+		t.Errorf("Expected %d keys, got %d", count, len(seen))
+	}
+	for i := 0; i < count; i++ {
+		if !seen[fmt.Sprintf("user:%05d", i)] {
+			t.Fatalf("Missing key user:%05d", i)
+		}
+	}
+	if pages != count/100+1 {
+		t.Errorf("Expected %d pages, got %d", count/100+1, pages)
+	}
+}
+
+func TestScanMaxLimit(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.MaxScanLimit = 50
+
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprintf("key_%03d", i), []byte("v"), 0)
+	}
+
+	// A huge limit is lowered to MaxScanLimit instead of sizing allocations
+	keys, next, err := c.Scan("", "", 1<<62)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 50 || next != "key_049" {
+		t.Errorf("Expected a page of 50 keys up to key_049, got %d keys up to %q", len(keys), next)
+	}
+}
+
+func TestKeyNormalizer(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.KeyNormalizer = strings.ToLower
+
+	c, err := NewSharded(config, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Set("key", []byte("value"), 0)
+	val, _, err := c.Get("KEY")
+	if err != nil || string(val) != "value" {
+		t.Errorf("Expected Get(KEY) to find key, got %q, %v", val, err)
+	}
+
+	// Multi-key results are keyed by the keys as requested
+	items, err := c.GetMulti([]string{"Key", "kEY", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items["Key"] == nil || items["kEY"] == nil {
+		t.Errorf("Expected results for Key and kEY, got %v", items)
+	}
+
+	// The stored key is the normalized form
+	c.Set("MixedCase", []byte("v"), 0)
+	if keys, _, _ := c.Scan("mixed", "", 10); len(keys) != 1 || keys[0] != "mixedcase" {
+		t.Errorf("Expected stored key mixedcase, got %v", keys)
+	}
+
+	if err := c.Delete("KEY"); err != nil {
+		t.Errorf("Delete(KEY) failed: %v", err)
+	}
+	if _, _, err := c.Get("key"); err != ErrKeyNotFound {
+		t.Errorf("Expected key deleted, got %v", err)
+	}
+}
+
+func TestDataType(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Store(Op{Op: OpSet, Key: "json", Value: []byte(`{"a":1}`), DataType: 1}); err != nil {
+		t.Fatal(err)
+	}
+	item, err := c.GetItem("json")
+	if err != nil || item.DataType != 1 || string(item.Value) != `{"a":1}` {
+		t.Fatalf("Expected JSON item with DataType 1, got %+v, %v", item, err)
+	}
+
+	// Updates in place keep the data type, a plain set resets it
+	c.Append("json", []byte(" "))
+	if item, _ := c.GetItem("json"); item == nil || item.DataType != 1 {
+		t.Errorf("Expected DataType 1 after append, got %+v", item)
+	}
+	c.Set("raw", []byte("v"), 0)
+	if item, _ := c.GetItem("raw"); item == nil || item.DataType != 0 {
+		t.Errorf("Expected DataType 0 for plain set, got %+v", item)
+	}
+
+	// Non-storage operations are rejected
+	if _, err := c.Store(Op{Op: OpDelete, Key: "json"}); err == nil {
+		t.Error("Expected Store to reject OpDelete")
+	}
+
+	// The data type is persisted with the key record
+	c.Close()
+	c, err = NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	items, err := c.GetMulti([]string{"json", "raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items["json"] == nil || items["json"].DataType != 1 || items["raw"] == nil || items["raw"].DataType != 0 {
+		t.Errorf("Expected DataType to survive restart, got %+v", items)
+	}
+}
+
+func TestPersistDerivedState(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.PersistDerivedState = true
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("old", []byte("v"), 0)
+	time.Sleep(5 * time.Millisecond)
+	c.SetWithTags("new", []byte("v"), 0, []string{"t"})
+	c.Get("new")
+	c.Get("new")
+	c.Close()
+
+	// Hit counts, access order and tags survive a clean restart
+	c, err = NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldMeta, _ := c.Meta("old")
+	newMeta, _ := c.Meta("new")
+	if newMeta == nil || newMeta.Hits != 2 || !newMeta.Fetched {
+		t.Errorf("Expected 2 hits on new, got %+v", newMeta)
+	}
+	if oldMeta == nil || !oldMeta.LastAccess.Before(newMeta.LastAccess) {
+		t.Errorf("Expected old to be accessed before new, got %+v and %+v", oldMeta, newMeta)
+	}
+	if keys := c.KeysByTag("t"); len(keys) != 1 || keys[0] != "new" {
+		t.Errorf("Expected tag t on new, got %v", keys)
+	}
+	c.Close()
+
+	// Without the sidecar (as after a crash) the state starts cold
+	if err := os.Remove(tmpDir + "/shard_00/" + StateFile); err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMeta, _ = c.Meta("new")
+	if newMeta == nil || newMeta.Hits != 0 || newMeta.Fetched {
+		t.Errorf("Expected cold state for new, got %+v", newMeta)
+	}
+	if keys := c.KeysByTag("t"); len(keys) != 0 {
+		t.Errorf("Expected no tags, got %v", keys)
+	}
+	c.Close()
+
+	// A damaged sidecar is ignored
+	os.WriteFile(tmpDir+"/shard_00/"+StateFile, []byte("{garbage"), 0644)
+	c, err = NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if val, _, err := c.Get("old"); err != nil || string(val) != "v" {
+		t.Errorf("Expected old to be intact, got %q, %v", val, err)
+	}
+}
+
+func TestIncrementInit(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// A missing key is created with the initial value, the delta is not applied
+	if val, _, err := c.IncrementInit("counter", 5, 10, 0); err != nil || val != 10 {
+		t.Errorf("Expected 10, got %d, %v", val, err)
+	}
+	if val, _, err := c.IncrementInit("counter", 5, 10, 0); err != nil || val != 15 {
+		t.Errorf("Expected 15, got %d, %v", val, err)
+	}
+
+	// An expired counter starts over
+	c.IncrementInit("expiring", 1, 1, 20*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	if val, _, err := c.IncrementInit("expiring", 1, 1, 20*time.Millisecond); err != nil || val != 1 {
+		t.Errorf("Expected expired counter to restart at 1, got %d, %v", val, err)
+	}
+	if _, _, err := c.Increment("missing", 1); err != ErrKeyNotFound {
+		t.Errorf("Expected Increment without initial to miss, got %v", err)
+	}
+}
+
+// checkIndexConsistent verifies that the slot, key id and expiry lookups of
+// the index match its entries
+func checkIndexConsistent(t *testing.T, idx *Index) {
+	t.Helper()
+	slots := 0
+	for _, m := range idx.slotIndex {
+		slots += len(m)
+	}
+	if slots != idx.Count() || len(idx.keyIdMap) != idx.Count() {
+		t.Errorf("%d entries, but %d slot and %d key id mappings", idx.Count(), slots, len(idx.keyIdMap))
+	}
+	for _, entry := range idx.Entries() {
+		if key := idx.slotIndex[entry.Bucket][entry.SlotIdx]; key != entry.Key {
+			t.Errorf("Slot %d/%d of %q maps to %q", entry.Bucket, entry.SlotIdx, entry.Key, key)
+		}
+		if key := idx.keyIdMap[entry.KeyId]; key != entry.Key {
+			t.Errorf("Key id %d of %q maps to %q", entry.KeyId, entry.Key, key)
+		}
+		heapIdx, inHeap := idx.expiryHeap.keyIndex[entry.KeyId]
+		if inHeap != (entry.Expiry > 0) {
+			t.Errorf("%q with expiry %d in expiry heap: %v", entry.Key, entry.Expiry, inHeap)
+		} else if inHeap && idx.expiryHeap.entries[heapIdx].Expiry != entry.Expiry {
+			t.Errorf("%q has expiry %d, heap has %d", entry.Key, entry.Expiry, idx.expiryHeap.entries[heapIdx].Expiry)
+		}
+	}
+}
+
+func TestIndexConsistency(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	idx := c.workers[0].index
+
+	// Touch then increment the same key
+	c.Set("counter", []byte("1"), 0)
+	c.Set("other", []byte("x"), time.Hour)
+	if _, err := c.Touch("counter", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Increment("counter", 5); err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := idx.Get("counter")
+	if entry.Expiry == 0 {
+		t.Error("Expected the touched expiry to survive the increment")
+	}
+	checkIndexConsistent(t, idx)
+
+	// Growing a value into another bucket moves the tail of its old bucket
+	// into the freed slot, that key must keep its slot mapping
+	c.Set("a", []byte("small"), 0)
+	c.Set("b", []byte("small"), 0)
+	if _, err := c.Append("counter", make([]byte, 2*MinBucketSize)); err != nil {
+		t.Fatal(err)
+	}
+	checkIndexConsistent(t, idx)
+	if _, err := c.Set("other", make([]byte, 2*MinBucketSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	checkIndexConsistent(t, idx)
+
+	// Deletes compact the moved keys correctly
+	for _, key := range []string{"a", "counter", "b", "other"} {
+		c.Delete(key)
+		checkIndexConsistent(t, idx)
+	}
+	if idx.Count() != 0 {
+		t.Errorf("Expected an empty index, got %d entries", idx.Count())
+	}
+}
+
+func TestKeySlotCompaction(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	idx := c.workers[0].index
+
+	for i := 0; i < 5; i++ {
+		c.Set(fmt.Sprintf("key_%d", i), []byte(fmt.Sprintf("value_%d", i)), time.Duration(i+1)*time.Hour)
+	}
+	tail, _ := idx.Get("key_4")
+
+	// Deleting a middle key moves the tail record into its key id
+	if err := c.Delete("key_1"); err != nil {
+		t.Fatal(err)
+	}
+	moved := idx.GetByKeyId(1)
+	if moved == nil || moved.Key != "key_4" {
+		t.Fatalf("Expected key id 1 to hold key_4, got %+v", moved)
+	}
+	if entry := idx.GetByKeyId(4); entry != nil {
+		t.Errorf("Expected key id 4 to be free, got %q", entry.Key)
+	}
+	heapIdx, ok := idx.expiryHeap.keyIndex[1]
+	if !ok || idx.expiryHeap.entries[heapIdx].Expiry != tail.Expiry {
+		t.Errorf("Expected the expiry of key_4 at key id 1 in the expiry heap")
+	}
+	checkIndexConsistent(t, idx)
+
+	rec, err := c.workers[0].storage.ReadKeyRecord(1)
+	if err != nil || string(rec.Key[:rec.KeyLen]) != "key_4" {
+		t.Errorf("Expected the key record of key_4 at key id 1, got %v", err)
+	}
+	if val, _, err := c.Get("key_4"); err != nil || string(val) != "value_4" {
+		t.Errorf("Expected value_4, got %q (err=%v)", val, err)
+	}
+}
+
+func TestDecrementInit(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	// A missing key is created with the initial value
+	if val, _, err := c.DecrementInit("counter", 3, 10, 0); err != nil || val != 10 {
+		t.Errorf("Expected 10, got %d, %v", val, err)
+	}
+	if val, _, err := c.DecrementInit("counter", 3, 10, 0); err != nil || val != 7 {
+		t.Errorf("Expected 7, got %d, %v", val, err)
+	}
+	if val, _, err := c.Decrement("counter", 3); err != nil || val != 4 {
+		t.Errorf("Expected 4, got %d, %v", val, err)
+	}
+
+	// Without an initial value a missing key stays missing
+	if _, _, err := c.Decrement("missing", 1); err != ErrKeyNotFound {
+		t.Errorf("Expected Decrement without initial to miss, got %v", err)
+	}
+	if _, _, err := c.Get("missing"); err != ErrKeyNotFound {
+		t.Errorf("Expected missing key not to be created, got %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The limit is enforced within a window
+	for i := uint64(1); i <= 3; i++ {
+		allowed, remaining, err := c.RateLimit("user1", 3, time.Hour)
+		if err != nil || !allowed || remaining != 3-i {
+			t.Fatalf("Request %d: expected allowed with %d remaining, got %v, %d, %v", i, 3-i, allowed, remaining, err)
+		}
+	}
+	if allowed, remaining, _ := c.RateLimit("user1", 3, time.Hour); allowed || remaining != 0 {
+		t.Errorf("Expected request over the limit to be denied, got %v, %d", allowed, remaining)
+	}
+
+	// Other keys have their own counter
+	if allowed, _, _ := c.RateLimit("user2", 3, time.Hour); !allowed {
+		t.Error("Expected other key to be allowed")
+	}
+
+	// The limit resets in the next window
+	window := 50 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		c.RateLimit("user3", 1, window)
+	}
+	time.Sleep(window)
+	if allowed, remaining, _ := c.RateLimit("user3", 1, window); !allowed || remaining != 0 {
+		t.Errorf("Expected request in a new window to be allowed, got %v, %d", allowed, remaining)
+	}
+
+	if _, _, err := c.RateLimit("user4", 1, 0); err == nil {
+		t.Error("Expected error for zero window")
+	}
+}
+
+func TestFlags(t *testing.T) {
+	for _, format := range []KeyFormat{KeyFormatFixed, KeyFormatPacked} {
+		t.Run(format.String(), func(t *testing.T) {
+			tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			config := DefaultConfig()
+			config.DataDir = tmpDir
+			config.SyncStrategy = SyncNone
+			config.KeyFormat = format
+
+			c, err := NewSharded(config, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Flags are returned as stored, also the full 32 bits
+			c.Store(Op{Op: OpSet, Key: "php", Value: []byte("a:0:{}"), Flags: 1})
+			c.Store(Op{Op: OpSet, Key: "max", Value: []byte("v"), Flags: math.MaxUint32})
+			c.Set("plain", []byte("v"), 0)
+			if item, err := c.GetItem("php"); err != nil || item.Flags != 1 {
+				t.Errorf("Expected flags 1, got %+v, %v", item, err)
+			}
+
+			// A cas keeps the new flags, an append the existing ones
+			item, _ := c.GetItem("php")
+			if _, err := c.Store(Op{Op: OpCas, Key: "php", Value: []byte("b:1;"), Cas: item.Cas, Flags: 4}); err != nil {
+				t.Fatal(err)
+			}
+			c.Append("php", []byte(" "))
+			if item, _ := c.GetItem("php"); item == nil || item.Flags != 4 {
+				t.Errorf("Expected flags 4 after cas and append, got %+v", item)
+			}
+
+			// Flags are persisted with the key record
+			c.Close()
+			c, err = NewSharded(config, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			items, err := c.GetMulti([]string{"php", "max", "plain"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if items["php"] == nil || items["php"].Flags != 4 || items["max"] == nil || items["max"].Flags != math.MaxUint32 ||
+				items["plain"] == nil || items["plain"].Flags != 0 {
+				t.Errorf("Expected flags to survive restart, got %+v %+v %+v", items["php"], items["max"], items["plain"])
+			}
+		})
+	}
+}
+
+func TestKeyRecordChecksum(t *testing.T) {
+	for _, format := range []KeyFormat{KeyFormatFixed, KeyFormatPacked} {
+		t.Run(format.String(), func(t *testing.T) {
+			tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			config := DefaultConfig()
+			config.DataDir = tmpDir
+			config.SyncStrategy = SyncNone
+			config.KeyFormat = format
+
+			c, err := NewSharded(config, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				c.Set(fmt.Sprintf("key%d", i), []byte("value"), 0)
+			}
+			c.Close()
+
+			// Simulate a torn write of the last record
+			keysPath := filepath.Join(tmpDir, "shard_00", "keys")
+			info, err := os.Stat(keysPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recSize := int64(KeyRecordSize)
+			if format == KeyFormatPacked {
+				recSize = PackedKeyRecordSize(len("key9"))
+			}
+			f, err := os.OpenFile(keysPath, os.O_RDWR, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteAt([]byte("garbage"), info.Size()-recSize+2)
+			f.Close()
+
+			c, err = NewSharded(config, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if items := c.Stats()["curr_items"]; items != "9" {
+				t.Errorf("Expected 9 items after recovery, got %s", items)
+			}
+			if _, _, err := c.Get("key9"); err != ErrKeyNotFound {
+				t.Errorf("Expected corrupt record to be discarded, got %v", err)
+			}
+			if val, _, err := c.Get("key8"); err != nil || string(val) != "value" {
+				t.Errorf("Expected key8 to survive, got %q, %v", val, err)
+			}
+			if info, _ := os.Stat(keysPath); info.Size() != 9*recSize {
+				t.Errorf("Expected keys file truncated to %d bytes, got %d", 9*recSize, info.Size())
+			}
+		})
+	}
+}
+
+func TestValueChecksum(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	evicted := make(chan EvictReason, 1)
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.OnEvict = func(key string, reason EvictReason) {
+		evicted <- reason
+	}
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("key", []byte("value"), 0)
+	c.Close()
+
+	// Flip a byte of the value
+	dataPath := filepath.Join(tmpDir, "shard_00", "data_00")
+	f, err := os.OpenFile(dataPath, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	f.ReadAt(b, DataHeaderSize)
+	f.WriteAt([]byte{b[0] ^ 0x01}, DataHeaderSize)
+	f.Close()
+
+	c, err = NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.Get("key"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt, got %v", err)
+	}
+	select {
+	case reason := <-evicted:
+		if reason != ReasonCorrupt {
+			t.Errorf("Expected OnEvict reason corrupt, got %v", reason)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected OnEvict for the corrupt value")
+	}
+	if _, _, err := c.Get("key"); err != ErrKeyNotFound {
+		t.Errorf("Expected corrupt value to be evicted, got %v", err)
+	}
+
+	// Data dirs with keys written before checksums keep the old header
+	legacyDir := filepath.Join(tmpDir, "legacy")
+	os.MkdirAll(legacyDir, 0755)
+	os.WriteFile(filepath.Join(legacyDir, "keys"), make([]byte, KeyRecordSize), 0644)
+	if size, err := dataHeaderSize(legacyDir, map[string]string{}); err != nil || size != legacyDataHeaderSize {
+		t.Errorf("Expected legacy header size %d, got %d (err=%v)", legacyDataHeaderSize, size, err)
+	}
+	if size, err := dataHeaderSize(legacyDir, map[string]string{"datachecksum": "crc32"}); err != nil || size != DataHeaderSize {
+		t.Errorf("Expected header size %d, got %d (err=%v)", DataHeaderSize, size, err)
+	}
+}
+
+func TestKeyRecordUpgrade(t *testing.T) {
+	// Records of an older key record version, as written before the
+	// version was recorded in the format file
+	legacyRecord := func(version int, packed bool, key string, cas uint64, slot int64, flags uint32) []byte {
+		keyArea := MaxKeySize
+		if packed {
+			keyArea = len(key)
+		}
+		buf := make([]byte, 2+keyArea+keyRecordTail(version))
+		binary.LittleEndian.PutUint16(buf[0:2], uint16(len(key)))
+		copy(buf[2:], key)
+		t := buf[2+keyArea:]
+		binary.LittleEndian.PutUint64(t[0:8], cas)
+		binary.LittleEndian.PutUint64(t[17:25], uint64(slot))
+		if version >= keyRecordV3 {
+			binary.LittleEndian.PutUint32(t[26:30], flags)
+		}
+		return buf
+	}
+	legacySlot := func(value string) []byte {
+		buf := make([]byte, legacyDataHeaderSize+MinBucketSize)
+		binary.LittleEndian.PutUint32(buf[1:5], uint32(len(value)))
+		copy(buf[legacyDataHeaderSize:], value)
+		return buf
+	}
+
+	for _, tt := range []struct {
+		name    string
+		version int
+		format  KeyFormat
+		file    string // Format file contents, empty for none
+	}{
+		{"v1 without format file", keyRecordV1, KeyFormatFixed, ""},
+		{"v2", keyRecordV2, KeyFormatFixed, "byteorder=LittleEndian\nkeyformat=fixed\n"},
+		{"v3", keyRecordV3, KeyFormatFixed, "byteorder=LittleEndian\nkeyformat=fixed\n"},
+		{"v3 packed", keyRecordV3, KeyFormatPacked, "byteorder=LittleEndian\nkeyformat=packed\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			shardDir := filepath.Join(tmpDir, "shard_00")
+			os.MkdirAll(shardDir, 0755)
+			packed := tt.format == KeyFormatPacked
+			keys := append(legacyRecord(tt.version, packed, "a", 5, 0, 7), legacyRecord(tt.version, packed, "bb", 6, 1, 0)...)
+			os.WriteFile(filepath.Join(shardDir, "keys"), keys, 0644)
+			os.WriteFile(filepath.Join(shardDir, "data_00"), append(legacySlot("first"), legacySlot("second")...), 0644)
+			if tt.file != "" {
+				os.WriteFile(filepath.Join(shardDir, FormatFile), []byte(tt.file), 0644)
+			}
+
+			config := DefaultConfig()
+			config.DataDir = tmpDir
+			config.SyncStrategy = SyncNone
+			config.KeyFormat = tt.format
+			for i := 0; i < 2; i++ { // Upgraded, then as recorded
+				c, err := NewSharded(config, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				item, err := c.GetItem("a")
+				if err != nil || string(item.Value) != "first" || item.Cas != 5 {
+					t.Errorf("Expected a = first with cas 5, got %+v (err=%v)", item, err)
+				} else if tt.version >= keyRecordV3 && item.Flags != 7 {
+					t.Errorf("Expected flags 7 to be kept, got %d", item.Flags)
+				}
+				if val, _, err := c.Get("bb"); err != nil || string(val) != "second" {
+					t.Errorf("Expected bb = second, got %q (err=%v)", val, err)
+				}
+				c.Close()
+			}
+			if data, _ := os.ReadFile(filepath.Join(shardDir, FormatFile)); !strings.Contains(string(data), "keyrecord=4\n") {
+				t.Errorf("Expected the key record version in the format file, got %q", data)
+			}
+		})
+	}
+
+	// A keys file of no known layout is refused and left as it is
+	tmpDir := t.TempDir()
+	shardDir := filepath.Join(tmpDir, "shard_00")
+	os.MkdirAll(shardDir, 0755)
+	garbage := bytes.Repeat([]byte{0xff}, 3000)
+	os.WriteFile(filepath.Join(shardDir, "keys"), garbage, 0644)
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	if _, err := NewSharded(config, 1); !errors.Is(err, ErrKeyRecordLayout) {
+		t.Errorf("Expected ErrKeyRecordLayout, got %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(shardDir, "keys")); !bytes.Equal(data, garbage) {
+		t.Errorf("Expected the keys file to be left as it is, got %d bytes", len(data))
+	}
+}
+
+func TestPartialKeyRecord(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		c.Set(fmt.Sprintf("key%d", i), []byte("value"), 0)
+	}
+	c.Close()
+
+	// Simulate an interrupted append of a record
+	keysPath := filepath.Join(tmpDir, "shard_00", "keys")
+	f, err := os.OpenFile(keysPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(bytes.Repeat([]byte("garbage"), 50))
+	f.Close()
+
+	c, err = NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(keysPath); info.Size() != 10*KeyRecordSize {
+		t.Errorf("Expected keys file truncated to %d bytes, got %d", 10*KeyRecordSize, info.Size())
+	}
+	// New records follow the recovered ones
+	c.Set("key10", []byte("value"), 0)
+	c.Set("key11", []byte("value"), 0)
+	c.Close()
+
+	c, err = NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if items := c.Stats()["curr_items"]; items != "12" {
+		t.Errorf("Expected 12 items after recovery, got %s", items)
+	}
+	for i := 0; i < 12; i++ {
+		if val, _, err := c.Get(fmt.Sprintf("key%d", i)); err != nil || string(val) != "value" {
+			t.Errorf("Expected key%d to survive, got %q, %v", i, val, err)
+		}
+	}
+}
+
+func TestCommandStats(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	c.Set("a", []byte("1"), 0)
+	c.Set("b", []byte("2"), 0)
+	c.Add("a", []byte("x"), 0) // Fails, still a set command
+	c.Get("a")
+	c.Get("missing")
+	c.GetMulti([]string{"a", "b", "missing"})
+	c.Increment("a", 1)
+	c.Decrement("missing", 1)
+	c.Delete("b")
+	c.Delete("b")
+	c.Delete("missing")
+
+	stats := c.Stats()
+	expected := map[string]string{
+		"cmd_get":       "5",
+		"cmd_set":       "3",
+		"get_hits":      "3",
+		"get_misses":    "2",
+		"delete_hits":   "1",
+		"delete_misses": "2",
+		"incr_hits":     "1",
+		"incr_misses":   "1",
+	}
+	for name, want := range expected {
+		if stats[name] != want {
+			t.Errorf("Expected %s %s, got %s", name, want, stats[name])
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.Compression = CompressionFlate
+	config.CompressionThreshold = 1024
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compressible := []byte(strings.Repeat("session data ", 5000))
+	incompressible := make([]byte, 64*1024)
+	for i := range incompressible {
+		incompressible[i] = byte(rand.Intn(256))
+	}
+	values := map[string][]byte{
+		"compressible":   compressible,
+		"incompressible": incompressible,
+		"small":          []byte(strings.Repeat("a", 100)), // Below the threshold
+	}
+	for key, value := range values {
+		if _, err := c.Set(key, value, 0); err != nil {
+			t.Fatalf("Set %s failed: %v", key, err)
+		}
+	}
+	c.Append("compressible", []byte("tail"))
+	values["compressible"] = append(compressible, "tail"...)
+
+	// The bucket is chosen by the compressed size, the size is the original one
+	if meta, err := c.Meta("compressible"); err != nil || meta.Bucket != 0 || meta.Size != len(values["compressible"]) {
+		t.Errorf("Expected compressible value in bucket 0 with its original size, got %+v, %v", meta, err)
+	}
+	if meta, err := c.Meta("incompressible"); err != nil || meta.Bucket == 0 {
+		t.Errorf("Expected incompressible value stored as given, got %+v, %v", meta, err)
+	}
+
+	check := func() {
+		t.Helper()
+		for key, value := range values {
+			got, _, err := c.Get(key)
+			if err != nil || !bytes.Equal(got, value) {
+				t.Errorf("%s: expected %d bytes back exactly, got %d, %v", key, len(value), len(got), err)
+			}
+		}
+	}
+	check()
+
+	// Compaction moves compressed slots as they are
+	c.Set("filler", []byte(strings.Repeat("x", 3000)), 0)
+	c.Set("moved", []byte(strings.Repeat("moved ", 1000)), 0)
+	c.Delete("compressible")
+	delete(values, "compressible")
+	values["moved"] = []byte(strings.Repeat("moved ", 1000))
+	check()
+
+	// And they are read back after a restart, also with compression off
+	c.Close()
+	config.Compression = CompressionNone
+	c, err = NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	check()
+}
+
+func TestExists(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	c.Set("present", []byte(strings.Repeat("v", 100000)), 0)
+	c.Set("expired", []byte("v"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	storage := c.workers[c.shardFor("present")].Storage()
+	readsBefore := storage.DataReads()
+	if ok, err := c.Exists("present"); err != nil || !ok {
+		t.Errorf("Expected present key to exist, got %v, %v", ok, err)
+	}
+	if reads := storage.DataReads() - readsBefore; reads != 0 {
+		t.Errorf("Expected no data reads for Exists, got %d", reads)
+	}
+	if meta, _ := c.Meta("present"); meta.Fetched {
+		t.Error("Expected Exists not to mark the key as fetched")
+	}
+
+	for _, key := range []string{"expired", "missing"} {
+		if ok, err := c.Exists(key); err != nil || ok {
+			t.Errorf("Expected %s not to exist, got %v, %v", key, ok, err)
+		}
+	}
+}
+
+func TestGetWithTTL(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	c.Set("key", []byte("value"), 100*time.Second)
+	c.Set("forever", []byte("value"), 0)
+
+	value, _, ttl, err := c.GetWithTTL("key")
+	if err != nil || string(value) != "value" {
+		t.Fatalf("Expected value, got %q, %v", value, err)
+	}
+	if ttl > 100*time.Second || ttl < 99*time.Second {
+		t.Errorf("Expected about 100s remaining, got %v", ttl)
+	}
+	if _, _, ttl, _ := c.GetWithTTL("forever"); ttl != NoExpiry {
+		t.Errorf("Expected NoExpiry for a key without TTL, got %v", ttl)
+	}
+	if item, _ := c.GetItem("key"); item.TTL > 100*time.Second || item.TTL < 99*time.Second {
+		t.Errorf("Expected GetItem to report about 100s remaining, got %v", item.TTL)
+	}
+	if _, _, _, err := c.GetWithTTL("missing"); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.ChannelCapacity = 1
+	config.RequestTimeout = 50 * time.Millisecond
+	config.MaxBufferedBytes = 10
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Block the worker: it stalls sending a response nobody reads yet
+	worker := c.workers[0]
+	block := make(chan *Response)
+	worker.RequestChan() <- &Request{Op: OpStats, RespChan: block}
+	for len(worker.RequestChan()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Queued, but not answered in time
+	value := []byte("queued")
+	if _, err := c.Set("key", value, 0); err != ErrBusy {
+		t.Errorf("Expected ErrBusy for an unanswered request, got %v", err)
+	}
+	copy(value, "reused")
+
+	// The queued set keeps its buffer budget, so the wait for room times out
+	if current, _ := c.BufferedBytes(); current != int64(len(value)) {
+		t.Errorf("Expected the queued set to hold %d buffered bytes, got %d", len(value), current)
+	}
+	start := time.Now()
+	if _, err := c.Set("other", []byte("waits!"), 0); err != ErrBusy {
+		t.Errorf("Expected ErrBusy waiting for buffer room, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the buffer wait to time out after 50ms, took %v", elapsed)
+	}
+
+	// The channel is full, so the request is not even taken
+	start = time.Now()
+	if _, _, err := c.Get("key"); err != ErrBusy {
+		t.Errorf("Expected ErrBusy for a full channel, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to time out after 50ms, took %v", elapsed)
+	}
+
+	// The timed out set is still applied, with the value as it was passed
+	<-block
+	value, _, err = c.Get("key")
+	if err != nil || string(value) != "queued" {
+		t.Errorf("Expected the queued value, got %q, %v", value, err)
+	}
+	if current, _ := c.BufferedBytes(); current != 0 {
+		t.Errorf("Expected the budget to be returned once taken, got %d", current)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	primaryDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(primaryDir)
+	followerDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(followerDir)
+
+	config := DefaultConfig()
+	config.DataDir = primaryDir
+	config.SyncStrategy = SyncNone
+	config.ReplicationEnabled = true
+	primary, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+
+	config.DataDir = followerDir
+	config.ReplicationEnabled = false
+	follower, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+
+	// Mutations before a flush, which must not survive it
+	primary.Set("flushed", []byte("v"), 0)
+	primary.FlushAll()
+
+	for i := 0; i < 100; i++ {
+		primary.Store(Op{Op: OpSet, Key: fmt.Sprintf("key%d", i), Value: []byte(fmt.Sprintf("value%d", i)), Flags: uint32(i)})
+	}
+	primary.Delete("key0")
+	primary.Set("counter", []byte("10"), 0)
+	primary.Increment("counter", 5)
+	primary.Append("key1", []byte("-appended"))
+	primary.Set("ttl", []byte("v"), time.Hour)
+	primary.Touch("key2", time.Minute)
+	primary.Transact([]Op{{Op: OpSet, Key: "batch", Value: []byte("committed")}})
+	primary.Transact([]Op{
+		{Op: OpSet, Key: "batch", Value: []byte("rolled back")},
+		{Op: OpReplace, Key: "batch", Value: []byte("x"), Cas: 1},
+		{Op: OpAdd, Key: "batch", Value: []byte("fails")},
+	})
+
+	replica := NewReplicaClient(primaryDir, follower)
+	replica.Start(5 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if value, _, _ := follower.Get("batch"); string(value) == "committed" {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	replica.Stop()
+	if err := replica.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	keys := []string{"flushed", "counter", "ttl", "batch"}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+	}
+	for _, key := range keys {
+		want, wantErr := primary.GetItem(key)
+		got, err := follower.GetItem(key)
+		if err != wantErr {
+			t.Errorf("%s: expected error %v, got %v", key, wantErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(got.Value, want.Value) || got.Flags != want.Flags {
+			t.Errorf("%s: expected %q (flags %d), got %q (flags %d)", key, want.Value, want.Flags, got.Value, got.Flags)
+		}
+		if diff := got.TTL - want.TTL; diff > time.Second || diff < -time.Second {
+			t.Errorf("%s: expected TTL %v, got %v", key, want.TTL, got.TTL)
+		}
+	}
+	if value, _, _ := follower.Get("batch"); string(value) != "committed" {
+		t.Errorf("Expected the rolled back batch not to be replicated, got %q", value)
+	}
+
+	// Replaying the logs from the start changes nothing
+	if err := NewReplicaClient(primaryDir, follower).Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := follower.Stats()["curr_items"], primary.Stats()["curr_items"]; got != want {
+		t.Errorf("Expected %s items after replay, got %s", want, got)
+	}
+
+	// A torn record at the end of a log is cut off when the primary reopens
+	walFile := filepath.Join(primaryDir, "shard_00", WALFileName)
+	info, _ := os.Stat(walFile)
+	f, _ := os.OpenFile(walFile, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write((&WALRecord{Op: OpSet, Key: "torn", Value: []byte("value")}).Encode()[:10])
+	f.Close()
+	if err := primary.ReloadShard(0); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.Stat(walFile); after.Size() != info.Size() {
+		t.Errorf("Expected the torn record to be cut off, size %d, want %d", after.Size(), info.Size())
+	}
+}
+
+func TestWALCheckpointPeriodicSync(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Checkpoints on every append while the sync goroutine syncs all the
+	// time (go test -race)
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncPeriodic
+	config.SyncInterval = time.Microsecond
+	config.ReplicationEnabled = true
+	config.WALCheckpointSize = 1
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 200; i++ {
+		if _, err := c.Set(fmt.Sprintf("key%d", i%10), []byte("value"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	primaryDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(primaryDir)
+	followerDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(followerDir)
+
+	config := DefaultConfig()
+	config.DataDir = primaryDir
+	config.SyncStrategy = SyncNone
+	config.ReplicationEnabled = true
+	config.WALCheckpointSize = 4096
+	primary, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+
+	config.DataDir = followerDir
+	config.ReplicationEnabled = false
+	follower, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+
+	replica := NewReplicaClient(primaryDir, follower)
+	for i := 0; i < 10; i++ {
+		primary.Set(fmt.Sprintf("key%d", i), []byte("first"), 0)
+	}
+	if err := replica.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwriting the same keys keeps the log near the size of the live keys
+	for round := 0; round < 100; round++ {
+		for i := 0; i < 10; i++ {
+			primary.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("round%d", round)), 0)
+		}
+	}
+	primary.Delete("key0")
+	walFile := filepath.Join(primaryDir, "shard_00", WALFileName)
+	info, err := os.Stat(walFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= 2*config.WALCheckpointSize {
+		t.Errorf("Expected the log to be checkpointed, size %d", info.Size())
+	}
+
+	// The follower applies the checkpoint from its start, the deletion of a
+	// key it has not seen being deleted included
+	if err := replica.Sync(); err != nil {
+		t.Fatalf("Sync after checkpoint failed: %v", err)
+	}
+	if _, _, err := follower.Get("key0"); err != ErrKeyNotFound {
+		t.Errorf("Expected key0 to be deleted on the follower, got %v", err)
+	}
+	for i := 1; i < 10; i++ {
+		if value, _, _ := follower.Get(fmt.Sprintf("key%d", i)); string(value) != "round99" {
+			t.Errorf("key%d: expected round99, got %q", i, value)
+		}
+	}
+}
+
+func TestDeleteCas(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	readCas, _ := c.Set("key", []byte("old"), 0)
+	newCas, _ := c.Set("key", []byte("new"), 0)
+
+	// A stale CAS keeps the newer value
+	if err := c.DeleteCas("key", readCas); err != ErrCasMismatch {
+		t.Errorf("Expected ErrCasMismatch, got %v", err)
+	}
+	if value, _, err := c.Get("key"); err != nil || string(value) != "new" {
+		t.Errorf("Expected the newer value to be kept, got %q, %v", value, err)
+	}
+
+	if err := c.DeleteCas("key", newCas); err != nil {
+		t.Errorf("Expected delete with the current CAS to succeed, got %v", err)
+	}
+	if _, _, err := c.Get("key"); err != ErrKeyNotFound {
+		t.Errorf("Expected the key to be deleted, got %v", err)
+	}
+	if err := c.DeleteCas("key", newCas); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for a missing key, got %v", err)
+	}
+}
+
+func TestTouchCas(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	readCas, _ := c.Set("session", []byte("old"), time.Minute)
+	newCas, _ := c.Set("session", []byte("new"), time.Minute)
+
+	// A stale CAS does not extend the rotated value
+	if _, err := c.TouchCas("session", time.Hour, readCas); err != ErrCasMismatch {
+		t.Errorf("Expected ErrCasMismatch, got %v", err)
+	}
+	if _, _, ttl, err := c.GetWithTTL("session"); err != nil || ttl > time.Minute {
+		t.Errorf("Expected the TTL to stay at 1m, got %v (err=%v)", ttl, err)
+	}
+
+	cas, err := c.TouchCas("session", time.Hour, newCas)
+	if err != nil || cas != newCas {
+		t.Errorf("Expected touch with the current CAS to keep it, got %d, %v", cas, err)
+	}
+	if _, _, ttl, err := c.GetWithTTL("session"); err != nil || ttl <= time.Minute {
+		t.Errorf("Expected the TTL to be extended to 1h, got %v (err=%v)", ttl, err)
+	}
+	if _, err := c.TouchCas("missing", time.Hour, newCas); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for a missing key, got %v", err)
+	}
+}
+
+func TestFlushAllAfter(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	// Without a delay the flush is immediate
+	c.Set("before", []byte("v"), 0)
+	c.FlushAllAfter(0)
+	if _, _, err := c.Get("before"); err != ErrKeyNotFound {
+		t.Errorf("Expected immediate flush, got %v", err)
+	}
+
+	// Items stay readable until the flush time, also ones written meanwhile
+	c.Set("before", []byte("v"), 0)
+	c.FlushAllAfter(200 * time.Millisecond)
+	c.Set("meanwhile", []byte("v"), 0)
+	for _, key := range []string{"before", "meanwhile"} {
+		if _, _, err := c.Get(key); err != nil {
+			t.Errorf("Expected %s before the flush time, got %v", key, err)
+		}
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	for _, key := range []string{"before", "meanwhile"} {
+		if _, _, err := c.Get(key); err != ErrKeyNotFound {
+			t.Errorf("Expected %s to be flushed, got %v", key, err)
+		}
+	}
+
+	// Items written after the flush time survive
+	c.Set("after", []byte("v"), 0)
+	time.Sleep(150 * time.Millisecond)
+	if value, _, err := c.Get("after"); err != nil || string(value) != "v" {
+		t.Errorf("Expected item set after the flush to survive, got %q, %v", value, err)
+	}
+
+	// Without requests the flush still runs, on the expiry timer
+	c.FlushAllAfter(50 * time.Millisecond)
+	time.Sleep(300 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		info, err := os.Stat(filepath.Join(c.config.DataDir, fmt.Sprintf("shard_%02d", i), "keys"))
+		if err != nil || info.Size() != 0 {
+			t.Errorf("Expected shard %d keys file to be truncated by the timer, got %v", i, err)
+		}
+	}
+}
+
+func TestUpdateSlotIdx(t *testing.T) {
+	for _, format := range []KeyFormat{KeyFormatFixed, KeyFormatPacked} {
+		t.Run(format.String(), func(t *testing.T) {
+			tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			s, err := NewStorage(tmpDir, StorageOptions{KeyFormat: format})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			// Neighbouring records must not be touched
+			records := make([]*KeyRecord, 3)
+			keyIds := make([]int64, 3)
+			var nextKeyId int64
+			for i := range records {
+				key := fmt.Sprintf("key%d", i)
+				rec := &KeyRecord{
+					KeyLen:   uint16(len(key)),
+					Cas:      uint64(100 + i),
+					Expiry:   int64(200 + i),
+					Bucket:   byte(i + 1),
+					SlotIdx:  int64(300 + i),
+					DataType: byte(i + 2),
+					Flags:    uint32(400 + i),
+				}
+				copy(rec.Key[:], key)
+				if err := s.WriteKeyRecord(nextKeyId, rec); err != nil {
+					t.Fatal(err)
+				}
+				records[i] = rec
+				keyIds[i] = nextKeyId
+				nextKeyId += s.KeyIdSpan(len(key))
+			}
+
+			if err := s.UpdateSlotIdx(keyIds[1], 999); err != nil {
+				t.Fatal(err)
+			}
+			records[1].SlotIdx = 999
+
+			for i, want := range records {
+				got, err := s.ReadKeyRecord(keyIds[i])
+				if err != nil {
+					t.Fatalf("Record %d: %v", i, err)
+				}
+				got.CRC = 0 // Computed on write
+				if *got != *want {
+					t.Errorf("Record %d mismatch: got %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMmap(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.UseMmap = true
+
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	check := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			key := fmt.Sprintf("key%d", i)
+			val, _, err := c.Get(key)
+			if err != nil || string(val) != "value"+strconv.Itoa(i) {
+				t.Fatalf("%s: got %q, %v", key, val, err)
+			}
+		}
+	}
+
+	// Map the file, then grow it past the mapping
+	for i := 0; i < 10; i++ {
+		c.Set(fmt.Sprintf("key%d", i), []byte("value"+strconv.Itoa(i)), 0)
+	}
+	check(0, 10)
+	for i := 10; i < 1000; i++ {
+		c.Set(fmt.Sprintf("key%d", i), []byte("value"+strconv.Itoa(i)), 0)
+	}
+	check(0, 1000)
+
+	// Overwrites are visible through the mapping
+	c.Set("key5", []byte("value5"), 0)
+	check(5, 6)
+
+	// Shrinking the file drops the mapping before the truncate
+	for i := 500; i < 1000; i++ {
+		c.Delete(fmt.Sprintf("key%d", i))
+	}
+	check(0, 500)
+	c.FlushAll()
+	if _, _, err := c.Get("key1"); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound after flush, got %v", err)
+	}
+	c.Set("key1", []byte("value1"), 0)
+	check(1, 2)
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, useMmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%v", useMmap), func(b *testing.B) {
+			tmpDir, err := os.MkdirTemp("", "tqcache-bench-*")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			config := DefaultConfig()
+			config.DataDir = tmpDir
+			config.SyncStrategy = SyncNone
+			config.UseMmap = useMmap
+			c, err := NewSharded(config, 1)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+
+			value := make([]byte, 4000)
+			for i := 0; i < 1000; i++ {
+				c.Set("key"+strconv.Itoa(i), value, 0)
+			}
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				c.Get("key" + strconv.Itoa(n%1000))
+			}
+		})
+	}
+}
+
+func TestLargeReads(t *testing.T) {
+	for _, useMmap := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mmap=%v", useMmap), func(t *testing.T) {
+			tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			config := DefaultConfig()
+			config.DataDir = tmpDir
+			config.SyncStrategy = SyncNone
+			config.UseMmap = useMmap
+			config.LargeReadThreshold = 64 * 1024
+			c, err := NewSharded(config, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			value := func(b byte) []byte { return bytes.Repeat([]byte{b}, 100*1024) }
+			c.Set("big", value('a'), 0)
+			c.Set("small", []byte("value"), 0)
+
+			// Overwrites and deletes move the value while readers copy it
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					if i%10 == 9 {
+						c.Delete("big")
+					}
+					c.Set(fmt.Sprintf("big%d", i%3), value('x'), 0)
+					c.Set("big", value('a'+byte(i%26)), 0)
+				}
+			}()
+			gets := 0
+			for i := 0; i < 400; i++ {
+				gets++
+				val, _, err := c.Get("big")
+				if err == ErrKeyNotFound {
+					continue
+				}
+				if err != nil || len(val) != 100*1024 || !bytes.Equal(val, value(val[0])) {
+					t.Fatalf("Expected a whole value, got %d bytes (err=%v)", len(val), err)
+				}
+				gets++
+				if val, _, err := c.Get("small"); err != nil || string(val) != "value" {
+					t.Fatalf("Expected small value, got %q (err=%v)", val, err)
+				}
+			}
+			wg.Wait()
+
+			val, cas, err := c.Get("big")
+			if err != nil || !bytes.Equal(val, value('a'+199%26)) || cas == 0 {
+				t.Errorf("Expected the last value, got %d bytes, cas %d (err=%v)", len(val), cas, err)
+			}
+			if got := c.Stats()["cmd_get"]; got != strconv.Itoa(gets+1) {
+				t.Errorf("Expected cmd_get %d, got %s", gets+1, got)
+			}
+		})
+	}
+}
+
+// BenchmarkLargeReads measures small gets while other clients read 16MB
+// values from the same shard, with and without the reader goroutines
+func BenchmarkLargeReads(b *testing.B) {
+	for _, threshold := range []int{0, 1024 * 1024} {
+		b.Run(fmt.Sprintf("threshold=%d", threshold), func(b *testing.B) {
+			tmpDir, err := os.MkdirTemp("", "tqcache-bench-*")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			config := DefaultConfig()
+			config.DataDir = tmpDir
+			config.SyncStrategy = SyncNone
+			config.MaxValueSize = 0
+			config.LargeReadThreshold = threshold
+			c, err := NewSharded(config, 1)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+
+			if _, err := c.Set("big", make([]byte, 16*1024*1024), 0); err != nil {
+				b.Fatal(err)
+			}
+			c.Set("small", make([]byte, 100), 0)
+
+			stop := make(chan struct{})
+			var wg, started sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				started.Add(1)
+				go func() {
+					defer wg.Done()
+					c.Get("big")
+					started.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+							c.Get("big")
+						}
+					}
+				}()
+			}
+			started.Wait()
+
+			latencies := make([]time.Duration, b.N)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				start := time.Now()
+				c.Get("small")
+				latencies[n] = time.Since(start)
+			}
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-µs")
+		})
+	}
+}
+
+func TestStoreMulti(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	c.Set("existing", []byte("old"), 0)
+	results := c.StoreMulti([]Op{
+		{Op: OpSet, Key: "a", Value: []byte("1"), Flags: 7},
+		{Op: OpAdd, Key: "existing", Value: []byte("2")},
+		{Op: OpReplace, Key: "missing", Value: []byte("3")},
+		{Op: OpDelete, Key: "a"},
+		{Op: OpSet, Key: "a", Value: []byte("4")},
+	})
+	for i, want := range map[int]error{0: nil, 1: ErrKeyExists, 2: ErrKeyNotFound, 4: nil} {
+		if results[i].Err != want {
+			t.Errorf("Op %d: expected %v, got %v", i, want, results[i].Err)
+		}
+	}
+	if results[3].Err == nil {
+		t.Error("Expected an error for a non-storage operation")
+	}
+	if results[0].Cas == 0 || results[4].Cas <= results[0].Cas {
+		t.Errorf("Expected increasing CAS values, got %d and %d", results[0].Cas, results[4].Cas)
+	}
+	if val, _, err := c.Get("a"); err != nil || string(val) != "4" {
+		t.Errorf("Expected the later set of a to win, got %q (err=%v)", val, err)
+	}
+	if val, _, _ := c.Get("existing"); string(val) != "old" {
+		t.Errorf("Expected existing to be unchanged, got %q", val)
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	for key, want := range map[string]error{
+		"key":                             nil,
+		"":                                ErrInvalidKey,
+		"with space":                      ErrInvalidKey,
+		"tab\t":                           ErrInvalidKey,
+		"nul\x00":                         ErrInvalidKey,
+		"del\x7f":                         ErrInvalidKey,
+		"utf8-ключ":                       nil,
+		strings.Repeat("k", 250):          nil,
+		strings.Repeat("k", 251):          ErrKeyTooLarge,
+		strings.Repeat("k", MaxKeySize+1): ErrKeyTooLarge,
+	} {
+		if err := ValidateKey(key, 250); err != want {
+			t.Errorf("ValidateKey(%q): expected %v, got %v", key, want, err)
+		}
+	}
+	if err := ValidateKey(strings.Repeat("k", MaxKeySize+1), 0); err != ErrKeyTooLarge {
+		t.Errorf("Expected MaxKeySize as the default limit, got %v", err)
+	}
+
+	// Stored keys are limited by Config.MaxKeySize
+	tmpDir := t.TempDir()
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+	config.MaxKeySize = 10
+	c, err := NewSharded(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Set("0123456789", []byte("v"), 0); err != nil {
+		t.Errorf("Expected a 10 byte key to be stored, got %v", err)
+	}
+	if _, err := c.Set("0123456789x", []byte("v"), 0); err != ErrKeyTooLarge {
+		t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+	}
+}
+
+func TestGOMAXPROCSUnchanged(t *testing.T) {
+	const sentinel = 3
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(sentinel))
+
+	config := DefaultConfig()
+	config.DataDir = t.TempDir()
+	config.SyncStrategy = SyncNone
+	c, err := NewSharded(config, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if n := runtime.GOMAXPROCS(0); n != sentinel {
+		t.Errorf("Expected GOMAXPROCS to stay %d, got %d", sentinel, n)
+	}
+
+	config.SetGOMAXPROCS = true
+	c, err = NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if n := runtime.GOMAXPROCS(0); n != 1 {
+		t.Errorf("Expected GOMAXPROCS 1 for 4 shards, got %d", n)
+	}
+}
+
+func TestGetDelete(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	setCas, _ := c.Set("job", []byte("payload"), 0)
+	c.Set("other", []byte("kept"), 0)
+
+	value, cas, err := c.GetDelete("job")
+	if err != nil || string(value) != "payload" || cas != setCas {
+		t.Fatalf("Expected payload with cas %d, got %q, %d, %v", setCas, value, cas, err)
+	}
+	if _, _, err := c.Get("job"); err != ErrKeyNotFound {
+		t.Errorf("Expected the key to be deleted, got %v", err)
+	}
+	if _, _, err := c.GetDelete("job"); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound on the second GetDelete, got %v", err)
+	}
+	if value, _, err := c.Get("other"); err != nil || string(value) != "kept" {
+		t.Errorf("Expected other keys to be kept, got %q, %v", value, err)
+	}
+
+	// Concurrent GetDeletes hand every value to exactly one caller
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprintf("item%d", i), []byte("v"), 0)
+	}
+	var taken atomic.Int64
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if _, _, err := c.GetDelete(fmt.Sprintf("item%d", i)); err == nil {
+					taken.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := taken.Load(); n != 100 {
+		t.Errorf("Expected 100 values taken, got %d", n)
+	}
+}
+
+func TestAppendCas(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	readCas, _ := c.Set("key", []byte("b"), 0)
+
+	// A matching CAS appends and returns a new CAS
+	cas, err := c.AppendCas("key", []byte("c"), readCas)
+	if err != nil || cas == readCas {
+		t.Fatalf("Expected append with the current CAS to succeed, got %d, %v", cas, err)
+	}
+
+	// The old CAS no longer matches
+	if _, err := c.AppendCas("key", []byte("x"), readCas); err != ErrCasMismatch {
+		t.Errorf("Expected ErrCasMismatch for append, got %v", err)
+	}
+	if _, err := c.PrependCas("key", []byte("x"), readCas); err != ErrCasMismatch {
+		t.Errorf("Expected ErrCasMismatch for prepend, got %v", err)
+	}
+	if _, err := c.PrependCas("key", []byte("a"), cas); err != nil {
+		t.Errorf("Expected prepend with the current CAS to succeed, got %v", err)
+	}
+	if value, _, _ := c.Get("key"); string(value) != "abc" {
+		t.Errorf("Expected abc, got %q", value)
+	}
+
+	// Zero appends unconditionally
+	if _, err := c.AppendCas("key", []byte("d"), 0); err != nil {
+		t.Errorf("Expected append without CAS to succeed, got %v", err)
+	}
+	if _, err := c.AppendCas("missing", []byte("d"), 1); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	c, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	if err := c.Ping(); err != nil {
+		t.Fatalf("Expected a healthy cache to answer, got %v", err)
+	}
+
+	c.recovering.Add(1)
+	if err := c.Ping(); err != ErrNotReady {
+		t.Errorf("Expected ErrNotReady while recovering, got %v", err)
+	}
+	c.recovering.Add(-1)
+
+	// A shard whose worker does not run does not answer in time
+	worker := c.workers[1]
+	worker.Stop()
+	start := time.Now()
+	if err := c.Ping(); !errors.Is(err, ErrBusy) || !strings.Contains(err.Error(), "shard 1") {
+		t.Errorf("Expected ErrBusy for shard 1, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*PingTimeout {
+		t.Errorf("Expected Ping to give up after %v, took %v", PingTimeout, elapsed)
+	}
+	worker.stopChan = make(chan struct{})
+	worker.Start()
+	if err := c.Ping(); err != nil {
+		t.Errorf("Expected the restarted worker to answer, got %v", err)
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncNone
+
+	c, err := NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bands by upper bound: 1 (0 and 1 bytes), 64 (33..64), 128 (65..128), 4096
+	for i, size := range []int{0, 1, 33, 64, 64, 65, 4000} {
+		if _, err := c.Set(fmt.Sprintf("key_%d", i), make([]byte, size), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Set("expired", make([]byte, 64), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	want := map[int]int64{0: 2, 6: 3, 7: 1, 12: 1}
+	check := func(c *ShardedCache) {
+		t.Helper()
+		counts, err := c.SizeHistogram()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(counts) != 13 {
+			t.Errorf("Expected 13 bands, got %v", counts)
+		}
+		for band, n := range counts {
+			if n != want[band] {
+				t.Errorf("Band %d (up to %d bytes): expected %d values, got %d", band, 1<<band, want[band], n)
+			}
+		}
+	}
+	check(c)
+	c.Close()
+
+	// Lengths are read from disk after recovery
+	c, err = NewSharded(config, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	check(c)
+
+	for length, band := range map[int]int{0: 0, 1: 0, 2: 1, 3: 2, 1024: 10, 1025: 11} {
+		if got := SizeBand(length); got != band {
+			t.Errorf("SizeBand(%d): expected %d, got %d", length, band, got)
+		}
+	}
+}
+
+func TestSyncAlwaysDurability(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncAlways
+
+	c, err := NewSharded(config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Sets, moves to other buckets and deletes, which compact the files
+	want := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		value := strings.Repeat(string(rune('a'+i%26)), 100+i*50)
+		if _, err := c.Set(key, []byte(value), 0); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = value
+	}
+	for i := 0; i < 50; i += 3 {
+		key := fmt.Sprintf("key_%d", i)
+		c.Delete(key)
+		delete(want, key)
+	}
+	for i := 1; i < 50; i += 5 {
+		key := fmt.Sprintf("key_%d", i)
+		if _, err := c.Append(key, []byte(strings.Repeat("z", 1000))); err == nil {
+			want[key] += strings.Repeat("z", 1000)
+		}
+	}
+	c.Set("counter", []byte("41"), 0)
+	c.Increment("counter", 1)
+	want["counter"] = "42"
+
+	// Recover from the files as a killed process leaves them, without Close
+	c2, err := NewSharded(config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	for key, value := range want {
+		got, _, err := c2.Get(key)
+		if err != nil || string(got) != value {
+			t.Errorf("%s: expected %d bytes, got %d bytes, %v", key, len(value), len(got), err)
+		}
+	}
+	if items := c2.Stats()["curr_items"]; items != strconv.Itoa(len(want)) {
+		t.Errorf("Expected %d items after recovery, got %s", len(want), items)
+	}
+}
+
+func TestSetSyncStrategy(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tqcache-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := DefaultConfig()
+	config.DataDir = tmpDir
+	config.SyncStrategy = SyncPeriodic
+
+	c, err := NewSharded(config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	check := func(strategy SyncStrategy) {
+		t.Helper()
+		if got := c.SyncStrategy(); got != strategy {
+			t.Errorf("Expected strategy %d, got %d", strategy, got)
+		}
+		if running := c.stopSync != nil; running != (strategy == SyncPeriodic) {
+			t.Errorf("Expected the sync goroutine running to be %v", !running)
+		}
+		for i, w := range c.workers {
+			if w.storage.syncAlways != (strategy == SyncAlways) || w.syncPaused != (strategy != SyncPeriodic) {
+				t.Errorf("Shard %d: unexpected syncAlways=%v syncPaused=%v for strategy %d", i, w.storage.syncAlways, w.syncPaused, strategy)
+			}
+		}
+	}
+	check(SyncPeriodic)
+
+	// A bulk import without fsync, then back to always
+	want := make(map[string]string)
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			key := fmt.Sprintf("key_%d", i)
+			value := strings.Repeat("v", 100+i)
+			if _, err := c.Set(key, []byte(value), 0); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = value
+		}
+	}
+	write(0, 50)
+	if err := c.SetSyncStrategy(SyncNone); err != nil {
+		t.Fatal(err)
+	}
+	check(SyncNone)
+	write(50, 150)
+	if err := c.SetSyncStrategy(SyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	check(SyncAlways)
+	write(150, 200)
+
+	// Recover from the files as a killed process leaves them, without Close
+	c2, err := NewSharded(config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	for key, value := range want {
+		if got, _, err := c2.Get(key); err != nil || string(got) != value {
+			t.Errorf("%s: expected %d bytes, got %d bytes, %v", key, len(value), len(got), err)
+		}
+	}
+
+	if err := c.SetSyncStrategy(SyncPeriodic); err != nil {
+		t.Fatal(err)
+	}
+	check(SyncPeriodic)
+	if err := c.SetSyncStrategy(SyncStrategy(42)); err == nil {
+		t.Error("Expected an error for an invalid strategy")
+	}
+	check(SyncPeriodic)
+}
+
+func TestDumpRestore(t *testing.T) {
+	src, cleanup := setupTestCache(t)
+	defer cleanup()
+
+	for i := 0; i < 500; i++ {
+		src.Store(Op{
+			Op:       OpSet,
+			Key:      fmt.Sprintf("key_%d", i),
+			Value:    bytes.Repeat([]byte{byte(i)}, i*10),
+			Flags:    uint32(i),
+			DataType: byte(i % 3),
+		})
+	}
+	src.Set("ttl", []byte("expires"), time.Hour)
+	src.Set("expired", []byte("gone"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	var dump bytes.Buffer
+	if err := src.Dump(&dump); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, cleanup2 := setupTestCache(t)
+	defer cleanup2()
+	if err := dst.Restore(bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		want, _ := src.GetItem(key)
+		got, err := dst.GetItem(key)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if !bytes.Equal(got.Value, want.Value) || got.Flags != want.Flags || got.DataType != want.DataType || got.TTL != NoExpiry {
+			t.Errorf("%s: expected %d bytes, flags %d, type %d without expiry, got %d bytes, flags %d, type %d, ttl %v",
+				key, len(want.Value), want.Flags, want.DataType, len(got.Value), got.Flags, got.DataType, got.TTL)
+		}
+	}
+	if _, _, ttl, err := dst.GetWithTTL("ttl"); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("Expected the TTL to be kept, got %v, %v", ttl, err)
+	}
+	if _, _, err := dst.Get("expired"); err != ErrKeyNotFound {
+		t.Errorf("Expected the expired item to be skipped, got %v", err)
+	}
+
+	// Only an empty cache accepts a dump, and only a complete dump
+	if err := dst.Restore(bytes.NewReader(dump.Bytes())); err != ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty, got %v", err)
+	}
+	empty, cleanup3 := setupTestCache(t)
+	defer cleanup3()
+	if err := empty.Restore(strings.NewReader("not a dump at all")); err != ErrDumpFormat {
+		t.Errorf("Expected ErrDumpFormat, got %v", err)
+	}
+	if err := empty.Restore(bytes.NewReader(dump.Bytes()[:dump.Len()-100])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected a truncated dump to fail, got %v", err)
+	}
+}
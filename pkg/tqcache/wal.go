@@ -0,0 +1,327 @@
+package tqcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// WALFileName is the name of the write-ahead log in a shard dir
+const WALFileName = "wal"
+
+// walHeaderSize is the length and CRC prefix of a WAL record
+const walHeaderSize = 8
+
+// ErrWALCorrupt is returned for a WAL record that does not match its CRC or
+// cannot be applied
+var ErrWALCorrupt = errors.New("corrupt wal record")
+
+// WALRecord is a mutation in the write-ahead log. A record holds the state a
+// key ended up in rather than the command that led to it (an incr is logged
+// as the resulting value), so applying a record twice has no further effect.
+//
+// On disk a record is (little-endian):
+//
+//	length   4  bytes following the CRC
+//	crc      4  CRC-32 (IEEE) of the bytes following it
+//	op       1  OpSet, OpDelete, OpTouch or OpFlushAll
+//	keyLen   2
+//	key      keyLen
+//	expiry   8  Unix milliseconds (0 = none)
+//	flags    4
+//	dataType 1
+//	value    rest of the record
+type WALRecord struct {
+	Op       OpType
+	Key      string
+	Value    []byte
+	Expiry   int64
+	Flags    uint32
+	DataType byte
+}
+
+// Encode returns the record in its on-disk form
+func (r *WALRecord) Encode() []byte {
+	bodyLen := 1 + 2 + len(r.Key) + 8 + 4 + 1 + len(r.Value)
+	buf := make([]byte, walHeaderSize+bodyLen)
+	body := buf[walHeaderSize:]
+	body[0] = byte(r.Op)
+	binary.LittleEndian.PutUint16(body[1:3], uint16(len(r.Key)))
+	off := 3 + copy(body[3:], r.Key)
+	binary.LittleEndian.PutUint64(body[off:off+8], uint64(r.Expiry))
+	binary.LittleEndian.PutUint32(body[off+8:off+12], r.Flags)
+	body[off+12] = r.DataType
+	copy(body[off+13:], r.Value)
+
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(bodyLen))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(body))
+	return buf
+}
+
+// ReadWALRecord reads the next record and returns it with its on-disk size.
+// A record cut off by the end of the log returns io.ErrUnexpectedEOF, the end
+// of the log itself io.EOF.
+func ReadWALRecord(r io.Reader) (*WALRecord, int64, error) {
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, err
+	}
+	bodyLen := binary.LittleEndian.Uint32(header[0:4])
+	if bodyLen < 1+2+8+4+1 {
+		return nil, 0, ErrWALCorrupt
+	}
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, 0, ErrWALCorrupt
+	}
+
+	keyLen := int(binary.LittleEndian.Uint16(body[1:3]))
+	if 3+keyLen+13 > len(body) {
+		return nil, 0, ErrWALCorrupt
+	}
+	off := 3 + keyLen
+	rec := &WALRecord{
+		Op:       OpType(body[0]),
+		Key:      string(body[3:off]),
+		Expiry:   int64(binary.LittleEndian.Uint64(body[off : off+8])),
+		Flags:    binary.LittleEndian.Uint32(body[off+8 : off+12]),
+		DataType: body[off+12],
+		Value:    body[off+13:],
+	}
+	return rec, int64(walHeaderSize + bodyLen), nil
+}
+
+// openWAL opens the write-ahead log for appending, a record torn by a crash
+// at the end of the log is cut off first
+func (w *Worker) openWAL(path string) error {
+	f, err := w.storage.openFile(path, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	var valid int64
+	reader := bufio.NewReader(f)
+	for {
+		_, n, err := ReadWALRecord(reader)
+		if err != nil {
+			break
+		}
+		valid += n
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	w.wal = f
+	w.walPath = path
+	w.walSize = valid
+	return nil
+}
+
+// appendWAL writes a record to the write-ahead log, if there is one, and
+// fsyncs it so a follower never misses an acknowledged mutation
+func (w *Worker) appendWAL(rec *WALRecord) error {
+	if w.wal == nil {
+		return nil
+	}
+	buf := rec.Encode()
+	if _, err := w.wal.Write(buf); err != nil {
+		return err
+	}
+	if err := w.wal.Sync(); err != nil {
+		return err
+	}
+	w.walSize += int64(len(buf))
+
+	limit := w.WALCheckpointSize
+	if limit <= 0 {
+		limit = DefaultWALCheckpointSize
+	}
+	if w.walSize >= limit && w.walSize >= 2*w.walCheckpointed {
+		if err := w.checkpointWAL(); err != nil {
+			// The record is logged, the log is checkpointed on a later append
+			slog.Warn("WAL checkpoint failed", "file", w.walPath, "error", err)
+		}
+	}
+	return nil
+}
+
+// checkpointWAL replaces the write-ahead log by a log that flushes and then
+// sets the live keys, which brings a follower in the same state as the full
+// log did. The flush carries the time of the checkpoint as its key, so each
+// checkpoint starts with another record and a ReplicaClient can tell that it
+// must apply the new log from its start.
+func (w *Worker) checkpointWAL() error {
+	tmpPath := w.walPath + ".tmp"
+	f, err := w.storage.openFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	buf := bufio.NewWriter(f)
+	generation := strconv.FormatInt(time.Now().UnixNano(), 10)
+	size, _ := buf.Write((&WALRecord{Op: OpFlushAll, Key: generation}).Encode())
+	written := int64(size)
+	now := time.Now().UnixMilli()
+	for _, entry := range w.index.Entries() {
+		if entry.Expiry > 0 && entry.Expiry <= now {
+			continue
+		}
+		value, err := w.storage.ReadDataSlot(entry.Bucket, entry.SlotIdx)
+		if err != nil {
+			return fail(err)
+		}
+		n, err := buf.Write((&WALRecord{
+			Op:       OpSet,
+			Key:      entry.Key,
+			Value:    value,
+			Expiry:   entry.Expiry,
+			Flags:    entry.Flags,
+			DataType: entry.DataType,
+		}).Encode())
+		if err != nil {
+			return fail(err)
+		}
+		written += int64(n)
+	}
+	if err := buf.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmpPath, w.walPath); err != nil {
+		return fail(err)
+	}
+
+	w.wal.Close()
+	w.wal = f
+	w.walSize = written
+	w.walCheckpointed = written
+	return nil
+}
+
+// logMutation writes the outcome of a successful request to the write-ahead
+// log. Keys removed by expiry or eviction are not logged, a follower expires
+// and evicts on its own.
+func (w *Worker) logMutation(req *Request, resp *Response) error {
+	switch req.Op {
+	case OpSet, OpAdd, OpReplace, OpCas:
+		return w.logKey(req.Key, req.Value)
+	case OpIncr, OpDecr:
+		return w.logKey(req.Key, resp.Value)
+	case OpAppend, OpPrepend:
+		return w.logKey(req.Key, nil)
+	case OpDelete, OpGetDelete:
+		return w.appendWAL(&WALRecord{Op: OpDelete, Key: req.Key})
+	case OpTouch, OpGat:
+		if entry, ok := w.index.Get(req.Key); ok {
+			return w.appendWAL(&WALRecord{Op: OpTouch, Key: req.Key, Expiry: entry.Expiry})
+		}
+	case OpFlushAll:
+		if w.flushAt == 0 { // Scheduled flushes are logged when they run
+			return w.appendWAL(&WALRecord{Op: OpFlushAll})
+		}
+	case OpBatch:
+		logged := make(map[string]bool)
+		for _, op := range req.Batch {
+			if op.Op == OpGet || logged[op.Key] {
+				continue
+			}
+			logged[op.Key] = true
+			if err := w.logKey(op.Key, nil); err != nil {
+				return err
+			}
+		}
+	case OpApplyWAL:
+		return w.appendWAL(req.WAL) // Chained followers
+	}
+	return nil
+}
+
+// logKey logs the current state of a key, reading its value from the data
+// file when it is not given
+func (w *Worker) logKey(key string, value []byte) error {
+	entry, ok := w.index.Get(key)
+	if !ok {
+		return w.appendWAL(&WALRecord{Op: OpDelete, Key: key})
+	}
+	if value == nil {
+		data, err := w.storage.ReadDataSlot(entry.Bucket, entry.SlotIdx)
+		if err != nil {
+			return err
+		}
+		value = data
+	}
+	return w.appendWAL(&WALRecord{
+		Op:       OpSet,
+		Key:      key,
+		Value:    value,
+		Expiry:   entry.Expiry,
+		Flags:    entry.Flags,
+		DataType: entry.DataType,
+	})
+}
+
+// handleApplyWAL applies a record of a primary's write-ahead log
+func (w *Worker) handleApplyWAL(req *Request) *Response {
+	if err := w.applyWAL(req.WAL); err != nil {
+		return &Response{Err: err}
+	}
+	w.checkSync()
+	return &Response{}
+}
+
+// applyWAL brings this shard in the state a WAL record describes
+func (w *Worker) applyWAL(rec *WALRecord) error {
+	entry, exists := w.index.Get(rec.Key)
+	switch rec.Op {
+	case OpSet:
+		if rec.Expiry > 0 && rec.Expiry <= time.Now().UnixMilli() {
+			if exists {
+				w.deleteEntry(entry)
+			}
+			return nil
+		}
+		if resp := w.doSet(rec.Key, rec.Value, 0, nil, rec.Flags, rec.DataType, 0, false); resp.Err != nil {
+			return resp.Err
+		}
+		entry, _ = w.index.Get(rec.Key)
+		if entry.Expiry != rec.Expiry {
+			return w.setExpiry(entry, rec.Expiry)
+		}
+	case OpDelete:
+		if exists {
+			w.deleteEntry(entry)
+		}
+	case OpTouch:
+		if exists {
+			return w.setExpiry(entry, rec.Expiry)
+		}
+	case OpFlushAll:
+		w.flush()
+	default:
+		return ErrWALCorrupt
+	}
+	return nil
+}
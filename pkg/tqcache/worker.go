@@ -1,8 +1,16 @@
 package tqcache
 
 import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/bits"
+	"math/rand"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,6 +31,26 @@ const (
 	OpPrepend
 	OpFlushAll
 	OpStats
+	OpMeta
+	OpKeysByTag
+	OpGetMulti
+	OpSnapshot
+	OpSnapshotRead
+	OpSnapshotEnd
+	OpExportRange
+	OpBatch
+	OpScan
+	OpExists
+	OpApplyWAL
+	OpBucketStats
+	OpSetMulti
+	OpSync
+	OpGetDelete
+	OpNoop
+	OpSizeHistogram
+	OpCompact
+	OpSetSyncStrategy
+	OpGat
 )
 
 // Request represents a cache operation request
@@ -33,7 +61,41 @@ type Request struct {
 	TTL      time.Duration
 	Cas      uint64
 	Delta    uint64
+	Tags     []string // Tags for storage ops, or the tag to query for OpKeysByTag
+	DataType byte     // Client data type hint stored with the value by storage ops
+	Flags    uint32   // Opaque client flags stored with the value by storage ops
+	Keys     []string // Keys for OpGetMulti and OpSnapshotRead
 	RespChan chan *Response
+
+	Snapshot *indexSnapshot // Snapshot for OpSnapshotRead and OpSnapshotEnd
+	EndKey   string         // Exclusive end of the key range for OpExportRange
+	Batch    []Op           // Operations applied atomically by OpBatch, or one by one by OpSetMulti
+	Prefix   string         // Key prefix for OpScan (Key is the exclusive cursor)
+	Limit    int            // Maximum number of keys for OpScan
+
+	ReturnPrevious bool // OpSet returns the value it overwrote in Response.Value
+	Stale          bool // OpGet also returns a value within ServeStale past its expiry
+
+	// OpIncr and OpDecr create a missing key with Initial (and TTL) if HasInitial
+	Initial    uint64
+	HasInitial bool
+
+	WAL *WALRecord // Record of a primary's write-ahead log for OpApplyWAL
+
+	FlushAt int64 // Unix nanoseconds OpFlushAll takes effect (0 = now)
+
+	SyncStrategy SyncStrategy // New strategy for OpSetSyncStrategy
+
+	release func() // Returns the buffer budget of the request (nil = none)
+}
+
+// taken returns the buffer budget of a request that left the request
+// channel, or that never entered it
+func (r *Request) taken() {
+	if r.release != nil {
+		r.release()
+		r.release = nil
+	}
 }
 
 // Response represents a cache operation response
@@ -42,6 +104,53 @@ type Response struct {
 	Cas   uint64
 	Err   error
 	Stats map[string]string
+	Meta  *KeyMeta
+	Keys  []string
+	Items map[string]*Item // Found keys for OpGetMulti and OpSnapshotRead
+
+	DataType     byte           // Data type hint of the value returned by OpGet
+	Flags        uint32         // Client flags of the value returned by OpGet
+	TTLRemaining time.Duration  // Remaining TTL of the value returned by OpGet (NoExpiry = none)
+	Expired      bool           // The value returned by OpGet with Stale is past its expiry
+	Snapshot     *indexSnapshot // Snapshot taken by OpSnapshot
+	Entries      []IndexEntry   // Index entries for OpExportRange
+	Results      []Result       // Results of the operations of OpBatch and OpSetMulti
+	Buckets      []BucketStat   // Disk usage per bucket for OpBucketStats
+	Sizes        []int64        // Value counts per size band for OpSizeHistogram
+}
+
+// NoExpiry is the remaining TTL reported for a value that does not expire
+const NoExpiry time.Duration = -1
+
+// Item is a value with its CAS token, data type hint, client flags and
+// remaining TTL
+type Item struct {
+	Value    []byte
+	Cas      uint64
+	DataType byte
+	Flags    uint32
+	TTL      time.Duration // Remaining TTL (NoExpiry = none)
+}
+
+// BucketStat reports the disk usage of a data bucket
+type BucketStat struct {
+	Bucket         int
+	SlotSize       int   // Slot size excluding the header
+	TotalSlots     int64 // Slots in the data file
+	UsedSlots      int64 // Slots holding a live entry
+	BytesUsed      int64 // Bytes of the used slots
+	BytesAllocated int64 // Bytes of the data file
+}
+
+// KeyMeta holds debug metadata for a single key
+type KeyMeta struct {
+	TTL        time.Duration // Remaining TTL (0 = no expiry)
+	LastAccess time.Time
+	Fetched    bool   // Whether the item was read since it was stored
+	Hits       uint64 // Number of reads since the item was stored
+	Cas        uint64
+	Bucket     int
+	Size       int
 }
 
 // Worker is the single-threaded storage worker
@@ -53,16 +162,74 @@ type Worker struct {
 	wg       sync.WaitGroup
 
 	nextKeyId  int64
-	nextSlotId [NumBuckets]int64
+	nextSlotId []int64 // Per bucket
+	keyGarbage int64   // Bytes of tombstoned records in a packed keys file
+	lastCas    uint64
 	startTime  time.Time
 
-	DefaultTTL time.Duration
-	MaxTTL     time.Duration // Maximum TTL cap (0 = no cap)
+	DefaultTTL      time.Duration
+	MaxTTL          time.Duration // Maximum TTL cap (0 = no cap)
+	MaxResponseSize int           // Largest value returned by get (0 = unlimited)
+	MaxValueSize    int           // Largest value stored (0 = up to the largest bucket)
+	MaxKeySize      int           // Longest key stored (0 = MaxKeySize)
+
+	// Eviction settings for this shard
+	MaxDataSize     int64 // Data file bytes before evicting (0 = unlimited)
+	EvictionPolicy  EvictionPolicy
+	EvictionSamples int
+	EvictionGrace   time.Duration // No eviction this long after start
+
+	CompactionRatio float64 // Free slot fraction that triggers Compact (0 = off)
+
+	ExpirySweepInterval time.Duration // Interval of the expiry sweep (0 = lazy expiry only)
+	ServeStale          time.Duration // Expired items are kept this long for stale gets
+	IdleTimeout         time.Duration // Items not accessed this long are swept (0 = off)
+
+	// Gets of values in buckets of at least LargeReadThreshold bytes are read
+	// by LargeReaders goroutines (0 = off), see largeread.go
+	LargeReadThreshold int
+	LargeReaders       int
+	largeReads         chan *largeRead // Gets waiting for a reader
+	readsDone          chan *largeRead // Gets read by a reader
+
+	PersistState bool // Save derived state to the sidecar file on close
+
+	// Background work counters (read concurrently by stats)
+	compactions atomic.Uint64 // Tail slots/records moved into freed slots
+	bytesMoved  atomic.Uint64 // Bytes copied while compacting
+	evictions   atomic.Uint64 // Items evicted to free space
+	freeSlots   atomic.Int64  // Data slots below the tails not used by an entry
+	totalSlots  atomic.Int64  // Data slots below the tails
+
+	// Command counters (read concurrently by stats)
+	cmdGet       atomic.Uint64 // Keys requested by get and multi-get
+	cmdSet       atomic.Uint64 // Storage commands (set, add, replace, cas, append, prepend)
+	getHits      atomic.Uint64
+	getMisses    atomic.Uint64
+	deleteHits   atomic.Uint64
+	deleteMisses atomic.Uint64
+	incrHits     atomic.Uint64 // Incr and decr of an existing key
+	incrMisses   atomic.Uint64 // Incr and decr of a missing key
+
+	snapshots []*indexSnapshot // Active snapshots needing copy-on-write
+
+	flushAt int64 // Unix nanoseconds of a scheduled flush (0 = none)
+
+	// Write-ahead log of mutations for a follower (nil = replication off)
+	wal               *os.File
+	walPath           string
+	walSize           int64 // Bytes in the log
+	walCheckpointed   int64 // Bytes in the log after the last checkpoint
+	WALCheckpointSize int64 // Log size that triggers a checkpoint (0 = default)
+	inBatch           bool  // Batch operations are logged when the batch commits
 
 	// Sync tracking for periodic mode
-	lastSync     time.Time
+	lastSync     atomic.Int64 // Unix nanoseconds, set by the sync goroutine
 	syncInterval time.Duration
 	syncNotify   func() // Called when sync is needed
+	syncPaused   bool   // No periodic syncs, the strategy is not SyncPeriodic
+
+	evictNotify func(key string, reason EvictReason) // Called for expired and evicted keys (may be nil)
 }
 
 func NewWorker(storage *Storage, DefaultTTL, MaxTTL time.Duration, channelCapacity int) (*Worker, error) {
@@ -72,14 +239,17 @@ func NewWorker(storage *Storage, DefaultTTL, MaxTTL time.Duration, channelCapaci
 	w := &Worker{
 		storage:      storage,
 		index:        NewIndex(),
+		nextSlotId:   make([]int64, storage.NumBuckets()),
 		reqChan:      make(chan *Request, channelCapacity),
 		stopChan:     make(chan struct{}),
 		startTime:    time.Now(),
 		DefaultTTL:   DefaultTTL,
 		MaxTTL:       MaxTTL,
-		lastSync:     time.Now(),
 		syncInterval: DefaultSyncInterval,
+
+		ExpirySweepInterval: DefaultExpirySweepInterval,
 	}
+	w.lastSync.Store(w.startTime.UnixNano())
 
 	// Recover state from disk
 	if err := w.recover(); err != nil {
@@ -91,20 +261,23 @@ func NewWorker(storage *Storage, DefaultTTL, MaxTTL time.Duration, channelCapaci
 
 // recover rebuilds in-memory structures from disk
 func (w *Worker) recover() error {
-	keyCount, err := w.storage.KeyCount()
-	if err != nil {
-		return err
-	}
-
 	now := time.Now().UnixMilli()
 
-	for keyId := int64(0); keyId < keyCount; keyId++ {
-		rec, err := w.storage.ReadKeyRecord(keyId)
-		if err != nil {
-			continue // Skip unreadable records
+	// Data slots in use, slots past the last referenced one are free (or preallocated)
+	usedSlots := make([]int64, w.storage.NumBuckets())
+
+	keyCount, err := w.storage.ScanKeyRecords(func(keyId int64, rec *KeyRecord) {
+		// New CAS values must stay above all persisted ones, also expired
+		// ones, even if the clock went backwards across the restart
+		if rec.Cas > w.lastCas {
+			w.lastCas = rec.Cas
+		}
+		if rec.Expiry != tombstoneExpiry && int(rec.Bucket) < len(usedSlots) && rec.SlotIdx >= usedSlots[rec.Bucket] {
+			usedSlots[rec.Bucket] = rec.SlotIdx + 1
 		}
 
 		// With continuous compaction, all records in file are valid
+		// (packed key files may also hold tombstones until they are rewritten)
 
 		// Extract key (null-terminated)
 		keyBytes := rec.Key[:]
@@ -122,7 +295,10 @@ func (w *Worker) recover() error {
 
 		// Skip expired entries (they will be compacted on first access/write)
 		if rec.Expiry > 0 && rec.Expiry <= now {
-			continue
+			if w.storage.KeyFormat() == KeyFormatPacked {
+				w.keyGarbage += PackedKeyRecordSize(int(rec.KeyLen))
+			}
+			return
 		}
 
 		entry := &IndexEntry{
@@ -132,19 +308,27 @@ func (w *Worker) recover() error {
 			SlotIdx: rec.SlotIdx,
 			Expiry:  rec.Expiry,
 			Cas:     rec.Cas,
+
+			DataType: rec.DataType,
+			Flags:    rec.Flags,
+
+			LastAccess: now,
 		}
 		w.index.Set(entry)
+	})
+	if err != nil {
+		return err
 	}
 
 	w.nextKeyId = keyCount
 
 	// Also scan data files for slot tracking
-	for bucket := 0; bucket < NumBuckets; bucket++ {
+	for bucket := range w.nextSlotId {
 		count, err := w.storage.SlotCount(bucket)
 		if err != nil {
 			return err
 		}
-		w.nextSlotId[bucket] = count
+		w.nextSlotId[bucket] = min(count, usedSlots[bucket])
 	}
 
 	return nil
@@ -152,6 +336,7 @@ func (w *Worker) recover() error {
 
 // Start starts the worker goroutine
 func (w *Worker) Start() {
+	w.startReaders()
 	w.wg.Add(1)
 	go w.run()
 }
@@ -160,6 +345,16 @@ func (w *Worker) Start() {
 func (w *Worker) Stop() {
 	close(w.stopChan)
 	w.wg.Wait()
+
+	// Requests still queued timed out, their callers are gone
+	for {
+		select {
+		case req := <-w.reqChan:
+			req.taken()
+		default:
+			return
+		}
+	}
 }
 
 // RequestChan returns the request channel
@@ -177,34 +372,52 @@ func (w *Worker) SetSyncInterval(interval time.Duration) {
 	w.syncInterval = interval
 }
 
+// SetEvictNotify sets the callback for keys dropped by expiry or eviction,
+// it runs in the worker goroutine and must not block
+func (w *Worker) SetEvictNotify(notify func(key string, reason EvictReason)) {
+	w.evictNotify = notify
+}
+
 // checkSync checks if sync is needed and triggers it if so
 func (w *Worker) checkSync() {
-	if w.syncNotify == nil {
+	if w.syncNotify == nil || w.syncPaused {
 		return
 	}
-	if time.Since(w.lastSync) >= w.syncInterval {
+	if time.Since(time.Unix(0, w.lastSync.Load())) >= w.syncInterval {
 		w.syncNotify()
 	}
 }
 
 // MarkSynced updates the last sync time
 func (w *Worker) MarkSynced() {
-	w.lastSync = time.Now()
+	w.lastSync.Store(time.Now().UnixNano())
 }
 
 func (w *Worker) run() {
 	defer w.wg.Done()
 
-	// Ticker for expiry cleanup
-	expiryTicker := time.NewTicker(100 * time.Millisecond)
+	// Ticker for expiry cleanup, without a sweep scheduled flushes and
+	// compaction still run at the default interval
+	interval := w.ExpirySweepInterval
+	if interval <= 0 {
+		interval = DefaultExpirySweepInterval
+	}
+	expiryTicker := time.NewTicker(interval)
 	defer expiryTicker.Stop()
 
 	for {
 		select {
 		case req := <-w.reqChan:
+			req.taken()
 			w.handleRequest(req)
+		case read := <-w.readsDone:
+			w.finishRead(read)
 		case <-expiryTicker.C:
-			w.cleanupExpired()
+			w.runScheduledFlush()
+			if w.ExpirySweepInterval > 0 {
+				w.cleanupExpired()
+			}
+			w.compactIfNeeded()
 		case <-w.stopChan:
 			return
 		}
@@ -212,8 +425,20 @@ func (w *Worker) run() {
 }
 
 func (w *Worker) handleRequest(req *Request) {
+	resp := w.process(req)
+
+	if resp != nil && req.RespChan != nil {
+		req.RespChan <- resp
+	}
+}
+
+// process executes a request and returns its response, or nil for a get
+// handed to a reader
+func (w *Worker) process(req *Request) *Response {
 	var resp *Response
 
+	w.runScheduledFlush()
+
 	switch req.Op {
 	case OpGet:
 		resp = w.handleGet(req)
@@ -227,6 +452,8 @@ func (w *Worker) handleRequest(req *Request) {
 		resp = w.handleDelete(req)
 	case OpTouch:
 		resp = w.handleTouch(req)
+	case OpGat:
+		resp = w.handleGat(req)
 	case OpCas:
 		resp = w.handleCas(req)
 	case OpIncr:
@@ -241,102 +468,387 @@ func (w *Worker) handleRequest(req *Request) {
 		resp = w.handleFlushAll(req)
 	case OpStats:
 		resp = w.handleStats(req)
+	case OpMeta:
+		resp = w.handleMeta(req)
+	case OpKeysByTag:
+		resp = w.handleKeysByTag(req)
+	case OpGetMulti:
+		resp = w.handleGetMulti(req)
+	case OpSnapshot:
+		resp = w.handleSnapshot(req)
+	case OpSnapshotRead:
+		resp = w.handleSnapshotRead(req)
+	case OpSnapshotEnd:
+		resp = w.handleSnapshotEnd(req)
+	case OpExportRange:
+		resp = w.handleExportRange(req)
+	case OpBatch:
+		resp = w.handleBatch(req)
+	case OpScan:
+		resp = w.handleScan(req)
+	case OpExists:
+		resp = w.handleExists(req)
+	case OpApplyWAL:
+		resp = w.handleApplyWAL(req)
+	case OpBucketStats:
+		resp = &Response{Buckets: w.BucketStats()}
+	case OpSetMulti:
+		resp = w.handleSetMulti(req)
+	case OpSync:
+		resp = w.handleSync(req)
+	case OpGetDelete:
+		resp = w.handleGetDelete(req)
+	case OpNoop:
+		resp = &Response{}
+	case OpSizeHistogram:
+		resp = &Response{Sizes: w.SizeHistogram()}
+	case OpCompact:
+		w.Compact()
+		resp = &Response{}
+	case OpSetSyncStrategy:
+		resp = w.handleSetSyncStrategy(req)
 	default:
 		resp = &Response{Err: ErrKeyNotFound}
 	}
+	if resp == nil {
+		return nil // Answered by finishRead
+	}
 
-	if req.RespChan != nil {
-		req.RespChan <- resp
+	if w.wal != nil && resp.Err == nil && !w.inBatch {
+		if err := w.logMutation(req, resp); err != nil {
+			resp.Err = fmt.Errorf("write-ahead log: %w", err)
+		}
+	}
+	w.countCommand(req, resp)
+	return resp
+}
+
+// countCommand updates the command counters for a processed request
+func (w *Worker) countCommand(req *Request, resp *Response) {
+	switch req.Op {
+	case OpGet, OpGat:
+		w.cmdGet.Add(1)
+		if resp.Err == nil {
+			w.getHits.Add(1)
+		} else if resp.Err == ErrKeyNotFound {
+			w.getMisses.Add(1)
+		}
+	case OpGetDelete:
+		w.cmdGet.Add(1)
+		if resp.Err == nil {
+			w.getHits.Add(1)
+			w.deleteHits.Add(1)
+		} else if resp.Err == ErrKeyNotFound {
+			w.getMisses.Add(1)
+			w.deleteMisses.Add(1)
+		}
+	case OpGetMulti:
+		if resp.Err != nil {
+			break
+		}
+		for _, key := range req.Keys {
+			w.cmdGet.Add(1)
+			if _, ok := resp.Items[key]; ok {
+				w.getHits.Add(1)
+			} else {
+				w.getMisses.Add(1)
+			}
+		}
+	case OpSet, OpAdd, OpReplace, OpCas, OpAppend, OpPrepend:
+		w.cmdSet.Add(1)
+	case OpDelete:
+		if resp.Err == nil {
+			w.deleteHits.Add(1)
+		} else if resp.Err == ErrKeyNotFound {
+			w.deleteMisses.Add(1)
+		}
+	case OpIncr, OpDecr:
+		if resp.Err == nil {
+			w.incrHits.Add(1)
+		} else if resp.Err == ErrKeyNotFound {
+			w.incrMisses.Add(1)
+		}
 	}
 }
 
 func (w *Worker) handleGet(req *Request) *Response {
+	// Only requests of a caller can be answered later
+	if w.largeReads != nil && !req.Stale && req.RespChan != nil && w.deferGet(req) {
+		return nil
+	}
+	return w.doGet(req.Key, req.Stale)
+}
+
+// handleExists reports whether a key is present from the index alone,
+// without reading its data slot or marking it as fetched
+func (w *Worker) handleExists(req *Request) *Response {
 	entry, ok := w.index.Get(req.Key)
+	if !ok || (entry.Expiry > 0 && entry.Expiry <= time.Now().UnixMilli()) {
+		return &Response{Err: ErrKeyNotFound}
+	}
+	return &Response{}
+}
+
+// handleSetMulti applies storage operations one by one, a failed operation
+// does not affect the others
+func (w *Worker) handleSetMulti(req *Request) *Response {
+	results := make([]Result, len(req.Batch))
+	for i, op := range req.Batch {
+		resp := w.process(&Request{
+			Op:       op.Op,
+			Key:      op.Key,
+			Value:    op.Value,
+			TTL:      op.TTL,
+			Cas:      op.Cas,
+			DataType: op.DataType,
+			Flags:    op.Flags,
+		})
+		results[i] = Result{Cas: resp.Cas, Err: resp.Err}
+	}
+	return &Response{Results: results}
+}
+
+// handleGetMulti reads all requested keys of this shard in one worker turn,
+// so the values and CAS tokens form a point-in-time view of the shard
+func (w *Worker) handleGetMulti(req *Request) *Response {
+	items := make(map[string]*Item, len(req.Keys))
+	for _, key := range req.Keys {
+		resp := w.doGet(key, false)
+		if resp.Err == ErrKeyNotFound {
+			continue
+		}
+		if resp.Err != nil {
+			return &Response{Err: resp.Err}
+		}
+		items[key] = &Item{Value: resp.Value, Cas: resp.Cas, DataType: resp.DataType, Flags: resp.Flags, TTL: resp.TTLRemaining}
+	}
+	return &Response{Items: items}
+}
+
+// doGet reads the value of a key, with stale also within ServeStale past
+// its expiry
+func (w *Worker) doGet(key string, stale bool) *Response {
+	entry, ok := w.index.Get(key)
 	if !ok {
 		return &Response{Err: ErrKeyNotFound}
 	}
 
 	// Check expiry
-	if entry.Expiry > 0 && entry.Expiry <= time.Now().UnixMilli() {
-		w.deleteEntry(entry)
+	now := time.Now().UnixMilli()
+	expired := entry.Expiry > 0 && entry.Expiry <= now
+	if expired && (!stale || entry.Expiry+w.ServeStale.Milliseconds() <= now) {
+		w.expireIfDue(entry, now)
 		return &Response{Err: ErrKeyNotFound}
 	}
+	ttl := NoExpiry
+	if expired {
+		ttl = 0
+	} else if entry.Expiry > 0 {
+		ttl = time.Duration(entry.Expiry-now) * time.Millisecond
+	}
+
+	data, err := w.readValue(entry)
+	if err != nil {
+		return &Response{Err: err}
+	}
 
-	// Read data
+	w.index.MarkFetched(entry, now)
+	return &Response{Value: data, Cas: entry.Cas, DataType: entry.DataType, Flags: entry.Flags, TTLRemaining: ttl, Expired: expired}
+}
+
+// readValue reads the value of an entry, values larger than MaxResponseSize
+// are refused before they are read
+func (w *Worker) readValue(entry *IndexEntry) ([]byte, error) {
+	if w.MaxResponseSize > 0 && w.storage.BucketSize(entry.Bucket) > w.MaxResponseSize {
+		length, err := w.storage.ReadDataLength(entry.Bucket, entry.SlotIdx)
+		if err != nil {
+			return nil, err
+		}
+		if length > w.MaxResponseSize {
+			return nil, ErrResponseTooLarge
+		}
+	}
+	return w.readEntry(entry)
+}
+
+// readEntry reads the value of an entry, an entry whose value fails its
+// checksum is evicted
+func (w *Worker) readEntry(entry *IndexEntry) ([]byte, error) {
 	data, err := w.storage.ReadDataSlot(entry.Bucket, entry.SlotIdx)
+	if errors.Is(err, ErrCorrupt) {
+		slog.Warn("Evicting corrupt value", "key", entry.Key, "bucket", entry.Bucket, "slot", entry.SlotIdx, "error", err)
+		w.deleteEntry(entry)
+		if w.evictNotify != nil {
+			w.evictNotify(entry.Key, ReasonCorrupt)
+		}
+	}
+	return data, err
+}
+
+// liveEntry returns the entry of key unless its expiry passed, expired
+// entries stay in the index until the sweep or the end of ServeStale
+func (w *Worker) liveEntry(key string) (*IndexEntry, bool) {
+	entry, ok := w.index.Get(key)
+	if !ok || (entry.Expiry > 0 && entry.Expiry <= time.Now().UnixMilli()) {
+		return nil, false
+	}
+	return entry, true
+}
+
+func (w *Worker) handleKeysByTag(req *Request) *Response {
+	now := time.Now().UnixMilli()
+	var keys []string
+	for _, key := range w.index.KeysByTag(req.Tags[0]) {
+		entry, ok := w.index.Get(key)
+		if !ok || (entry.Expiry > 0 && entry.Expiry <= now) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return &Response{Keys: keys}
+}
+
+// handleExportRange returns the index entries from Key up to EndKey, including
+// expired ones. Lengths are read from disk as they are not persisted in the index.
+func (w *Worker) handleExportRange(req *Request) *Response {
+	var entries []IndexEntry
+	var err error
+	w.index.Range(req.Key, req.EndKey, func(entry *IndexEntry) bool {
+		entry.Length, err = w.storage.ReadDataLength(entry.Bucket, entry.SlotIdx)
+		if err != nil {
+			return false
+		}
+		entries = append(entries, *entry)
+		return true
+	})
+	if err != nil {
+		return &Response{Err: err}
+	}
+	return &Response{Entries: entries}
+}
+
+// handleScan returns up to Limit unexpired keys with Prefix after the cursor in Key
+func (w *Worker) handleScan(req *Request) *Response {
+	now := time.Now().UnixMilli()
+	start := req.Prefix
+	if req.Key > start {
+		start = req.Key
+	}
+	var keys []string // Not sized by the limit, few keys may match
+	w.index.Range(start, "", func(entry *IndexEntry) bool {
+		if !strings.HasPrefix(entry.Key, req.Prefix) {
+			return false // Past the prefix range
+		}
+		if entry.Key == req.Key || (entry.Expiry > 0 && entry.Expiry <= now) {
+			return true
+		}
+		keys = append(keys, entry.Key)
+		return len(keys) < req.Limit
+	})
+	return &Response{Keys: keys}
+}
+
+func (w *Worker) handleMeta(req *Request) *Response {
+	entry, ok := w.index.Get(req.Key)
+	if !ok {
+		return &Response{Err: ErrKeyNotFound}
+	}
+
+	now := time.Now()
+	if entry.Expiry > 0 && entry.Expiry <= now.UnixMilli() {
+		w.expireIfDue(entry, now.UnixMilli())
+		return &Response{Err: ErrKeyNotFound}
+	}
+
+	// Only the length is needed, the value is neither read nor decompressed
+	size, err := w.storage.ReadDataLength(entry.Bucket, entry.SlotIdx)
 	if err != nil {
 		return &Response{Err: err}
 	}
 
-	return &Response{Value: data, Cas: entry.Cas}
+	meta := &KeyMeta{
+		LastAccess: time.UnixMilli(entry.LastAccess),
+		Fetched:    entry.Fetched,
+		Hits:       entry.Hits,
+		Cas:        entry.Cas,
+		Bucket:     entry.Bucket,
+		Size:       size,
+	}
+	if entry.Expiry > 0 {
+		meta.TTL = time.UnixMilli(entry.Expiry).Sub(now)
+	}
+	return &Response{Meta: meta}
 }
 
 func (w *Worker) handleSet(req *Request) *Response {
-	resp := w.doSet(req.Key, req.Value, req.TTL, 0, false)
+	var prev []byte
+	if req.ReturnPrevious {
+		if entry, ok := w.index.Get(req.Key); ok && (entry.Expiry == 0 || entry.Expiry > time.Now().UnixMilli()) {
+			data, err := w.readEntry(entry)
+			if err != nil {
+				return &Response{Err: err}
+			}
+			prev = data
+		}
+	}
+	resp := w.doSet(req.Key, req.Value, req.TTL, req.Tags, req.Flags, req.DataType, 0, false)
+	if resp.Err == nil {
+		resp.Value = prev
+	}
 	w.checkSync()
 	return resp
 }
 
 func (w *Worker) handleAdd(req *Request) *Response {
 	// Only set if key doesn't exist
-	if _, ok := w.index.Get(req.Key); ok {
+	if _, ok := w.liveEntry(req.Key); ok {
 		return &Response{Err: ErrKeyExists}
 	}
-	resp := w.doSet(req.Key, req.Value, req.TTL, 0, false)
+	resp := w.doSet(req.Key, req.Value, req.TTL, req.Tags, req.Flags, req.DataType, 0, false)
 	w.checkSync()
 	return resp
 }
 
 func (w *Worker) handleReplace(req *Request) *Response {
 	// Only set if key exists
-	if _, ok := w.index.Get(req.Key); !ok {
+	if _, ok := w.liveEntry(req.Key); !ok {
 		return &Response{Err: ErrKeyNotFound}
 	}
-	resp := w.doSet(req.Key, req.Value, req.TTL, 0, false)
+	resp := w.doSet(req.Key, req.Value, req.TTL, req.Tags, req.Flags, req.DataType, 0, false)
 	w.checkSync()
 	return resp
 }
 
 func (w *Worker) handleCas(req *Request) *Response {
-	entry, ok := w.index.Get(req.Key)
+	entry, ok := w.liveEntry(req.Key)
 	if !ok {
 		return &Response{Err: ErrKeyNotFound}
 	}
 	if entry.Cas != req.Cas {
 		return &Response{Err: ErrCasMismatch}
 	}
-	resp := w.doSet(req.Key, req.Value, req.TTL, 0, false)
+	resp := w.doSet(req.Key, req.Value, req.TTL, req.Tags, req.Flags, req.DataType, 0, false)
 	w.checkSync()
 	return resp
 }
 
-func (w *Worker) doSet(key string, value []byte, ttl time.Duration, existingCas uint64, checkCas bool) *Response {
-	if len(key) > MaxKeySize {
-		return &Response{Err: ErrKeyTooLarge}
+func (w *Worker) doSet(key string, value []byte, ttl time.Duration, tags []string, flags uint32, dataType byte, existingCas uint64, checkCas bool) *Response {
+	if err := checkKeySize(key, w.MaxKeySize); err != nil {
+		return &Response{Err: err}
+	}
+	if w.MaxValueSize > 0 && len(value) > w.MaxValueSize {
+		return &Response{Err: ErrValueTooLarge}
 	}
 
-	// Find bucket for value
-	bucket, err := w.storage.BucketForSize(len(value))
+	// Find bucket for value, as stored
+	data, flag := w.storage.EncodeValue(value)
+	bucket, err := w.storage.BucketForSize(len(data))
 	if err != nil {
 		return &Response{Err: err}
 	}
 
 	now := time.Now()
-	var expiry int64
-	if ttl > 0 {
-		// Cap TTL to MaxTTL if set
-		if w.MaxTTL > 0 && ttl > w.MaxTTL {
-			ttl = w.MaxTTL
-		}
-		expiry = now.Add(ttl).UnixMilli()
-	} else if w.DefaultTTL > 0 {
-		defaultTTL := w.DefaultTTL
-		// Cap default TTL to MaxTTL if set
-		if w.MaxTTL > 0 && defaultTTL > w.MaxTTL {
-			defaultTTL = w.MaxTTL
-		}
-		expiry = now.Add(defaultTTL).UnixMilli()
-	}
+	expiry := w.expiryAt(now, ttl)
 
 	// Check if key exists
 	existing, exists := w.index.Get(key)
@@ -346,6 +858,10 @@ func (w *Worker) doSet(key string, value []byte, ttl time.Duration, existingCas
 		}
 	}
 
+	if exists {
+		w.preserve(existing)
+	}
+
 	// Compact old data slot if bucket changed
 	if exists && existing.Bucket != bucket {
 		w.compactDataSlot(existing.Bucket, existing.SlotIdx)
@@ -357,7 +873,7 @@ func (w *Worker) doSet(key string, value []byte, ttl time.Duration, existingCas
 		keyId = existing.KeyId
 	} else {
 		keyId = w.nextKeyId
-		w.nextKeyId++
+		w.nextKeyId += w.storage.KeyIdSpan(len(key))
 	}
 
 	// Allocate data slot - always append (continuous defrag keeps files compact)
@@ -372,15 +888,17 @@ func (w *Worker) doSet(key string, value []byte, ttl time.Duration, existingCas
 	}
 
 	// Generate new CAS
-	cas := uint64(now.UnixNano())
+	cas := w.nextCas(now)
 
 	// Write key record (including bucket/slotIdx for recovery)
 	keyRec := &KeyRecord{
-		KeyLen:  uint16(len(key)),
-		Cas:     cas,
-		Expiry:  expiry,
-		Bucket:  byte(bucket),
-		SlotIdx: slotIdx,
+		KeyLen:   uint16(len(key)),
+		Cas:      cas,
+		Expiry:   expiry,
+		Bucket:   byte(bucket),
+		SlotIdx:  slotIdx,
+		DataType: dataType,
+		Flags:    flags,
 	}
 	copy(keyRec.Key[:], key)
 	if err := w.storage.WriteKeyRecord(keyId, keyRec); err != nil {
@@ -388,7 +906,7 @@ func (w *Worker) doSet(key string, value []byte, ttl time.Duration, existingCas
 	}
 
 	// Write data
-	if err := w.storage.WriteDataSlot(bucket, slotIdx, value); err != nil {
+	if err := w.storage.WriteDataSlot(bucket, slotIdx, data, flag); err != nil {
 		return &Response{Err: err}
 	}
 
@@ -401,24 +919,152 @@ func (w *Worker) doSet(key string, value []byte, ttl time.Duration, existingCas
 		Length:  len(value),
 		Expiry:  expiry,
 		Cas:     cas,
+
+		DataType: dataType,
+		Flags:    flags,
+
+		LastAccess: now.UnixMilli(),
 	}
 	w.index.Set(entry)
+	w.index.SetTags(key, tags)
+	w.index.MarkUsed(key)
+	w.evictIfNeeded(key)
 
 	return &Response{Cas: cas}
 }
 
+// dataSize returns the total size of the data files of this shard
+func (w *Worker) dataSize() int64 {
+	var size int64
+	for bucket := range w.nextSlotId {
+		size += w.nextSlotId[bucket] * int64(w.storage.SlotSize(bucket))
+	}
+	return size
+}
+
+// evictIfNeeded evicts items until the data files fit in MaxDataSize.
+// The key that was just written is never evicted. Reads run in the worker
+// too and return a copy of the value, so eviction never affects one in progress.
+func (w *Worker) evictIfNeeded(keep string) {
+	if w.MaxDataSize <= 0 || w.EvictionPolicy == EvictionNone {
+		return
+	}
+	if time.Since(w.startTime) < w.EvictionGrace {
+		return // Let the working set settle after startup
+	}
+	for w.dataSize() > w.MaxDataSize && w.index.Count() > 1 {
+		var victim *IndexEntry
+		if w.EvictionPolicy == EvictionLRU {
+			victim = w.index.LeastRecentlyUsed(keep)
+		} else {
+			victim = w.sampleVictim(keep)
+		}
+		if victim == nil {
+			return
+		}
+		w.deleteEntry(victim)
+		w.evictions.Add(1)
+		if w.evictNotify != nil {
+			w.evictNotify(victim.Key, ReasonLRU)
+		}
+	}
+}
+
+// sampleVictim returns the least recently used of a few randomly sampled entries.
+// Key ids are dense (continuous compaction), so they are sampled directly.
+func (w *Worker) sampleVictim(keep string) *IndexEntry {
+	samples := w.EvictionSamples
+	if samples <= 0 {
+		samples = DefaultEvictionSamples
+	}
+	var victim *IndexEntry
+	for i := 0; i < samples; i++ {
+		var entry *IndexEntry
+		if w.storage.KeyFormat() == KeyFormatPacked {
+			// Packed key ids are sparse byte offsets
+			if sampled := w.index.Sample(1); len(sampled) > 0 {
+				entry = sampled[0]
+			}
+		} else {
+			entry = w.index.GetByKeyId(rand.Int63n(w.nextKeyId))
+		}
+		if entry == nil || entry.Key == keep {
+			continue
+		}
+		if victim == nil || entry.LastAccess < victim.LastAccess {
+			victim = entry
+		}
+	}
+	return victim
+}
+
+// nextCas returns a CAS value based on the clock that is always higher than
+// the previous one (and than all CAS values recovered from disk)
+func (w *Worker) nextCas(now time.Time) uint64 {
+	cas := uint64(now.UnixNano())
+	if cas <= w.lastCas {
+		cas = w.lastCas + 1
+	}
+	w.lastCas = cas
+	return cas
+}
+
+// expiryAt returns the expiry for a TTL requested by a client (0 = DefaultTTL),
+// capped to MaxTTL. Set and touch both use it, so the limits apply to both.
+func (w *Worker) expiryAt(now time.Time, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		ttl = w.DefaultTTL
+	}
+	if ttl <= 0 {
+		return 0 // No expiry
+	}
+	// Cap TTL to MaxTTL if set
+	if w.MaxTTL > 0 && ttl > w.MaxTTL {
+		ttl = w.MaxTTL
+	}
+	return expiryFor(now, ttl)
+}
+
+// expiryFor returns the expiry (Unix milliseconds) for a TTL starting at now.
+// It adds whole milliseconds, so the remaining TTL computed from it later is
+// at most ttl and fits a time.Duration even for the largest one (a far-future
+// timestamp saturates the duration at about 292 years).
+func expiryFor(now time.Time, ttl time.Duration) int64 {
+	return now.UnixMilli() + ttl.Milliseconds()
+}
+
 func (w *Worker) handleDelete(req *Request) *Response {
 	entry, ok := w.index.Get(req.Key)
 	if !ok {
 		return &Response{Err: ErrKeyNotFound}
 	}
+	// A nonzero CAS only deletes the value it was read with
+	if req.Cas != 0 && entry.Cas != req.Cas {
+		return &Response{Err: ErrCasMismatch}
+	}
 
 	w.deleteEntry(entry)
 	w.checkSync()
 	return &Response{}
 }
 
+// handleGetDelete reads a value and deletes its key in one worker turn, so
+// no other request sees or changes the key in between
+func (w *Worker) handleGetDelete(req *Request) *Response {
+	resp := w.doGet(req.Key, false)
+	if resp.Err != nil {
+		return resp
+	}
+	if entry, ok := w.index.Get(req.Key); ok {
+		w.deleteEntry(entry)
+		w.checkSync()
+	}
+	return resp
+}
+
 func (w *Worker) deleteEntry(entry *IndexEntry) {
+	w.preserve(entry)
+
 	// Remove from index FIRST (clears slotIndex before compactDataSlot moves another entry there)
 	w.index.Delete(entry.Key)
 
@@ -426,9 +1072,78 @@ func (w *Worker) deleteEntry(entry *IndexEntry) {
 	w.compactDataSlot(entry.Bucket, entry.SlotIdx)
 
 	// Compact key slot: move tail to freed slot and truncate
+	if w.storage.KeyFormat() == KeyFormatPacked {
+		w.freePackedKey(entry)
+		return
+	}
 	w.compactKeySlot(entry.KeyId)
 }
 
+// expireEntry deletes an entry whose expiry has passed
+func (w *Worker) expireEntry(entry *IndexEntry) {
+	w.deleteEntry(entry)
+	if w.evictNotify != nil {
+		w.evictNotify(entry.Key, ReasonExpired)
+	}
+}
+
+// expireIfDue deletes an expired entry once it is past the ServeStale window
+func (w *Worker) expireIfDue(entry *IndexEntry, now int64) {
+	if entry.Expiry+w.ServeStale.Milliseconds() <= now {
+		w.expireEntry(entry)
+	}
+}
+
+// freePackedKey releases the record of a deleted key in a packed keys file.
+// Records vary in size, so only the tail is truncated and other records are
+// tombstoned until they make up half of the file, which is then rewritten.
+func (w *Worker) freePackedKey(entry *IndexEntry) {
+	size := PackedKeyRecordSize(len(entry.Key))
+	if entry.KeyId+size == w.nextKeyId {
+		if err := w.storage.TruncateKeysFile(entry.KeyId); err == nil {
+			w.nextKeyId = entry.KeyId
+			return
+		}
+	}
+
+	rec := &KeyRecord{KeyLen: uint16(len(entry.Key)), Expiry: tombstoneExpiry}
+	copy(rec.Key[:], entry.Key)
+	w.storage.WriteKeyRecord(entry.KeyId, rec)
+	w.keyGarbage += size
+
+	if w.keyGarbage*2 > w.nextKeyId {
+		w.rewriteKeys()
+	}
+}
+
+// rewriteKeys writes the live records to a new packed keys file, dropping tombstones
+func (w *Worker) rewriteKeys() {
+	entries := w.index.Entries()
+	recs := make([]*KeyRecord, len(entries))
+	for i, entry := range entries {
+		recs[i] = &KeyRecord{
+			KeyLen:   uint16(len(entry.Key)),
+			Cas:      entry.Cas,
+			Expiry:   entry.Expiry,
+			Bucket:   byte(entry.Bucket),
+			SlotIdx:  entry.SlotIdx,
+			DataType: entry.DataType,
+			Flags:    entry.Flags,
+		}
+		copy(recs[i].Key[:], entry.Key)
+	}
+
+	keyIds, nextKeyId, err := w.storage.RewriteKeys(recs)
+	if err != nil {
+		return // Keep the tombstones, retried on a later delete
+	}
+	w.index.RenumberKeyIds(entries, keyIds)
+	w.compactions.Add(1)
+	w.bytesMoved.Add(uint64(nextKeyId))
+	w.nextKeyId = nextKeyId
+	w.keyGarbage = 0
+}
+
 // compactDataSlot moves the tail slot to fill the freed slot, then truncates the file
 func (w *Worker) compactDataSlot(bucket int, freedSlotIdx int64) {
 	tailIdx := w.nextSlotId[bucket] - 1
@@ -437,20 +1152,21 @@ func (w *Worker) compactDataSlot(bucket int, freedSlotIdx int64) {
 	}
 
 	if freedSlotIdx == tailIdx {
-		// Already the tail, just decrement and truncate
-		w.nextSlotId[bucket]--
-		w.storage.TruncateDataFile(bucket, w.nextSlotId[bucket])
+		// Already the tail, just truncate
+		w.truncateDataTail(bucket)
 		return
 	}
 
-	// Read tail slot data
-	tailData, err := w.storage.ReadDataSlot(bucket, tailIdx)
+	// Read tail slot data as stored
+	tailData, tailFlag, err := w.storage.ReadRawDataSlot(bucket, tailIdx)
 	if err != nil {
+		w.storage.MarkDataFree(bucket, freedSlotIdx)
 		return // Can't read, skip compaction
 	}
 
 	// Write tail data to freed slot
-	if err := w.storage.WriteDataSlot(bucket, freedSlotIdx, tailData); err != nil {
+	if err := w.storage.WriteDataSlot(bucket, freedSlotIdx, tailData, tailFlag); err != nil {
+		w.storage.MarkDataFree(bucket, freedSlotIdx)
 		return // Can't write, skip compaction
 	}
 
@@ -461,10 +1177,73 @@ func (w *Worker) compactDataSlot(bucket int, freedSlotIdx int64) {
 		w.index.UpdateSlotIdx(tailEntry, freedSlotIdx)
 		w.storage.UpdateSlotIdx(tailEntry.KeyId, freedSlotIdx)
 	}
+	w.compactions.Add(1)
+	w.bytesMoved.Add(uint64(len(tailData)))
 
-	// Truncate file
-	w.nextSlotId[bucket]--
-	w.storage.TruncateDataFile(bucket, w.nextSlotId[bucket])
+	w.truncateDataTail(bucket)
+}
+
+// Compact fills the free data slots of every bucket with tail slots and
+// truncates the files, it must run in the worker goroutine
+func (w *Worker) Compact() {
+	for bucket := range w.nextSlotId {
+		for slotIdx := int64(0); slotIdx < w.nextSlotId[bucket]; slotIdx++ {
+			if w.index.GetByBucketSlot(bucket, slotIdx) != nil {
+				continue
+			}
+			// Drop free tail slots, so the slot moved in is a live one
+			for tail := w.nextSlotId[bucket] - 1; tail > slotIdx && w.index.GetByBucketSlot(bucket, tail) == nil; tail-- {
+				w.truncateDataTail(bucket)
+			}
+			w.compactDataSlot(bucket, slotIdx)
+		}
+		// Slots past the tail are left by recovery, the file still holds them
+		if count, err := w.storage.SlotCount(bucket); err == nil && count > w.nextSlotId[bucket] {
+			w.storage.TruncateDataFile(bucket, w.nextSlotId[bucket])
+		}
+	}
+	w.updateSlotStats()
+	w.checkSync()
+}
+
+// compactIfNeeded runs Compact when the free slot fraction exceeds CompactionRatio
+func (w *Worker) compactIfNeeded() {
+	w.updateSlotStats()
+	if w.CompactionRatio <= 0 {
+		return
+	}
+	free, total := w.SlotStats()
+	if free > 0 && float64(free) > w.CompactionRatio*float64(total) {
+		w.Compact()
+	}
+}
+
+// updateSlotStats recounts the free data slots for SlotStats
+func (w *Worker) updateSlotStats() {
+	var free, total int64
+	for bucket, count := range w.nextSlotId {
+		total += count
+		free += count - int64(w.index.BucketEntries(bucket))
+	}
+	w.freeSlots.Store(free)
+	w.totalSlots.Store(total)
+}
+
+// SlotStats returns the number of free data slots and of all data slots up to
+// the tails, as of the last expiry tick or compaction
+func (w *Worker) SlotStats() (free, total int64) {
+	return w.freeSlots.Load(), w.totalSlots.Load()
+}
+
+// truncateDataTail drops the tail slot of a bucket file. If the truncate fails,
+// the slot counter keeps matching the file size and the tail slot is marked free.
+func (w *Worker) truncateDataTail(bucket int) {
+	newCount := w.nextSlotId[bucket] - 1
+	if err := w.storage.TruncateDataFile(bucket, newCount); err != nil {
+		w.storage.MarkDataFree(bucket, newCount)
+		return
+	}
+	w.nextSlotId[bucket] = newCount
 }
 
 // compactKeySlot moves the tail key record to fill the freed slot, then truncates the file
@@ -475,20 +1254,21 @@ func (w *Worker) compactKeySlot(freedKeyId int64) {
 	}
 
 	if freedKeyId == tailKeyId {
-		// Already the tail, just decrement and truncate
-		w.nextKeyId--
-		w.storage.TruncateKeysFile(w.nextKeyId)
+		// Already the tail, just truncate
+		w.truncateKeysTail()
 		return
 	}
 
 	// Read tail key record
 	tailRec, err := w.storage.ReadKeyRecord(tailKeyId)
 	if err != nil {
+		w.storage.WriteKeyRecord(freedKeyId, tombstoneKeyRecord())
 		return // Can't read, skip compaction
 	}
 
 	// Write tail record to freed slot
 	if err := w.storage.WriteKeyRecord(freedKeyId, tailRec); err != nil {
+		w.storage.WriteKeyRecord(freedKeyId, tombstoneKeyRecord())
 		return // Can't write, skip compaction
 	}
 
@@ -498,139 +1278,193 @@ func (w *Worker) compactKeySlot(freedKeyId int64) {
 		// Update index to point to new keyId
 		w.index.UpdateKeyId(tailEntry, freedKeyId)
 	}
+	w.compactions.Add(1)
+	w.bytesMoved.Add(KeyRecordSize)
+
+	w.truncateKeysTail()
+}
+
+// truncateKeysTail drops the tail record of the keys file. If the truncate fails,
+// the key counter keeps matching the file size and the tail record is overwritten
+// with a tombstone so recovery does not resurrect it.
+func (w *Worker) truncateKeysTail() {
+	newCount := w.nextKeyId - 1
+	if err := w.storage.TruncateKeysFile(newCount); err != nil {
+		w.storage.WriteKeyRecord(newCount, tombstoneKeyRecord())
+		return
+	}
+	w.nextKeyId = newCount
+}
 
-	// Truncate file
-	w.nextKeyId--
-	w.storage.TruncateKeysFile(w.nextKeyId)
+// tombstoneKeyRecord returns a key record that recovery skips (expired in 1970)
+func tombstoneKeyRecord() *KeyRecord {
+	return &KeyRecord{Expiry: tombstoneExpiry}
 }
 
 func (w *Worker) handleTouch(req *Request) *Response {
-	entry, ok := w.index.Get(req.Key)
+	entry, ok := w.liveEntry(req.Key)
 	if !ok {
 		return &Response{Err: ErrKeyNotFound}
 	}
+	// A nonzero CAS only extends the value it was read with
+	if req.Cas != 0 && entry.Cas != req.Cas {
+		return &Response{Err: ErrCasMismatch}
+	}
+
+	if err := w.setExpiry(entry, w.expiryAt(time.Now(), req.TTL)); err != nil {
+		return &Response{Err: err}
+	}
+
+	w.checkSync()
+	return &Response{Cas: entry.Cas}
+}
+
+// handleGat gets a value and sets its new expiry in one step, so the key can
+// not change or go away in between
+func (w *Worker) handleGat(req *Request) *Response {
+	entry, ok := w.liveEntry(req.Key)
+	if !ok {
+		return &Response{Err: ErrKeyNotFound}
+	}
+	data, err := w.readValue(entry)
+	if err != nil {
+		return &Response{Err: err}
+	}
 
 	now := time.Now()
-	var expiry int64
-	if req.TTL > 0 {
-		expiry = now.Add(req.TTL).UnixMilli()
+	if err := w.setExpiry(entry, w.expiryAt(now, req.TTL)); err != nil {
+		return &Response{Err: err}
 	}
+	w.index.MarkFetched(entry, now.UnixMilli())
+	ttl := NoExpiry
+	if entry.Expiry > 0 {
+		ttl = time.Duration(entry.Expiry-now.UnixMilli()) * time.Millisecond
+	}
+
+	w.checkSync()
+	return &Response{Value: data, Cas: entry.Cas, DataType: entry.DataType, Flags: entry.Flags, TTLRemaining: ttl}
+}
 
-	// Update key record
+// setExpiry changes the expiry of an entry in its key record and the index
+func (w *Worker) setExpiry(entry *IndexEntry, expiry int64) error {
 	rec, err := w.storage.ReadKeyRecord(entry.KeyId)
 	if err != nil {
-		return &Response{Err: err}
+		return err
 	}
 	rec.Expiry = expiry
 	if err := w.storage.WriteKeyRecord(entry.KeyId, rec); err != nil {
-		return &Response{Err: err}
+		return err
 	}
-
-	// Update index
 	entry.Expiry = expiry
 	w.index.Set(entry)
-
-	w.checkSync()
-	return &Response{Cas: entry.Cas}
+	return nil
 }
 
 func (w *Worker) handleIncr(req *Request) *Response {
-	return w.doIncrDecr(req.Key, req.Delta, true)
+	return w.doIncrDecr(req, true)
 }
 
 func (w *Worker) handleDecr(req *Request) *Response {
-	return w.doIncrDecr(req.Key, req.Delta, false)
+	return w.doIncrDecr(req, false)
 }
 
-func (w *Worker) doIncrDecr(key string, delta uint64, incr bool) *Response {
-	entry, ok := w.index.Get(key)
+func (w *Worker) doIncrDecr(req *Request, incr bool) *Response {
+	delta := req.Delta
+	entry, ok := w.index.Get(req.Key)
+	if ok && entry.Expiry > 0 && entry.Expiry <= time.Now().UnixMilli() {
+		w.expireEntry(entry)
+		ok = false
+	}
 	if !ok {
-		return &Response{Err: ErrKeyNotFound}
+		if !req.HasInitial {
+			return &Response{Err: ErrKeyNotFound}
+		}
+		// Create the counter with the initial value, the delta is not applied
+		value := []byte(strconv.FormatUint(req.Initial, 10))
+		resp := w.doSet(req.Key, value, req.TTL, nil, 0, 0, 0, false)
+		if resp.Err == nil {
+			resp.Value = value
+		}
+		w.checkSync()
+		return resp
 	}
 
 	// Read current value
-	data, err := w.storage.ReadDataSlot(entry.Bucket, entry.SlotIdx)
+	data, err := w.readEntry(entry)
 	if err != nil {
 		return &Response{Err: err}
 	}
 
-	// Parse as number - must be all digits
-	var val uint64
-	for _, b := range data {
-		if b >= '0' && b <= '9' {
-			val = val*10 + uint64(b-'0')
-		} else {
-			return &Response{Err: ErrNotNumeric}
-		}
+	// Parse as number - must be all digits and fit in 64 bits
+	val, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return &Response{Err: ErrNotNumeric}
 	}
 
-	// Apply delta
+	// Apply delta: increments wrap around at 2^64 and decrements stop at 0,
+	// like memcached
 	if incr {
 		val += delta
+	} else if delta > val {
+		val = 0
 	} else {
-		if delta > val {
-			val = 0
-		} else {
-			val -= delta
-		}
+		val -= delta
 	}
+	newData := []byte(strconv.FormatUint(val, 10))
 
-	// Convert back to string
-	newData := []byte(strings.TrimLeft(string(data), "0123456789") +
-		func() string {
-			if val == 0 {
-				return "0"
-			}
-			s := ""
-			for v := val; v > 0; v /= 10 {
-				s = string('0'+byte(v%10)) + s
-			}
-			return s
-		}())
+	w.preserve(entry)
+	now := time.Now()
+	entry.Cas = w.nextCas(now)
 
-	// Actually, let's just store the number
-	newData = []byte(func() string {
-		if val == 0 {
-			return "0"
-		}
-		s := ""
-		for v := val; v > 0; v /= 10 {
-			s = string('0'+byte(v%10)) + s
-		}
-		return s
-	}())
+	// Write key record so the new CAS survives a restart
+	keyRec := &KeyRecord{
+		KeyLen:   uint16(len(req.Key)),
+		Cas:      entry.Cas,
+		Expiry:   entry.Expiry,
+		Bucket:   byte(entry.Bucket),
+		SlotIdx:  entry.SlotIdx,
+		DataType: entry.DataType,
+		Flags:    entry.Flags,
+	}
+	copy(keyRec.Key[:], req.Key)
+	if err := w.storage.WriteKeyRecord(entry.KeyId, keyRec); err != nil {
+		return &Response{Err: err}
+	}
 
 	// Write back
-	if err := w.storage.WriteDataSlot(entry.Bucket, entry.SlotIdx, newData); err != nil {
+	if err := w.storage.WriteDataSlot(entry.Bucket, entry.SlotIdx, newData, FlagInUse); err != nil {
 		return &Response{Err: err}
 	}
 
-	// Update CAS
-	now := time.Now()
-	entry.Cas = uint64(now.UnixNano())
 	entry.Length = len(newData)
+	entry.LastAccess = now.UnixMilli()
 	w.index.Set(entry)
+	w.index.MarkUsed(req.Key)
 
 	w.checkSync()
 	return &Response{Value: newData, Cas: entry.Cas}
 }
 
 func (w *Worker) handleAppend(req *Request) *Response {
-	return w.doAppendPrepend(req.Key, req.Value, true)
+	return w.doAppendPrepend(req.Key, req.Value, req.Cas, true)
 }
 
 func (w *Worker) handlePrepend(req *Request) *Response {
-	return w.doAppendPrepend(req.Key, req.Value, false)
+	return w.doAppendPrepend(req.Key, req.Value, req.Cas, false)
 }
 
-func (w *Worker) doAppendPrepend(key string, value []byte, append bool) *Response {
-	entry, ok := w.index.Get(key)
+func (w *Worker) doAppendPrepend(key string, value []byte, cas uint64, append bool) *Response {
+	entry, ok := w.liveEntry(key)
 	if !ok {
 		return &Response{Err: ErrKeyNotFound}
 	}
+	// A nonzero CAS only extends the value it was read with
+	if cas != 0 && entry.Cas != cas {
+		return &Response{Err: ErrCasMismatch}
+	}
 
 	// Read current value
-	data, err := w.storage.ReadDataSlot(entry.Bucket, entry.SlotIdx)
+	data, err := w.readEntry(entry)
 	if err != nil {
 		return &Response{Err: err}
 	}
@@ -647,12 +1481,19 @@ func (w *Worker) doAppendPrepend(key string, value []byte, append bool) *Respons
 		copy(newData[len(value):], data)
 	}
 
-	// Check if we need a new bucket
-	newBucket, err := w.storage.BucketForSize(len(newData))
+	if w.MaxValueSize > 0 && len(newData) > w.MaxValueSize {
+		return &Response{Err: ErrValueTooLarge}
+	}
+
+	// Check if we need a new bucket, for the value as stored
+	stored, flag := w.storage.EncodeValue(newData)
+	newBucket, err := w.storage.BucketForSize(len(stored))
 	if err != nil {
 		return &Response{Err: err}
 	}
 
+	w.preserve(entry)
+
 	// Compact old slot and allocate new if bucket changed
 	if newBucket != entry.Bucket {
 		w.compactDataSlot(entry.Bucket, entry.SlotIdx)
@@ -662,40 +1503,109 @@ func (w *Worker) doAppendPrepend(key string, value []byte, append bool) *Respons
 		entry.SlotIdx = w.nextSlotId[newBucket]
 		w.nextSlotId[newBucket]++
 	}
+	now := time.Now()
+	entry.Cas = w.nextCas(now)
+
+	// Write key record (including bucket/slotIdx for recovery)
+	keyRec := &KeyRecord{
+		KeyLen:   uint16(len(key)),
+		Cas:      entry.Cas,
+		Expiry:   entry.Expiry,
+		Bucket:   byte(entry.Bucket),
+		SlotIdx:  entry.SlotIdx,
+		DataType: entry.DataType,
+		Flags:    entry.Flags,
+	}
+	copy(keyRec.Key[:], key)
+	if err := w.storage.WriteKeyRecord(entry.KeyId, keyRec); err != nil {
+		return &Response{Err: err}
+	}
 
 	// Write new data
-	if err := w.storage.WriteDataSlot(entry.Bucket, entry.SlotIdx, newData); err != nil {
+	if err := w.storage.WriteDataSlot(entry.Bucket, entry.SlotIdx, stored, flag); err != nil {
 		return &Response{Err: err}
 	}
 
 	// Update entry
-	now := time.Now()
-	entry.Cas = uint64(now.UnixNano())
 	entry.Length = len(newData)
+	entry.LastAccess = time.Now().UnixMilli()
 	w.index.Set(entry)
+	w.index.MarkUsed(key)
+	w.evictIfNeeded(key)
 
 	w.checkSync()
 	return &Response{Cas: entry.Cas}
 }
 
+// handleFlushAll flushes the shard now, or schedules the flush for FlushAt.
+// A scheduled flush invalidates everything written before FlushAt, also the
+// items written after the request, and replaces an earlier scheduled flush.
 func (w *Worker) handleFlushAll(req *Request) *Response {
+	if req.FlushAt > time.Now().UnixNano() {
+		w.flushAt = req.FlushAt
+		return &Response{}
+	}
+	w.flush()
+	return &Response{}
+}
+
+// runScheduledFlush flushes the shard once the time of a scheduled flush has
+// come, before any later request sees the items it invalidates
+func (w *Worker) runScheduledFlush() {
+	if w.flushAt == 0 || time.Now().UnixNano() < w.flushAt {
+		return
+	}
+	w.flush()
+	w.appendWAL(&WALRecord{Op: OpFlushAll})
+}
+
+// flush removes all items and truncates the files
+func (w *Worker) flush() {
+	w.flushAt = 0
+
 	// Reset in-memory structures
+	oldIndex := w.index
+	if len(w.snapshots) > 0 {
+		for _, entry := range oldIndex.Entries() {
+			w.preserve(entry)
+		}
+	}
 	w.index = NewIndex()
-
-	// Truncate all files to reclaim space
-	w.storage.TruncateKeysFile(0)
-	for bucket := 0; bucket < NumBuckets; bucket++ {
-		w.storage.TruncateDataFile(bucket, 0)
+	if oldIndex.lru != nil {
+		w.index.EnableLRU()
 	}
 
-	// Reset slot counters
-	w.nextKeyId = 0
-	for i := range w.nextSlotId {
-		w.nextSlotId[i] = 0
+	// Truncate all files to reclaim space, on failure keep the counters in
+	// sync with the file sizes and overwrite the records that remain
+	if err := w.storage.TruncateKeysFile(0); err != nil {
+		if w.storage.KeyFormat() == KeyFormatPacked {
+			// Packed records can only be overwritten in place by their own key
+			for _, entry := range oldIndex.Entries() {
+				rec := &KeyRecord{KeyLen: uint16(len(entry.Key)), Expiry: tombstoneExpiry}
+				copy(rec.Key[:], entry.Key)
+				w.storage.WriteKeyRecord(entry.KeyId, rec)
+			}
+			w.keyGarbage = w.nextKeyId
+		} else {
+			for keyId := int64(0); keyId < w.nextKeyId; keyId++ {
+				w.storage.WriteKeyRecord(keyId, tombstoneKeyRecord())
+			}
+		}
+	} else {
+		w.nextKeyId = 0
+		w.keyGarbage = 0
+	}
+	for bucket := range w.nextSlotId {
+		if err := w.storage.TruncateDataFile(bucket, 0); err != nil {
+			for slotIdx := int64(0); slotIdx < w.nextSlotId[bucket]; slotIdx++ {
+				w.storage.MarkDataFree(bucket, slotIdx)
+			}
+		} else {
+			w.nextSlotId[bucket] = 0
+		}
 	}
 
 	w.checkSync()
-	return &Response{}
 }
 
 func (w *Worker) handleStats(req *Request) *Response {
@@ -711,24 +1621,138 @@ func (w *Worker) handleStats(req *Request) *Response {
 		}
 		return s
 	}()
+	for name, n := range w.CommandStats() {
+		stats[name] = strconv.FormatUint(n, 10)
+	}
 	return &Response{Stats: stats}
 }
 
-func (w *Worker) cleanupExpired() {
+// BucketStats returns the disk usage of each data bucket, it must run in
+// the worker goroutine
+func (w *Worker) BucketStats() []BucketStat {
+	stats := make([]BucketStat, w.storage.NumBuckets())
+	for bucket := range stats {
+		slotSize := int64(w.storage.SlotSize(bucket))
+		total, _ := w.storage.SlotCount(bucket)
+		used := int64(w.index.BucketEntries(bucket))
+		stats[bucket] = BucketStat{
+			Bucket:         bucket,
+			SlotSize:       w.storage.BucketSize(bucket),
+			TotalSlots:     total,
+			UsedSlots:      used,
+			BytesUsed:      used * slotSize,
+			BytesAllocated: total * slotSize,
+		}
+	}
+	return stats
+}
+
+// SizeHistogram counts the live values per power-of-two size band, element i
+// holds the values of more than 1<<(i-1) and at most 1<<i bytes. It must run
+// in the worker goroutine.
+func (w *Worker) SizeHistogram() []int64 {
+	var counts []int64
 	now := time.Now().UnixMilli()
+	w.index.Range("", "", func(entry *IndexEntry) bool {
+		if entry.Expiry > 0 && entry.Expiry <= now {
+			return true
+		}
+		length := entry.Length
+		if length == 0 {
+			// Lengths are not persisted, recovered entries read theirs from disk
+			if n, err := w.storage.ReadDataLength(entry.Bucket, entry.SlotIdx); err == nil {
+				length = n
+			}
+		}
+		band := SizeBand(length)
+		for len(counts) <= band {
+			counts = append(counts, 0)
+		}
+		counts[band]++
+		return true
+	})
+	return counts
+}
+
+// SizeBand returns the power-of-two size band of a value length, the
+// smallest i with length <= 1<<i
+func SizeBand(length int) int {
+	if length <= 1 {
+		return 0
+	}
+	return bits.Len(uint(length - 1))
+}
+
+// cleanupExpired deletes the entries whose expiry (and ServeStale window) has
+// passed and frees their slots, so keys that are never read again do not hold
+// on to disk space
+func (w *Worker) cleanupExpired() {
+	now := time.Now().UnixMilli() - w.ServeStale.Milliseconds()
 
-	// Peek at expired entries and delete them properly
+	deleted := false
 	for {
-		entry := w.index.expiryHeap.PeekMin()
-		if entry == nil || entry.Expiry > now || entry.Expiry == 0 {
+		expired := w.index.expiryHeap.PeekMin()
+		if expired == nil || expired.Expiry > now || expired.Expiry == 0 {
 			break
 		}
 
-		// Find and delete the entry from the B-tree by keyId
-		// We need to iterate the B-tree to find by keyId
-		// For now, just remove from heap - Get() will handle the actual deletion
-		// when it finds the expired key
-		w.index.expiryHeap.Remove(entry.KeyId)
+		entry := w.index.GetByKeyId(expired.KeyId)
+		if entry == nil || entry.Expiry == 0 || entry.Expiry > now {
+			// Stale heap entry, the key is gone or got a new expiry
+			w.index.expiryHeap.Remove(expired.KeyId)
+			continue
+		}
+		w.expireEntry(entry)
+		deleted = true
+	}
+	if w.cleanupIdle() {
+		deleted = true
+	}
+	if deleted {
+		w.checkSync()
+	}
+}
+
+// cleanupIdle deletes the entries not accessed within IdleTimeout, walking the
+// access order from the least recently used. It reports whether any were deleted.
+func (w *Worker) cleanupIdle() bool {
+	if w.IdleTimeout <= 0 {
+		return false
+	}
+	cutoff := time.Now().Add(-w.IdleTimeout).UnixMilli()
+
+	deleted := false
+	for {
+		entry := w.index.LeastRecentlyUsed("")
+		if entry == nil || entry.LastAccess > cutoff {
+			return deleted
+		}
+		w.deleteEntry(entry)
+		if w.evictNotify != nil {
+			w.evictNotify(entry.Key, ReasonIdle)
+		}
+		deleted = true
+	}
+}
+
+// CompactionStats returns the number of compaction moves, the bytes they
+// copied and the number of evictions performed by this worker
+func (w *Worker) CompactionStats() (compactions, bytesMoved, evictions uint64) {
+	return w.compactions.Load(), w.bytesMoved.Load(), w.evictions.Load()
+}
+
+// CommandStats returns the command counters of this worker by their
+// memcached stats name
+func (w *Worker) CommandStats() map[string]uint64 {
+	return map[string]uint64{
+		"cmd_get":       w.cmdGet.Load(),
+		"cmd_set":       w.cmdSet.Load(),
+		"get_hits":      w.getHits.Load(),
+		"get_misses":    w.getMisses.Load(),
+		"delete_hits":   w.deleteHits.Load(),
+		"delete_misses": w.deleteMisses.Load(),
+		"incr_hits":     w.incrHits.Load(),
+		"incr_misses":   w.incrMisses.Load(),
 	}
 }
 
@@ -737,11 +1761,35 @@ func (w *Worker) StartTime() time.Time {
 	return w.startTime
 }
 
-// Sync syncs the worker's storage to disk
+// Sync syncs the worker's storage to disk. It also runs on the sync
+// goroutine, so it leaves the write-ahead log alone, appendWAL fsyncs it.
 func (w *Worker) Sync() error {
 	return w.storage.Sync()
 }
 
+// handleSync syncs the storage between requests, so no write is half-applied
+func (w *Worker) handleSync(req *Request) *Response {
+	if err := w.Sync(); err != nil {
+		return &Response{Err: err}
+	}
+	w.MarkSynced()
+	return &Response{}
+}
+
+// handleSetSyncStrategy switches the fsync behaviour of the storage, the
+// write-ahead log is always fsynced. What was written without fsync is synced first, unless the
+// new strategy is SyncNone.
+func (w *Worker) handleSetSyncStrategy(req *Request) *Response {
+	if req.SyncStrategy != SyncNone {
+		if resp := w.handleSync(req); resp.Err != nil {
+			return resp
+		}
+	}
+	w.storage.syncAlways = req.SyncStrategy == SyncAlways
+	w.syncPaused = req.SyncStrategy != SyncPeriodic
+	return &Response{}
+}
+
 // Storage returns the worker's storage for direct access
 func (w *Worker) Storage() *Storage {
 	return w.storage
@@ -755,5 +1803,11 @@ func (w *Worker) Index() *Index {
 // Close stops the worker and closes storage
 func (w *Worker) Close() error {
 	w.Stop()
+	if w.PersistState {
+		w.saveState() // Best-effort, a missing sidecar means a cold start
+	}
+	if w.wal != nil {
+		w.wal.Close()
+	}
 	return w.storage.Close()
 }